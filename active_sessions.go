@@ -0,0 +1,136 @@
+package pagemanager
+
+import (
+	"html/template"
+	"net/http"
+
+	"github.com/bokwoon95/pagemanager/erro"
+	"github.com/bokwoon95/pagemanager/hy"
+	"github.com/bokwoon95/pagemanager/hyforms"
+	"github.com/bokwoon95/pagemanager/tpl"
+)
+
+const (
+	inputSessionAction = "pm-session-action"
+	inputSessionHash   = "pm-session-hash"
+
+	sessionActionRevoke       = "revoke"
+	sessionActionRevokeOthers = "revoke-others"
+)
+
+type activeSessionsData struct {
+	w        http.ResponseWriter `json:"-"`
+	r        *http.Request       `json:"-"`
+	Sessions []Session
+
+	action      string // set by the form callback on POST
+	sessionHash string // set by the form callback on POST
+}
+
+func (data *activeSessionsData) LogoutForm() (template.HTML, error) {
+	return logoutForm(data.w, data.r)
+}
+
+func (data *activeSessionsData) Form() (template.HTML, error) {
+	return hyforms.MarshalForm(data.w, data.r, data.formCallback)
+}
+
+func (data *activeSessionsData) formCallback(form *hyforms.Form) {
+	const timeFormat = "2006-01-02 15:04 MST"
+	r := form.Request()
+	form.Set("#pm-active-sessions", hy.Attr{"method": "POST"})
+	for _, errMsg := range form.ErrMsgs() {
+		form.Append("div.red", nil, hy.Txt(errMsg))
+	}
+	for _, session := range data.Sessions {
+		div := hy.H("div.mv3", nil)
+		userAgent := session.UserAgent
+		if userAgent == "" {
+			userAgent = msg(r, "active_sessions.unknown_device")
+		}
+		header := hy.H("div", nil, hy.Txt(userAgent))
+		if session.Current {
+			header.Append("span.b", nil, hy.Txt(" ", msg(r, "active_sessions.this_device")))
+		}
+		div.AppendElements(header)
+		div.Append("div.f6.gray", nil, hy.Txt(msg(r, "active_sessions.times",
+			session.CreatedAt.Local().Format(timeFormat),
+			session.LastSeenAt.Local().Format(timeFormat),
+			session.ExpiresAt.Local().Format(timeFormat),
+		)))
+		if !session.Current {
+			div.Append("button.pointer.pa1.mt1.bg-white", hy.Attr{
+				"type":  "submit",
+				"name":  inputSessionHash,
+				"value": session.Hash,
+			}, hy.Txt(msg(r, "active_sessions.log_out")))
+		}
+		form.AppendElements(div)
+	}
+	if len(data.Sessions) > 1 {
+		form.Append("div.mt3", nil, hy.H("button.pointer.pa2.bg-white", hy.Attr{
+			"type":  "submit",
+			"name":  inputSessionAction,
+			"value": sessionActionRevokeOthers,
+		}, hy.Txt(msg(r, "active_sessions.log_out_others"))))
+	}
+
+	form.Unmarshal(func() {
+		data.action = r.FormValue(inputSessionAction)
+		data.sessionHash = r.FormValue(inputSessionHash)
+		if data.action == "" && data.sessionHash != "" {
+			data.action = sessionActionRevoke
+		}
+	})
+}
+
+// activeSessions lists the sessions of the user, where they can log out of
+// any of their other sessions e.g. on a lost phone.
+func (pm *PageManager) activeSessions(w http.ResponseWriter, r *http.Request) {
+	data := &activeSessionsData{w: w, r: r}
+	user, ok := pm.requireCookieSession(w, r)
+	if !ok {
+		return
+	}
+	var err error
+	data.Sessions, err = getUserSessions(r.Context(), pm.dataDB, user.UserID, user.sessionHash)
+	if err != nil {
+		pm.InternalServerError(w, r, erro.Wrap(err))
+		return
+	}
+	switch r.Method {
+	case "GET":
+		err = pm.tpl.Render(w, r, data, tpl.Files("active_sessions.html"))
+		if err != nil {
+			pm.InternalServerError(w, r, erro.Wrap(err))
+			return
+		}
+	case "POST":
+		errMsgs, ok := hyforms.UnmarshalForm(w, r, data.formCallback)
+		if !ok {
+			hyforms.Redirect(w, r, LocaleURL(r, r.URL.Path), errMsgs)
+			return
+		}
+		switch data.action {
+		case sessionActionRevoke:
+			err = revokeSession(r.Context(), pm.dataDB, user.UserID, data.sessionHash)
+		case sessionActionRevokeOthers:
+			err = revokeOtherSessions(r.Context(), pm.dataDB, user.UserID, user.sessionHash)
+		default:
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		if err == ErrSessionNotFound {
+			errMsgs.FormErrMsgs = append(errMsgs.FormErrMsgs, err.Error())
+			hyforms.Redirect(w, r, LocaleURL(r, r.URL.Path), errMsgs)
+			return
+		}
+		if err != nil {
+			pm.InternalServerError(w, r, erro.Wrap(err))
+			return
+		}
+		Redirect(w, r, r.URL.Path)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,434 @@
+package pagemanager
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bokwoon95/pagemanager/erro"
+	"github.com/bokwoon95/pagemanager/hy"
+	"github.com/bokwoon95/pagemanager/hyforms"
+	"github.com/bokwoon95/pagemanager/sq"
+	"github.com/bokwoon95/pagemanager/tables"
+	"github.com/bokwoon95/pagemanager/tpl"
+)
+
+// apiTokenPrefix makes API tokens recognisable e.g. to secret scanners.
+const apiTokenPrefix = "pmt_"
+
+// APIToken is a personal access token that scripts authenticate as a user
+// with, as listed at URLAPITokens. Requests authenticated with it only have
+// the permissions of the user that are among its Scopes.
+type APIToken struct {
+	Hash       string
+	Name       string
+	Scopes     []string
+	CreatedAt  time.Time
+	LastUsedAt time.Time // zero if it was never used
+	ExpiresAt  time.Time // zero if it never expires
+}
+
+// Expired reports whether the token has expired.
+func (token APIToken) Expired() bool {
+	return !token.ExpiresAt.IsZero() && !time.Now().Before(token.ExpiresAt)
+}
+
+// bearerToken returns the token of the Authorization: Bearer header of r.
+func bearerToken(r *http.Request) (token string, ok bool) {
+	const prefix = "Bearer "
+	header := r.Header.Get("Authorization")
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", false
+	}
+	return strings.TrimSpace(header[len(prefix):]), true
+}
+
+// newAPIToken creates an API token for userID and returns it. Only its
+// publicBox hash is stored, so it cannot be shown again. scopes must be
+// permissions, expiresAt may be zero for a token that never expires.
+func (pm *PageManager) newAPIToken(ctx context.Context, db sq.Queryer, userID int64, name string, scopes []string, expiresAt time.Time) (string, error) {
+	if !pm.boxesInitialized() {
+		return "", ErrBoxesNotInitialized
+	}
+	scopes = dedupSorted(scopes)
+	if len(scopes) == 0 {
+		return "", ErrInvalidAPITokenScopes
+	}
+	err := checkPermissionsExist(ctx, db, scopes)
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, 32)
+	_, err = rand.Read(b)
+	if err != nil {
+		return "", erro.Wrap(err)
+	}
+	token := apiTokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+	hash, err := pm.publicBox.Hash([]byte(token))
+	if err != nil {
+		return "", erro.Wrap(err)
+	}
+	API_TOKENS := tables.NEW_API_TOKENS(ctx, "")
+	_, _, err = sq.ExecContext(ctx, db, sq.SQLite.
+		InsertInto(API_TOKENS).
+		Valuesx(func(col *sq.Column) error {
+			col.SetString(API_TOKENS.TOKEN_HASH, base64.RawURLEncoding.EncodeToString(hash))
+			col.SetInt64(API_TOKENS.USER_ID, userID)
+			col.SetString(API_TOKENS.NAME, name)
+			col.SetString(API_TOKENS.SCOPES, strings.Join(scopes, ","))
+			col.SetTime(API_TOKENS.CREATED_AT, time.Now().UTC())
+			if !expiresAt.IsZero() {
+				col.SetTime(API_TOKENS.EXPIRES_AT, expiresAt.UTC())
+			}
+			return nil
+		}), 0,
+	)
+	if err != nil {
+		return "", erro.Wrap(err)
+	}
+	return token, nil
+}
+
+// getAPITokenUser returns the user of an API token, with their permissions
+// limited to the token's scopes. The user gets no roles, so that role checks
+// such as for roleSuperadmin cannot get around the scopes. The superadmin
+// cannot use API tokens at all.
+func (pm *PageManager) getAPITokenUser(ctx context.Context, token string) (user SessionUser, err error) {
+	if !strings.HasPrefix(token, apiTokenPrefix) {
+		return user, ErrInvalidAPIToken
+	}
+	hashes, err := pm.publicBox.HashAll([]byte(token))
+	if err != nil {
+		return user, erro.Wrap(err)
+	}
+	b64Hashes := make([]string, len(hashes))
+	for i, hash := range hashes {
+		b64Hashes[i] = base64.RawURLEncoding.EncodeToString(hash)
+	}
+	var scopes string
+	var lastUsedAt, expiresAt time.Time
+	API_TOKENS := tables.NEW_API_TOKENS(ctx, "t")
+	USERS := tables.NEW_USERS(ctx, "u")
+	grants := newUserGrants(ctx, USERS)
+	user.Roles = make(map[string]bool)
+	user.Permissions = make(map[string]bool)
+	_, err = sq.FetchContext(ctx, pm.dataDB, sq.SQLite.
+		From(API_TOKENS).
+		Join(USERS, USERS.USER_ID.Eq(API_TOKENS.USER_ID)).
+		Where(
+			API_TOKENS.TOKEN_HASH.In(b64Hashes),
+			USERS.USER_ID.NeInt64(1),
+		).
+		Limit(1),
+		func(row *sq.Row) error {
+			user.apiTokenHash = row.String(API_TOKENS.TOKEN_HASH)
+			scopes = row.String(API_TOKENS.SCOPES)
+			lastUsedAt = row.Time(API_TOKENS.LAST_USED_AT)
+			expiresAt = row.Time(API_TOKENS.EXPIRES_AT)
+			err := user.User.RowMapper(USERS)(row)
+			if err != nil {
+				return erro.Wrap(err)
+			}
+			return grants.RowMapper(&user)(row)
+		},
+	)
+	if err != nil {
+		return SessionUser{}, erro.Wrap(err)
+	}
+	if !user.Valid {
+		return SessionUser{}, ErrInvalidAPIToken
+	}
+	if user.Disabled {
+		return SessionUser{}, ErrUserDisabled
+	}
+	now := time.Now().UTC()
+	if !expiresAt.IsZero() && !now.Before(expiresAt) {
+		return SessionUser{}, ErrInvalidAPIToken
+	}
+	permissions := make(map[string]bool)
+	for _, scope := range strings.Split(scopes, ",") {
+		if user.Permissions[scope] {
+			permissions[scope] = true
+		}
+	}
+	user.Roles = make(map[string]bool)
+	user.Permissions = permissions
+	if now.Sub(lastUsedAt) >= sessionRenewInterval {
+		// like LAST_SEEN_AT of sessions, LAST_USED_AT is only accurate to
+		// sessionRenewInterval so that not every request writes to the
+		// database
+		_, _, err = sq.ExecContext(ctx, pm.dataDB, sq.SQLite.
+			Update(API_TOKENS).
+			Set(API_TOKENS.LAST_USED_AT.SetTime(now)).
+			Where(API_TOKENS.TOKEN_HASH.EqString(user.apiTokenHash)), 0,
+		)
+		if err != nil {
+			return SessionUser{}, erro.Wrap(err)
+		}
+	}
+	return user, nil
+}
+
+// getUserAPITokens returns the API tokens of userID, newest first.
+func getUserAPITokens(ctx context.Context, db sq.Queryer, userID int64) ([]APIToken, error) {
+	var tokens []APIToken
+	API_TOKENS := tables.NEW_API_TOKENS(ctx, "t")
+	_, err := sq.FetchContext(ctx, db, sq.SQLite.
+		From(API_TOKENS).
+		Where(API_TOKENS.USER_ID.EqInt64(userID)).
+		OrderBy(API_TOKENS.CREATED_AT.Desc()),
+		func(row *sq.Row) error {
+			token := APIToken{
+				Hash:       row.String(API_TOKENS.TOKEN_HASH),
+				Name:       row.String(API_TOKENS.NAME),
+				CreatedAt:  row.Time(API_TOKENS.CREATED_AT),
+				LastUsedAt: row.Time(API_TOKENS.LAST_USED_AT),
+				ExpiresAt:  row.Time(API_TOKENS.EXPIRES_AT),
+			}
+			scopes := row.String(API_TOKENS.SCOPES)
+			return row.Accumulate(func() error {
+				if scopes != "" {
+					token.Scopes = strings.Split(scopes, ",")
+				}
+				tokens = append(tokens, token)
+				return nil
+			})
+		},
+	)
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	return tokens, nil
+}
+
+// revokeAPIToken deletes the API token of userID with tokenHash.
+func revokeAPIToken(ctx context.Context, db sq.Queryer, userID int64, tokenHash string) error {
+	API_TOKENS := tables.NEW_API_TOKENS(ctx, "")
+	rowsAffected, _, err := sq.ExecContext(ctx, db, sq.SQLite.
+		DeleteFrom(API_TOKENS).
+		Where(
+			API_TOKENS.USER_ID.EqInt64(userID),
+			API_TOKENS.TOKEN_HASH.EqString(tokenHash),
+		),
+		sq.ErowsAffected,
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	if rowsAffected == 0 {
+		return ErrAPITokenNotFound
+	}
+	return nil
+}
+
+const (
+	inputAPITokenAction  = "pm-api-token-action"
+	inputAPITokenHash    = "pm-api-token-hash"
+	inputAPITokenName    = "pm-api-token-name"
+	inputAPITokenScopes  = "pm-api-token-scopes"
+	inputAPITokenExpires = "pm-api-token-expires" // days, or empty for never
+
+	apiTokenActionCreate = "create"
+	apiTokenActionRevoke = "revoke"
+)
+
+type apiTokensData struct {
+	w        http.ResponseWriter `json:"-"`
+	r        *http.Request       `json:"-"`
+	Tokens   []APIToken
+	Scopes   []string // the permissions of the user, which tokens can be scoped to
+	NewToken string   // shown once right after it is created
+
+	action    string    // set by the form callbacks on POST
+	tokenHash string    // set by the form callbacks on POST
+	name      string    // set by the form callbacks on POST
+	scopes    []string  // set by the form callbacks on POST
+	expiresAt time.Time // set by the form callbacks on POST
+}
+
+func (data *apiTokensData) LogoutForm() (template.HTML, error) {
+	return logoutForm(data.w, data.r)
+}
+
+func (data *apiTokensData) TokensList() (template.HTML, error) {
+	return hyforms.MarshalForm(data.w, data.r, data.revokeFormCallback)
+}
+
+func (data *apiTokensData) CreateForm() (template.HTML, error) {
+	return hyforms.MarshalForm(data.w, data.r, data.createFormCallback)
+}
+
+func (data *apiTokensData) revokeFormCallback(form *hyforms.Form) {
+	const timeFormat = "2006-01-02 15:04 MST"
+	r := form.Request()
+	form.Set("#pm-api-tokens", hy.Attr{"method": "POST"})
+	action := form.Hidden(inputAPITokenAction, apiTokenActionRevoke)
+	form.AppendElements(action)
+	for _, errMsg := range form.ErrMsgs() {
+		form.Append("div.red", nil, hy.Txt(errMsg))
+	}
+	if len(data.Tokens) == 0 {
+		form.Append("div.mv3.f6.gray", nil, hy.Txt(msg(r, "api_tokens.no_tokens")))
+	}
+	for _, token := range data.Tokens {
+		div := hy.H("div.mv3", nil)
+		header := hy.H("div", nil, hy.Txt(token.Name))
+		if token.Expired() {
+			header.Append("span.b", nil, hy.Txt(" ", msg(r, "api_tokens.expired")))
+		}
+		div.AppendElements(header)
+		div.Append("div.f6.gray", nil, hy.Txt(msg(r, "api_tokens.scopes"), strings.Join(token.Scopes, ", ")))
+		lastUsed := msg(r, "api_tokens.never_used")
+		if !token.LastUsedAt.IsZero() {
+			lastUsed = msg(r, "api_tokens.last_used", token.LastUsedAt.Local().Format(timeFormat))
+		}
+		expires := msg(r, "api_tokens.never_expires")
+		if !token.ExpiresAt.IsZero() {
+			expires = msg(r, "api_tokens.expires_at", token.ExpiresAt.Local().Format(timeFormat))
+		}
+		div.Append("div.f6.gray", nil, hy.Txt(msg(r, "api_tokens.times",
+			token.CreatedAt.Local().Format(timeFormat), lastUsed, expires,
+		)))
+		div.Append("button.pointer.pa1.mt1.bg-white", hy.Attr{
+			"type":  "submit",
+			"name":  inputAPITokenHash,
+			"value": token.Hash,
+		}, hy.Txt(msg(r, "api_tokens.revoke")))
+		form.AppendElements(div)
+	}
+
+	form.Unmarshal(func() {
+		data.action = action.Value()
+		data.tokenHash = r.FormValue(inputAPITokenHash)
+	})
+}
+
+func (data *apiTokensData) createFormCallback(form *hyforms.Form) {
+	r := form.Request()
+	form.Set("#pm-create-api-token", hy.Attr{"method": "POST"})
+	action := form.Hidden(inputAPITokenAction, apiTokenActionCreate)
+	name := form.Text(inputAPITokenName, "").Set("#pm-create-api-token-name.pa2", hy.Attr{"placeholder": msg(r, "api_tokens.name_placeholder")})
+	expires := form.Select(inputAPITokenExpires, []hyforms.Option{
+		{Value: "30", Display: msg(r, "api_tokens.expires_30_days"), Selected: true},
+		{Value: "90", Display: msg(r, "api_tokens.expires_90_days")},
+		{Value: "365", Display: msg(r, "api_tokens.expires_year")},
+		{Value: "", Display: msg(r, "api_tokens.expires_never")},
+	}).Set("#pm-create-api-token-expires.pa2", nil)
+	form.AppendElements(action)
+	appendErrMsgs(form, form.ErrMsgs())
+	form.Append("div.mt3.mb1", nil, hy.H("label.pointer", hy.Attr{"for": name.ID()}, hy.Txt(msg(r, "api_tokens.name"))))
+	form.Append("div", nil, name)
+	appendErrMsgs(form, name.ErrMsgs())
+	form.Append("div.mt3.mb1", nil, hy.Txt(msg(r, "api_tokens.scopes")))
+	scopes := form.Checkboxes(inputAPITokenScopes, data.Scopes)
+	for i, checkbox := range scopes.Inputs() {
+		checkbox.Set(".pointer", nil)
+		form.Append("div.mv1", nil, hy.H("label.pointer", nil, checkbox, hy.Txt(" ", data.Scopes[i])))
+	}
+	form.Append("div.mt3.mb1", nil, hy.H("label.pointer", hy.Attr{"for": expires.ID()}, hy.Txt(msg(r, "api_tokens.expires"))))
+	form.Append("div", nil, expires)
+	form.Append("div.mt3", nil, hy.H("button.pointer.pa2.bg-white", hy.Attr{"type": "submit"}, hy.Txt(msg(r, "api_tokens.create"))))
+
+	form.Unmarshal(func() {
+		data.action = action.Value()
+		data.name = name.Validate(hyforms.Required).Value()
+		data.scopes = scopes.Values()
+		if days, err := strconv.Atoi(expires.Value()); err == nil && days > 0 {
+			data.expiresAt = time.Now().AddDate(0, 0, days)
+		}
+	})
+}
+
+// apiTokens is where users create API tokens for their scripts, and revoke
+// them. It cannot be used with an API token.
+func (pm *PageManager) apiTokens(w http.ResponseWriter, r *http.Request) {
+	data := &apiTokensData{w: w, r: r}
+	user, ok := pm.requireCookieSession(w, r)
+	if !ok {
+		return
+	}
+	if user.UserID == 1 {
+		pm.Forbidden(w, r)
+		return
+	}
+	for permission := range user.Permissions {
+		data.Scopes = append(data.Scopes, permission)
+	}
+	sort.Strings(data.Scopes)
+	var err error
+	data.Tokens, err = getUserAPITokens(r.Context(), pm.dataDB, user.UserID)
+	if err != nil {
+		pm.InternalServerError(w, r, erro.Wrap(err))
+		return
+	}
+	switch r.Method {
+	case "GET":
+		err = pm.tpl.Render(w, r, data, tpl.Files("api_tokens.html"))
+		if err != nil {
+			pm.InternalServerError(w, r, erro.Wrap(err))
+			return
+		}
+	case "POST":
+		var errMsgs hyforms.ValidationErrMsgs
+		var ok bool
+		switch r.FormValue(inputAPITokenAction) {
+		case apiTokenActionCreate:
+			errMsgs, ok = hyforms.UnmarshalForm(w, r, data.createFormCallback)
+		case apiTokenActionRevoke:
+			errMsgs, ok = hyforms.UnmarshalForm(w, r, data.revokeFormCallback)
+		default:
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		if !ok {
+			hyforms.Redirect(w, r, LocaleURL(r, r.URL.Path), errMsgs)
+			return
+		}
+		switch data.action {
+		case apiTokenActionCreate:
+			// tokens can only be scoped to permissions the user has now
+			var scopes []string
+			for _, scope := range data.scopes {
+				if user.Permissions[scope] {
+					scopes = append(scopes, scope)
+				}
+			}
+			data.NewToken, err = pm.newAPIToken(r.Context(), pm.dataDB, user.UserID, data.name, scopes, data.expiresAt)
+		case apiTokenActionRevoke:
+			err = revokeAPIToken(r.Context(), pm.dataDB, user.UserID, data.tokenHash)
+		}
+		if err == ErrAPITokenNotFound || err == ErrInvalidAPITokenScopes {
+			errMsgs.FormErrMsgs = append(errMsgs.FormErrMsgs, err.Error())
+			hyforms.Redirect(w, r, LocaleURL(r, r.URL.Path), errMsgs)
+			return
+		}
+		if err != nil {
+			pm.InternalServerError(w, r, erro.Wrap(err))
+			return
+		}
+		if data.NewToken != "" {
+			// The new token is shown once in the response itself, so that
+			// it is never stored in a cookie or a cache.
+			data.Tokens, err = getUserAPITokens(r.Context(), pm.dataDB, user.UserID)
+			if err != nil {
+				pm.InternalServerError(w, r, erro.Wrap(err))
+				return
+			}
+			w.Header().Set("Cache-Control", "no-store")
+			err = pm.tpl.Render(w, r, data, tpl.Files("api_tokens.html"))
+			if err != nil {
+				pm.InternalServerError(w, r, erro.Wrap(err))
+			}
+			return
+		}
+		Redirect(w, r, r.URL.Path)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
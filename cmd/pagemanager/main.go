@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 
 	"github.com/bokwoon95/pagemanager"
 	"github.com/go-chi/chi"
@@ -17,6 +18,14 @@ var mainfile string
 
 func main() {
 	flag.Parse()
+	switch flag.Arg(0) {
+	case "validate-themes":
+		os.Exit(validateThemes())
+	case "install-theme":
+		os.Exit(installTheme(flag.Arg(1), flag.Arg(2)))
+	case "uninstall-theme":
+		os.Exit(uninstallTheme(flag.Arg(1)))
+	}
 	pm, err := pagemanager.New()
 	if err != nil {
 		log.Fatalln(err)
@@ -30,3 +39,85 @@ func main() {
 	fmt.Println("listening on :80")
 	http.ListenAndServe(":80", mux)
 }
+
+// validateThemes prints the problems found in every theme and returns the exit
+// code of the validate-themes subcommand.
+func validateThemes() int {
+	datafolder, err := pagemanager.LocateDataFolder()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	reports, err := pagemanager.ValidateThemes(datafolder)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	exitCode := 0
+	for _, report := range reports {
+		if len(report.Diagnostics) == 0 {
+			fmt.Printf("%s: ok\n", report.ThemePath)
+			continue
+		}
+		exitCode = 1
+		fmt.Printf("%s:\n", report.ThemePath)
+		for _, diagnostic := range report.Diagnostics {
+			fmt.Printf("\t%s\n", diagnostic)
+		}
+	}
+	return exitCode
+}
+
+// installTheme installs the theme in the zip archive at filename into
+// pm-themes/<themePath> and returns the exit code of the install-theme
+// subcommand.
+func installTheme(filename, themePath string) int {
+	if filename == "" || themePath == "" {
+		fmt.Fprintln(os.Stderr, "usage: pagemanager install-theme <archive.zip> <theme-path>")
+		return 2
+	}
+	datafolder, err := pagemanager.LocateDataFolder()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	err = pagemanager.InstallTheme(datafolder, themePath, f, info.Size())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("installed %s\n", themePath)
+	return 0
+}
+
+// uninstallTheme removes pm-themes/<themePath> and returns the exit code of
+// the uninstall-theme subcommand.
+func uninstallTheme(themePath string) int {
+	if themePath == "" {
+		fmt.Fprintln(os.Stderr, "usage: pagemanager uninstall-theme <theme-path>")
+		return 2
+	}
+	datafolder, err := pagemanager.LocateDataFolder()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	err = pagemanager.UninstallTheme(datafolder, themePath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("uninstalled %s\n", themePath)
+	return 0
+}
@@ -22,6 +22,23 @@ const (
 	// page, the changes will be gone forever.
 	URLConsole   = "/pm-console"
 	URLAnalytics = "/pm-analytics"
+	URLCSPReport = "/pm-csp-report" // POST
+
+	URLManageThemes   = "/pm-manage-themes"   // GET,POST
+	URLManageLocales  = "/pm-manage-locales"  // GET,POST pm-locale=code
+	URLTranslations   = "/pm-translations"    // GET,POST pm-data-id=/url pm-locale=code pm-source-locale=code
+	URLManageUsers    = "/pm-manage-users"    // GET,POST pm-user=public_user_id
+	URLManageRoles    = "/pm-manage-roles"    // GET,POST pm-role=name pm-user=public_user_id
+	URLSessions       = "/pm-sessions"        // GET,POST
+	URLTwoFactor      = "/pm-2fa"             // GET,POST
+	URLLoginTwoFactor = "/pm-login-2fa"       // GET,POST
+	URLForgotPassword = "/pm-forgot-password" // GET,POST
+	URLResetPassword  = "/pm-reset-password"  // GET,POST token=token
+	URLVerifyEmail    = "/pm-verify-email"    // GET,POST token=token
+	URLOAuthLogin     = "/pm-oauth-login"     // GET provider=name
+	URLOAuthCallback  = "/pm-oauth-callback"  // GET state=state code=code
+	URLIdentities     = "/pm-identities"      // GET,POST
+	URLAPITokens      = "/pm-api-tokens"      // GET,POST
 )
 
 // superadminURLs are the URLs where a superadmin account is needed, and the
@@ -29,12 +46,56 @@ const (
 var superadminURLs = map[string]struct{}{
 	URLLogout: {}, URLLogin: {}, URLSuperadminLogin: {}, URLDashboard: {},
 	URLCreatePage: {}, URLViewPage: {}, URLEditPage: {}, URLDeletePage: {},
-	URLConsole: {}, URLAnalytics: {},
+	URLConsole: {}, URLAnalytics: {}, URLManageThemes: {}, URLManageLocales: {},
+	URLTranslations: {}, URLManageUsers: {}, URLManageRoles: {},
+	URLSessions: {}, URLTwoFactor: {}, URLLoginTwoFactor: {},
+	URLForgotPassword: {}, URLResetPassword: {}, URLVerifyEmail: {},
+	URLOAuthLogin: {}, URLOAuthCallback: {}, URLIdentities: {},
+	URLAPITokens: {},
 }
 
 var (
 	ErrBoxesNotInitialized     = errors.New("boxes not initialized")
 	ErrInvalidLoginCredentials = errors.New("Invalid username/email or password")
+	ErrTooManyLoginAttempts    = errors.New("too many failed login attempts")
+	ErrTOTPEnabled             = errors.New("two-factor authentication is already enabled")
+	ErrTOTPNotEnrolled         = errors.New("two-factor authentication is not set up")
+	ErrInvalidTOTPCode         = errors.New("invalid authentication code")
+	ErrInvalidRecoveryCode     = errors.New("invalid recovery code")
+	ErrInvalidEmailToken       = errors.New("this link is invalid or has expired")
+	ErrPasswordMismatch        = errors.New("passwords do not match")
+	ErrNoEmail                 = errors.New("no email address is set")
+	ErrNoBaseURL               = errors.New("emails with links cannot be sent because -pm-base-url is not set")
+	ErrInvalidIdentityProvider = errors.New("invalid identity provider")
+	ErrIdentityNotLinked       = errors.New("no account is linked to this identity")
+	ErrIdentityLinked          = errors.New("this identity is already linked to another account")
+	ErrOAuthLoginFailed        = errors.New("logging in with the identity provider failed, please try again")
+	ErrInvalidThemePath        = errors.New("invalid theme path")
+	ErrInvalidThemeArchive     = errors.New("invalid theme archive")
+	ErrThemeExists             = errors.New("theme already exists")
+	ErrThemeNotFound           = errors.New("no such theme")
+	ErrThemeInUse              = errors.New("theme is in use")
+	ErrInvalidLocaleCode       = errors.New("invalid locale code")
+	ErrLocaleExists            = errors.New("locale already exists")
+	ErrLocaleNotFound          = errors.New("no such locale")
+	ErrInvalidLocaleFallbacks  = errors.New("invalid locale fallbacks")
+	ErrInvalidLoginID          = errors.New("invalid login id")
+	ErrLoginIDExists           = errors.New("login id already exists")
+	ErrInvalidEmail            = errors.New("invalid email")
+	ErrInvalidUserData         = errors.New("user data is not a JSON object")
+	ErrUserNotFound            = errors.New("no such user")
+	ErrUserDisabled            = errors.New("user is disabled")
+	ErrSessionExpired          = errors.New("session expired")
+	ErrSessionNotFound         = errors.New("no such session")
+	ErrInvalidAPIToken         = errors.New("invalid or expired API token")
+	ErrAPITokenNotFound        = errors.New("no such API token")
+	ErrInvalidAPITokenScopes   = errors.New("choose at least one of your permissions as a scope")
+	ErrInvalidRoleName         = errors.New("invalid role name")
+	ErrRoleExists              = errors.New("role already exists")
+	ErrRoleNotFound            = errors.New("no such role")
+	ErrRoleReserved            = errors.New("role is reserved")
+	ErrInvalidPermissionName   = errors.New("invalid permission name")
+	ErrPermissionNotFound      = errors.New("no such permission")
 )
 
 type ctxKey string
@@ -54,12 +115,22 @@ const (
 	permissionViewPage   = "pagemanager:view-page"
 	permissionChangePage = "pagemanager:change-page"
 	permissionDeletePage = "pagemanager:delete-page"
+
+	permissionManageThemes  = "pagemanager:manage-themes"
+	permissionManageLocales = "pagemanager:manage-locales"
+	permissionManageUsers   = "pagemanager:manage-users"
+	permissionManageRoles   = "pagemanager:manage-roles"
 )
 
 const (
 	cookieSession        = "pm-session"
 	cookieLoginRedirect  = "pm-login-redirect"
 	cookieLogoutRedirect = "pm-logout-redirect"
+	cookieLocale         = "pm-locale"
+	cookieCSRF           = "pm-csrf"
+	cookiePendingLogin   = "pm-pending-login"
+	cookieFlash          = "pm-flash"
+	cookieOAuthFlow      = "pm-oauth-flow"
 )
 
 const (
@@ -68,7 +139,23 @@ const (
 	EditModeBasic      = "basic"
 	EditModeAdvanced   = "advanced"
 
-	queryparamJSON = "pm-json"
+	queryparamJSON   = "pm-json"
+	queryparamLocale = "pm-locale"
+
+	queryparamUser         = "pm-user"
+	queryparamRole         = "pm-role"
+	queryparamDataID       = "pm-data-id"
+	queryparamSourceLocale = "pm-source-locale"
+)
+
+const (
+	FieldTypeText     = "text"
+	FieldTypeRichText = "richtext"
+	FieldTypeImage    = "image"
+	FieldTypeLink     = "link"
+	FieldTypeBoolean  = "boolean"
+	FieldTypeNumber   = "number"
+	FieldTypeList     = "list" // a list of objects, stored as rows
 )
 
 const (
@@ -78,3 +165,8 @@ const (
 	PageTypeRedirect = "redirect"
 	PageTypeDisabled = "disabled"
 )
+
+const (
+	ContentFormatHTML     = ""
+	ContentFormatMarkdown = "markdown"
+)
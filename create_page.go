@@ -22,6 +22,10 @@ type createPageData struct {
 	Templates [][]string
 }
 
+func (data *createPageData) LogoutForm() (template.HTML, error) {
+	return logoutForm(data.w, data.r)
+}
+
 func (data *createPageData) Form() (template.HTML, error) {
 	return hyforms.MarshalForm(data.w, data.r, data.formCallback)
 }
@@ -38,6 +42,7 @@ func (data *createPageData) formCallback(form *hyforms.Form) {
 		RedirectGroupID = "redirect-group"
 		DisabledGroupID = "disabled-group"
 	)
+	r := form.Request()
 	form.Set("#pm-create-page", hy.Attr{"method": "POST"})
 	var urlValue string
 	if hyforms.Validate(data.URL, hyforms.IsRelativeURL) == nil {
@@ -48,11 +53,11 @@ func (data *createPageData) formCallback(form *hyforms.Form) {
 		data.PageType = PageTypeTemplate
 	}
 	pageType := form.Select("pm-page-type", hyforms.Options{
-		{Value: PageTypeTemplate, Display: "Theme Template", Selected: data.PageType == PageTypeTemplate},
-		{Value: PageTypePlugin, Display: "Plugin Handler", Selected: data.PageType == PageTypePlugin},
-		{Value: PageTypeContent, Display: "Content", Selected: data.PageType == PageTypeContent},
-		{Value: PageTypeRedirect, Display: "Redirect", Selected: data.PageType == PageTypeRedirect},
-		{Value: PageTypeDisabled, Display: "Disabled", Selected: data.PageType == PageTypeDisabled},
+		{Value: PageTypeTemplate, Display: msg(r, "create_page.page_type_template"), Selected: data.PageType == PageTypeTemplate},
+		{Value: PageTypePlugin, Display: msg(r, "create_page.page_type_plugin"), Selected: data.PageType == PageTypePlugin},
+		{Value: PageTypeContent, Display: msg(r, "create_page.page_type_content"), Selected: data.PageType == PageTypeContent},
+		{Value: PageTypeRedirect, Display: msg(r, "create_page.page_type_redirect"), Selected: data.PageType == PageTypeRedirect},
+		{Value: PageTypeDisabled, Display: msg(r, "create_page.page_type_disabled"), Selected: data.PageType == PageTypeDisabled},
 	}).Set("#pm-page-type.pointer", hy.Attr{"size": "5"})
 	var themePathOptions hyforms.Options
 	for i, themeName := range data.Themes {
@@ -89,42 +94,42 @@ func (data *createPageData) formCallback(form *hyforms.Form) {
 	disabled := form.Checkbox("pm-disabled", "", data.Hidden).Set("#pm-disabled.pointer.dib", nil)
 
 	form.AppendElements(
-		hy.H("div.mt3.mb1", nil, hy.H("label.pointer", hy.Attr{"for": pageURL.ID()}, hy.Txt("URL: "))),
+		hy.H("div.mt3.mb1", nil, hy.H("label.pointer", hy.Attr{"for": pageURL.ID()}, hy.Txt(msg(r, "create_page.url")))),
 		hy.H("div", nil, pageURL),
 	)
 	if data.URLExists {
-		form.Append("div.f6.red", nil, hy.Txt("error: url", data.URL, "already exists"))
+		form.Append("div.f6.red", nil, hy.Txt(msg(r, "create_page.url_exists", data.URL)))
 	} else if data.URL == "/" {
-		form.Append("div.f6.gray", nil, hy.Txt(`Note: "/" refers to your home page.`))
+		form.Append("div.f6.gray", nil, hy.Txt(msg(r, "create_page.home_page_note")))
 	}
 	form.Append("div", nil,
-		hy.H("div.mt3.mb1", nil, hy.H("label.pointer", hy.Attr{"for": pageType.ID()}, hy.Txt("Page Type: "))),
+		hy.H("div.mt3.mb1", nil, hy.H("label.pointer", hy.Attr{"for": pageType.ID()}, hy.Txt(msg(r, "create_page.page_type")))),
 		hy.H("div", nil, pageType),
 	)
 	form.Append("div", hy.Attr{"id": TemplateGroupID},
-		hy.H("div.mt3.mb1", nil, hy.H("label.pointer", hy.Attr{"for": themePath.ID()}, hy.Txt("Theme Path: "))),
+		hy.H("div.mt3.mb1", nil, hy.H("label.pointer", hy.Attr{"for": themePath.ID()}, hy.Txt(msg(r, "create_page.theme_path")))),
 		hy.H("div", nil, themePath),
-		hy.H("div.mt3.mb1", nil, hy.H("label.pointer", hy.Attr{}, hy.Txt("Template Name: "))),
+		hy.H("div.mt3.mb1", nil, hy.H("label.pointer", hy.Attr{}, hy.Txt(msg(r, "create_page.template_name")))),
 		templateNames,
 	)
 	form.Append("div", hy.Attr{"id": PluginGroupID},
-		hy.H("div.mt3.mb1", nil, hy.H("label.pointer", hy.Attr{"for": pluginName.ID()}, hy.Txt("Plugin Name: "))),
+		hy.H("div.mt3.mb1", nil, hy.H("label.pointer", hy.Attr{"for": pluginName.ID()}, hy.Txt(msg(r, "create_page.plugin_name")))),
 		hy.H("div", nil, pluginName),
-		hy.H("div.mt3.mb1", nil, hy.H("label.pointer", hy.Attr{"for": handlerName.ID()}, hy.Txt("Handler Name: "))),
+		hy.H("div.mt3.mb1", nil, hy.H("label.pointer", hy.Attr{"for": handlerName.ID()}, hy.Txt(msg(r, "create_page.handler_name")))),
 		hy.H("div", nil, handlerName),
 	)
 	form.Append("div", hy.Attr{"id": ContentGroupID},
-		hy.H("div.mt3.mb1", nil, hy.H("label.pointer", hy.Attr{"for": content.ID()}, hy.Txt("Content: "))),
+		hy.H("div.mt3.mb1", nil, hy.H("label.pointer", hy.Attr{"for": content.ID()}, hy.Txt(msg(r, "create_page.content")))),
 		hy.H("div", nil, content),
 	)
 	form.Append("div", hy.Attr{"id": RedirectGroupID},
-		hy.H("div.mt3.mb1", nil, hy.H("label.pointer", hy.Attr{"for": redirectURL.ID()}, hy.Txt("Redirect URL: "))),
+		hy.H("div.mt3.mb1", nil, hy.H("label.pointer", hy.Attr{"for": redirectURL.ID()}, hy.Txt(msg(r, "create_page.redirect_url")))),
 		hy.H("div", nil, redirectURL),
 	)
 	form.Append("div", hy.Attr{"id": DisabledGroupID},
-		hy.H("div.mt3.mb1", nil, hy.H("label.pointer", hy.Attr{"for": disabled.ID()}, hy.Txt("Disabled: "), disabled)),
+		hy.H("div.mt3.mb1", nil, hy.H("label.pointer", hy.Attr{"for": disabled.ID()}, hy.Txt(msg(r, "create_page.disabled")), disabled)),
 	)
-	form.Append("div.mt3", nil, hy.H("button.pointer.pa2.bg-white", hy.Attr{"type": "submit"}, hy.Txt("Create Page")))
+	form.Append("div.mt3", nil, hy.H("button.pointer.pa2.bg-white", hy.Attr{"type": "submit"}, hy.Txt(msg(r, "create_page.submit"))))
 
 	form.Unmarshal(func() {
 		data.Valid = true
@@ -0,0 +1,144 @@
+package pagemanager
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/bokwoon95/pagemanager/erro"
+)
+
+// editModeCSP are the sources that editmode.css and editmode.js need in order
+// to work.
+var editModeCSP = map[string][]string{
+	"script-src":     {"'self'"},
+	"style-src":      {"'self'"},
+	"style-src-attr": {"'unsafe-inline'"},
+	"img-src":        {"'self'", "blob:", "data:"},
+	"connect-src":    {"'self'"},
+}
+
+// cspFallbacks maps a CSP directive to the directive that the browser falls
+// back to when it is not declared. Directives not listed here fall back to
+// default-src.
+var cspFallbacks = map[string]string{
+	"script-src-elem": "script-src",
+	"script-src-attr": "script-src",
+	"style-src-elem":  "style-src",
+	"style-src-attr":  "style-src",
+}
+
+// cspSources returns the sources that are in effect for a CSP directive,
+// taking fallback directives into account. If the directive is not restricted
+// at all, ok is false.
+func cspSources(csp map[string][]string, directive string) (sources []string, ok bool) {
+	for directive != "" {
+		if sources, ok = csp[directive]; ok {
+			return sources, true
+		}
+		if directive == "default-src" {
+			break
+		}
+		if fallback, ok := cspFallbacks[directive]; ok {
+			directive = fallback
+		} else {
+			directive = "default-src"
+		}
+	}
+	return nil, false
+}
+
+// extendCSP allows additional sources for a CSP directive. Directives that are
+// not restricted are left alone, because declaring them would only restrict
+// them further. If the directive already allows 'unsafe-inline', hashes and
+// nonces are not added as they would cause the browser to ignore
+// 'unsafe-inline'.
+func extendCSP(csp map[string][]string, directive string, sources ...string) {
+	existing, ok := cspSources(csp, directive)
+	if !ok {
+		return
+	}
+	unsafeInline := false
+	for _, source := range existing {
+		if source == "'unsafe-inline'" {
+			unsafeInline = true
+			break
+		}
+	}
+	merged := append([]string(nil), existing...)
+	for _, source := range sources {
+		if unsafeInline && (strings.HasPrefix(source, "'sha") || strings.HasPrefix(source, "'nonce-")) {
+			continue
+		}
+		merged = append(merged, source)
+	}
+	csp[directive] = merged
+}
+
+// serializeCSP converts csp into its header form. Directives are sorted by
+// name and duplicate sources are removed.
+func serializeCSP(csp map[string][]string) string {
+	directives := make([]string, 0, len(csp))
+	for directive := range csp {
+		directives = append(directives, directive)
+	}
+	sort.Strings(directives)
+	buf := bufpool.Get().(*bytes.Buffer)
+	defer func() {
+		buf.Reset()
+		bufpool.Put(buf)
+	}()
+	for i, directive := range directives {
+		if i > 0 {
+			buf.WriteString("; ")
+		}
+		buf.WriteString(directive)
+		seen := make(map[string]struct{})
+		for _, source := range csp[directive] {
+			if _, ok := seen[source]; ok {
+				continue
+			}
+			seen[source] = struct{}{}
+			buf.WriteString(" " + source)
+		}
+	}
+	return buf.String()
+}
+
+func newNonce() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", erro.Wrap(err)
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// cspReport logs the Content-Security-Policy violation reports sent by
+// browsers.
+func (pm *PageManager) cspReport(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		b, err := io.ReadAll(io.LimitReader(r.Body, 64<<10))
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		buf := &bytes.Buffer{}
+		err = json.Compact(buf, b)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Content-Security-Policy violation: %s", buf.String())
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,118 @@
+package pagemanager
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"sync"
+
+	"github.com/bokwoon95/pagemanager/encrypthash"
+	"github.com/bokwoon95/pagemanager/erro"
+	"github.com/bokwoon95/pagemanager/hyforms"
+)
+
+// csrfProtector issues and verifies the CSRF tokens of a request for hyforms.
+// A token is a hash of the session hash of the user, or of a random pm-csrf
+// cookie if the user is not logged in, so it cannot be forged without the keys
+// and is useless to anyone but the user it was issued to.
+//
+// A csrfProtector belongs to a single request, so that the pm-csrf cookie is
+// set at most once however many forms the request renders.
+type csrfProtector struct {
+	pm     *PageManager
+	w      http.ResponseWriter
+	once   sync.Once
+	anonID string
+	err    error
+}
+
+func newCSRFFallbackBox() (encrypthash.Box, error) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		return encrypthash.Box{}, erro.Wrap(err)
+	}
+	return encrypthash.NewStaticKey(key)
+}
+
+// box returns the publicBox, or the csrfFallbackBox if the boxes are not
+// initialized yet e.g. while the superadmin is being set up.
+func (p *csrfProtector) box() encrypthash.Box {
+	if p.pm.boxesInitialized() {
+		return p.pm.publicBox
+	}
+	return p.pm.csrfFallbackBox
+}
+
+// binding returns what the CSRF tokens of r are bound to. If issue is true
+// and the user is neither logged in nor has a pm-csrf cookie, a new pm-csrf
+// cookie is set.
+func (p *csrfProtector) binding(r *http.Request, issue bool) (string, error) {
+	user, _ := p.pm.getUser(p.w, r)
+	if user.Valid && user.apiTokenHash != "" {
+		return "token:" + user.apiTokenHash, nil
+	}
+	if user.Valid {
+		return "session:" + user.sessionHash, nil
+	}
+	if c, _ := r.Cookie(cookieCSRF); c != nil && c.Value != "" {
+		return "anon:" + c.Value, nil
+	}
+	if !issue {
+		return "", nil
+	}
+	p.once.Do(func() {
+		b := make([]byte, 24)
+		_, p.err = rand.Read(b)
+		if p.err != nil {
+			return
+		}
+		p.anonID = base64.RawURLEncoding.EncodeToString(b)
+		http.SetCookie(p.w, &http.Cookie{
+			Path:     "/",
+			Name:     cookieCSRF,
+			Value:    p.anonID,
+			HttpOnly: true,
+			Secure:   *flagSecureCookies || r.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		})
+	})
+	if p.err != nil {
+		return "", erro.Wrap(p.err)
+	}
+	return "anon:" + p.anonID, nil
+}
+
+func (p *csrfProtector) CSRFToken(r *http.Request) (string, error) {
+	binding, err := p.binding(r, true)
+	if err != nil {
+		return "", erro.Wrap(err)
+	}
+	hash, err := p.box().Hash([]byte(binding))
+	if err != nil {
+		return "", erro.Wrap(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(hash), nil
+}
+
+func (p *csrfProtector) VerifyCSRFToken(r *http.Request, token string) error {
+	binding, err := p.binding(r, false)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	if binding == "" {
+		return hyforms.ErrCSRFTokenInvalid
+	}
+	hash, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	return p.box().VerifyHash([]byte(binding), hash)
+}
+
+// CSRFExempt exempts requests authenticated with an API token, as browsers
+// never send an Authorization header on their own so they cannot be forged.
+func (p *csrfProtector) CSRFExempt(r *http.Request) bool {
+	user, _ := p.pm.getUser(p.w, r)
+	return user.Valid && user.apiTokenHash != ""
+}
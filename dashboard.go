@@ -18,6 +18,10 @@ type dashboardData struct {
 	Pages []Page
 }
 
+func (data *dashboardData) LogoutForm() (template.HTML, error) {
+	return logoutForm(data.w, data.r)
+}
+
 func (d *dashboardData) PagesList() (template.HTML, error) {
 	var els hy.Elements
 	els.Append("div.mv2", nil, hy.H("a", hy.Attr{"href": URLCreatePage}, hy.Txt("create")))
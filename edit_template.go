@@ -0,0 +1,306 @@
+package pagemanager
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+
+	"github.com/bokwoon95/pagemanager/erro"
+	"github.com/bokwoon95/pagemanager/hy"
+	"github.com/bokwoon95/pagemanager/hyforms"
+	"github.com/bokwoon95/pagemanager/sq"
+	"github.com/bokwoon95/pagemanager/tpl"
+)
+
+// maxListItems caps the number of items a list field can be submitted with.
+const maxListItems = 1000
+
+type editTemplateData struct {
+	w          http.ResponseWriter `json:"-"`
+	r          *http.Request       `json:"-"`
+	URL        string
+	LocaleCode string
+	Fields     []templateField
+	Values     map[string]string
+	Rows       map[string][]map[string]interface{}
+}
+
+func (data *editTemplateData) LogoutForm() (template.HTML, error) {
+	return logoutForm(data.w, data.r)
+}
+
+func (data *editTemplateData) Form() (template.HTML, error) {
+	return hyforms.MarshalForm(data.w, data.r, data.formCallback)
+}
+
+func (data *editTemplateData) formCallback(form *hyforms.Form) {
+	form.Set("#pm-edit-template", hy.Attr{"method": "POST"})
+	for _, errMsg := range form.ErrMsgs() {
+		form.Append("div.red", nil, hy.Txt(errMsg))
+	}
+	var unmarshallers []func()
+	for _, field := range data.Fields {
+		field := field
+		name := "pm-field-" + field.Name
+		if field.Type == FieldTypeList {
+			unmarshallers = append(unmarshallers, data.listField(form, name, field))
+			continue
+		}
+		el, value := fieldInput(form, name, field, data.Values[field.Name])
+		form.AppendElements(el)
+		unmarshallers = append(unmarshallers, func() {
+			v, _ := value()
+			data.Values[field.Name] = hy.Stringify(v)
+		})
+	}
+	form.Append("div.mt3", nil, hy.H("button.pointer.pa2.bg-white", hy.Attr{"type": "submit"}, hy.Txt("Save")))
+
+	form.Unmarshal(func() {
+		for _, unmarshaller := range unmarshallers {
+			unmarshaller()
+		}
+	})
+}
+
+// listField renders every item of a list field followed by an empty item that
+// can be filled in to add a new item. The number of items rendered is tracked
+// in a hidden input so that the items can be read back on submission. The returned unmarshaller collects the
+// submitted items into data.Rows, skipping deleted and empty items.
+func (data *editTemplateData) listField(form *hyforms.Form, name string, field templateField) (unmarshaller func()) {
+	rows := data.Rows[field.Name]
+	count := form.Hidden(name+".count", strconv.Itoa(len(rows)+1))
+	numItems := len(rows) + 1
+	if n, err := strconv.Atoi(form.Request().FormValue(count.Name())); err == nil && n >= 0 && n <= maxListItems {
+		numItems = n
+	}
+	type item struct {
+		values  map[string]func() (interface{}, bool)
+		deleted *hyforms.ToggledInput
+	}
+	items := make([]item, numItems)
+	list := hy.H("fieldset.mt3", nil, hy.H("legend", nil, hy.Txt(field.Label)), count)
+	if field.Description != "" {
+		list.Append("div.f6.gray", nil, hy.Txt(field.Description))
+	}
+	for i := range items {
+		var row map[string]interface{}
+		if i < len(rows) {
+			row = rows[i]
+		}
+		itemName := fmt.Sprintf("%s[%d]", name, i)
+		items[i].values = make(map[string]func() (interface{}, bool))
+		fieldset := hy.H("fieldset.mt2", nil)
+		for _, subfield := range field.Fields {
+			if subfield.Type == FieldTypeList {
+				continue // nested lists are not supported
+			}
+			var defaultValue string
+			if v, ok := row[subfield.Name]; ok {
+				defaultValue = hy.Stringify(v)
+			}
+			el, value := fieldInput(form, itemName+"."+subfield.Name, subfield, defaultValue)
+			fieldset.AppendElements(el)
+			items[i].values[subfield.Name] = value
+		}
+		if i < numItems-1 {
+			items[i].deleted = form.Checkbox(itemName+".pm-delete", "", false).Set(".pointer", hy.Attr{"id": itemName + ".pm-delete"})
+			fieldset.Append("div.mt2", nil, hy.H("label.pointer", hy.Attr{"for": itemName + ".pm-delete"}, items[i].deleted, hy.Txt(" Delete")))
+		}
+		list.AppendElements(fieldset)
+	}
+	form.AppendElements(list)
+	return func() {
+		var submitted []map[string]interface{}
+		for _, item := range items {
+			if item.deleted != nil && item.deleted.Checked() {
+				continue
+			}
+			row := make(map[string]interface{})
+			empty := true
+			for subfieldName, value := range item.values {
+				v, ok := value()
+				if !ok {
+					continue
+				}
+				row[subfieldName] = v
+				if _, isBool := v.(bool); !isBool {
+					empty = false
+				}
+			}
+			if empty {
+				continue
+			}
+			submitted = append(submitted, row)
+		}
+		data.Rows[field.Name] = submitted
+	}
+}
+
+// fieldInput renders the input of a single (non-list) field. The returned value
+// function reports the submitted value, typed according to the field's type,
+// and whether a value was submitted at all.
+func fieldInput(form *hyforms.Form, name string, field templateField, defaultValue string) (el hy.Element, value func() (interface{}, bool)) {
+	div := hy.H("div", nil)
+	label := hy.H("label.pointer", hy.Attr{"for": name}, hy.Txt(field.Label))
+	switch field.Type {
+	case FieldTypeBoolean:
+		input := form.Checkbox(name, "", defaultValue == "true").Set(".pointer", hy.Attr{"id": name})
+		div.Append("div.mt3.mb1", nil, hy.H("label.pointer", hy.Attr{"for": name}, input, hy.Txt(" "+field.Label)))
+		value = func() (interface{}, bool) { return input.Checked(), true }
+	case FieldTypeRichText:
+		input := form.Textarea(name, defaultValue).Set(".pa2.w-100", hy.Attr{"id": name, "rows": "8", "data-pm-richtext": hy.Enabled})
+		div.Append("div.mt3.mb1", nil, label)
+		div.Append("div", nil, input)
+		value = func() (interface{}, bool) { return input.Value(), input.Value() != "" }
+	case FieldTypeNumber:
+		input := form.Input("number", name, defaultValue).Set(".pa2", hy.Attr{"id": name, "step": "any"})
+		div.Append("div.mt3.mb1", nil, label)
+		div.Append("div", nil, input)
+		for _, errMsg := range input.ErrMsgs() {
+			div.Append("div.f7.red", nil, hy.Txt(errMsg))
+		}
+		value = func() (interface{}, bool) {
+			if input.Value() == "" {
+				return "", false
+			}
+			num, err := strconv.ParseFloat(input.Value(), 64)
+			if err != nil {
+				form.AddInputErrMsgs(input.Name(), fmt.Sprintf("%s is not a number", input.Value()))
+				return "", false
+			}
+			return num, true
+		}
+	case FieldTypeImage, FieldTypeLink:
+		input := form.Text(name, defaultValue).Set(".pa2.w-100", hy.Attr{"id": name})
+		div.Append("div.mt3.mb1", nil, label)
+		div.Append("div", nil, input)
+		for _, errMsg := range input.ErrMsgs() {
+			div.Append("div.f7.red", nil, hy.Txt(errMsg))
+		}
+		value = func() (interface{}, bool) {
+			input.Validate(hyforms.Optional, hyforms.Or(hyforms.IsURL, hyforms.IsRelativeURL))
+			return input.Value(), input.Value() != ""
+		}
+	default: // FieldTypeText
+		input := form.Text(name, defaultValue).Set(".pa2.w-100", hy.Attr{"id": name})
+		div.Append("div.mt3.mb1", nil, label)
+		div.Append("div", nil, input)
+		value = func() (interface{}, bool) { return input.Value(), input.Value() != "" }
+	}
+	if field.Description != "" {
+		div.Append("div.f6.gray", nil, hy.Txt(field.Description))
+	}
+	return div, value
+}
+
+// editTemplate serves the advanced edit mode of a template page, which is a
+// form generated from the template's fields. Values are saved for the page's
+// URL in the page's locale.
+func (pm *PageManager) editTemplate(w http.ResponseWriter, r *http.Request, fields []templateField) {
+	data := &editTemplateData{
+		w:          w,
+		r:          r,
+		URL:        r.URL.Path,
+		LocaleCode: LocaleCode(r),
+		Fields:     fields,
+	}
+	user, _ := pm.getUser(w, r)
+	switch {
+	case !user.Valid:
+		pm.RedirectToLogin(w, r)
+		return
+	case !user.Permissions[permissionChangePage]:
+		pm.Forbidden(w, r)
+		return
+	}
+	editURL := r.URL.Path + "?" + queryparamEditMode + "=" + EditModeAdvanced
+	var err error
+	switch r.Method {
+	case "GET":
+		data.Values, data.Rows, err = pm.getPageData(r.Context(), data.LocaleCode, data.URL)
+		if err != nil {
+			pm.InternalServerError(w, r, erro.Wrap(err))
+			return
+		}
+		err = pm.tpl.Render(w, r, data, tpl.Files("edit_template.html"))
+		if err != nil {
+			pm.InternalServerError(w, r, erro.Wrap(err))
+			return
+		}
+	case "POST":
+		data.Values = make(map[string]string)
+		data.Rows = make(map[string][]map[string]interface{})
+		errMsgs, ok := hyforms.UnmarshalForm(w, r, data.formCallback)
+		if !ok {
+			hyforms.Redirect(w, r, LocaleURL(r, editURL), errMsgs)
+			return
+		}
+		data.sanitize(pm, user)
+		err = sq.WithTxContext(r.Context(), pm.dataDB, nil, func(tx *sql.Tx) error {
+			for _, field := range data.Fields {
+				if field.Type == FieldTypeList {
+					err := setPageRows(r.Context(), tx, data.LocaleCode, data.URL, field.Name, data.Rows[field.Name])
+					if err != nil {
+						return erro.Wrap(err)
+					}
+					continue
+				}
+				err := setPageValue(r.Context(), tx, data.LocaleCode, data.URL, field.Name, data.Values[field.Name])
+				if err != nil {
+					return erro.Wrap(err)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			pm.InternalServerError(w, r, erro.Wrap(err))
+			return
+		}
+		Redirect(w, r, editURL)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// sanitize sanitizes the submitted values, including those of list items,
+// according to the user's sanitize policy. Only values of fields declared with
+// a type other than richtext are left as they are, since templates render them
+// escaped. Values of undeclared keys are sanitized like richtext because
+// nothing stops a template from rendering them as HTML.
+func (data *editTemplateData) sanitize(pm *PageManager, user SessionUser) {
+	fieldTypes := make(map[string]string)
+	subfieldTypes := make(map[string]map[string]string)
+	for _, field := range data.Fields {
+		fieldTypes[field.Name] = field.Type
+		if field.Type != FieldTypeList {
+			continue
+		}
+		subfieldTypes[field.Name] = make(map[string]string)
+		for _, subfield := range field.Fields {
+			subfieldTypes[field.Name][subfield.Name] = subfield.Type
+		}
+	}
+	isPlain := func(fieldType string, declared bool) bool {
+		return declared && fieldType != FieldTypeRichText && fieldType != FieldTypeList
+	}
+	for key, v := range data.Values {
+		if fieldType, ok := fieldTypes[key]; !isPlain(fieldType, ok) {
+			data.Values[key] = pm.sanitizeHTML(user, v)
+		}
+	}
+	for key, rows := range data.Rows {
+		for _, row := range rows {
+			for name, v := range row {
+				s, ok := v.(string)
+				if !ok {
+					continue
+				}
+				if fieldType, ok := subfieldTypes[key][name]; !isPlain(fieldType, ok) {
+					row[name] = pm.sanitizeHTML(user, s)
+				}
+			}
+		}
+	}
+}
@@ -675,8 +675,10 @@ document.addEventListener("DOMContentLoaded", function main() {
       for (const [key, value] of formdata.entries()) {
         console.log(key + ", " + value);
       }
+      const pmJSON = JSON.parse(document.querySelector("script[data-pm-json]")?.textContent || "{}");
       const res = await fetch("/upload", {
         method: "POST",
+        headers: { "X-CSRF-Token": pmJSON.csrfToken || "" },
         body: formdata,
       });
       console.log(res);
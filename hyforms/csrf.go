@@ -0,0 +1,99 @@
+package hyforms
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/bokwoon95/pagemanager/hy"
+)
+
+const (
+	// CSRFTokenName is the name of the hidden input that MarshalForm injects
+	// the CSRF token into.
+	CSRFTokenName = "hyforms.csrf"
+	// CSRFHeader is the header that fetch requests send the CSRF token in.
+	CSRFHeader = "X-CSRF-Token"
+)
+
+const CSRFErrMsg = "[CSRFErrMsg] invalid or missing CSRF token, please reload the page and try again"
+
+// ErrCSRFTokenInvalid is returned by VerifyCSRFToken if the request has no CSRF
+// token or an invalid one.
+var ErrCSRFTokenInvalid = errors.New("invalid or missing CSRF token")
+
+const ctxKeyCSRFProtector ctxKey = "csrfProtector"
+
+// CSRFProtector issues the CSRF tokens of a request and verifies them.
+// VerifyCSRFToken must return an error if token was not issued by CSRFToken
+// for the same user.
+type CSRFProtector interface {
+	CSRFToken(r *http.Request) (token string, err error)
+	VerifyCSRFToken(r *http.Request, token string) error
+}
+
+// CSRFExempter may be implemented by a CSRFProtector to exempt requests that
+// cannot be forged from needing a CSRF token, e.g. requests authenticated by
+// a header that browsers never send on their own instead of by a cookie.
+type CSRFExempter interface {
+	CSRFExempt(r *http.Request) bool
+}
+
+// WithCSRFProtector returns a copy of ctx that makes MarshalForm inject a CSRF
+// token issued by p into every POST form, and UnmarshalForm reject any form
+// without a valid one. Pass it to the request that forms are marshalled and
+// unmarshalled with, e.g. r.WithContext(hyforms.WithCSRFProtector(r.Context(), p)).
+func WithCSRFProtector(ctx context.Context, p CSRFProtector) context.Context {
+	return context.WithValue(ctx, ctxKeyCSRFProtector, p)
+}
+
+// CSRFToken returns the CSRF token of r, which is empty if r has no
+// CSRFProtector. Requests that are not made with a form e.g. fetch requests
+// should send it in the CSRFHeader.
+func CSRFToken(r *http.Request) (string, error) {
+	p, _ := r.Context().Value(ctxKeyCSRFProtector).(CSRFProtector)
+	if p == nil {
+		return "", nil
+	}
+	return p.CSRFToken(r)
+}
+
+// VerifyCSRFToken verifies the CSRF token sent in the CSRFHeader or else in
+// the CSRFTokenName form value of r. It always succeeds if r has no
+// CSRFProtector or the CSRFProtector exempts r. Handlers of requests that are not unmarshalled with
+// UnmarshalForm e.g. JSON requests should call it themselves.
+func VerifyCSRFToken(r *http.Request) error {
+	p, _ := r.Context().Value(ctxKeyCSRFProtector).(CSRFProtector)
+	if p == nil {
+		return nil
+	}
+	if e, ok := p.(CSRFExempter); ok && e.CSRFExempt(r) {
+		return nil
+	}
+	token := r.Header.Get(CSRFHeader)
+	if token == "" {
+		token = r.FormValue(CSRFTokenName)
+	}
+	if token == "" {
+		return ErrCSRFTokenInvalid
+	}
+	if p.VerifyCSRFToken(r, token) != nil {
+		return ErrCSRFTokenInvalid
+	}
+	return nil
+}
+
+// csrfInput returns the hidden input holding the CSRF token of r, or nil if
+// the form is not a POST form or r has no CSRFProtector. GET forms do not get
+// a token because it would end up in the URL.
+func csrfInput(r *http.Request, attrs hy.Attributes) (hy.Element, error) {
+	if !strings.EqualFold(attrs.Dict["method"], "POST") {
+		return nil, nil
+	}
+	token, err := CSRFToken(r)
+	if err != nil || token == "" {
+		return nil, err
+	}
+	return hy.H("input", hy.Attr{"type": "hidden", "name": CSRFTokenName, "value": token}), nil
+}
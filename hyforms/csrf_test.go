@@ -0,0 +1,92 @@
+package hyforms
+
+import (
+	"errors"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/bokwoon95/pagemanager/hy"
+	"github.com/bokwoon95/pagemanager/testutil"
+)
+
+type staticCSRFProtector string
+
+func (p staticCSRFProtector) CSRFToken(r *http.Request) (string, error) { return string(p), nil }
+
+func (p staticCSRFProtector) VerifyCSRFToken(r *http.Request, token string) error {
+	if token != string(p) {
+		return errors.New("token mismatch")
+	}
+	return nil
+}
+
+// headerCSRFProtector exempts requests with an Authorization header.
+type headerCSRFProtector struct{ staticCSRFProtector }
+
+func (p headerCSRFProtector) CSRFExempt(r *http.Request) bool {
+	return r.Header.Get("Authorization") != ""
+}
+
+func Test_CSRF(t *testing.T) {
+	newRequest := func(method string, form url.Values) *http.Request {
+		r := httptest.NewRequest(method, "/", strings.NewReader(form.Encode()))
+		if method == "POST" {
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		return r.WithContext(WithCSRFProtector(r.Context(), staticCSRFProtector("s3cr3t")))
+	}
+	formCallback := func(method string) func(*Form) {
+		return func(form *Form) {
+			form.Set("", hy.Attr{"method": method})
+		}
+	}
+	t.Run("marshal", func(t *testing.T) {
+		is := testutil.New(t)
+		r := newRequest("GET", nil)
+		output, err := MarshalForm(httptest.NewRecorder(), r, formCallback("POST"))
+		is.NoErr(err)
+		is.Equal(template.HTML(`<form method="POST"><input name="hyforms.csrf" type="hidden" value="s3cr3t"></form>`), output)
+		output, err = MarshalForm(httptest.NewRecorder(), r, formCallback("GET"))
+		is.NoErr(err)
+		is.True(!strings.Contains(string(output), "s3cr3t"))
+	})
+	t.Run("unmarshal", func(t *testing.T) {
+		is := testutil.New(t)
+		_, ok := UnmarshalForm(httptest.NewRecorder(), newRequest("POST", url.Values{CSRFTokenName: {"s3cr3t"}}), formCallback("POST"))
+		is.True(ok)
+		errMsgs, ok := UnmarshalForm(httptest.NewRecorder(), newRequest("POST", url.Values{CSRFTokenName: {"guess"}}), formCallback("POST"))
+		is.True(!ok)
+		is.True(ErrMsgsMatch(errMsgs.FormErrMsgs, CSRFErrMsg))
+		_, ok = UnmarshalForm(httptest.NewRecorder(), newRequest("POST", nil), formCallback("POST"))
+		is.True(!ok)
+	})
+	t.Run("header", func(t *testing.T) {
+		is := testutil.New(t)
+		r := newRequest("POST", nil)
+		is.True(errors.Is(VerifyCSRFToken(r), ErrCSRFTokenInvalid))
+		r.Header.Set(CSRFHeader, "s3cr3t")
+		is.NoErr(VerifyCSRFToken(r))
+		token, err := CSRFToken(r)
+		is.NoErr(err)
+		is.Equal("s3cr3t", token)
+	})
+	t.Run("exempt", func(t *testing.T) {
+		is := testutil.New(t)
+		r := httptest.NewRequest("POST", "/", nil)
+		r = r.WithContext(WithCSRFProtector(r.Context(), headerCSRFProtector{"s3cr3t"}))
+		is.True(errors.Is(VerifyCSRFToken(r), ErrCSRFTokenInvalid))
+		r.Header.Set("Authorization", "Bearer token")
+		is.NoErr(VerifyCSRFToken(r))
+	})
+	t.Run("no protector", func(t *testing.T) {
+		is := testutil.New(t)
+		r := httptest.NewRequest("POST", "/", nil)
+		is.NoErr(VerifyCSRFToken(r))
+		_, ok := UnmarshalForm(httptest.NewRecorder(), r, formCallback("POST"))
+		is.True(ok)
+	})
+}
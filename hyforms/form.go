@@ -28,10 +28,16 @@ func (f *Form) WriteHTML(w io.Writer) error {
 	if f.mode == FormModeUnmarshal {
 		return nil
 	}
-	// check f.request.Context() for any CSRF token and prepend it into the form as necessary
-	// or should this be done in a hook?
 	f.attrs.Tag = "form"
-	err := hy.WriteHTML(w, f.attrs, f.children...)
+	children := f.children
+	csrf, err := csrfInput(f.request, f.attrs)
+	if err != nil {
+		return err
+	}
+	if csrf != nil {
+		children = append([]hy.Element{csrf}, children...)
+	}
+	err = hy.WriteHTML(w, f.attrs, children...)
 	if err != nil {
 		return err
 	}
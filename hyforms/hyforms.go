@@ -81,6 +81,9 @@ func UnmarshalForm(w http.ResponseWriter, r *http.Request, fn func(*Form)) (errM
 		inputNames:   make(map[string]struct{}),
 		inputErrMsgs: make(map[string][]string),
 	}
+	if VerifyCSRFToken(r) != nil {
+		form.formErrMsgs = append(form.formErrMsgs, errMsgf(r.Context(), CSRFErrMsg))
+	}
 	fn(form)
 	if len(form.formErrMsgs) > 0 || len(form.inputErrMsgs) > 0 {
 		errMsgs.FormErrMsgs = form.formErrMsgs
@@ -196,7 +199,13 @@ func validateInput(f *Form, inputName string, value interface{}, validators []Va
 	}
 }
 
+// ErrMsgsMatch reports whether any of the errMsgs contains target. If target
+// is an error message constant like RequiredErrMsg only its [tag] has to
+// match, so that translated error messages are matched as well.
 func ErrMsgsMatch(errMsgs []string, target string) bool {
+	if tag := errMsgTag(target); tag != "" {
+		target = tag
+	}
 	for _, msg := range errMsgs {
 		if strings.Contains(msg, target) {
 			return true
@@ -335,6 +335,10 @@ func (i *SelectInput) Values() []string {
 	return i.form.request.Form[i.name]
 }
 
+func (i *SelectInput) ErrMsgs() []string {
+	return i.form.inputErrMsgs[i.name]
+}
+
 type TextareaInput struct {
 	form         *Form
 	attrs        hy.Attributes
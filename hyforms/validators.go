@@ -76,10 +76,50 @@ func And(validators ...Validator) Validator {
 type ctxKey string
 
 const (
-	ctxKeyName          ctxKey = "name"
-	ctxKeyDoNotDecorate ctxKey = "doNotDecorate"
+	ctxKeyName             ctxKey = "name"
+	ctxKeyDoNotDecorate    ctxKey = "doNotDecorate"
+	ctxKeyErrMsgTranslator ctxKey = "errMsgTranslator"
 )
 
+// ErrMsgTranslator translates the error message of a validator. errMsg is
+// one of the error message constants e.g. RequiredErrMsg, and args are its
+// arguments e.g. the length of LengthGtErrMsg. The translation replaces the
+// text of the constant but not its [tag], so that ErrMsgsMatch still matches
+// translated error messages.
+type ErrMsgTranslator func(errMsg string, args ...interface{}) string
+
+// WithErrMsgTranslator returns a copy of ctx that makes the validators
+// translate their error messages with translate. Pass it to the request that
+// is unmarshalled, e.g. r.WithContext(hyforms.WithErrMsgTranslator(r.Context(), translate)).
+func WithErrMsgTranslator(ctx context.Context, translate ErrMsgTranslator) context.Context {
+	return context.WithValue(ctx, ctxKeyErrMsgTranslator, translate)
+}
+
+// errMsgTag returns the [tag] that an error message constant starts with.
+func errMsgTag(errMsg string) string {
+	if strings.HasPrefix(errMsg, "[") {
+		if i := strings.IndexByte(errMsg, ']'); i > 0 {
+			return errMsg[:i+1]
+		}
+	}
+	return ""
+}
+
+// errMsgf returns the error message constant errMsg followed by its args, or
+// its translation if ctx has an ErrMsgTranslator.
+func errMsgf(ctx context.Context, errMsg string, args ...interface{}) string {
+	if translate, _ := ctx.Value(ctxKeyErrMsgTranslator).(ErrMsgTranslator); translate != nil {
+		if tag := errMsgTag(errMsg); tag != "" {
+			return tag + " " + translate(errMsg, args...)
+		}
+		return translate(errMsg, args...)
+	}
+	for _, arg := range args {
+		errMsg += fmt.Sprintf(" %v", arg)
+	}
+	return errMsg
+}
+
 func decorateErrMsg(ctx context.Context, errMsg string, value string) string {
 	doNotDecorate, _ := ctx.Value(ctxKeyDoNotDecorate).(bool)
 	if doNotDecorate {
@@ -100,7 +140,7 @@ func Required(ctx context.Context, value interface{}) (stop bool, errMsg string)
 		str = hy.Stringify(value)
 	}
 	if str == "" {
-		return true, decorateErrMsg(ctx, RequiredErrMsg, str)
+		return true, decorateErrMsg(ctx, errMsgf(ctx, RequiredErrMsg), str)
 	}
 	return false, ""
 }
@@ -129,7 +169,7 @@ func IsRegexp(re *regexp.Regexp) Validator {
 			str = hy.Stringify(value)
 		}
 		if !re.MatchString(str) {
-			return false, decorateErrMsg(ctx, fmt.Sprintf("%s %s", IsRegexpErrMsg, re), str)
+			return false, decorateErrMsg(ctx, errMsgf(ctx, IsRegexpErrMsg, re), str)
 		}
 		return false, ""
 	}
@@ -148,7 +188,7 @@ func IsEmail(ctx context.Context, value interface{}) (stop bool, errMsg string)
 		str = hy.Stringify(value)
 	}
 	if !emailRegexp.MatchString(str) {
-		return false, decorateErrMsg(ctx, IsEmailErrMsg, str)
+		return false, decorateErrMsg(ctx, errMsgf(ctx, IsEmailErrMsg), str)
 	}
 	return false, ""
 }
@@ -169,7 +209,7 @@ func IsURL(ctx context.Context, value interface{}) (stop bool, errMsg string) {
 		str = hy.Stringify(value)
 	}
 	if str == "" || utf8.RuneCountInString(str) >= maxURLRuneCount || len(str) <= minURLRuneCount || strings.HasPrefix(str, ".") {
-		return false, decorateErrMsg(ctx, IsURLErrMsg, str)
+		return false, decorateErrMsg(ctx, errMsgf(ctx, IsURLErrMsg), str)
 	}
 	strTemp := str
 	if strings.Contains(str, ":") && !strings.Contains(str, "://") {
@@ -179,16 +219,16 @@ func IsURL(ctx context.Context, value interface{}) (stop bool, errMsg string) {
 	}
 	u, err := url.Parse(strTemp)
 	if err != nil {
-		return false, decorateErrMsg(ctx, IsURLErrMsg, str)
+		return false, decorateErrMsg(ctx, errMsgf(ctx, IsURLErrMsg), str)
 	}
 	if strings.HasPrefix(u.Host, ".") {
-		return false, decorateErrMsg(ctx, IsURLErrMsg, str)
+		return false, decorateErrMsg(ctx, errMsgf(ctx, IsURLErrMsg), str)
 	}
 	if u.Host == "" && (u.Path != "" && !strings.Contains(u.Path, ".")) {
-		return false, decorateErrMsg(ctx, IsURLErrMsg, str)
+		return false, decorateErrMsg(ctx, errMsgf(ctx, IsURLErrMsg), str)
 	}
 	if !urlRegexp.MatchString(str) {
-		return false, decorateErrMsg(ctx, IsURLErrMsg, str)
+		return false, decorateErrMsg(ctx, errMsgf(ctx, IsURLErrMsg), str)
 	}
 	return false, ""
 }
@@ -201,12 +241,12 @@ func IsRelativeURL(ctx context.Context, value interface{}) (stop bool, errMsg st
 		str = hy.Stringify(value)
 	}
 	if str == "" || str[0] != '/' {
-		return false, decorateErrMsg(ctx, IsRelativeURLErrMsg, str)
+		return false, decorateErrMsg(ctx, errMsgf(ctx, IsRelativeURLErrMsg), str)
 	}
 	strTemp := "http://host.com" + str
 	_, errMsg = IsURL(ctx, strTemp)
 	if errMsg != "" {
-		return false, decorateErrMsg(ctx, IsRelativeURLErrMsg, str)
+		return false, decorateErrMsg(ctx, errMsgf(ctx, IsRelativeURLErrMsg), str)
 	}
 	return false, ""
 }
@@ -226,7 +266,7 @@ func AnyOf(targets ...string) Validator {
 				return false, ""
 			}
 		}
-		return false, decorateErrMsg(ctx, fmt.Sprintf("%s (%s)", AnyOfErrMsg, strings.Join(targets, " | ")), str)
+		return false, decorateErrMsg(ctx, errMsgf(ctx, AnyOfErrMsg, "("+strings.Join(targets, " | ")+")"), str)
 	}
 }
 
@@ -242,7 +282,7 @@ func NoneOf(targets ...string) Validator {
 		}
 		for _, target := range targets {
 			if target == str {
-				return false, decorateErrMsg(ctx, fmt.Sprintf("%s (%s)", NoneOfErrMsg, strings.Join(targets, " | ")), str)
+				return false, decorateErrMsg(ctx, errMsgf(ctx, NoneOfErrMsg, "("+strings.Join(targets, " | ")+")"), str)
 			}
 		}
 		return false, ""
@@ -260,7 +300,7 @@ func LengthGt(length int) Validator {
 			str = hy.Stringify(value)
 		}
 		if utf8.RuneCountInString(str) <= length {
-			return false, decorateErrMsg(ctx, fmt.Sprintf("%s %d", LengthGtErrMsg, length), str)
+			return false, decorateErrMsg(ctx, errMsgf(ctx, LengthGtErrMsg, length), str)
 		}
 		return false, ""
 	}
@@ -275,7 +315,7 @@ func LengthGe(length int) Validator {
 			str = hy.Stringify(value)
 		}
 		if utf8.RuneCountInString(str) < length {
-			return false, decorateErrMsg(ctx, fmt.Sprintf("%s %d", LengthGeErrMsg, length), str)
+			return false, decorateErrMsg(ctx, errMsgf(ctx, LengthGeErrMsg, length), str)
 		}
 		return false, ""
 	}
@@ -290,7 +330,7 @@ func LengthLt(length int) Validator {
 			str = hy.Stringify(value)
 		}
 		if utf8.RuneCountInString(str) >= length {
-			return false, decorateErrMsg(ctx, fmt.Sprintf("%s %d", LengthLtErrMsg, length), str)
+			return false, decorateErrMsg(ctx, errMsgf(ctx, LengthLtErrMsg, length), str)
 		}
 		return false, ""
 	}
@@ -305,7 +345,7 @@ func LengthLe(length int) Validator {
 			str = hy.Stringify(value)
 		}
 		if utf8.RuneCountInString(str) > length {
-			return false, decorateErrMsg(ctx, fmt.Sprintf("%s %d", LengthLeErrMsg, length), str)
+			return false, decorateErrMsg(ctx, errMsgf(ctx, LengthLeErrMsg, length), str)
 		}
 		return false, ""
 	}
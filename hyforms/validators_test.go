@@ -1,8 +1,41 @@
 package hyforms
 
 import (
+	"context"
+	"fmt"
 	"testing"
+
+	"github.com/bokwoon95/pagemanager/testutil"
 )
 
 func Test_Validators(t *testing.T) {
 }
+
+func Test_ErrMsgTranslator(t *testing.T) {
+	t.Run("default", func(t *testing.T) {
+		is := testutil.New(t)
+		ctx := context.WithValue(context.Background(), ctxKeyDoNotDecorate, true)
+		_, errMsg := LengthGt(3)(ctx, "ab")
+		is.Equal(LengthGtErrMsg+" 3", errMsg)
+	})
+	t.Run("translated", func(t *testing.T) {
+		is := testutil.New(t)
+		ctx := context.WithValue(context.Background(), ctxKeyDoNotDecorate, true)
+		ctx = WithErrMsgTranslator(ctx, func(errMsg string, args ...interface{}) string {
+			switch errMsg {
+			case RequiredErrMsg:
+				return "Pflichtfeld"
+			case LengthGtErrMsg:
+				return fmt.Sprintf("zu kurz, mindestens %d Zeichen", args[0].(int)+1)
+			}
+			return errMsg
+		})
+		_, errMsg := Required(ctx, "")
+		is.Equal("[RequiredErrMsg] Pflichtfeld", errMsg)
+		is.True(ErrMsgsMatch([]string{errMsg}, RequiredErrMsg))
+		_, errMsg = LengthGt(3)(ctx, "ab")
+		is.Equal("[LengthGtErrMsg] zu kurz, mindestens 4 Zeichen", errMsg)
+		is.True(ErrMsgsMatch([]string{errMsg}, LengthGtErrMsg))
+		is.True(!ErrMsgsMatch([]string{errMsg}, LengthGeErrMsg))
+	})
+}
@@ -0,0 +1,466 @@
+package pagemanager
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/bokwoon95/pagemanager/erro"
+	"github.com/bokwoon95/pagemanager/oidc"
+	"github.com/bokwoon95/pagemanager/sq"
+	"github.com/bokwoon95/pagemanager/tables"
+)
+
+// IdentityProvider is an external OAuth2 or OpenID Connect provider that users
+// can log in with. Identities from the provider are linked to users in
+// PM_USER_IDENTITIES by the provider's subject claim.
+type IdentityProvider struct {
+	oidc.Provider
+	Name        string // identifies the provider in URLs and PM_USER_IDENTITIES e.g. "google"
+	DisplayName string // shown on the login button, defaults to Name
+	// RedirectURL must match the redirect URL registered with the provider.
+	// It defaults to URLOAuthCallback on the pm-base-url.
+	RedirectURL string
+	// SubjectClaim is the claim that identifies the user at the provider. It
+	// defaults to "sub", plain OAuth2 providers may need e.g. "id".
+	SubjectClaim string
+	// CreateUsers creates a user on the first login of an identity that is
+	// not linked to any user yet. Otherwise a user has to link the identity
+	// from URLIdentities before they can log in with it.
+	CreateUsers bool
+	// LinkVerifiedEmail links an identity that is not linked yet to the user
+	// with the same email, as long as both the provider and pagemanager have
+	// verified the email.
+	LinkVerifiedEmail bool
+	// RoleClaim is the claim that lists the user's groups at the provider e.g.
+	// "groups", and RoleMapping maps those groups to pagemanager roles. The
+	// roles in RoleMapping are granted and revoked on every login to match
+	// the claim, other roles of the user are left alone.
+	RoleClaim   string
+	RoleMapping map[string][]string
+}
+
+type identityProvider struct {
+	IdentityProvider
+	client *oidc.Client
+}
+
+var identityProviderNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// RegisterIdentityProvider adds an identity provider to log in with,
+// replacing any provider with the same name. The provider is only contacted
+// when a user logs in with it.
+func (pm *PageManager) RegisterIdentityProvider(provider IdentityProvider) error {
+	if !identityProviderNameRegexp.MatchString(provider.Name) {
+		return fmt.Errorf("%w %q", ErrInvalidIdentityProvider, provider.Name)
+	}
+	if provider.ClientID == "" {
+		return fmt.Errorf("%w %q: no ClientID", ErrInvalidIdentityProvider, provider.Name)
+	}
+	if provider.Issuer == "" && (provider.AuthURL == "" || provider.TokenURL == "" || provider.UserInfoURL == "") {
+		return fmt.Errorf("%w %q: an OAuth2 provider without an Issuer needs an AuthURL, TokenURL and UserInfoURL", ErrInvalidIdentityProvider, provider.Name)
+	}
+	if provider.RedirectURL == "" && *flagBaseURL == "" {
+		return fmt.Errorf("%w %q: no RedirectURL, and -pm-base-url is not set", ErrInvalidIdentityProvider, provider.Name)
+	}
+	if provider.DisplayName == "" {
+		provider.DisplayName = provider.Name
+	}
+	if provider.SubjectClaim == "" {
+		provider.SubjectClaim = "sub"
+	}
+	pm.identityProvidersMutex.Lock()
+	defer pm.identityProvidersMutex.Unlock()
+	pm.identityProviders[provider.Name] = &identityProvider{
+		IdentityProvider: provider,
+		client:           oidc.NewClient(provider.Provider, nil),
+	}
+	return nil
+}
+
+// loadIdentityProviders registers the identity providers in the JSON file
+// named by the pm-identity-providers flag, which holds a list of
+// IdentityProviders.
+func (pm *PageManager) loadIdentityProviders(filename string) error {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	var providers []IdentityProvider
+	err = json.Unmarshal(b, &providers)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	for _, provider := range providers {
+		err = pm.RegisterIdentityProvider(provider)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+	}
+	return nil
+}
+
+func (pm *PageManager) getIdentityProvider(name string) (*identityProvider, bool) {
+	pm.identityProvidersMutex.RLock()
+	defer pm.identityProvidersMutex.RUnlock()
+	provider, ok := pm.identityProviders[name]
+	return provider, ok
+}
+
+// getIdentityProviders returns the identity providers sorted by name.
+func (pm *PageManager) getIdentityProviders() []*identityProvider {
+	pm.identityProvidersMutex.RLock()
+	defer pm.identityProvidersMutex.RUnlock()
+	providers := make([]*identityProvider, 0, len(pm.identityProviders))
+	for _, provider := range pm.identityProviders {
+		providers = append(providers, provider)
+	}
+	sort.Slice(providers, func(i, j int) bool { return providers[i].Name < providers[j].Name })
+	return providers
+}
+
+// externalIdentity is who a user is at an identity provider, from the claims
+// that the provider returned.
+type externalIdentity struct {
+	provider      string
+	subject       string
+	email         string
+	emailVerified bool
+	loginID       string // the user's preferred username, if any
+	displayname   string
+	groups        []string
+}
+
+func (ident externalIdentity) key() string {
+	return ident.provider + ":" + ident.subject
+}
+
+func (provider *identityProvider) externalIdentity(claims oidc.Claims) (externalIdentity, error) {
+	ident := externalIdentity{
+		provider:      provider.Name,
+		subject:       claims.String(provider.SubjectClaim),
+		email:         claims.String("email"),
+		emailVerified: claims.Bool("email_verified"),
+		loginID:       claims.String("preferred_username"),
+		displayname:   claims.String("name"),
+	}
+	if ident.subject == "" {
+		return ident, fmt.Errorf("%w: no %q claim", ErrInvalidIdentityProvider, provider.SubjectClaim)
+	}
+	if ident.loginID == "" {
+		ident.loginID = claims.String("login")
+	}
+	if provider.RoleClaim != "" {
+		ident.groups = claims.Strings(provider.RoleClaim)
+	}
+	return ident, nil
+}
+
+// mappedRoles returns the roles that the identity's groups map to, and every
+// role that RoleMapping can grant.
+func (provider *identityProvider) mappedRoles(ident externalIdentity) (granted, all []string) {
+	for _, group := range ident.groups {
+		granted = append(granted, provider.RoleMapping[group]...)
+	}
+	for _, roleNames := range provider.RoleMapping {
+		all = append(all, roleNames...)
+	}
+	return dedupSorted(granted), dedupSorted(all)
+}
+
+// loginWithIdentity returns the user that ident logs in as, linking ident to
+// a user or creating one as the provider allows, and syncs the user's mapped
+// roles.
+func (pm *PageManager) loginWithIdentity(ctx context.Context, provider *identityProvider, ident externalIdentity) (userID int64, err error) {
+	err = sq.WithTxContext(ctx, pm.dataDB, nil, func(tx *sql.Tx) error {
+		userID, err = getIdentityUserID(ctx, tx, ident)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		if userID == 0 && provider.LinkVerifiedEmail && ident.email != "" && ident.emailVerified {
+			userID, err = getUserIDByVerifiedEmail(ctx, tx, ident.email)
+			if err != nil {
+				return erro.Wrap(err)
+			}
+		}
+		if userID == 0 && provider.CreateUsers {
+			userID, err = createIdentityUser(ctx, tx, ident)
+			if err != nil {
+				return erro.Wrap(err)
+			}
+		}
+		if userID == 0 {
+			return ErrIdentityNotLinked
+		}
+		err = linkIdentity(ctx, tx, userID, ident)
+		if err != nil {
+			return err
+		}
+		granted, all := provider.mappedRoles(ident)
+		return syncMappedRoles(ctx, tx, userID, granted, all)
+	})
+	return userID, err
+}
+
+// getIdentityUserID returns the user that ident is linked to, or 0 if there
+// is none.
+func getIdentityUserID(ctx context.Context, db sq.Queryer, ident externalIdentity) (int64, error) {
+	var userID int64
+	USER_IDENTITIES := tables.NEW_USER_IDENTITIES(ctx, "ui")
+	_, err := sq.FetchContext(ctx, db, sq.SQLite.
+		From(USER_IDENTITIES).
+		Where(USER_IDENTITIES.IDENTITY_KEY.EqString(ident.key())),
+		func(row *sq.Row) error {
+			userID = row.Int64(USER_IDENTITIES.USER_ID)
+			return nil
+		},
+	)
+	if err != nil {
+		return 0, erro.Wrap(err)
+	}
+	return userID, nil
+}
+
+// getUserIDByVerifiedEmail returns the only user with email as their verified
+// email, or 0 if there is no such user or more than one.
+func getUserIDByVerifiedEmail(ctx context.Context, db sq.Queryer, email string) (int64, error) {
+	var userIDs []int64
+	USERS := tables.NEW_USERS(ctx, "u")
+	_, err := sq.FetchContext(ctx, db, sq.SQLite.
+		From(USERS).
+		Where(
+			sq.Predicatef("lower(?) = lower(?)", USERS.EMAIL, email),
+			USERS.EMAIL_VERIFIED,
+			USERS.USER_ID.NeInt(1),
+		),
+		func(row *sq.Row) error {
+			userID := row.Int64(USERS.USER_ID)
+			return row.Accumulate(func() error {
+				userIDs = append(userIDs, userID)
+				return nil
+			})
+		},
+	)
+	if err != nil {
+		return 0, erro.Wrap(err)
+	}
+	if len(userIDs) != 1 {
+		return 0, nil
+	}
+	return userIDs[0], nil
+}
+
+// createIdentityUser creates a user for ident. The user gets a random
+// password that no one knows, they can set one with a password reset.
+func createIdentityUser(ctx context.Context, db sq.Queryer, ident externalIdentity) (int64, error) {
+	user := User{Displayname: ident.displayname}
+	if validateEmail(ident.email) == nil {
+		user.Email = ident.email
+	}
+	// Prefer the username or email that the user goes by at the provider,
+	// numbering it if it is taken.
+	candidate := ident.loginID
+	if candidate == "" {
+		candidate = user.Email
+	}
+	if validateLoginID(candidate) != nil {
+		candidate = ident.key()
+	}
+	user.LoginID = candidate
+	for i := 2; ; i++ {
+		exists, err := loginIDExists(ctx, db, user.LoginID, 0)
+		if err != nil {
+			return 0, erro.Wrap(err)
+		}
+		if !exists {
+			break
+		}
+		if i > 100 {
+			user.LoginID = ident.key()
+			break
+		}
+		user.LoginID = candidate + "-" + strconv.Itoa(i)
+	}
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return 0, erro.Wrap(err)
+	}
+	user, err = createUser(ctx, db, user, base64.RawURLEncoding.EncodeToString(b))
+	if err != nil {
+		return 0, erro.Wrap(err)
+	}
+	if user.Email != "" && ident.emailVerified {
+		USERS := tables.NEW_USERS(ctx, "")
+		_, _, err = sq.ExecContext(ctx, db, sq.SQLite.
+			Update(USERS).
+			Set(USERS.EMAIL_VERIFIED.SetBool(true)).
+			Where(USERS.USER_ID.EqInt64(user.UserID)), 0,
+		)
+		if err != nil {
+			return 0, erro.Wrap(err)
+		}
+	}
+	return user.UserID, nil
+}
+
+// linkIdentity links ident to the user, or updates when the link was last used
+// if it is already linked to them. It returns ErrIdentityLinked if ident is
+// linked to someone else.
+func linkIdentity(ctx context.Context, db sq.Queryer, userID int64, ident externalIdentity) error {
+	if userID == 1 {
+		return ErrIdentityLinked
+	}
+	linkedUserID, err := getIdentityUserID(ctx, db, ident)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	if linkedUserID != 0 && linkedUserID != userID {
+		return ErrIdentityLinked
+	}
+	now := time.Now()
+	USER_IDENTITIES := tables.NEW_USER_IDENTITIES(ctx, "")
+	if linkedUserID == userID {
+		_, _, err = sq.ExecContext(ctx, db, sq.SQLite.
+			Update(USER_IDENTITIES).
+			Set(
+				USER_IDENTITIES.EMAIL.SetString(ident.email),
+				USER_IDENTITIES.LAST_LOGIN_AT.SetTime(now),
+			).
+			Where(USER_IDENTITIES.IDENTITY_KEY.EqString(ident.key())), 0,
+		)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		return nil
+	}
+	_, _, err = sq.ExecContext(ctx, db, sq.SQLite.
+		InsertInto(USER_IDENTITIES).
+		Valuesx(func(col *sq.Column) error {
+			col.SetString(USER_IDENTITIES.IDENTITY_KEY, ident.key())
+			col.SetString(USER_IDENTITIES.PROVIDER, ident.provider)
+			col.SetString(USER_IDENTITIES.SUBJECT, ident.subject)
+			col.SetInt64(USER_IDENTITIES.USER_ID, userID)
+			col.SetString(USER_IDENTITIES.EMAIL, ident.email)
+			col.SetTime(USER_IDENTITIES.CREATED_AT, now)
+			col.SetTime(USER_IDENTITIES.LAST_LOGIN_AT, now)
+			return nil
+		}), 0,
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	return nil
+}
+
+// syncMappedRoles gives the user the granted roles and takes away the rest of
+// the roles in all. Roles that do not exist are skipped, and roleSuperadmin is
+// never granted.
+func syncMappedRoles(ctx context.Context, db sq.Queryer, userID int64, granted, all []string) error {
+	if len(all) == 0 {
+		return nil
+	}
+	USER_ROLES := tables.NEW_USER_ROLES(ctx, "")
+	_, _, err := sq.ExecContext(ctx, db, sq.SQLite.
+		DeleteFrom(USER_ROLES).
+		Where(
+			USER_ROLES.USER_ID.EqInt64(userID),
+			USER_ROLES.ROLE_NAME.In(all),
+		), 0,
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	var roleNames []string
+	for _, name := range granted {
+		if name == roleSuperadmin {
+			continue
+		}
+		exists, err := roleExists(ctx, db, name)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		if exists {
+			roleNames = append(roleNames, name)
+		}
+	}
+	if len(roleNames) == 0 {
+		return nil
+	}
+	_, _, err = sq.ExecContext(ctx, db, sq.SQLite.
+		InsertInto(USER_ROLES).
+		Valuesx(func(col *sq.Column) error {
+			for _, name := range roleNames {
+				col.SetInt64(USER_ROLES.USER_ID, userID)
+				col.SetString(USER_ROLES.ROLE_NAME, name)
+			}
+			return nil
+		}), 0,
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	return nil
+}
+
+// UserIdentity is an identity at an identity provider that a user can log in
+// with, as listed at URLIdentities.
+type UserIdentity struct {
+	Provider    string
+	Subject     string
+	Email       string
+	CreatedAt   time.Time
+	LastLoginAt time.Time
+}
+
+func getUserIdentities(ctx context.Context, db sq.Queryer, userID int64) ([]UserIdentity, error) {
+	var identities []UserIdentity
+	USER_IDENTITIES := tables.NEW_USER_IDENTITIES(ctx, "ui")
+	_, err := sq.FetchContext(ctx, db, sq.SQLite.
+		From(USER_IDENTITIES).
+		Where(USER_IDENTITIES.USER_ID.EqInt64(userID)).
+		OrderBy(USER_IDENTITIES.PROVIDER, USER_IDENTITIES.CREATED_AT),
+		func(row *sq.Row) error {
+			identity := UserIdentity{
+				Provider:    row.String(USER_IDENTITIES.PROVIDER),
+				Subject:     row.String(USER_IDENTITIES.SUBJECT),
+				Email:       row.String(USER_IDENTITIES.EMAIL),
+				CreatedAt:   row.Time(USER_IDENTITIES.CREATED_AT),
+				LastLoginAt: row.Time(USER_IDENTITIES.LAST_LOGIN_AT),
+			}
+			return row.Accumulate(func() error {
+				identities = append(identities, identity)
+				return nil
+			})
+		},
+	)
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	return identities, nil
+}
+
+// unlinkIdentity unlinks an identity from the user, who can no longer log in
+// with it.
+func unlinkIdentity(ctx context.Context, db sq.Queryer, userID int64, provider, subject string) error {
+	USER_IDENTITIES := tables.NEW_USER_IDENTITIES(ctx, "")
+	_, _, err := sq.ExecContext(ctx, db, sq.SQLite.
+		DeleteFrom(USER_IDENTITIES).
+		Where(
+			USER_IDENTITIES.USER_ID.EqInt64(userID),
+			USER_IDENTITIES.IDENTITY_KEY.EqString(provider+":"+subject),
+		), 0,
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	return nil
+}
@@ -0,0 +1,452 @@
+package pagemanager
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bokwoon95/pagemanager/erro"
+	"github.com/bokwoon95/pagemanager/sq"
+	"github.com/bokwoon95/pagemanager/tables"
+)
+
+// Locale is a locale that pages can be translated into. Its pages are served
+// under /<Code>/.
+type Locale struct {
+	Code        string
+	Description string
+	IsDefault   bool
+
+	// Fallbacks are the locale codes whose values are used, in order, when a
+	// value has not been translated into this locale. The chain is not
+	// followed transitively.
+	Fallbacks []string
+}
+
+// localeCodeRegexp matches BCP 47 style locale codes like en, de-CH or
+// zh-Hant-TW.
+var localeCodeRegexp = regexp.MustCompile(`^[a-zA-Z]{2,8}(-[a-zA-Z0-9]{1,8})*$`)
+
+func validateLocaleCode(code string) error {
+	// Locale codes are the first segment of a localized URL, so they must not
+	// shadow pagemanager's own /pm-* URLs.
+	if !localeCodeRegexp.MatchString(code) || strings.HasPrefix(strings.ToLower(code), "pm-") {
+		return fmt.Errorf("%w %q", ErrInvalidLocaleCode, code)
+	}
+	return nil
+}
+
+func getLocales(ctx context.Context, db sq.Queryer) (map[string]Locale, error) {
+	l := tables.NEW_LOCALES(ctx, "l")
+	db = sq.NewDB(db, nil, sq.Linterpolate|sq.Lcaller|sq.Lresults)
+	locales := make(map[string]Locale)
+	_, err := sq.FetchContext(ctx, db, sq.SQLite.From(l), func(row *sq.Row) error {
+		var locale Locale
+		locale.Code = row.String(l.LOCALE_CODE)
+		locale.Description = row.String(l.DESCRIPTION)
+		locale.IsDefault = row.Bool(l.IS_DEFAULT)
+		b := row.Bytes(l.FALLBACK_CODES)
+		return row.Accumulate(func() error {
+			if len(b) > 0 {
+				err := json.Unmarshal(b, &locale.Fallbacks)
+				if err != nil {
+					return erro.Wrap(err)
+				}
+			}
+			locales[locale.Code] = locale
+			return nil
+		})
+	})
+	if err != nil {
+		return locales, erro.Wrap(err)
+	}
+	return locales, nil
+}
+
+// refreshLocales reloads pm.locales from the database, so that changes to
+// the locales take effect without a restart.
+func (pm *PageManager) refreshLocales(ctx context.Context) error {
+	locales, err := getLocales(ctx, pm.dataDB)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	pm.localesMutex.Lock()
+	defer pm.localesMutex.Unlock()
+	pm.locales = locales
+	return nil
+}
+
+// sortedLocales returns the locales sorted by their locale code.
+func (pm *PageManager) sortedLocales() []Locale {
+	pm.localesMutex.RLock()
+	defer pm.localesMutex.RUnlock()
+	locales := make([]Locale, 0, len(pm.locales))
+	for _, locale := range pm.locales {
+		locales = append(locales, locale)
+	}
+	sort.Slice(locales, func(i, j int) bool { return locales[i].Code < locales[j].Code })
+	return locales
+}
+
+func localeExists(ctx context.Context, db sq.Queryer, code string) (bool, error) {
+	l := tables.NEW_LOCALES(ctx, "l")
+	exists, err := sq.ExistsContext(ctx, db, sq.SQLite.From(l).Where(l.LOCALE_CODE.EqString(code)))
+	if err != nil {
+		return false, erro.Wrap(err)
+	}
+	return exists, nil
+}
+
+func addLocale(ctx context.Context, db sq.Queryer, code, description string) error {
+	err := validateLocaleCode(code)
+	if err != nil {
+		return err
+	}
+	exists, err := localeExists(ctx, db, code)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	if exists {
+		return fmt.Errorf("%w: %s", ErrLocaleExists, code)
+	}
+	l := tables.NEW_LOCALES(ctx, "l")
+	_, _, err = sq.ExecContext(ctx, db, sq.SQLite.
+		InsertInto(l).
+		Valuesx(func(col *sq.Column) error {
+			col.SetString(l.LOCALE_CODE, code)
+			col.SetString(l.DESCRIPTION, description)
+			return nil
+		}), 0,
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	return nil
+}
+
+func describeLocale(ctx context.Context, db sq.Queryer, code, description string) error {
+	l := tables.NEW_LOCALES(ctx, "l")
+	rowsAffected, _, err := sq.ExecContext(ctx, db, sq.SQLite.
+		Update(l).
+		Set(l.DESCRIPTION.SetString(description)).
+		Where(l.LOCALE_CODE.EqString(code)),
+		sq.ErowsAffected,
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	if rowsAffected == 0 {
+		return fmt.Errorf("%w: %s", ErrLocaleNotFound, code)
+	}
+	return nil
+}
+
+// renameLocale changes a locale's code, moving its translations and updating
+// the fallback chains that refer to it.
+func renameLocale(ctx context.Context, db sq.Queryer, code, newCode string) error {
+	if code == newCode {
+		return nil
+	}
+	err := validateLocaleCode(newCode)
+	if err != nil {
+		return err
+	}
+	exists, err := localeExists(ctx, db, newCode)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	if exists {
+		return fmt.Errorf("%w: %s", ErrLocaleExists, newCode)
+	}
+	l := tables.NEW_LOCALES(ctx, "l")
+	rowsAffected, _, err := sq.ExecContext(ctx, db, sq.SQLite.
+		Update(l).
+		Set(l.LOCALE_CODE.SetString(newCode)).
+		Where(l.LOCALE_CODE.EqString(code)),
+		sq.ErowsAffected,
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	if rowsAffected == 0 {
+		return fmt.Errorf("%w: %s", ErrLocaleNotFound, code)
+	}
+	PAGEDATA := tables.NEW_PAGEDATA(ctx, "p")
+	_, _, err = sq.ExecContext(ctx, db, sq.SQLite.
+		Update(PAGEDATA).
+		Set(PAGEDATA.LOCALE_CODE.SetString(newCode)).
+		Where(PAGEDATA.LOCALE_CODE.EqString(code)), 0,
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	return updateFallbacks(ctx, db, func(fallbacks []string) []string {
+		for i := range fallbacks {
+			if fallbacks[i] == code {
+				fallbacks[i] = newCode
+			}
+		}
+		return fallbacks
+	})
+}
+
+// deleteLocale deletes a locale together with its translations, and removes
+// it from the fallback chains that refer to it.
+func deleteLocale(ctx context.Context, db sq.Queryer, code string) error {
+	l := tables.NEW_LOCALES(ctx, "l")
+	rowsAffected, _, err := sq.ExecContext(ctx, db, sq.SQLite.
+		DeleteFrom(l).
+		Where(l.LOCALE_CODE.EqString(code)),
+		sq.ErowsAffected,
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	if rowsAffected == 0 {
+		return fmt.Errorf("%w: %s", ErrLocaleNotFound, code)
+	}
+	PAGEDATA := tables.NEW_PAGEDATA(ctx, "p")
+	_, _, err = sq.ExecContext(ctx, db, sq.SQLite.
+		DeleteFrom(PAGEDATA).
+		Where(PAGEDATA.LOCALE_CODE.EqString(code)), 0,
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	return updateFallbacks(ctx, db, func(fallbacks []string) []string {
+		n := 0
+		for _, fallback := range fallbacks {
+			if fallback != code {
+				fallbacks[n] = fallback
+				n++
+			}
+		}
+		return fallbacks[:n]
+	})
+}
+
+// setDefaultLocale makes code the default locale. An empty code unsets the
+// default locale.
+func setDefaultLocale(ctx context.Context, db sq.Queryer, code string) error {
+	if code != "" {
+		exists, err := localeExists(ctx, db, code)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		if !exists {
+			return fmt.Errorf("%w: %s", ErrLocaleNotFound, code)
+		}
+	}
+	l := tables.NEW_LOCALES(ctx, "l")
+	_, _, err := sq.ExecContext(ctx, db, sq.SQLite.
+		Update(l).
+		Set(l.IS_DEFAULT.SetBool(false)).
+		Where(l.IS_DEFAULT), 0,
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	if code == "" {
+		return nil
+	}
+	_, _, err = sq.ExecContext(ctx, db, sq.SQLite.
+		Update(l).
+		Set(l.IS_DEFAULT.SetBool(true)).
+		Where(l.LOCALE_CODE.EqString(code)), 0,
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	return nil
+}
+
+// setLocaleFallbacks replaces the fallback chain of a locale. Every fallback
+// must be an existing locale other than the locale itself, and may only
+// appear once.
+func setLocaleFallbacks(ctx context.Context, db sq.Queryer, code string, fallbacks []string) error {
+	locales, err := getLocales(ctx, db)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	if _, ok := locales[code]; !ok {
+		return fmt.Errorf("%w: %s", ErrLocaleNotFound, code)
+	}
+	seen := make(map[string]bool)
+	for _, fallback := range fallbacks {
+		if _, ok := locales[fallback]; !ok {
+			return fmt.Errorf("%w: no such locale %q", ErrInvalidLocaleFallbacks, fallback)
+		}
+		if fallback == code {
+			return fmt.Errorf("%w: %s cannot fall back to itself", ErrInvalidLocaleFallbacks, code)
+		}
+		if seen[fallback] {
+			return fmt.Errorf("%w: %s appears more than once", ErrInvalidLocaleFallbacks, fallback)
+		}
+		seen[fallback] = true
+	}
+	return setFallbacks(ctx, db, code, fallbacks)
+}
+
+func setFallbacks(ctx context.Context, db sq.Queryer, code string, fallbacks []string) error {
+	var value interface{} // NULL if there are no fallbacks
+	if len(fallbacks) > 0 {
+		b, err := json.Marshal(fallbacks)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		value = string(b)
+	}
+	l := tables.NEW_LOCALES(ctx, "l")
+	_, _, err := sq.ExecContext(ctx, db, sq.SQLite.
+		Update(l).
+		Set(sq.Assign(l.FALLBACK_CODES, value)).
+		Where(l.LOCALE_CODE.EqString(code)), 0,
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	return nil
+}
+
+// updateFallbacks rewrites the fallback chain of every locale with fn.
+func updateFallbacks(ctx context.Context, db sq.Queryer, fn func(fallbacks []string) []string) error {
+	locales, err := getLocales(ctx, db)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	for _, locale := range locales {
+		if len(locale.Fallbacks) == 0 {
+			continue
+		}
+		err = setFallbacks(ctx, db, locale.Code, fn(locale.Fallbacks))
+		if err != nil {
+			return erro.Wrap(err)
+		}
+	}
+	return nil
+}
+
+// defaultLocale returns the code of the default locale, or "" if there is
+// none.
+func (pm *PageManager) defaultLocale() string {
+	pm.localesMutex.RLock()
+	defer pm.localesMutex.RUnlock()
+	for _, locale := range pm.locales {
+		if locale.IsDefault {
+			return locale.Code
+		}
+	}
+	return ""
+}
+
+// parseAcceptLanguage returns the language ranges of an Accept-Language header
+// e.g. "de-CH, de;q=0.9, en;q=0.8", ordered by descending quality. Ranges with
+// a quality of 0 are left out.
+func parseAcceptLanguage(header string) []string {
+	type languageRange struct {
+		tag     string
+		quality float64
+	}
+	var ranges []languageRange
+	for _, part := range strings.Split(header, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		lr := languageRange{tag: part, quality: 1}
+		if i := strings.IndexByte(part, ';'); i >= 0 {
+			lr.tag = strings.TrimSpace(part[:i])
+			for _, param := range strings.Split(part[i+1:], ";") {
+				param = strings.TrimSpace(param)
+				if !strings.HasPrefix(param, "q=") {
+					continue
+				}
+				q, err := strconv.ParseFloat(param[len("q="):], 64)
+				if err != nil || q < 0 || q > 1 {
+					q = 0
+				}
+				lr.quality = q
+			}
+		}
+		if lr.tag != "" && lr.quality > 0 {
+			ranges = append(ranges, lr)
+		}
+	}
+	sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].quality > ranges[j].quality })
+	tags := make([]string, len(ranges))
+	for i := range ranges {
+		tags[i] = ranges[i].tag
+	}
+	return tags
+}
+
+// matchLocale returns the locale that best matches the language range tag:
+// the locale with the same code, else the closest locale that tag is more
+// specific than (de-CH-1996 matches de-CH, then de), else a locale that is
+// more specific than tag (de matches de-CH). It returns "" if nothing matches.
+func matchLocale(locales []Locale, tag string) string {
+	for prefix := tag; prefix != ""; {
+		for _, locale := range locales {
+			if strings.EqualFold(locale.Code, prefix) {
+				return locale.Code
+			}
+		}
+		i := strings.LastIndexByte(prefix, '-')
+		if i < 0 {
+			break
+		}
+		prefix = prefix[:i]
+	}
+	for _, locale := range locales {
+		if len(locale.Code) > len(tag) && strings.EqualFold(locale.Code[:len(tag)+1], tag+"-") {
+			return locale.Code
+		}
+	}
+	return ""
+}
+
+// negotiateLocale picks the locale that a request for the root URL should be
+// redirected to: the locale in the locale cookie if it still exists, else the
+// best match for the Accept-Language header, else the default locale. It
+// returns "" if there is no locale to redirect to.
+func (pm *PageManager) negotiateLocale(r *http.Request) string {
+	locales := pm.sortedLocales()
+	if c, _ := r.Cookie(cookieLocale); c != nil {
+		for _, locale := range locales {
+			if locale.Code == c.Value {
+				return locale.Code
+			}
+		}
+	}
+	for _, tag := range parseAcceptLanguage(r.Header.Get("Accept-Language")) {
+		if tag == "*" {
+			break
+		}
+		if localeCode := matchLocale(locales, tag); localeCode != "" {
+			return localeCode
+		}
+	}
+	return pm.defaultLocale()
+}
+
+// rememberLocale stores the locale of a localized request in the locale
+// cookie, so that the next visit to the root URL is redirected back to it.
+func rememberLocale(w http.ResponseWriter, r *http.Request, localeCode string) {
+	if c, _ := r.Cookie(cookieLocale); c != nil && c.Value == localeCode {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     cookieLocale,
+		Value:    localeCode,
+		Path:     "/",
+		MaxAge:   int((365 * 24 * time.Hour).Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
@@ -1,8 +1,13 @@
 package pagemanager
 
 import (
+	"errors"
 	"html/template"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode"
 
 	"github.com/bokwoon95/pagemanager/erro"
 	"github.com/bokwoon95/pagemanager/hy"
@@ -33,18 +38,18 @@ func (d *loginData) LoginForm(form *hyforms.Form) {
 		}
 	}
 	form.Append("div.mt3.mb1", nil,
-		hy.H("label.pointer", hy.Attr{"for": loginID.ID()}, hy.Txt("Email or Username:")))
+		hy.H("label.pointer", hy.Attr{"for": loginID.ID()}, hy.Txt(msg(form.Request(), "login.login_id"))))
 	form.Append("div", nil, loginID)
 	if hyforms.ErrMsgsMatch(loginID.ErrMsgs(), hyforms.RequiredErrMsg) {
-		form.Append("div.f7.red", nil, hy.Txt(hyforms.RequiredErrMsg))
+		form.Append("div.f7.red", nil, hy.Txt(msg(form.Request(), "hyforms.RequiredErrMsg")))
 	}
 	form.Append("div.mt3.mb1", nil,
-		hy.H("label.pointer", hy.Attr{"for": password.ID()}, hy.Txt("Password:")))
+		hy.H("label.pointer", hy.Attr{"for": password.ID()}, hy.Txt(msg(form.Request(), "login.password"))))
 	form.Append("div", nil, password)
 	if hyforms.ErrMsgsMatch(password.ErrMsgs(), hyforms.RequiredErrMsg) {
-		form.Append("div.f7.red", nil, hy.Txt(hyforms.RequiredErrMsg))
+		form.Append("div.f7.red", nil, hy.Txt(msg(form.Request(), "hyforms.RequiredErrMsg")))
 	}
-	form.Append("div.mt3", nil, hy.H("button.pointer.pa2", hy.Attr{"type": "submit"}, hy.Txt("Log In")))
+	form.Append("div.mt3", nil, hy.H("button.pointer.pa2", hy.Attr{"type": "submit"}, hy.Txt(msg(form.Request(), "login.submit"))))
 
 	form.Unmarshal(func() {
 		d.LoginID = loginID.Validate(hyforms.Required).Value()
@@ -53,10 +58,17 @@ func (d *loginData) LoginForm(form *hyforms.Form) {
 }
 
 func (pm *PageManager) login(w http.ResponseWriter, r *http.Request) {
+	type identityProviderLink struct {
+		Text string
+		URL  string
+	}
 	type templateData struct {
-		Title  string
-		Header template.HTML
-		Form   template.HTML
+		Title             string
+		Header            template.HTML
+		Notice            string
+		Form              template.HTML
+		ForgotPassword    string
+		IdentityProviders []identityProviderLink
 	}
 	data := &loginData{}
 	var err error
@@ -68,9 +80,17 @@ func (pm *PageManager) login(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		tdata := templateData{
-			Title:  "PageManager Login",
-			Header: "PageManager Login",
+			Title:          msg(r, "login.title"),
+			Header:         template.HTML(msg(r, "login.title")),
+			ForgotPassword: msg(r, "login.forgot_password"),
 		}
+		for _, provider := range pm.getIdentityProviders() {
+			tdata.IdentityProviders = append(tdata.IdentityProviders, identityProviderLink{
+				Text: msg(r, "login.log_in_with", provider.DisplayName),
+				URL:  URLOAuthLogin + "?" + url.Values{"provider": {provider.Name}}.Encode(),
+			})
+		}
+		_ = hyforms.GetCookieValue(w, r, cookieFlash, &tdata.Notice)
 		tdata.Form, err = hyforms.MarshalForm(w, r, data.LoginForm)
 		if err != nil {
 			pm.InternalServerError(w, r, erro.Wrap(err))
@@ -87,8 +107,20 @@ func (pm *PageManager) login(w http.ResponseWriter, r *http.Request) {
 			hyforms.Redirect(w, r, LocaleURL(r, r.URL.Path), errMsgs)
 			return
 		}
+		lockoutKeys := loginLockoutKeys(r, "login", data.LoginID)
+		wait, err := reserveLoginAttempt(r.Context(), pm.dataDB, lockoutKeys)
+		if err != nil {
+			pm.InternalServerError(w, r, erro.Wrap(err))
+			return
+		}
+		if wait > 0 {
+			errMsgs.FormErrMsgs = append(errMsgs.FormErrMsgs, msg(r, "login.too_many_attempts", wait))
+			hyforms.Redirect(w, r, LocaleURL(r, r.URL.Path), errMsgs)
+			return
+		}
 		var userID int64
 		var passwordHash []byte
+		var disabled, totpEnabled bool
 		USERS := tables.NEW_USERS(r.Context(), "u")
 		rowCount, err := sq.Fetch(pm.dataDB, sq.SQLite.
 			From(USERS).
@@ -96,6 +128,8 @@ func (pm *PageManager) login(w http.ResponseWriter, r *http.Request) {
 			func(row *sq.Row) error {
 				userID = row.Int64(USERS.USER_ID)
 				passwordHash = row.Bytes(USERS.PASSWORD_HASH)
+				disabled = row.Bool(USERS.DISABLED)
+				totpEnabled = row.Bool(USERS.TOTP_ENABLED)
 				return nil
 			},
 		)
@@ -105,17 +139,35 @@ func (pm *PageManager) login(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		if rowCount == 0 {
+			passwordHash = pm.dummyPasswordHash
+		}
+		err = keyderiv.CompareHashAndPassword(passwordHash, []byte(data.Password))
+		if rowCount == 0 || err != nil {
 			errMsgs.FormErrMsgs = append(errMsgs.FormErrMsgs, ErrInvalidLoginCredentials.Error())
 			hyforms.Redirect(w, r, LocaleURL(r, r.URL.Path), errMsgs)
 			return
 		}
-		err = keyderiv.CompareHashAndPassword(passwordHash, []byte(data.Password))
+		err = clearLoginFailures(r.Context(), pm.dataDB, lockoutKeys)
 		if err != nil {
-			errMsgs.FormErrMsgs = append(errMsgs.FormErrMsgs, ErrInvalidLoginCredentials.Error())
+			pm.InternalServerError(w, r, erro.Wrap(err))
+			return
+		}
+		if disabled {
+			errMsgs.FormErrMsgs = append(errMsgs.FormErrMsgs, ErrUserDisabled.Error())
 			hyforms.Redirect(w, r, LocaleURL(r, r.URL.Path), errMsgs)
 			return
 		}
-		err = pm.newSession(w, userID, nil)
+		if totpEnabled {
+			err = pm.setPendingLogin(w, r, userID)
+			if err != nil {
+				errMsgs.FormErrMsgs = append(errMsgs.FormErrMsgs, err.Error())
+				hyforms.Redirect(w, r, LocaleURL(r, r.URL.Path), errMsgs)
+				return
+			}
+			Redirect(w, r, URLLoginTwoFactor)
+			return
+		}
+		err = pm.newSession(w, r, userID, nil)
 		if err != nil {
 			pm.InternalServerError(w, r, erro.Wrap(err))
 			return
@@ -132,9 +184,26 @@ func (pm *PageManager) login(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// logoutFormCallback is the log out form in the navbar. It has no inputs, it
+// is a hyforms form only so that it carries a CSRF token.
+func logoutFormCallback(form *hyforms.Form) {
+	form.Set("#pm-logout", hy.Attr{"method": "POST", "action": URLLogout, "hidden": hy.Enabled})
+}
+
+// logoutForm renders the log out form of the navbar. Every page data that
+// renders the navbar has a LogoutForm method that calls it.
+func logoutForm(w http.ResponseWriter, r *http.Request) (template.HTML, error) {
+	return hyforms.MarshalForm(w, r, logoutFormCallback)
+}
+
 func (pm *PageManager) logout(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "POST":
+		_, ok := hyforms.UnmarshalForm(w, r, logoutFormCallback)
+		if !ok {
+			pm.Forbidden(w, r)
+			return
+		}
 		err := pm.deleteSession(w, r)
 		if err != nil {
 			pm.InternalServerError(w, r, erro.Wrap(err))
@@ -151,3 +220,123 @@ func (pm *PageManager) logout(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 	}
 }
+
+type loginTwoFactorData struct {
+	Code string
+}
+
+func (d *loginTwoFactorData) LoginForm(form *hyforms.Form) {
+	code := form.
+		Text(inputTOTPCode, "").
+		Set("#pm-totp-code.bg-near-white.pa2.w-100", hy.Attr{"required": hy.Enabled, "autocomplete": "one-time-code"})
+
+	form.Set(".bg-white.center-form", hy.Attr{"method": "POST"})
+	for _, errMsg := range form.ErrMsgs() {
+		form.Append("div.red", nil, hy.Txt(errMsg))
+	}
+	form.Append("div.mt3.mb1", nil,
+		hy.H("label.pointer", hy.Attr{"for": code.ID()}, hy.Txt(msg(form.Request(), "login.totp_code"))))
+	form.Append("div", nil, code)
+	form.Append("div.f7.gray", nil, hy.Txt(msg(form.Request(), "login.totp_code_hint")))
+	if hyforms.ErrMsgsMatch(code.ErrMsgs(), hyforms.RequiredErrMsg) {
+		form.Append("div.f7.red", nil, hy.Txt(msg(form.Request(), "hyforms.RequiredErrMsg")))
+	}
+	form.Append("div.mt3", nil, hy.H("button.pointer.pa2", hy.Attr{"type": "submit"}, hy.Txt(msg(form.Request(), "login.submit"))))
+
+	form.Unmarshal(func() {
+		d.Code = code.Validate(hyforms.Required).Value()
+	})
+}
+
+// twoFactorLockoutKeys returns the lockout keys of the TOTP and recovery codes
+// of a user, which are throttled like passwords.
+func twoFactorLockoutKeys(r *http.Request, userID int64) []loginLockoutKey {
+	return loginLockoutKeys(r, "2fa", strconv.FormatInt(userID, 10))
+}
+
+// loginTwoFactor is the second step of logging in for users with two-factor
+// authentication, after login or superadminLogin have checked their password.
+// The code may be a TOTP code or a recovery code.
+func (pm *PageManager) loginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	type templateData struct {
+		Title  string
+		Header template.HTML
+		Form   template.HTML
+	}
+	data := &loginTwoFactorData{}
+	userID := pm.getPendingLogin(r)
+	if userID == 0 {
+		Redirect(w, r, URLLogin)
+		return
+	}
+	var err error
+	switch r.Method {
+	case "GET":
+		tdata := templateData{
+			Title:  msg(r, "login.totp_title"),
+			Header: template.HTML(msg(r, "login.totp_title")),
+		}
+		tdata.Form, err = hyforms.MarshalForm(w, r, data.LoginForm)
+		if err != nil {
+			pm.InternalServerError(w, r, erro.Wrap(err))
+			return
+		}
+		err = pm.tpl.Render(w, r, tdata, tpl.Files("login_two_factor.html"))
+		if err != nil {
+			pm.InternalServerError(w, r, erro.Wrap(err))
+			return
+		}
+	case "POST":
+		errMsgs, ok := hyforms.UnmarshalForm(w, r, data.LoginForm)
+		if !ok {
+			hyforms.Redirect(w, r, LocaleURL(r, r.URL.Path), errMsgs)
+			return
+		}
+		lockoutKeys := twoFactorLockoutKeys(r, userID)
+		wait, err := reserveLoginAttempt(r.Context(), pm.dataDB, lockoutKeys)
+		if err != nil {
+			pm.InternalServerError(w, r, erro.Wrap(err))
+			return
+		}
+		if wait > 0 {
+			errMsgs.FormErrMsgs = append(errMsgs.FormErrMsgs, msg(r, "login.too_many_attempts", wait))
+			hyforms.Redirect(w, r, LocaleURL(r, r.URL.Path), errMsgs)
+			return
+		}
+		// TOTP codes are all digits, recovery codes are words.
+		if strings.IndexFunc(data.Code, unicode.IsLetter) >= 0 {
+			err = pm.useRecoveryCode(r.Context(), pm.dataDB, userID, data.Code)
+		} else {
+			err = pm.verifyTOTP(r.Context(), pm.dataDB, userID, data.Code)
+		}
+		if errors.Is(err, ErrInvalidTOTPCode) || errors.Is(err, ErrInvalidRecoveryCode) {
+			errMsgs.FormErrMsgs = append(errMsgs.FormErrMsgs, err.Error())
+			hyforms.Redirect(w, r, LocaleURL(r, r.URL.Path), errMsgs)
+			return
+		}
+		if err != nil {
+			pm.InternalServerError(w, r, erro.Wrap(err))
+			return
+		}
+		err = clearLoginFailures(r.Context(), pm.dataDB, lockoutKeys)
+		if err != nil {
+			pm.InternalServerError(w, r, erro.Wrap(err))
+			return
+		}
+		clearPendingLogin(w)
+		err = pm.newSession(w, r, userID, nil)
+		if err != nil {
+			pm.InternalServerError(w, r, erro.Wrap(err))
+			return
+		}
+		var redirectURL string
+		_ = hyforms.GetCookieValue(w, r, cookieLoginRedirect, &redirectURL)
+		if redirectURL != "" {
+			Redirect(w, r, redirectURL)
+			return
+		}
+		Redirect(w, r, URLDashboard)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,295 @@
+package pagemanager
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bokwoon95/pagemanager/erro"
+	"github.com/bokwoon95/pagemanager/keyderiv"
+	"github.com/bokwoon95/pagemanager/sq"
+	"github.com/bokwoon95/pagemanager/tables"
+)
+
+// Failed logins are throttled per client IP and per login ID. Every failure
+// after the free attempts locks the IP or login ID out for twice as long as
+// the one before, up to loginLockoutMax. Lockouts are checked before the
+// password is, so that locked out attempts do not cost an argon2id hash.
+//
+// An attempt is counted as a failure before its password is checked and given
+// back if the password turns out to be right, so that parallel attempts cannot
+// all get past the lockout check before any of their failures are recorded.
+const (
+	loginFreeAttempts   = 5  // per login ID
+	loginIPFreeAttempts = 20 // per IP, which may be shared by many users behind a NAT
+	mailIPFreeAttempts  = 20 // per IP, for the requests that send emails
+	loginLockoutBase    = time.Second
+	loginLockoutMax     = 15 * time.Minute
+	loginFailureWindow  = 24 * time.Hour // failures older than this are forgotten
+)
+
+// loginLockoutKey identifies what a login attempt is throttled on.
+type loginLockoutKey struct {
+	key          string
+	freeAttempts int
+	// clearOnLogin is false for the IP key, so that an attacker cannot reset
+	// the failures of their IP by logging into an account of their own.
+	clearOnLogin bool
+}
+
+// loginLockoutKeys returns the lockout keys of a login attempt for loginID
+// from r. kind separates the login IDs of different logins e.g. the
+// superadmin login from the user login. The login ID is hashed so that
+// passwords that were typed into the login ID input by mistake are not
+// stored.
+func loginLockoutKeys(r *http.Request, kind, loginID string) []loginLockoutKey {
+	loginIDHash := sha256.Sum256([]byte(loginID))
+	return []loginLockoutKey{
+		{key: "ip:" + clientIP(r), freeAttempts: loginIPFreeAttempts},
+		{key: kind + ":" + base64.RawURLEncoding.EncodeToString(loginIDHash[:]), freeAttempts: loginFreeAttempts, clearOnLogin: true},
+	}
+}
+
+// mailLockoutKeys returns the lockout keys of a request that sends an email
+// about id, e.g. a password reset email. The IP key is separate from the login
+// IP key, so that sending emails never locks the IP out of logging in.
+func mailLockoutKeys(r *http.Request, kind, id string) []loginLockoutKey {
+	idHash := sha256.Sum256([]byte(id))
+	return []loginLockoutKey{
+		{key: "ip-mail:" + clientIP(r), freeAttempts: mailIPFreeAttempts},
+		{key: kind + ":" + base64.RawURLEncoding.EncodeToString(idHash[:]), freeAttempts: loginFreeAttempts},
+	}
+}
+
+// clientIP returns the IP of the client of r. IPv6 clients are grouped by
+// their /64 prefix, since a single client usually gets a whole /64.
+//
+// If r comes from one of the -pm-trusted-proxies, the client IP is the
+// rightmost IP of the X-Forwarded-For header that is not a trusted proxy. If
+// the PageManager is behind a reverse proxy that is not listed, every client
+// shares the proxy's IP and its lockout.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip != nil && isTrustedProxy(ip) {
+		forwardedFor := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+		for i := len(forwardedFor) - 1; i >= 0; i-- {
+			forwardedIP := net.ParseIP(strings.TrimSpace(forwardedFor[i]))
+			if forwardedIP == nil {
+				break
+			}
+			host, ip = forwardedIP.String(), forwardedIP
+			if !isTrustedProxy(ip) {
+				break
+			}
+		}
+	}
+	if ip == nil || ip.To4() != nil {
+		return host
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+// isTrustedProxy reports whether ip is one of the -pm-trusted-proxies.
+func isTrustedProxy(ip net.IP) bool {
+	for _, proxy := range strings.Split(*flagTrustedProxies, ",") {
+		proxy = strings.TrimSpace(proxy)
+		if proxy == "" {
+			continue
+		}
+		if _, ipnet, err := net.ParseCIDR(proxy); err == nil {
+			if ipnet.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if proxyIP := net.ParseIP(proxy); proxyIP != nil && proxyIP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// loginLockoutDuration returns how long a key is locked out for after its
+// failures'th failure.
+func loginLockoutDuration(failures, freeAttempts int) time.Duration {
+	if failures <= freeAttempts {
+		return 0
+	}
+	duration := loginLockoutBase
+	for i := freeAttempts + 1; i < failures && duration < loginLockoutMax; i++ {
+		duration *= 2
+	}
+	if duration > loginLockoutMax {
+		return loginLockoutMax
+	}
+	return duration
+}
+
+// reserveLoginAttempt returns how long until none of keys are locked out,
+// which is zero if they are not locked out. If they are not, the attempt is
+// counted as a failure against every one of keys right away, locking out those
+// that have used up their free attempts. The attempt must be given back with
+// clearLoginFailures or cancelLoginAttempt if it turns out not to have failed.
+// Failures that have been forgotten are deleted along the way.
+//
+// The delete is the first statement of the transaction, so that the
+// transaction holds the write lock before it reads the failures and parallel
+// attempts for the same keys are counted one after the other.
+func reserveLoginAttempt(ctx context.Context, db *sql.DB, keys []loginLockoutKey) (wait time.Duration, err error) {
+	now := time.Now().UTC()
+	err = sq.WithTxContext(ctx, db, nil, func(tx *sql.Tx) error {
+		LOGIN_LOCKOUTS := tables.NEW_LOGIN_LOCKOUTS(ctx, "")
+		_, _, err := sq.ExecContext(ctx, tx, sq.SQLite.
+			DeleteFrom(LOGIN_LOCKOUTS).
+			Where(
+				LOGIN_LOCKOUTS.LAST_FAILURE_AT.LtTime(now.Add(-loginFailureWindow)),
+				LOGIN_LOCKOUTS.LOCKED_UNTIL.LtTime(now),
+			), 0,
+		)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		var lockedUntil time.Time
+		failures := make(map[string]int)
+		_, err = sq.FetchContext(ctx, tx, sq.SQLite.
+			From(LOGIN_LOCKOUTS).
+			Where(LOGIN_LOCKOUTS.LOCKOUT_KEY.In(lockoutKeyStrings(keys))),
+			func(row *sq.Row) error {
+				key := row.String(LOGIN_LOCKOUTS.LOCKOUT_KEY)
+				n := row.Int(LOGIN_LOCKOUTS.FAILURES)
+				lastFailureAt := row.Time(LOGIN_LOCKOUTS.LAST_FAILURE_AT)
+				until := row.Time(LOGIN_LOCKOUTS.LOCKED_UNTIL)
+				return row.Accumulate(func() error {
+					if lastFailureAt.After(now.Add(-loginFailureWindow)) {
+						failures[key] = n
+					}
+					if until.After(now) && until.After(lockedUntil) {
+						lockedUntil = until
+					}
+					return nil
+				})
+			},
+		)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		if !lockedUntil.IsZero() {
+			wait = lockedUntil.Sub(now).Round(time.Second)
+			if wait < time.Second {
+				wait = time.Second
+			}
+			return nil
+		}
+		_, _, err = sq.ExecContext(ctx, tx, sq.SQLite.
+			InsertInto(LOGIN_LOCKOUTS).
+			Valuesx(func(col *sq.Column) error {
+				for _, key := range keys {
+					n := failures[key.key] + 1
+					col.SetString(LOGIN_LOCKOUTS.LOCKOUT_KEY, key.key)
+					col.SetInt(LOGIN_LOCKOUTS.FAILURES, n)
+					col.SetTime(LOGIN_LOCKOUTS.LAST_FAILURE_AT, now)
+					col.SetTime(LOGIN_LOCKOUTS.LOCKED_UNTIL, now.Add(loginLockoutDuration(n, key.freeAttempts)))
+				}
+				return nil
+			}).
+			OnConflict(LOGIN_LOCKOUTS.LOCKOUT_KEY).
+			DoUpdateSet(
+				sq.SetExcluded(LOGIN_LOCKOUTS.FAILURES),
+				sq.SetExcluded(LOGIN_LOCKOUTS.LAST_FAILURE_AT),
+				sq.SetExcluded(LOGIN_LOCKOUTS.LOCKED_UNTIL),
+			), 0,
+		)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, erro.Wrap(err)
+	}
+	return wait, nil
+}
+
+// cancelLoginAttempt gives back an attempt reserved by reserveLoginAttempt
+// that did not fail. Lockouts that the attempt started are left in place, as
+// parallel attempts may have been counted on top of it.
+func cancelLoginAttempt(ctx context.Context, db sq.Queryer, keys []loginLockoutKey) error {
+	LOGIN_LOCKOUTS := tables.NEW_LOGIN_LOCKOUTS(ctx, "")
+	_, _, err := sq.ExecContext(ctx, db, sq.SQLite.
+		Update(LOGIN_LOCKOUTS).
+		Set(sq.Assign(LOGIN_LOCKOUTS.FAILURES, sq.Fieldf("? - 1", LOGIN_LOCKOUTS.FAILURES))).
+		Where(
+			LOGIN_LOCKOUTS.LOCKOUT_KEY.In(lockoutKeyStrings(keys)),
+			LOGIN_LOCKOUTS.FAILURES.GtInt(0),
+		), 0,
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	return nil
+}
+
+// clearLoginFailures forgets the failures of the keys that are cleared on a
+// successful login, and gives back the attempt reserved by
+// reserveLoginAttempt for the rest.
+func clearLoginFailures(ctx context.Context, db sq.Queryer, keys []loginLockoutKey) error {
+	var clear, cancel []loginLockoutKey
+	for _, key := range keys {
+		if key.clearOnLogin {
+			clear = append(clear, key)
+		} else {
+			cancel = append(cancel, key)
+		}
+	}
+	if len(clear) > 0 {
+		LOGIN_LOCKOUTS := tables.NEW_LOGIN_LOCKOUTS(ctx, "")
+		_, _, err := sq.ExecContext(ctx, db, sq.SQLite.
+			DeleteFrom(LOGIN_LOCKOUTS).
+			Where(LOGIN_LOCKOUTS.LOCKOUT_KEY.In(lockoutKeyStrings(clear))), 0,
+		)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+	}
+	if len(cancel) > 0 {
+		err := cancelLoginAttempt(ctx, db, cancel)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+	}
+	return nil
+}
+
+func lockoutKeyStrings(keys []loginLockoutKey) []string {
+	strs := make([]string, len(keys))
+	for i, key := range keys {
+		strs[i] = key.key
+	}
+	return strs
+}
+
+// newDummyPasswordHash returns the hash of a random password, which is
+// compared against when a login ID does not exist so that a login takes just
+// as long whether or not the login ID exists.
+func newDummyPasswordHash() ([]byte, error) {
+	password := make([]byte, 24)
+	_, err := rand.Read(password)
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	passwordHash, err := keyderiv.GenerateFromPassword(password)
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	return passwordHash, nil
+}
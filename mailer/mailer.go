@@ -0,0 +1,184 @@
+// Package mailer sends plain text emails, either through an SMTP server or,
+// for local testing, into a directory or a log.
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var ErrInvalidHeader = errors.New("invalid email header")
+
+// Message is a plain text email.
+type Message struct {
+	From    string // optional, Mailers fall back to their own From address
+	To      []string
+	Subject string
+	Body    string
+}
+
+// Mailer sends emails.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// Bytes returns msg formatted as an RFC 5322 email. It fails if any address
+// is invalid or the subject contains a newline, so that header values cannot
+// inject headers of their own.
+func (msg Message) Bytes() ([]byte, error) {
+	if msg.From == "" || len(msg.To) == 0 {
+		return nil, fmt.Errorf("%w: missing From or To", ErrInvalidHeader)
+	}
+	for _, addr := range append([]string{msg.From}, msg.To...) {
+		if _, err := mail.ParseAddress(addr); err != nil || strings.ContainsAny(addr, "\r\n") {
+			return nil, fmt.Errorf("%w: address %q", ErrInvalidHeader, addr)
+		}
+	}
+	if strings.ContainsAny(msg.Subject, "\r\n") {
+		return nil, fmt.Errorf("%w: subject %q", ErrInvalidHeader, msg.Subject)
+	}
+	messageID, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+	domain := "localhost"
+	if addr, err := mail.ParseAddress(msg.From); err == nil {
+		if i := strings.LastIndex(addr.Address, "@"); i >= 0 {
+			domain = addr.Address[i+1:]
+		}
+	}
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(buf, "Message-ID: <%s@%s>\r\n", messageID, domain)
+	fmt.Fprintf(buf, "From: %s\r\n", msg.From)
+	fmt.Fprintf(buf, "To: %s\r\n", strings.Join(msg.To, ", "))
+	fmt.Fprintf(buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	buf.WriteString("\r\n")
+	body := strings.ReplaceAll(msg.Body, "\r\n", "\n")
+	buf.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	return buf.Bytes(), nil
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// SMTP sends emails through an SMTP server, using STARTTLS if the server
+// supports it. Username and Password are optional, net/smtp only sends them
+// over TLS or to localhost.
+type SMTP struct {
+	Addr     string // host:port
+	Username string
+	Password string
+	From     string
+}
+
+func (m SMTP) Send(ctx context.Context, msg Message) error {
+	if msg.From == "" {
+		msg.From = m.From
+	}
+	b, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+	from, err := mail.ParseAddress(msg.From)
+	if err != nil {
+		return err
+	}
+	to := make([]string, len(msg.To))
+	for i, addr := range msg.To {
+		a, err := mail.ParseAddress(addr)
+		if err != nil {
+			return err
+		}
+		to[i] = a.Address
+	}
+	var auth smtp.Auth
+	if m.Username != "" {
+		host, _, err := net.SplitHostPort(m.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- smtp.SendMail(m.Addr, auth, from.Address, to, b)
+	}()
+	select {
+	case err = <-errc:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// File writes each email into Dir as a .eml file instead of sending it.
+type File struct {
+	Dir  string
+	From string
+}
+
+func (m File) Send(ctx context.Context, msg Message) error {
+	if msg.From == "" {
+		msg.From = m.From
+	}
+	b, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(m.Dir, 0755)
+	if err != nil {
+		return err
+	}
+	suffix, err := randomHex(4)
+	if err != nil {
+		return err
+	}
+	name := time.Now().UTC().Format("20060102T150405.000000000") + "-" + suffix + ".eml"
+	return os.WriteFile(filepath.Join(m.Dir, name), b, 0600)
+}
+
+// Log logs each email instead of sending it. A nil Logger logs to the
+// standard logger.
+type Log struct {
+	Logger *log.Logger
+	From   string
+}
+
+func (m Log) Send(ctx context.Context, msg Message) error {
+	if msg.From == "" {
+		msg.From = m.From
+	}
+	b, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+	if m.Logger == nil {
+		log.Printf("mailer: not sending email\n%s", b)
+		return nil
+	}
+	m.Logger.Printf("mailer: not sending email\n%s", b)
+	return nil
+}
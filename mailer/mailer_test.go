@@ -0,0 +1,64 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bokwoon95/pagemanager/testutil"
+)
+
+func Test_MessageBytes(t *testing.T) {
+	is := testutil.New(t)
+	b, err := Message{
+		From:    "PageManager <noreply@example.com>",
+		To:      []string{"alice@example.com"},
+		Subject: "Reset your password",
+		Body:    "line one\nline two\n",
+	}.Bytes()
+	is.NoErr(err)
+	s := string(b)
+	is.True(strings.Contains(s, "From: PageManager <noreply@example.com>\r\n"))
+	is.True(strings.Contains(s, "To: alice@example.com\r\n"))
+	is.True(strings.Contains(s, "Subject: Reset your password\r\n"))
+	is.True(strings.Contains(s, "@example.com>\r\n"))
+	is.True(strings.HasSuffix(s, "\r\n\r\nline one\r\nline two\r\n"))
+}
+
+func Test_MessageBytesHeaderInjection(t *testing.T) {
+	type TT struct {
+		description string
+		msg         Message
+	}
+	tests := []TT{
+		{"newline in subject", Message{From: "a@example.com", To: []string{"b@example.com"}, Subject: "hi\r\nBcc: c@example.com"}},
+		{"newline in to", Message{From: "a@example.com", To: []string{"b@example.com\r\nBcc: c@example.com"}}},
+		{"invalid from", Message{From: "not an address", To: []string{"b@example.com"}}},
+		{"no recipients", Message{From: "a@example.com"}},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.description, func(t *testing.T) {
+			is := testutil.New(t)
+			_, err := tt.msg.Bytes()
+			is.True(errors.Is(err, ErrInvalidHeader))
+		})
+	}
+}
+
+func Test_File(t *testing.T) {
+	is := testutil.New(t)
+	dir := t.TempDir()
+	m := File{Dir: dir, From: "noreply@example.com"}
+	err := m.Send(context.Background(), Message{To: []string{"alice@example.com"}, Subject: "hello", Body: "hello"})
+	is.NoErr(err)
+	matches, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	is.NoErr(err)
+	is.Equal(1, len(matches))
+	b, err := os.ReadFile(matches[0])
+	is.NoErr(err)
+	is.True(strings.Contains(string(b), "From: noreply@example.com\r\n"))
+}
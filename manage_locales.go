@@ -0,0 +1,385 @@
+package pagemanager
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/bokwoon95/pagemanager/erro"
+	"github.com/bokwoon95/pagemanager/hy"
+	"github.com/bokwoon95/pagemanager/hyforms"
+	"github.com/bokwoon95/pagemanager/sq"
+	"github.com/bokwoon95/pagemanager/tpl"
+)
+
+const (
+	inputLocaleAction      = "pm-locale-action"
+	inputLocaleCode        = "pm-locale-code"
+	inputLocaleNewCode     = "pm-locale-new-code"
+	inputLocaleDescription = "pm-locale-description"
+	inputLocaleFallbacks   = "pm-locale-fallbacks"
+	inputLocaleDefault     = "pm-locale-default"
+
+	localeActionAdd          = "add"
+	localeActionEdit         = "edit" // describe, set-fallbacks, set-default and rename in one go
+	localeActionRename       = "rename"
+	localeActionDescribe     = "describe"
+	localeActionSetDefault   = "set-default"
+	localeActionSetFallbacks = "set-fallbacks"
+	localeActionDelete       = "delete"
+)
+
+var errUnknownLocaleAction = errors.New("unknown locale action")
+
+// localeRequest is a change to the locales. It is filled in from the forms on
+// URLManageLocales, or decoded from the body of a JSON request to it e.g.
+//
+//	POST /pm-manage-locales
+//	Content-Type: application/json
+//	X-CSRF-Token: <the hyforms.csrf input of the forms on the page>
+//
+//	{"Action": "set-fallbacks", "Code": "de-CH", "Fallbacks": ["de", "en"]}
+type localeRequest struct {
+	Action      string
+	Code        string
+	NewCode     string
+	Description string
+	IsDefault   bool
+	Fallbacks   []string
+}
+
+func (req localeRequest) apply(ctx context.Context, db sq.Queryer) error {
+	switch req.Action {
+	case localeActionAdd:
+		return addLocale(ctx, db, req.Code, req.Description)
+	case localeActionRename:
+		return renameLocale(ctx, db, req.Code, req.NewCode)
+	case localeActionDescribe:
+		return describeLocale(ctx, db, req.Code, req.Description)
+	case localeActionSetDefault:
+		return setDefaultLocale(ctx, db, req.Code)
+	case localeActionSetFallbacks:
+		return setLocaleFallbacks(ctx, db, req.Code, req.Fallbacks)
+	case localeActionDelete:
+		return deleteLocale(ctx, db, req.Code)
+	case localeActionEdit:
+		err := describeLocale(ctx, db, req.Code, req.Description)
+		if err != nil {
+			return err
+		}
+		err = setLocaleFallbacks(ctx, db, req.Code, req.Fallbacks)
+		if err != nil {
+			return err
+		}
+		locales, err := getLocales(ctx, db)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		switch {
+		case req.IsDefault:
+			err = setDefaultLocale(ctx, db, req.Code)
+		case locales[req.Code].IsDefault:
+			err = setDefaultLocale(ctx, db, "")
+		}
+		if err != nil {
+			return err
+		}
+		if req.NewCode == "" {
+			return nil
+		}
+		return renameLocale(ctx, db, req.Code, req.NewCode)
+	}
+	return fmt.Errorf("%w %q", errUnknownLocaleAction, req.Action)
+}
+
+// applyLocaleRequest applies req in a transaction and reloads pm.locales.
+func (pm *PageManager) applyLocaleRequest(ctx context.Context, req localeRequest) error {
+	err := sq.WithTxContext(ctx, pm.dataDB, nil, func(tx *sql.Tx) error {
+		return req.apply(ctx, tx)
+	})
+	if err != nil {
+		return err
+	}
+	return pm.refreshLocales(ctx)
+}
+
+// localeErrStatus returns the HTTP status code that a locale request error
+// should be reported with.
+func localeErrStatus(err error) int {
+	switch {
+	case err == nil:
+		return http.StatusOK
+	case errors.Is(err, ErrLocaleNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrInvalidLocaleCode), errors.Is(err, ErrLocaleExists),
+		errors.Is(err, ErrInvalidLocaleFallbacks), errors.Is(err, errUnknownLocaleAction):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+type manageLocalesData struct {
+	w       http.ResponseWriter `json:"-"`
+	r       *http.Request       `json:"-"`
+	Locales []Locale
+	Edit    Locale // the locale selected for editing with ?pm-locale=code
+
+	req localeRequest // set by the form callbacks on POST
+}
+
+func (data *manageLocalesData) LogoutForm() (template.HTML, error) {
+	return logoutForm(data.w, data.r)
+}
+
+func (data *manageLocalesData) LocalesList() (template.HTML, error) {
+	var els hy.Elements
+	for _, locale := range data.Locales {
+		div := hy.H("div.mv2", nil)
+		header := hy.H("div", nil, hy.Txt(locale.Code))
+		if locale.Description != "" {
+			header.Append("span", nil, hy.Txt(" (", locale.Description, ")"))
+		}
+		if locale.IsDefault {
+			header.Append("span.b", nil, hy.Txt(" default"))
+		}
+		editURL := LocaleURL(data.r, URLManageLocales+"?"+queryparamLocale+"="+url.QueryEscape(locale.Code))
+		header.Append("a.ml2", hy.Attr{"href": editURL}, hy.Txt("edit"))
+		div.AppendElements(header)
+		if len(locale.Fallbacks) > 0 {
+			div.Append("div.f6.gray", nil, hy.Txt("Falls back to: ", strings.Join(locale.Fallbacks, ", ")))
+		}
+		els.AppendElements(div)
+	}
+	return hy.Marshal(els)
+}
+
+func (data *manageLocalesData) AddForm() (template.HTML, error) {
+	return hyforms.MarshalForm(data.w, data.r, data.addFormCallback)
+}
+
+func (data *manageLocalesData) EditForm() (template.HTML, error) {
+	if data.Edit.Code == "" {
+		return "", nil
+	}
+	return hyforms.MarshalForm(data.w, data.r, data.editFormCallback)
+}
+
+func (data *manageLocalesData) DeleteForm() (template.HTML, error) {
+	return hyforms.MarshalForm(data.w, data.r, data.deleteFormCallback)
+}
+
+func (data *manageLocalesData) addFormCallback(form *hyforms.Form) {
+	form.Set("#pm-add-locale", hy.Attr{"method": "POST"})
+	action := form.Hidden(inputLocaleAction, localeActionAdd)
+	code := form.Text(inputLocaleCode, "").Set("#pm-add-locale-code.pa2", hy.Attr{"placeholder": "e.g. de-CH"})
+	description := form.Text(inputLocaleDescription, "").Set("#pm-add-locale-description.pa2", nil)
+	form.AppendElements(action)
+	form.Append("div.mt3.mb1", nil, hy.H("label.pointer", hy.Attr{"for": code.ID()}, hy.Txt("Locale code: ")))
+	form.Append("div", nil, code)
+	for _, errMsg := range code.ErrMsgs() {
+		form.Append("div.f7.red", nil, hy.Txt(errMsg))
+	}
+	form.Append("div.mt3.mb1", nil, hy.H("label.pointer", hy.Attr{"for": description.ID()}, hy.Txt("Description: ")))
+	form.Append("div", nil, description)
+	form.Append("div.mt3", nil, hy.H("button.pointer.pa2.bg-white", hy.Attr{"type": "submit"}, hy.Txt("Add")))
+
+	form.Unmarshal(func() {
+		data.req = localeRequest{
+			Action:      localeActionAdd,
+			Code:        code.Validate(hyforms.Required).Value(),
+			Description: description.Value(),
+		}
+	})
+}
+
+func (data *manageLocalesData) editFormCallback(form *hyforms.Form) {
+	form.Set("#pm-edit-locale", hy.Attr{"method": "POST"})
+	action := form.Hidden(inputLocaleAction, localeActionEdit)
+	code := form.Hidden(inputLocaleCode, data.Edit.Code)
+	newCode := form.Text(inputLocaleNewCode, data.Edit.Code).Set("#pm-edit-locale-code.pa2", nil)
+	description := form.Text(inputLocaleDescription, data.Edit.Description).Set("#pm-edit-locale-description.pa2", nil)
+	fallbacks := form.Text(inputLocaleFallbacks, strings.Join(data.Edit.Fallbacks, ", ")).Set("#pm-edit-locale-fallbacks.pa2", hy.Attr{"placeholder": "e.g. de, en"})
+	isDefault := form.Checkbox(inputLocaleDefault, "", data.Edit.IsDefault).Set("#pm-edit-locale-default.pointer", nil)
+	form.AppendElements(action, code)
+	form.Append("div.mt3.mb1", nil, hy.H("label.pointer", hy.Attr{"for": newCode.ID()}, hy.Txt("Locale code: ")))
+	form.Append("div", nil, newCode)
+	for _, errMsg := range newCode.ErrMsgs() {
+		form.Append("div.f7.red", nil, hy.Txt(errMsg))
+	}
+	form.Append("div.mt3.mb1", nil, hy.H("label.pointer", hy.Attr{"for": description.ID()}, hy.Txt("Description: ")))
+	form.Append("div", nil, description)
+	form.Append("div.mt3.mb1", nil, hy.H("label.pointer", hy.Attr{"for": fallbacks.ID()}, hy.Txt("Fallback locales, in order: ")))
+	form.Append("div", nil, fallbacks)
+	for _, errMsg := range fallbacks.ErrMsgs() {
+		form.Append("div.f7.red", nil, hy.Txt(errMsg))
+	}
+	form.Append("div.mt3", nil, hy.H("label.pointer", hy.Attr{"for": isDefault.ID()}, isDefault, hy.Txt(" Default locale")))
+	form.Append("div.mt3", nil, hy.H("button.pointer.pa2.bg-white", hy.Attr{"type": "submit"}, hy.Txt("Save")))
+
+	form.Unmarshal(func() {
+		data.req = localeRequest{
+			Action:      localeActionEdit,
+			Code:        code.Value(),
+			NewCode:     newCode.Validate(hyforms.Required).Value(),
+			Description: description.Value(),
+			IsDefault:   isDefault.Checked(),
+			Fallbacks:   splitLocaleCodes(fallbacks.Value()),
+		}
+	})
+}
+
+func (data *manageLocalesData) deleteFormCallback(form *hyforms.Form) {
+	form.Set("#pm-delete-locale", hy.Attr{"method": "POST"})
+	action := form.Hidden(inputLocaleAction, localeActionDelete)
+	var opts hyforms.Options
+	for _, locale := range data.Locales {
+		opts.Append(hyforms.Option{Value: locale.Code, Display: locale.Code})
+	}
+	code := form.Select(inputLocaleCode, opts).Set("#pm-delete-locale-code.pa2", nil)
+	form.AppendElements(action)
+	form.Append("div.mt3.mb1", nil, hy.H("label.pointer", hy.Attr{"for": code.ID()}, hy.Txt("Locale: ")))
+	form.Append("div", nil, code)
+	for _, errMsg := range code.ErrMsgs() {
+		form.Append("div.f7.red", nil, hy.Txt(errMsg))
+	}
+	form.Append("div.mt1.f6.gray", nil, hy.Txt("Deleting a locale also deletes its translations."))
+	form.Append("div.mt3", nil, hy.H("button.pointer.pa2.bg-white", hy.Attr{"type": "submit"}, hy.Txt("Delete")))
+
+	form.Unmarshal(func() {
+		data.req = localeRequest{
+			Action: localeActionDelete,
+			Code:   code.Value(),
+		}
+	})
+}
+
+// splitLocaleCodes splits a comma separated list of locale codes.
+func splitLocaleCodes(s string) []string {
+	var codes []string
+	for _, code := range strings.Split(s, ",") {
+		code = strings.TrimSpace(code)
+		if code != "" {
+			codes = append(codes, code)
+		}
+	}
+	return codes
+}
+
+func (pm *PageManager) manageLocales(w http.ResponseWriter, r *http.Request) {
+	data := &manageLocalesData{w: w, r: r}
+	user, _ := pm.getUser(w, r)
+	switch {
+	case !user.Valid:
+		pm.RedirectToLogin(w, r)
+		return
+	case !user.Permissions[permissionManageLocales]:
+		pm.Forbidden(w, r)
+		return
+	}
+	data.Locales = pm.sortedLocales()
+	switch r.Method {
+	case "GET":
+		editCode := r.FormValue(queryparamLocale)
+		for _, locale := range data.Locales {
+			if locale.Code == editCode {
+				data.Edit = locale
+			}
+		}
+		err := pm.tpl.Render(w, r, data, tpl.Files("manage_locales.html"))
+		if err != nil {
+			pm.InternalServerError(w, r, erro.Wrap(err))
+			return
+		}
+	case "POST":
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" {
+			pm.manageLocalesJSON(w, r)
+			return
+		}
+		var errMsgs hyforms.ValidationErrMsgs
+		var ok bool
+		var inputName string // the input that errors are reported on
+		redirectURL := r.URL.Path
+		switch r.FormValue(inputLocaleAction) {
+		case localeActionAdd:
+			errMsgs, ok = hyforms.UnmarshalForm(w, r, data.addFormCallback)
+			inputName = inputLocaleCode
+		case localeActionEdit:
+			errMsgs, ok = hyforms.UnmarshalForm(w, r, data.editFormCallback)
+			inputName = inputLocaleNewCode
+			redirectURL += "?" + queryparamLocale + "=" + url.QueryEscape(r.FormValue(inputLocaleCode))
+		case localeActionDelete:
+			errMsgs, ok = hyforms.UnmarshalForm(w, r, data.deleteFormCallback)
+			inputName = inputLocaleCode
+		default:
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		if !ok {
+			hyforms.Redirect(w, r, LocaleURL(r, redirectURL), errMsgs)
+			return
+		}
+		err := pm.applyLocaleRequest(r.Context(), data.req)
+		if errors.Is(err, ErrInvalidLocaleFallbacks) {
+			inputName = inputLocaleFallbacks
+		}
+		switch localeErrStatus(err) {
+		case http.StatusOK:
+		case http.StatusInternalServerError:
+			pm.InternalServerError(w, r, erro.Wrap(err))
+			return
+		default:
+			errMsgs.InputErrMsgs[inputName] = []string{err.Error()}
+			hyforms.Redirect(w, r, LocaleURL(r, redirectURL), errMsgs)
+			return
+		}
+		if data.req.Action == localeActionEdit {
+			redirectURL = r.URL.Path + "?" + queryparamLocale + "=" + url.QueryEscape(data.req.NewCode)
+		}
+		Redirect(w, r, redirectURL)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// manageLocalesJSON applies a JSON encoded localeRequest and responds with
+// the resulting locales, or with the error if the request failed.
+func (pm *PageManager) manageLocalesJSON(w http.ResponseWriter, r *http.Request) {
+	var req localeRequest
+	err := hyforms.VerifyCSRFToken(r)
+	if err != nil {
+		writeJSON(w, http.StatusForbidden, map[string]string{"Error": err.Error()})
+		return
+	}
+	err = json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"Error": err.Error()})
+		return
+	}
+	err = pm.applyLocaleRequest(r.Context(), req)
+	switch status := localeErrStatus(err); status {
+	case http.StatusOK:
+		writeJSON(w, status, map[string]interface{}{"Locales": pm.sortedLocales()})
+	case http.StatusInternalServerError:
+		pm.InternalServerError(w, r, erro.Wrap(err))
+	default:
+		writeJSON(w, status, map[string]string{"Error": err.Error()})
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
@@ -0,0 +1,514 @@
+package pagemanager
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/bokwoon95/pagemanager/erro"
+	"github.com/bokwoon95/pagemanager/hy"
+	"github.com/bokwoon95/pagemanager/hyforms"
+	"github.com/bokwoon95/pagemanager/sq"
+	"github.com/bokwoon95/pagemanager/tpl"
+)
+
+const (
+	inputRoleAction      = "pm-role-action"
+	inputRoleName        = "pm-role-name"
+	inputRoleDescription = "pm-role-description"
+	inputRolePermissions = "pm-role-permissions"
+	inputRoleUser        = "pm-role-user"
+	inputRoleUserRoles   = "pm-role-user-roles"
+
+	roleActionAdd                = "add"
+	roleActionEdit               = "edit" // describe and set-permissions in one go
+	roleActionDescribe           = "describe"
+	roleActionSetPermissions     = "set-permissions"
+	roleActionDelete             = "delete"
+	roleActionSetUserRoles       = "set-user-roles"
+	roleActionSetUserPermissions = "set-user-permissions"
+	roleActionEditUser           = "edit-user" // set-user-roles and set-user-permissions in one go
+)
+
+var errUnknownRoleAction = errors.New("unknown role action")
+
+// roleRequest is a change to the roles, or to the roles and permissions of a
+// user. It is filled in from the forms on URLManageRoles, or decoded from the
+// body of a JSON request to it e.g.
+//
+//	POST /pm-manage-roles
+//	Content-Type: application/json
+//	X-CSRF-Token: <the hyforms.csrf input of the forms on the page>
+//
+//	{"Action": "add", "Role": "editor", "Permissions": ["pagemanager:change-page"]}
+//	{"Action": "set-user-roles", "PublicUserID": "XqCf8D8-AViaK_p9", "Roles": ["editor"]}
+type roleRequest struct {
+	Action       string
+	Role         string
+	Description  string
+	Permissions  []string
+	PublicUserID string
+	Roles        []string
+}
+
+func (req roleRequest) apply(ctx context.Context, db sq.Queryer) error {
+	switch req.Action {
+	case roleActionAdd:
+		err := addRole(ctx, db, req.Role, req.Description)
+		if err != nil {
+			return err
+		}
+		return setRolePermissions(ctx, db, req.Role, req.Permissions)
+	case roleActionDescribe:
+		return describeRole(ctx, db, req.Role, req.Description)
+	case roleActionSetPermissions:
+		return setRolePermissions(ctx, db, req.Role, req.Permissions)
+	case roleActionDelete:
+		return deleteRole(ctx, db, req.Role)
+	case roleActionSetUserRoles:
+		return setUserRoles(ctx, db, req.PublicUserID, req.Roles)
+	case roleActionSetUserPermissions:
+		return setUserPermissions(ctx, db, req.PublicUserID, req.Permissions)
+	case roleActionEdit:
+		err := describeRole(ctx, db, req.Role, req.Description)
+		if err != nil {
+			return err
+		}
+		return setRolePermissions(ctx, db, req.Role, req.Permissions)
+	case roleActionEditUser:
+		err := setUserRoles(ctx, db, req.PublicUserID, req.Roles)
+		if err != nil {
+			return err
+		}
+		return setUserPermissions(ctx, db, req.PublicUserID, req.Permissions)
+	}
+	return fmt.Errorf("%w %q", errUnknownRoleAction, req.Action)
+}
+
+// applyRoleRequest applies req in a transaction.
+func (pm *PageManager) applyRoleRequest(ctx context.Context, req roleRequest) error {
+	return sq.WithTxContext(ctx, pm.dataDB, nil, func(tx *sql.Tx) error {
+		return req.apply(ctx, tx)
+	})
+}
+
+// roleErrStatus returns the HTTP status code that a role request error should
+// be reported with.
+func roleErrStatus(err error) int {
+	switch {
+	case err == nil:
+		return http.StatusOK
+	case errors.Is(err, ErrRoleNotFound), errors.Is(err, ErrUserNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrInvalidRoleName), errors.Is(err, ErrRoleExists),
+		errors.Is(err, ErrRoleReserved), errors.Is(err, ErrPermissionNotFound),
+		errors.Is(err, errUnknownRoleAction):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// roleErrInput returns the input that a role request error is reported on,
+// or "" if it is reported on the whole form.
+func roleErrInput(err error) string {
+	switch {
+	case errors.Is(err, ErrInvalidRoleName), errors.Is(err, ErrRoleExists):
+		return inputRoleName
+	}
+	return ""
+}
+
+type manageRolesData struct {
+	w               http.ResponseWriter `json:"-"`
+	r               *http.Request       `json:"-"`
+	Roles           []Role
+	Permissions     []Permission
+	Users           []User
+	EditRole        Role     // the role selected for editing with ?pm-role=name
+	EditUser        User     // the user selected for editing with ?pm-user=public_user_id
+	UserRoles       []string // the roles of EditUser
+	UserPermissions []string // the permissions granted directly to EditUser
+
+	req roleRequest // set by the form callbacks on POST
+}
+
+func (data *manageRolesData) LogoutForm() (template.HTML, error) {
+	return logoutForm(data.w, data.r)
+}
+
+func (data *manageRolesData) RolesList() (template.HTML, error) {
+	var els hy.Elements
+	for _, role := range data.Roles {
+		div := hy.H("div.mv2", nil)
+		header := hy.H("div", nil, hy.Txt(role.Name))
+		if role.Description != "" {
+			header.Append("span", nil, hy.Txt(" (", role.Description, ")"))
+		}
+		editURL := LocaleURL(data.r, URLManageRoles+"?"+queryparamRole+"="+url.QueryEscape(role.Name))
+		header.Append("a.ml2", hy.Attr{"href": editURL}, hy.Txt(msg(data.r, "manage_roles.edit")))
+		div.AppendElements(header)
+		if len(role.Permissions) > 0 {
+			div.Append("div.f6.gray", nil, hy.Txt(msg(data.r, "manage_roles.permissions"), strings.Join(role.Permissions, ", ")))
+		}
+		els.AppendElements(div)
+	}
+	return hy.Marshal(els)
+}
+
+func (data *manageRolesData) PermissionsList() (template.HTML, error) {
+	var els hy.Elements
+	for _, permission := range data.Permissions {
+		div := hy.H("div.mv1", nil, hy.H("span.code", nil, hy.Txt(permission.Name)))
+		if permission.Description != "" {
+			div.Append("span.gray", nil, hy.Txt(" ", permission.Description))
+		}
+		els.AppendElements(div)
+	}
+	return hy.Marshal(els)
+}
+
+func (data *manageRolesData) UsersList() (template.HTML, error) {
+	if len(data.Users) == 0 {
+		return hy.Marshal(hy.H("div.mv2.gray", nil, hy.Txt(msg(data.r, "manage_roles.no_users"))))
+	}
+	var els hy.Elements
+	for _, user := range data.Users {
+		editURL := LocaleURL(data.r, URLManageRoles+"?"+queryparamUser+"="+url.QueryEscape(user.PublicUserID))
+		els.Append("div.mv1", nil, hy.Txt(user.LoginID), hy.H("a.ml2", hy.Attr{"href": editURL}, hy.Txt(msg(data.r, "manage_roles.edit_access"))))
+	}
+	return hy.Marshal(els)
+}
+
+func (data *manageRolesData) AddForm() (template.HTML, error) {
+	return hyforms.MarshalForm(data.w, data.r, data.addFormCallback)
+}
+
+func (data *manageRolesData) EditForm() (template.HTML, error) {
+	if data.EditRole.Name == "" {
+		return "", nil
+	}
+	return hyforms.MarshalForm(data.w, data.r, data.editFormCallback)
+}
+
+func (data *manageRolesData) DeleteForm() (template.HTML, error) {
+	return hyforms.MarshalForm(data.w, data.r, data.deleteFormCallback)
+}
+
+func (data *manageRolesData) UserForm() (template.HTML, error) {
+	if !data.EditUser.Valid {
+		return "", nil
+	}
+	return hyforms.MarshalForm(data.w, data.r, data.userFormCallback)
+}
+
+// permissionCheckboxes appends a checkbox for every permission to the form,
+// checking those in checked. Permissions in locked are checked and cannot be
+// unchecked.
+func (data *manageRolesData) permissionCheckboxes(form *hyforms.Form, checked, locked []string) *hyforms.ToggledInputs {
+	var names []string
+	for _, permission := range data.Permissions {
+		names = append(names, permission.Name)
+	}
+	isChecked, isLocked := make(map[string]bool), make(map[string]bool)
+	for _, name := range checked {
+		isChecked[name] = true
+	}
+	for _, name := range locked {
+		isLocked[name] = true
+	}
+	checkboxes := form.Checkboxes(inputRolePermissions, names)
+	for i, checkbox := range checkboxes.Inputs() {
+		permission := data.Permissions[i]
+		attrs := hy.Attr{}
+		if isLocked[permission.Name] {
+			attrs["disabled"] = hy.Enabled
+		}
+		checkbox.Check(isChecked[permission.Name] || isLocked[permission.Name]).Set(".pointer", attrs)
+		label := hy.H("label.pointer", nil, checkbox, hy.Txt(" ", permission.Name))
+		if permission.Description != "" {
+			label.Append("span.f6.gray", nil, hy.Txt(" ", permission.Description))
+		}
+		form.Append("div.mv1", nil, label)
+	}
+	return checkboxes
+}
+
+func (data *manageRolesData) addFormCallback(form *hyforms.Form) {
+	form.Set("#pm-add-role", hy.Attr{"method": "POST"})
+	action := form.Hidden(inputRoleAction, roleActionAdd)
+	name := form.Text(inputRoleName, "").Set("#pm-add-role-name.pa2", hy.Attr{"placeholder": "e.g. editor"})
+	description := form.Text(inputRoleDescription, "").Set("#pm-add-role-description.pa2", nil)
+	form.AppendElements(action)
+	appendErrMsgs(form, form.ErrMsgs())
+	form.Append("div.mt3.mb1", nil, hy.H("label.pointer", hy.Attr{"for": name.ID()}, hy.Txt(msg(data.r, "manage_roles.role_name"))))
+	form.Append("div", nil, name)
+	appendErrMsgs(form, name.ErrMsgs())
+	form.Append("div.mt3.mb1", nil, hy.H("label.pointer", hy.Attr{"for": description.ID()}, hy.Txt(msg(data.r, "manage_roles.description"))))
+	form.Append("div", nil, description)
+	form.Append("div.mt3.mb1", nil, hy.Txt(msg(data.r, "manage_roles.permissions")))
+	permissions := data.permissionCheckboxes(form, nil, nil)
+	form.Append("div.mt3", nil, hy.H("button.pointer.pa2.bg-white", hy.Attr{"type": "submit"}, hy.Txt(msg(data.r, "manage_roles.add"))))
+
+	form.Unmarshal(func() {
+		data.req = roleRequest{
+			Action:      roleActionAdd,
+			Role:        name.Validate(hyforms.Required).Value(),
+			Description: description.Value(),
+			Permissions: permissions.Values(),
+		}
+	})
+}
+
+func (data *manageRolesData) editFormCallback(form *hyforms.Form) {
+	form.Set("#pm-edit-role", hy.Attr{"method": "POST"})
+	action := form.Hidden(inputRoleAction, roleActionEdit)
+	name := form.Hidden(inputRoleName, data.EditRole.Name)
+	description := form.Text(inputRoleDescription, data.EditRole.Description).Set("#pm-edit-role-description.pa2", nil)
+	var locked []string
+	if data.EditRole.Name == roleSuperadmin {
+		for _, permission := range builtinPermissions {
+			locked = append(locked, permission.Name)
+		}
+	}
+	form.AppendElements(action, name)
+	appendErrMsgs(form, form.ErrMsgs())
+	form.Append("div.mt3.mb1", nil, hy.H("label.pointer", hy.Attr{"for": description.ID()}, hy.Txt(msg(data.r, "manage_roles.description"))))
+	form.Append("div", nil, description)
+	form.Append("div.mt3.mb1", nil, hy.Txt(msg(data.r, "manage_roles.permissions")))
+	permissions := data.permissionCheckboxes(form, data.EditRole.Permissions, locked)
+	form.Append("div.mt3", nil, hy.H("button.pointer.pa2.bg-white", hy.Attr{"type": "submit"}, hy.Txt(msg(data.r, "manage_roles.save"))))
+
+	form.Unmarshal(func() {
+		data.req = roleRequest{
+			Action:      roleActionEdit,
+			Role:        name.Value(),
+			Description: description.Value(),
+			Permissions: permissions.Values(),
+		}
+	})
+}
+
+func (data *manageRolesData) deleteFormCallback(form *hyforms.Form) {
+	form.Set("#pm-delete-role", hy.Attr{"method": "POST"})
+	action := form.Hidden(inputRoleAction, roleActionDelete)
+	var opts hyforms.Options
+	for _, role := range data.Roles {
+		if role.Name != roleSuperadmin {
+			opts.Append(hyforms.Option{Value: role.Name, Display: role.Name})
+		}
+	}
+	name := form.Select(inputRoleName, opts).Set("#pm-delete-role-name.pa2", nil)
+	form.AppendElements(action)
+	appendErrMsgs(form, form.ErrMsgs())
+	form.Append("div.mt3.mb1", nil, hy.H("label.pointer", hy.Attr{"for": name.ID()}, hy.Txt(msg(data.r, "manage_roles.role"))))
+	form.Append("div", nil, name)
+	appendErrMsgs(form, name.ErrMsgs())
+	form.Append("div.mt1.f6.gray", nil, hy.Txt(msg(data.r, "manage_roles.delete_hint")))
+	form.Append("div.mt3", nil, hy.H("button.pointer.pa2.bg-white", hy.Attr{"type": "submit"}, hy.Txt(msg(data.r, "manage_roles.delete"))))
+
+	form.Unmarshal(func() {
+		data.req = roleRequest{
+			Action: roleActionDelete,
+			Role:   name.Value(),
+		}
+	})
+}
+
+func (data *manageRolesData) userFormCallback(form *hyforms.Form) {
+	form.Set("#pm-edit-user-access", hy.Attr{"method": "POST"})
+	action := form.Hidden(inputRoleAction, roleActionEditUser)
+	publicID := form.Hidden(inputRoleUser, data.EditUser.PublicUserID)
+	var roleNames []string
+	for _, role := range data.Roles {
+		if role.Name != roleSuperadmin {
+			roleNames = append(roleNames, role.Name)
+		}
+	}
+	hasRole := make(map[string]bool)
+	for _, name := range data.UserRoles {
+		hasRole[name] = true
+	}
+	form.AppendElements(action, publicID)
+	appendErrMsgs(form, form.ErrMsgs())
+	form.Append("div.mt3.mb1", nil, hy.Txt(msg(data.r, "manage_roles.roles")))
+	roles := form.Checkboxes(inputRoleUserRoles, roleNames)
+	for _, checkbox := range roles.Inputs() {
+		checkbox.Check(hasRole[checkbox.Value()]).Set(".pointer", nil)
+		form.Append("div.mv1", nil, hy.H("label.pointer", nil, checkbox, hy.Txt(" ", checkbox.Value())))
+	}
+	form.Append("div.mt3.mb1", nil, hy.Txt(msg(data.r, "manage_roles.user_permissions")))
+	permissions := data.permissionCheckboxes(form, data.UserPermissions, nil)
+	form.Append("div.mt3", nil, hy.H("button.pointer.pa2.bg-white", hy.Attr{"type": "submit"}, hy.Txt(msg(data.r, "manage_roles.save"))))
+
+	form.Unmarshal(func() {
+		data.req = roleRequest{
+			Action:       roleActionEditUser,
+			PublicUserID: publicID.Value(),
+			Roles:        roles.Values(),
+			Permissions:  permissions.Values(),
+		}
+	})
+}
+
+func (pm *PageManager) manageRoles(w http.ResponseWriter, r *http.Request) {
+	data := &manageRolesData{w: w, r: r}
+	user, _ := pm.getUser(w, r)
+	switch {
+	case !user.Valid:
+		pm.RedirectToLogin(w, r)
+		return
+	case !user.Permissions[permissionManageRoles]:
+		pm.Forbidden(w, r)
+		return
+	}
+	var err error
+	data.Roles, err = getRoles(r.Context(), pm.dataDB)
+	if err != nil {
+		pm.InternalServerError(w, r, erro.Wrap(err))
+		return
+	}
+	data.Permissions, err = getPermissions(r.Context(), pm.dataDB)
+	if err != nil {
+		pm.InternalServerError(w, r, erro.Wrap(err))
+		return
+	}
+	data.Users, err = getUsers(r.Context(), pm.dataDB)
+	if err != nil {
+		pm.InternalServerError(w, r, erro.Wrap(err))
+		return
+	}
+	switch r.Method {
+	case "GET":
+		editRole := r.FormValue(queryparamRole)
+		for _, role := range data.Roles {
+			if role.Name == editRole {
+				data.EditRole = role
+			}
+		}
+		editUser := r.FormValue(queryparamUser)
+		for _, user := range data.Users {
+			if editUser != "" && user.PublicUserID == editUser {
+				data.EditUser = user
+			}
+		}
+		if data.EditUser.Valid {
+			data.UserRoles, data.UserPermissions, err = getUserAccess(r.Context(), pm.dataDB, data.EditUser.UserID)
+			if err != nil {
+				pm.InternalServerError(w, r, erro.Wrap(err))
+				return
+			}
+		}
+		err = pm.tpl.Render(w, r, data, tpl.Files("manage_roles.html"))
+		if err != nil {
+			pm.InternalServerError(w, r, erro.Wrap(err))
+			return
+		}
+	case "POST":
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" {
+			pm.manageRolesJSON(w, r)
+			return
+		}
+		var errMsgs hyforms.ValidationErrMsgs
+		var ok bool
+		redirectURL := r.URL.Path
+		switch r.FormValue(inputRoleAction) {
+		case roleActionAdd:
+			errMsgs, ok = hyforms.UnmarshalForm(w, r, data.addFormCallback)
+		case roleActionEdit:
+			errMsgs, ok = hyforms.UnmarshalForm(w, r, data.editFormCallback)
+			redirectURL += "?" + queryparamRole + "=" + url.QueryEscape(r.FormValue(inputRoleName))
+		case roleActionDelete:
+			errMsgs, ok = hyforms.UnmarshalForm(w, r, data.deleteFormCallback)
+		case roleActionEditUser:
+			errMsgs, ok = hyforms.UnmarshalForm(w, r, data.userFormCallback)
+			redirectURL += "?" + queryparamUser + "=" + url.QueryEscape(r.FormValue(inputRoleUser))
+		default:
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		if !ok {
+			hyforms.Redirect(w, r, LocaleURL(r, redirectURL), errMsgs)
+			return
+		}
+		err = pm.applyRoleRequest(r.Context(), data.req)
+		switch roleErrStatus(err) {
+		case http.StatusOK:
+		case http.StatusInternalServerError:
+			pm.InternalServerError(w, r, erro.Wrap(err))
+			return
+		default:
+			if inputName := roleErrInput(err); inputName != "" {
+				errMsgs.InputErrMsgs[inputName] = []string{err.Error()}
+			} else {
+				errMsgs.FormErrMsgs = append(errMsgs.FormErrMsgs, err.Error())
+			}
+			hyforms.Redirect(w, r, LocaleURL(r, redirectURL), errMsgs)
+			return
+		}
+		Redirect(w, r, redirectURL)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// manageRolesJSON applies a JSON encoded roleRequest and responds with the
+// resulting roles and permissions, or with the error if the request failed.
+// Requests that change a user are also responded to with the user's roles
+// and direct permissions.
+func (pm *PageManager) manageRolesJSON(w http.ResponseWriter, r *http.Request) {
+	var req roleRequest
+	err := hyforms.VerifyCSRFToken(r)
+	if err != nil {
+		writeJSON(w, http.StatusForbidden, map[string]string{"Error": err.Error()})
+		return
+	}
+	err = json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"Error": err.Error()})
+		return
+	}
+	err = pm.applyRoleRequest(r.Context(), req)
+	switch status := roleErrStatus(err); status {
+	case http.StatusOK:
+		resp := make(map[string]interface{})
+		resp["Roles"], err = getRoles(r.Context(), pm.dataDB)
+		if err != nil {
+			pm.InternalServerError(w, r, erro.Wrap(err))
+			return
+		}
+		resp["Permissions"], err = getPermissions(r.Context(), pm.dataDB)
+		if err != nil {
+			pm.InternalServerError(w, r, erro.Wrap(err))
+			return
+		}
+		if req.PublicUserID != "" {
+			user, err := getUserByPublicID(r.Context(), pm.dataDB, req.PublicUserID)
+			if err != nil {
+				pm.InternalServerError(w, r, erro.Wrap(err))
+				return
+			}
+			roles, permissions, err := getUserAccess(r.Context(), pm.dataDB, user.UserID)
+			if err != nil {
+				pm.InternalServerError(w, r, erro.Wrap(err))
+				return
+			}
+			resp["User"] = map[string]interface{}{
+				"PublicUserID": user.PublicUserID,
+				"Roles":        roles,
+				"Permissions":  permissions,
+			}
+		}
+		writeJSON(w, status, resp)
+	case http.StatusInternalServerError:
+		pm.InternalServerError(w, r, erro.Wrap(err))
+	default:
+		writeJSON(w, status, map[string]string{"Error": err.Error()})
+	}
+}
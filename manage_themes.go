@@ -0,0 +1,219 @@
+package pagemanager
+
+import (
+	"errors"
+	"html/template"
+	"mime/multipart"
+	"net/http"
+	"sort"
+
+	"github.com/bokwoon95/pagemanager/erro"
+	"github.com/bokwoon95/pagemanager/hy"
+	"github.com/bokwoon95/pagemanager/hyforms"
+	"github.com/bokwoon95/pagemanager/tpl"
+)
+
+const (
+	inputThemeAction        = "pm-theme-action"
+	inputThemeArchive       = "pm-theme-archive"
+	inputInstallThemePath   = "pm-install-theme-path"
+	inputUninstallThemePath = "pm-uninstall-theme-path"
+
+	themeActionInstall   = "install"
+	themeActionUninstall = "uninstall"
+)
+
+type themeSummary struct {
+	Path        string
+	Name        string
+	Description string
+	Err         string
+}
+
+type manageThemesData struct {
+	w      http.ResponseWriter `json:"-"`
+	r      *http.Request       `json:"-"`
+	Themes []themeSummary
+
+	// set by the form callbacks on POST
+	themePath string
+	archive   *multipart.FileHeader
+}
+
+func (data *manageThemesData) LogoutForm() (template.HTML, error) {
+	return logoutForm(data.w, data.r)
+}
+
+func (data *manageThemesData) ThemesList() (template.HTML, error) {
+	var els hy.Elements
+	for _, t := range data.Themes {
+		div := hy.H("div.mv2", nil)
+		div.Append("div", nil, hy.Txt("ThemePath: ", t.Path))
+		if t.Name != "" {
+			div.Append("div", nil, hy.Txt("Name: ", t.Name))
+		}
+		if t.Description != "" {
+			div.Append("div", nil, hy.Txt("Description: ", t.Description))
+		}
+		if t.Err != "" {
+			div.Append("div.red", nil, hy.Txt("Error: ", t.Err))
+		}
+		els.AppendElements(div)
+	}
+	return hy.Marshal(els)
+}
+
+func (data *manageThemesData) InstallForm() (template.HTML, error) {
+	return hyforms.MarshalForm(data.w, data.r, data.installFormCallback)
+}
+
+func (data *manageThemesData) UninstallForm() (template.HTML, error) {
+	return hyforms.MarshalForm(data.w, data.r, data.uninstallFormCallback)
+}
+
+func (data *manageThemesData) installFormCallback(form *hyforms.Form) {
+	form.Set("#pm-install-theme", hy.Attr{"method": "POST", "enctype": "multipart/form-data"})
+	action := form.Hidden(inputThemeAction, themeActionInstall)
+	archive := form.Input("file", inputThemeArchive, "").Set("#pm-theme-archive", hy.Attr{"accept": ".zip,application/zip"})
+	themePath := form.Text(inputInstallThemePath, "").Set("#pm-install-theme-path.pa2", nil)
+	form.AppendElements(action)
+	form.Append("div.mt3.mb1", nil, hy.H("label.pointer", hy.Attr{"for": archive.ID()}, hy.Txt("Theme archive (.zip): ")))
+	form.Append("div", nil, archive)
+	for _, errMsg := range archive.ErrMsgs() {
+		form.Append("div.f7.red", nil, hy.Txt(errMsg))
+	}
+	form.Append("div.mt3.mb1", nil, hy.H("label.pointer", hy.Attr{"for": themePath.ID()}, hy.Txt("Install to pm-themes/")))
+	form.Append("div", nil, themePath)
+	for _, errMsg := range themePath.ErrMsgs() {
+		form.Append("div.f7.red", nil, hy.Txt(errMsg))
+	}
+	form.Append("div.mt3", nil, hy.H("button.pointer.pa2.bg-white", hy.Attr{"type": "submit"}, hy.Txt("Install")))
+
+	form.Unmarshal(func() {
+		data.themePath = themePath.Validate(hyforms.Required).Value()
+		_, data.archive, _ = form.Request().FormFile(inputThemeArchive)
+		if data.archive == nil {
+			form.AddInputErrMsgs(inputThemeArchive, "no theme archive uploaded")
+		}
+	})
+}
+
+func (data *manageThemesData) uninstallFormCallback(form *hyforms.Form) {
+	form.Set("#pm-uninstall-theme", hy.Attr{"method": "POST"})
+	action := form.Hidden(inputThemeAction, themeActionUninstall)
+	var opts hyforms.Options
+	for _, t := range data.Themes {
+		opts.Append(hyforms.Option{Value: t.Path, Display: t.Path})
+	}
+	themePath := form.Select(inputUninstallThemePath, opts).Set("#pm-uninstall-theme-path.pa2", nil)
+	form.AppendElements(action)
+	form.Append("div.mt3.mb1", nil, hy.H("label.pointer", hy.Attr{"for": themePath.ID()}, hy.Txt("Theme: ")))
+	form.Append("div", nil, themePath)
+	for _, errMsg := range themePath.ErrMsgs() {
+		form.Append("div.f7.red", nil, hy.Txt(errMsg))
+	}
+	form.Append("div.mt3", nil, hy.H("button.pointer.pa2.bg-white", hy.Attr{"type": "submit"}, hy.Txt("Uninstall")))
+
+	form.Unmarshal(func() {
+		data.themePath = themePath.Value()
+	})
+}
+
+func (pm *PageManager) manageThemes(w http.ResponseWriter, r *http.Request) {
+	data := &manageThemesData{w: w, r: r}
+	user, _ := pm.getUser(w, r)
+	switch {
+	case !user.Valid:
+		pm.RedirectToLogin(w, r)
+		return
+	case !user.Permissions[permissionManageThemes]:
+		pm.Forbidden(w, r)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		err := pm.refreshThemes()
+		if err != nil {
+			pm.InternalServerError(w, r, erro.Wrap(err))
+			return
+		}
+		pm.themesMutex.RLock()
+		for _, t := range pm.themes {
+			summary := themeSummary{Path: t.path, Name: t.name, Description: t.description}
+			if t.err != nil {
+				summary.Err = t.err.Error()
+			}
+			data.Themes = append(data.Themes, summary)
+		}
+		pm.themesMutex.RUnlock()
+		sort.Slice(data.Themes, func(i, j int) bool { return data.Themes[i].Path < data.Themes[j].Path })
+		err = pm.tpl.Render(w, r, data, tpl.Files("manage_themes.html"))
+		if err != nil {
+			pm.InternalServerError(w, r, erro.Wrap(err))
+			return
+		}
+	case "POST":
+		// The upload may be a little larger than the extracted theme because
+		// of the multipart and zip headers.
+		r.Body = http.MaxBytesReader(w, r.Body, maxThemeArchiveSize+1<<20)
+		err := r.ParseMultipartForm(32 << 20)
+		if err != nil && !errors.Is(err, http.ErrNotMultipart) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var errMsgs hyforms.ValidationErrMsgs
+		var ok bool
+		var inputName string // the input that errors are reported on
+		switch r.FormValue(inputThemeAction) {
+		case themeActionInstall:
+			errMsgs, ok = hyforms.UnmarshalForm(w, r, data.installFormCallback)
+			if ok {
+				inputName = inputThemeArchive
+				err = data.install(pm.datafolder)
+				if errors.Is(err, ErrInvalidThemePath) || errors.Is(err, ErrThemeExists) {
+					inputName = inputInstallThemePath
+				}
+			}
+		case themeActionUninstall:
+			errMsgs, ok = hyforms.UnmarshalForm(w, r, data.uninstallFormCallback)
+			if ok {
+				inputName = inputUninstallThemePath
+				err = uninstallTheme(r.Context(), pm.dataDB, pm.datafolder, data.themePath)
+			}
+		default:
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		if !ok {
+			hyforms.Redirect(w, r, LocaleURL(r, r.URL.Path), errMsgs)
+			return
+		}
+		switch {
+		case errors.Is(err, ErrInvalidThemePath), errors.Is(err, ErrThemeExists), errors.Is(err, ErrInvalidThemeArchive),
+			errors.Is(err, ErrThemeNotFound), errors.Is(err, ErrThemeInUse):
+			errMsgs.InputErrMsgs[inputName] = []string{err.Error()}
+			hyforms.Redirect(w, r, LocaleURL(r, r.URL.Path), errMsgs)
+			return
+		case err != nil:
+			pm.InternalServerError(w, r, erro.Wrap(err))
+			return
+		}
+		err = pm.refreshThemes()
+		if err != nil {
+			pm.InternalServerError(w, r, erro.Wrap(err))
+			return
+		}
+		Redirect(w, r, r.URL.Path)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (data *manageThemesData) install(datafolder string) error {
+	f, err := data.archive.Open()
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	defer f.Close()
+	return InstallTheme(datafolder, data.themePath, f, data.archive.Size)
+}
@@ -0,0 +1,458 @@
+package pagemanager
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"net/url"
+
+	"github.com/bokwoon95/pagemanager/erro"
+	"github.com/bokwoon95/pagemanager/hy"
+	"github.com/bokwoon95/pagemanager/hyforms"
+	"github.com/bokwoon95/pagemanager/sq"
+	"github.com/bokwoon95/pagemanager/tpl"
+)
+
+const (
+	inputUserAction      = "pm-user-action"
+	inputUserPublicID    = "pm-user-public-id"
+	inputUserLoginID     = "pm-user-login-id"
+	inputUserPassword    = "pm-user-password"
+	inputUserEmail       = "pm-user-email"
+	inputUserDisplayname = "pm-user-displayname"
+	inputUserData        = "pm-user-data"
+	inputUserDisabled    = "pm-user-disabled"
+
+	userActionCreate      = "create" // creates a user, with an invite password if Password is empty
+	userActionEdit        = "edit"   // updates the user, and the password if Password is not empty
+	userActionSetPassword = "set-password"
+	userActionDisable     = "disable"
+	userActionEnable      = "enable"
+	userActionDelete      = "delete"
+)
+
+var errUnknownUserAction = errors.New("unknown user action")
+
+// userRequest is a change to the users. It is filled in from the forms on
+// URLManageUsers, or decoded from the body of a JSON request to it e.g.
+//
+//	POST /pm-manage-users
+//	Content-Type: application/json
+//	X-CSRF-Token: <the hyforms.csrf input of the forms on the page>
+//
+//	{"Action": "create", "LoginID": "alice", "Email": "alice@example.com"}
+//
+// Users other than the one being created are identified by PublicUserID.
+type userRequest struct {
+	Action       string
+	PublicUserID string
+	LoginID      string
+	Password     string
+	Email        string
+	Displayname  string
+	UserData     map[string]interface{}
+	Disabled     bool
+
+	invitePassword string // set by apply if a user was created without a password
+}
+
+func (req *userRequest) apply(ctx context.Context, db sq.Queryer) error {
+	switch req.Action {
+	case userActionCreate:
+		password := req.Password
+		if password == "" {
+			var err error
+			password, err = newInvitePassword()
+			if err != nil {
+				return erro.Wrap(err)
+			}
+			req.invitePassword = password
+		}
+		user, err := createUser(ctx, db, User{
+			LoginID:     req.LoginID,
+			Email:       req.Email,
+			Displayname: req.Displayname,
+			UserData:    req.UserData,
+			Disabled:    req.Disabled,
+		}, password)
+		if err != nil {
+			return err
+		}
+		req.PublicUserID = user.PublicUserID
+		return nil
+	case userActionSetPassword:
+		return setUserPassword(ctx, db, req.PublicUserID, req.Password)
+	case userActionDisable:
+		return setUserDisabled(ctx, db, req.PublicUserID, true)
+	case userActionEnable:
+		return setUserDisabled(ctx, db, req.PublicUserID, false)
+	case userActionDelete:
+		return deleteUser(ctx, db, req.PublicUserID)
+	case userActionEdit:
+		err := updateUser(ctx, db, User{
+			PublicUserID: req.PublicUserID,
+			LoginID:      req.LoginID,
+			Email:        req.Email,
+			Displayname:  req.Displayname,
+			UserData:     req.UserData,
+		})
+		if err != nil {
+			return err
+		}
+		if req.Password != "" {
+			err = setUserPassword(ctx, db, req.PublicUserID, req.Password)
+			if err != nil {
+				return err
+			}
+		}
+		return setUserDisabled(ctx, db, req.PublicUserID, req.Disabled)
+	}
+	return fmt.Errorf("%w %q", errUnknownUserAction, req.Action)
+}
+
+// applyUserRequest applies req in a transaction.
+func (pm *PageManager) applyUserRequest(ctx context.Context, req *userRequest) error {
+	return sq.WithTxContext(ctx, pm.dataDB, nil, func(tx *sql.Tx) error {
+		return req.apply(ctx, tx)
+	})
+}
+
+// userErrStatus returns the HTTP status code that a user request error should
+// be reported with.
+func userErrStatus(err error) int {
+	switch {
+	case err == nil:
+		return http.StatusOK
+	case errors.Is(err, ErrUserNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrInvalidLoginID), errors.Is(err, ErrLoginIDExists),
+		errors.Is(err, ErrInvalidEmail), errors.Is(err, errUnknownUserAction):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// userErrInput returns the input that a user request error is reported on.
+func userErrInput(err error) string {
+	switch {
+	case errors.Is(err, ErrInvalidLoginID), errors.Is(err, ErrLoginIDExists):
+		return inputUserLoginID
+	case errors.Is(err, ErrInvalidEmail):
+		return inputUserEmail
+	}
+	return inputUserPublicID
+}
+
+type manageUsersData struct {
+	w      http.ResponseWriter `json:"-"`
+	r      *http.Request       `json:"-"`
+	Users  []User
+	Edit   User // the user selected for editing with ?pm-user=public_user_id
+	Invite struct {
+		LoginID  string
+		Password string
+	} // the invite password of the user that was just created
+
+	req userRequest // set by the form callbacks on POST
+}
+
+func (data *manageUsersData) LogoutForm() (template.HTML, error) {
+	return logoutForm(data.w, data.r)
+}
+
+func (data *manageUsersData) UsersList() (template.HTML, error) {
+	if len(data.Users) == 0 {
+		return hy.Marshal(hy.H("div.mv2.gray", nil, hy.Txt(msg(data.r, "manage_users.no_users"))))
+	}
+	var els hy.Elements
+	for _, user := range data.Users {
+		div := hy.H("div.mv2", nil)
+		header := hy.H("div", nil, hy.Txt(user.LoginID))
+		if user.Displayname != "" {
+			header.Append("span", nil, hy.Txt(" (", user.Displayname, ")"))
+		}
+		if user.Disabled {
+			header.Append("span.b.red", nil, hy.Txt(" ", msg(data.r, "manage_users.disabled")))
+		}
+		editURL := LocaleURL(data.r, URLManageUsers+"?"+queryparamUser+"="+url.QueryEscape(user.PublicUserID))
+		header.Append("a.ml2", hy.Attr{"href": editURL}, hy.Txt(msg(data.r, "manage_users.edit")))
+		div.AppendElements(header)
+		if user.Email != "" && user.EmailVerified {
+			div.Append("div.f6.gray", nil, hy.Txt(user.Email))
+		} else if user.Email != "" {
+			div.Append("div.f6.gray", nil, hy.Txt(user.Email), hy.H("span.i", nil, hy.Txt(" ", msg(data.r, "manage_users.unverified"))))
+		}
+		els.AppendElements(div)
+	}
+	return hy.Marshal(els)
+}
+
+func (data *manageUsersData) CreateForm() (template.HTML, error) {
+	return hyforms.MarshalForm(data.w, data.r, data.createFormCallback)
+}
+
+func (data *manageUsersData) EditForm() (template.HTML, error) {
+	if !data.Edit.Valid {
+		return "", nil
+	}
+	return hyforms.MarshalForm(data.w, data.r, data.editFormCallback)
+}
+
+func (data *manageUsersData) DeleteForm() (template.HTML, error) {
+	if len(data.Users) == 0 {
+		return "", nil
+	}
+	return hyforms.MarshalForm(data.w, data.r, data.deleteFormCallback)
+}
+
+// appendErrMsgs appends the error messages of an input to the form, to be
+// displayed below the input.
+func appendErrMsgs(form *hyforms.Form, errMsgs []string) {
+	for _, errMsg := range errMsgs {
+		form.Append("div.f7.red", nil, hy.Txt(errMsg))
+	}
+}
+
+func (data *manageUsersData) createFormCallback(form *hyforms.Form) {
+	r := form.Request()
+	form.Set("#pm-create-user", hy.Attr{"method": "POST"})
+	action := form.Hidden(inputUserAction, userActionCreate)
+	loginID := form.Text(inputUserLoginID, "").Set("#pm-create-user-login-id.pa2", nil)
+	password := form.Input("password", inputUserPassword, "").Set("#pm-create-user-password.pa2", hy.Attr{"autocomplete": "new-password"})
+	email := form.Input("email", inputUserEmail, "").Set("#pm-create-user-email.pa2", nil)
+	displayname := form.Text(inputUserDisplayname, "").Set("#pm-create-user-displayname.pa2", nil)
+	form.AppendElements(action)
+	form.Append("div.mt3.mb1", nil, hy.H("label.pointer", hy.Attr{"for": loginID.ID()}, hy.Txt(msg(r, "manage_users.login_id"))))
+	form.Append("div", nil, loginID)
+	appendErrMsgs(form, loginID.ErrMsgs())
+	form.Append("div.mt3.mb1", nil, hy.H("label.pointer", hy.Attr{"for": password.ID()}, hy.Txt(msg(r, "manage_users.password"))))
+	form.Append("div", nil, password)
+	form.Append("div.mt1.f6.gray", nil, hy.Txt(msg(r, "manage_users.password_hint")))
+	form.Append("div.mt3.mb1", nil, hy.H("label.pointer", hy.Attr{"for": email.ID()}, hy.Txt(msg(r, "manage_users.email"))))
+	form.Append("div", nil, email)
+	appendErrMsgs(form, email.ErrMsgs())
+	form.Append("div.mt3.mb1", nil, hy.H("label.pointer", hy.Attr{"for": displayname.ID()}, hy.Txt(msg(r, "manage_users.displayname"))))
+	form.Append("div", nil, displayname)
+	form.Append("div.mt3", nil, hy.H("button.pointer.pa2.bg-white", hy.Attr{"type": "submit"}, hy.Txt(msg(r, "manage_users.create"))))
+
+	form.Unmarshal(func() {
+		data.req = userRequest{
+			Action:      userActionCreate,
+			LoginID:     loginID.Validate(hyforms.Required).Value(),
+			Password:    password.Value(),
+			Email:       email.Value(),
+			Displayname: displayname.Value(),
+		}
+	})
+}
+
+func (data *manageUsersData) editFormCallback(form *hyforms.Form) {
+	r := form.Request()
+	form.Set("#pm-edit-user", hy.Attr{"method": "POST"})
+	var userData string
+	if len(data.Edit.UserData) > 0 {
+		b, _ := json.MarshalIndent(data.Edit.UserData, "", "  ")
+		userData = string(b)
+	}
+	action := form.Hidden(inputUserAction, userActionEdit)
+	publicID := form.Hidden(inputUserPublicID, data.Edit.PublicUserID)
+	loginID := form.Text(inputUserLoginID, data.Edit.LoginID).Set("#pm-edit-user-login-id.pa2", nil)
+	password := form.Input("password", inputUserPassword, "").Set("#pm-edit-user-password.pa2", hy.Attr{"autocomplete": "new-password"})
+	email := form.Input("email", inputUserEmail, data.Edit.Email).Set("#pm-edit-user-email.pa2", nil)
+	displayname := form.Text(inputUserDisplayname, data.Edit.Displayname).Set("#pm-edit-user-displayname.pa2", nil)
+	userDataInput := form.Textarea(inputUserData, userData).Set("#pm-edit-user-data.pa2.w-100.code", hy.Attr{"rows": "6"})
+	disabled := form.Checkbox(inputUserDisabled, "", data.Edit.Disabled).Set("#pm-edit-user-disabled.pointer", nil)
+	form.AppendElements(action, publicID)
+	appendErrMsgs(form, publicID.ErrMsgs())
+	form.Append("div.mt3.mb1", nil, hy.H("label.pointer", hy.Attr{"for": loginID.ID()}, hy.Txt(msg(r, "manage_users.login_id"))))
+	form.Append("div", nil, loginID)
+	appendErrMsgs(form, loginID.ErrMsgs())
+	form.Append("div.mt3.mb1", nil, hy.H("label.pointer", hy.Attr{"for": password.ID()}, hy.Txt(msg(r, "manage_users.new_password"))))
+	form.Append("div", nil, password)
+	form.Append("div.mt1.f6.gray", nil, hy.Txt(msg(r, "manage_users.new_password_hint")))
+	form.Append("div.mt3.mb1", nil, hy.H("label.pointer", hy.Attr{"for": email.ID()}, hy.Txt(msg(r, "manage_users.email"))))
+	form.Append("div", nil, email)
+	appendErrMsgs(form, email.ErrMsgs())
+	form.Append("div.mt3.mb1", nil, hy.H("label.pointer", hy.Attr{"for": displayname.ID()}, hy.Txt(msg(r, "manage_users.displayname"))))
+	form.Append("div", nil, displayname)
+	form.Append("div.mt3.mb1", nil, hy.H("label.pointer", hy.Attr{"for": userDataInput.ID()}, hy.Txt(msg(r, "manage_users.user_data"))))
+	form.Append("div", nil, userDataInput)
+	appendErrMsgs(form, userDataInput.ErrMsgs())
+	form.Append("div.mt3", nil, hy.H("label.pointer", hy.Attr{"for": disabled.ID()}, disabled, hy.Txt(" ", msg(r, "manage_users.disable"))))
+	form.Append("div.mt1.f6.gray", nil, hy.Txt(msg(r, "manage_users.disable_hint")))
+	form.Append("div.mt3", nil, hy.H("button.pointer.pa2.bg-white", hy.Attr{"type": "submit"}, hy.Txt(msg(r, "manage_users.save"))))
+
+	form.Unmarshal(func() {
+		data.req = userRequest{
+			Action:       userActionEdit,
+			PublicUserID: publicID.Value(),
+			LoginID:      loginID.Validate(hyforms.Required).Value(),
+			Password:     password.Value(),
+			Email:        email.Value(),
+			Displayname:  displayname.Value(),
+			Disabled:     disabled.Checked(),
+		}
+		if s := userDataInput.Value(); s != "" {
+			err := json.Unmarshal([]byte(s), &data.req.UserData)
+			if err != nil || data.req.UserData == nil {
+				form.AddInputErrMsgs(userDataInput.Name(), ErrInvalidUserData.Error())
+			}
+		}
+	})
+}
+
+func (data *manageUsersData) deleteFormCallback(form *hyforms.Form) {
+	r := form.Request()
+	form.Set("#pm-delete-user", hy.Attr{"method": "POST"})
+	action := form.Hidden(inputUserAction, userActionDelete)
+	var opts hyforms.Options
+	for _, user := range data.Users {
+		opts.Append(hyforms.Option{Value: user.PublicUserID, Display: user.LoginID})
+	}
+	publicID := form.Select(inputUserPublicID, opts).Set("#pm-delete-user-public-id.pa2", nil)
+	form.AppendElements(action)
+	form.Append("div.mt3.mb1", nil, hy.H("label.pointer", hy.Attr{"for": publicID.ID()}, hy.Txt(msg(r, "manage_users.user"))))
+	form.Append("div", nil, publicID)
+	appendErrMsgs(form, publicID.ErrMsgs())
+	form.Append("div.mt1.f6.gray", nil, hy.Txt(msg(r, "manage_users.delete_hint")))
+	form.Append("div.mt3", nil, hy.H("button.pointer.pa2.bg-white", hy.Attr{"type": "submit"}, hy.Txt(msg(r, "manage_users.delete"))))
+
+	form.Unmarshal(func() {
+		data.req = userRequest{
+			Action:       userActionDelete,
+			PublicUserID: publicID.Value(),
+		}
+	})
+}
+
+func (pm *PageManager) manageUsers(w http.ResponseWriter, r *http.Request) {
+	data := &manageUsersData{w: w, r: r}
+	user, _ := pm.getUser(w, r)
+	switch {
+	case !user.Valid:
+		pm.RedirectToLogin(w, r)
+		return
+	case !user.Permissions[permissionManageUsers]:
+		pm.Forbidden(w, r)
+		return
+	}
+	var err error
+	data.Users, err = getUsers(r.Context(), pm.dataDB)
+	if err != nil {
+		pm.InternalServerError(w, r, erro.Wrap(err))
+		return
+	}
+	switch r.Method {
+	case "GET":
+		editID := r.FormValue(queryparamUser)
+		for _, user := range data.Users {
+			if editID != "" && user.PublicUserID == editID {
+				data.Edit = user
+			}
+		}
+		err = pm.tpl.Render(w, r, data, tpl.Files("manage_users.html"))
+		if err != nil {
+			pm.InternalServerError(w, r, erro.Wrap(err))
+			return
+		}
+	case "POST":
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" {
+			pm.manageUsersJSON(w, r)
+			return
+		}
+		var errMsgs hyforms.ValidationErrMsgs
+		var ok bool
+		redirectURL := r.URL.Path
+		switch r.FormValue(inputUserAction) {
+		case userActionCreate:
+			errMsgs, ok = hyforms.UnmarshalForm(w, r, data.createFormCallback)
+		case userActionEdit:
+			errMsgs, ok = hyforms.UnmarshalForm(w, r, data.editFormCallback)
+			redirectURL += "?" + queryparamUser + "=" + url.QueryEscape(r.FormValue(inputUserPublicID))
+		case userActionDelete:
+			errMsgs, ok = hyforms.UnmarshalForm(w, r, data.deleteFormCallback)
+		default:
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		if !ok {
+			hyforms.Redirect(w, r, LocaleURL(r, redirectURL), errMsgs)
+			return
+		}
+		err = pm.applyUserRequest(r.Context(), &data.req)
+		switch userErrStatus(err) {
+		case http.StatusOK:
+		case http.StatusInternalServerError:
+			pm.InternalServerError(w, r, erro.Wrap(err))
+			return
+		default:
+			errMsgs.InputErrMsgs[userErrInput(err)] = []string{err.Error()}
+			hyforms.Redirect(w, r, LocaleURL(r, redirectURL), errMsgs)
+			return
+		}
+		if data.req.invitePassword != "" {
+			// The invite password is shown once in the response itself, so
+			// that it is never stored in a cookie or a cache.
+			data.Invite.LoginID = data.req.LoginID
+			data.Invite.Password = data.req.invitePassword
+			data.Users, err = getUsers(r.Context(), pm.dataDB)
+			if err != nil {
+				pm.InternalServerError(w, r, erro.Wrap(err))
+				return
+			}
+			w.Header().Set("Cache-Control", "no-store")
+			err = pm.tpl.Render(w, r, data, tpl.Files("manage_users.html"))
+			if err != nil {
+				pm.InternalServerError(w, r, erro.Wrap(err))
+			}
+			return
+		}
+		Redirect(w, r, redirectURL)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// manageUsersJSON applies a JSON encoded userRequest and responds with the
+// resulting users, or with the error if the request failed. Users created
+// without a password are responded to with their invite password.
+func (pm *PageManager) manageUsersJSON(w http.ResponseWriter, r *http.Request) {
+	var req userRequest
+	err := hyforms.VerifyCSRFToken(r)
+	if err != nil {
+		writeJSON(w, http.StatusForbidden, map[string]string{"Error": err.Error()})
+		return
+	}
+	err = json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"Error": err.Error()})
+		return
+	}
+	err = pm.applyUserRequest(r.Context(), &req)
+	switch status := userErrStatus(err); status {
+	case http.StatusOK:
+		users, err := getUsers(r.Context(), pm.dataDB)
+		if err != nil {
+			pm.InternalServerError(w, r, erro.Wrap(err))
+			return
+		}
+		resp := map[string]interface{}{"Users": users}
+		if req.Action == userActionCreate {
+			resp["PublicUserID"] = req.PublicUserID
+		}
+		if req.invitePassword != "" {
+			resp["InvitePassword"] = req.invitePassword
+			w.Header().Set("Cache-Control", "no-store")
+		}
+		writeJSON(w, status, resp)
+	case http.StatusInternalServerError:
+		pm.InternalServerError(w, r, erro.Wrap(err))
+	default:
+		writeJSON(w, status, map[string]string{"Error": err.Error()})
+	}
+}
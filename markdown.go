@@ -0,0 +1,93 @@
+package pagemanager
+
+import (
+	"bytes"
+	"html/template"
+	"strings"
+
+	"github.com/bokwoon95/pagemanager/erro"
+	"github.com/bokwoon95/pagemanager/hy"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+var markdownLocaleCodeKey = parser.NewContextKey()
+
+// markdown renders CommonMark with the table and footnote extensions. Raw HTML
+// in the source is omitted and links with dangerous URLs (such as javascript:)
+// are emptied, as the renderer is not configured with html.WithUnsafe.
+var markdown = goldmark.New(
+	goldmark.WithExtensions(extension.Table, extension.Footnote),
+	goldmark.WithParserOptions(
+		parser.WithASTTransformers(util.Prioritized(localeLinkTransformer{}, 100)),
+	),
+)
+
+// localeLinkTransformer prefixes the locale code to root-relative links, the
+// same way LocaleURL does. Links to pagemanager's own files (/pm-themes/,
+// /pm-images/ etc) are left alone as they are not localized.
+type localeLinkTransformer struct{}
+
+func (localeLinkTransformer) Transform(node *ast.Document, reader text.Reader, pc parser.Context) {
+	localeCode, _ := pc.Get(markdownLocaleCodeKey).(string)
+	if localeCode == "" {
+		return
+	}
+	_ = ast.Walk(node, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		link, ok := n.(*ast.Link)
+		if !ok {
+			return ast.WalkContinue, nil
+		}
+		dest := string(link.Destination)
+		if strings.HasPrefix(dest, "/") && !strings.HasPrefix(dest, "//") && !strings.HasPrefix(dest, "/pm-") {
+			link.Destination = []byte(localeURL(localeCode, dest))
+		}
+		return ast.WalkContinue, nil
+	})
+}
+
+// renderMarkdown converts Markdown to HTML. If localeCode is not empty,
+// root-relative links are prefixed with it.
+func renderMarkdown(src []byte, localeCode string) (template.HTML, error) {
+	buf := bufpool.Get().(*bytes.Buffer)
+	defer func() {
+		buf.Reset()
+		bufpool.Put(buf)
+	}()
+	pc := parser.NewContext()
+	pc.Set(markdownLocaleCodeKey, localeCode)
+	err := markdown.Convert(src, buf, parser.WithContext(pc))
+	if err != nil {
+		return "", erro.Wrap(err)
+	}
+	return template.HTML(buf.String()), nil
+}
+
+// md is the template function that renders Markdown, e.g. {{ md `# Title` }}.
+// Links are not localized, use pmMarkdown for that.
+func md(v interface{}) (template.HTML, error) {
+	return renderMarkdown(markdownSource(v), "")
+}
+
+// pmMarkdown is the template function that renders Markdown with root-relative
+// links localized to the page's locale, e.g. {{ pmMarkdown $ $body }}.
+func pmMarkdown(pg PageData, v interface{}, opts ...PageDataOption) (template.HTML, error) {
+	for _, opt := range opts {
+		opt(&pg)
+	}
+	return renderMarkdown(markdownSource(v), pg.LocaleCode)
+}
+
+func markdownSource(v interface{}) []byte {
+	if v == nil {
+		return nil
+	}
+	return []byte(hy.Stringify(v))
+}
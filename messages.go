@@ -0,0 +1,54 @@
+package pagemanager
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/bokwoon95/pagemanager/hyforms"
+	"github.com/bokwoon95/pagemanager/msgcat"
+)
+
+// messages is the message catalog of the built-in UI, loaded from the
+// messages directory by New. Messages missing from a locale fall back to
+// English.
+var messages *msgcat.Catalog
+
+// msg returns the message for key in the locale of the request.
+func msg(r *http.Request, key string, args ...interface{}) string {
+	if messages == nil {
+		return key
+	}
+	return messages.Message(LocaleCode(r), key, args...)
+}
+
+// msgN returns the plural form of the message for key that matches n in the
+// locale of the request.
+func msgN(r *http.Request, key string, n int, args ...interface{}) string {
+	if messages == nil {
+		return key
+	}
+	return messages.Plural(LocaleCode(r), key, n, args...)
+}
+
+// errMsgTranslator translates hyforms error messages with the messages keyed
+// "hyforms.<Tag>" e.g. "hyforms.RequiredErrMsg". Error messages without a
+// message keep their default text.
+func errMsgTranslator(localeCode string) hyforms.ErrMsgTranslator {
+	return func(errMsg string, args ...interface{}) string {
+		var tag, text string
+		if i := strings.IndexByte(errMsg, ']'); strings.HasPrefix(errMsg, "[") && i > 0 {
+			tag, text = errMsg[1:i], strings.TrimSpace(errMsg[i+1:])
+		} else {
+			text = errMsg
+		}
+		key := "hyforms." + tag
+		if tag != "" && messages != nil && messages.Has(localeCode, key) {
+			return messages.Message(localeCode, key, args...)
+		}
+		for _, arg := range args {
+			text += fmt.Sprintf(" %v", arg)
+		}
+		return text
+	}
+}
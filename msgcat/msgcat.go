@@ -0,0 +1,184 @@
+// Package msgcat implements message catalogs: translated messages looked up
+// by locale code and key, with plural forms.
+package msgcat
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// Catalog holds the messages of one or more languages. A catalog is loaded
+// from a directory of JSON files named after their locale code, e.g. en.json
+// or de-CH.json. Each file maps keys to either a message, or an object of
+// plural forms keyed by plural category:
+//
+//	{
+//	    "login.title": "PageManager Login",
+//	    "pages.count": {"one": "%d page", "other": "%d pages"}
+//	}
+//
+// Messages are fmt format strings.
+type Catalog struct {
+	fallback string                        // the locale code used when a message is missing
+	messages map[string]map[string]message // locale code => key => message
+}
+
+type message struct {
+	text   string
+	plural map[string]string // plural category => text
+}
+
+func (m *message) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, &m.text); err == nil {
+		return nil
+	}
+	return json.Unmarshal(b, &m.plural)
+}
+
+// Load loads every .json file in dir of fsys into a catalog. Messages missing
+// from a locale are looked up in the fallback locale.
+func Load(fsys fs.FS, dir string, fallback string) (*Catalog, error) {
+	c := &Catalog{
+		fallback: strings.ToLower(fallback),
+		messages: make(map[string]map[string]message),
+	}
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || path.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		b, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		messages := make(map[string]message)
+		err = json.Unmarshal(b, &messages)
+		if err != nil {
+			return nil, fmt.Errorf("msgcat: %s: %w", entry.Name(), err)
+		}
+		localeCode := strings.ToLower(strings.TrimSuffix(entry.Name(), ".json"))
+		c.messages[localeCode] = messages
+	}
+	return c, nil
+}
+
+// lookup returns the message for key in the closest locale to localeCode: the
+// locale itself, then its parents (de-CH-1996, de-CH, de) and finally the
+// fallback locale.
+func (c *Catalog) lookup(localeCode, key string) (message, bool) {
+	for code := strings.ToLower(localeCode); code != ""; {
+		if m, ok := c.messages[code][key]; ok {
+			return m, true
+		}
+		i := strings.LastIndexByte(code, '-')
+		if i < 0 {
+			break
+		}
+		code = code[:i]
+	}
+	m, ok := c.messages[c.fallback][key]
+	return m, ok
+}
+
+// Has reports whether the catalog has a message for key in localeCode or the
+// fallback locale.
+func (c *Catalog) Has(localeCode, key string) bool {
+	_, ok := c.lookup(localeCode, key)
+	return ok
+}
+
+// Message returns the message for key formatted with args. If there is no such
+// message, the key itself is returned.
+func (c *Catalog) Message(localeCode, key string, args ...interface{}) string {
+	m, ok := c.lookup(localeCode, key)
+	if !ok {
+		return key
+	}
+	text := m.text
+	if m.plural != nil {
+		text = m.plural["other"]
+	}
+	return format(text, args)
+}
+
+// Plural returns the plural form of the message for key that matches the
+// count n, formatted with n followed by args.
+func (c *Catalog) Plural(localeCode, key string, n int, args ...interface{}) string {
+	m, ok := c.lookup(localeCode, key)
+	if !ok {
+		return key
+	}
+	args = append([]interface{}{n}, args...)
+	if m.plural == nil {
+		return format(m.text, args)
+	}
+	text, ok := m.plural[PluralCategory(localeCode, n)]
+	if !ok {
+		text = m.plural["other"]
+	}
+	return format(text, args)
+}
+
+func format(text string, args []interface{}) string {
+	if len(args) == 0 {
+		return text
+	}
+	return fmt.Sprintf(text, args...)
+}
+
+// PluralCategory returns the CLDR plural category ("one", "few", "many" or
+// "other") of the count n in the language of localeCode. Languages without
+// plural rules here use the English rule.
+func PluralCategory(localeCode string, n int) string {
+	language := strings.ToLower(localeCode)
+	if i := strings.IndexByte(language, '-'); i >= 0 {
+		language = language[:i]
+	}
+	if n < 0 {
+		n = -n
+	}
+	mod10, mod100 := n%10, n%100
+	switch language {
+	case "ja", "ko", "zh", "th", "vi", "id", "ms":
+		return "other"
+	case "fr", "pt":
+		if n == 0 || n == 1 {
+			return "one"
+		}
+		return "other"
+	case "ru", "uk", "be":
+		switch {
+		case mod10 == 1 && mod100 != 11:
+			return "one"
+		case mod10 >= 2 && mod10 <= 4 && (mod100 < 12 || mod100 > 14):
+			return "few"
+		}
+		return "many"
+	case "pl":
+		switch {
+		case n == 1:
+			return "one"
+		case mod10 >= 2 && mod10 <= 4 && (mod100 < 12 || mod100 > 14):
+			return "few"
+		}
+		return "many"
+	case "cs", "sk":
+		switch {
+		case n == 1:
+			return "one"
+		case n >= 2 && n <= 4:
+			return "few"
+		}
+		return "other"
+	}
+	if n == 1 {
+		return "one"
+	}
+	return "other"
+}
@@ -0,0 +1,57 @@
+package msgcat
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/bokwoon95/pagemanager/testutil"
+)
+
+func Test_Catalog(t *testing.T) {
+	fsys := fstest.MapFS{
+		"messages/en.json": {Data: []byte(`{
+			"hello": "Hello %s",
+			"pages": {"one": "%d page", "other": "%d pages"},
+			"only.en": "English only"
+		}`)},
+		"messages/de.json": {Data: []byte(`{
+			"hello": "Hallo %s",
+			"pages": {"one": "%d Seite", "other": "%d Seiten"}
+		}`)},
+		"messages/de-ch.json": {Data: []byte(`{"hello": "Grüezi %s"}`)},
+		"messages/ru.json":    {Data: []byte(`{"pages": {"one": "%d страница", "few": "%d страницы", "many": "%d страниц"}}`)},
+		"messages/README":     {Data: []byte(`not a catalog`)},
+	}
+	c, err := Load(fsys, "messages", "en")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Run("lookup", func(t *testing.T) {
+		is := testutil.New(t, testutil.Parallel)
+		is.Equal("Hello Bob", c.Message("", "hello", "Bob"))
+		is.Equal("Hallo Bob", c.Message("de", "hello", "Bob"))
+		is.Equal("Grüezi Bob", c.Message("de-CH", "hello", "Bob"))
+		is.Equal("Hallo Bob", c.Message("de-AT", "hello", "Bob"))
+		is.Equal("English only", c.Message("de-CH", "only.en"))
+		is.Equal("missing.key", c.Message("de", "missing.key"))
+		is.True(c.Has("de", "only.en"))
+		is.True(!c.Has("de", "missing.key"))
+	})
+	t.Run("plural", func(t *testing.T) {
+		is := testutil.New(t, testutil.Parallel)
+		is.Equal("1 page", c.Plural("en", "pages", 1))
+		is.Equal("0 pages", c.Plural("en", "pages", 0))
+		is.Equal("2 Seiten", c.Plural("de-CH", "pages", 2))
+		is.Equal("21 страница", c.Plural("ru", "pages", 21))
+		is.Equal("3 страницы", c.Plural("ru", "pages", 3))
+		is.Equal("11 страниц", c.Plural("ru", "pages", 11))
+	})
+	t.Run("plural categories", func(t *testing.T) {
+		is := testutil.New(t, testutil.Parallel)
+		is.Equal("one", PluralCategory("fr", 0))
+		is.Equal("other", PluralCategory("en", 0))
+		is.Equal("few", PluralCategory("pl", 22))
+		is.Equal("many", PluralCategory("pl", 12))
+		is.Equal("other", PluralCategory("ja", 1))
+	})
+}
@@ -0,0 +1,372 @@
+package pagemanager
+
+import (
+	"crypto/subtle"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bokwoon95/pagemanager/erro"
+	"github.com/bokwoon95/pagemanager/hy"
+	"github.com/bokwoon95/pagemanager/hyforms"
+	"github.com/bokwoon95/pagemanager/oidc"
+	"github.com/bokwoon95/pagemanager/sq"
+	"github.com/bokwoon95/pagemanager/tables"
+	"github.com/bokwoon95/pagemanager/tpl"
+)
+
+const oauthFlowMaxAge = 10 * time.Minute
+
+// oauthFlow is a login at an identity provider that is in progress. It is
+// kept in a signed cookie between sending the user to the provider and the
+// provider sending them back to URLOAuthCallback.
+type oauthFlow struct {
+	Provider   string
+	State      string
+	Nonce      string
+	Verifier   string // PKCE code verifier
+	LinkUserID int64  // if not 0, the identity is linked to this user instead of logged in with
+	Expires    time.Time
+}
+
+// redirectURL returns the URL that the provider sends users back to, which is
+// URLOAuthCallback on the pm-base-url unless the provider has a RedirectURL.
+func (provider *identityProvider) redirectURL() (string, error) {
+	if provider.RedirectURL != "" {
+		return provider.RedirectURL, nil
+	}
+	base, err := baseURL()
+	if err != nil {
+		return "", err
+	}
+	return base + URLOAuthCallback, nil
+}
+
+// startOAuthFlow sends the user to log in at the provider. If linkUserID is
+// not 0 the identity that they log in as is linked to that user.
+func (pm *PageManager) startOAuthFlow(w http.ResponseWriter, r *http.Request, provider *identityProvider, linkUserID int64) error {
+	flow := oauthFlow{
+		Provider:   provider.Name,
+		LinkUserID: linkUserID,
+		Expires:    time.Now().Add(oauthFlowMaxAge),
+	}
+	var err error
+	for _, s := range []*string{&flow.State, &flow.Nonce} {
+		*s, err = oidc.NewState()
+		if err != nil {
+			return erro.Wrap(err)
+		}
+	}
+	flow.Verifier, err = oidc.NewVerifier()
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	redirectURL, err := provider.redirectURL()
+	if err != nil {
+		return err
+	}
+	authURL, err := provider.client.AuthCodeURL(r.Context(), redirectURL, flow.State, flow.Nonce, flow.Verifier)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	// The provider sends the user back with a top level GET, which still
+	// carries SameSite=Lax cookies.
+	err = hyforms.SetCookieValue(w, cookieOAuthFlow, flow, &http.Cookie{
+		MaxAge:   int(oauthFlowMaxAge / time.Second),
+		HttpOnly: true,
+		Secure:   *flagSecureCookies || r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	http.Redirect(w, r, authURL, http.StatusFound)
+	return nil
+}
+
+// oauthLogin sends the user to log in at the identity provider named by the
+// provider query parameter.
+func (pm *PageManager) oauthLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	provider, ok := pm.getIdentityProvider(r.URL.Query().Get("provider"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	err := pm.startOAuthFlow(w, r, provider, 0)
+	if err != nil {
+		log.Printf("starting login with %s: %v", provider.Name, err)
+		hyforms.Redirect(w, r, LocaleURL(r, URLLogin), hyforms.ValidationErrMsgs{
+			FormErrMsgs: []string{ErrOAuthLoginFailed.Error()},
+		})
+	}
+}
+
+// oauthCallback is where identity providers send users back to after they
+// log in. It checks the state against the oauthFlow cookie, exchanges the
+// code for the user's claims and then logs in as or links the identity.
+func (pm *PageManager) oauthCallback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	var flow oauthFlow
+	_ = hyforms.GetCookieValue(w, r, cookieOAuthFlow, &flow)
+	failURL := LocaleURL(r, URLLogin)
+	if flow.LinkUserID != 0 {
+		failURL = LocaleURL(r, URLIdentities)
+	}
+	fail := func(err error) {
+		errMsg := ErrOAuthLoginFailed.Error()
+		if errors.Is(err, ErrIdentityNotLinked) || errors.Is(err, ErrIdentityLinked) || errors.Is(err, ErrUserDisabled) {
+			errMsg = err.Error()
+		} else {
+			log.Printf("logging in with %s: %v", flow.Provider, err)
+		}
+		hyforms.Redirect(w, r, failURL, hyforms.ValidationErrMsgs{FormErrMsgs: []string{errMsg}})
+	}
+	query := r.URL.Query()
+	if flow.State == "" || time.Now().After(flow.Expires) ||
+		subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(flow.State)) != 1 {
+		fail(errors.New("state does not match the login that was started"))
+		return
+	}
+	if query.Get("error") != "" {
+		fail(errors.New(query.Get("error") + ": " + query.Get("error_description")))
+		return
+	}
+	provider, ok := pm.getIdentityProvider(flow.Provider)
+	if !ok {
+		fail(ErrInvalidIdentityProvider)
+		return
+	}
+	callbackURL, err := provider.redirectURL()
+	if err != nil {
+		fail(err)
+		return
+	}
+	token, err := provider.client.Exchange(r.Context(), callbackURL, query.Get("code"), flow.Verifier)
+	if err != nil {
+		fail(err)
+		return
+	}
+	claims, err := provider.client.Claims(r.Context(), token, flow.Nonce)
+	if err != nil {
+		fail(err)
+		return
+	}
+	ident, err := provider.externalIdentity(claims)
+	if err != nil {
+		fail(err)
+		return
+	}
+	if flow.LinkUserID != 0 {
+		// Only link to the user who started linking, in case the session
+		// changed in between, and never on the strength of an API token.
+		user, _ := pm.getUser(w, r)
+		if !user.Valid || user.apiTokenHash != "" || user.UserID != flow.LinkUserID {
+			fail(errors.New("logged in as a different user than the one linking"))
+			return
+		}
+		err = linkIdentity(r.Context(), pm.dataDB, user.UserID, ident)
+		if err != nil {
+			fail(err)
+			return
+		}
+		_ = hyforms.SetCookieValue(w, cookieFlash, msg(r, "identities.linked", provider.DisplayName), &http.Cookie{HttpOnly: true, MaxAge: 60})
+		Redirect(w, r, URLIdentities)
+		return
+	}
+	userID, err := pm.loginWithIdentity(r.Context(), provider, ident)
+	if err != nil {
+		fail(err)
+		return
+	}
+	var user User
+	USERS := tables.NEW_USERS(r.Context(), "u")
+	_, err = sq.FetchContext(r.Context(), pm.dataDB, sq.SQLite.
+		From(USERS).
+		Where(USERS.USER_ID.EqInt64(userID)),
+		user.RowMapper(USERS),
+	)
+	if err != nil {
+		pm.InternalServerError(w, r, erro.Wrap(err))
+		return
+	}
+	if user.Disabled {
+		fail(ErrUserDisabled)
+		return
+	}
+	if user.TOTPEnabled {
+		err = pm.setPendingLogin(w, r, userID)
+		if err != nil {
+			fail(err)
+			return
+		}
+		Redirect(w, r, URLLoginTwoFactor)
+		return
+	}
+	err = pm.newSession(w, r, userID, nil)
+	if err != nil {
+		pm.InternalServerError(w, r, erro.Wrap(err))
+		return
+	}
+	var redirectURL string
+	_ = hyforms.GetCookieValue(w, r, cookieLoginRedirect, &redirectURL)
+	if redirectURL != "" {
+		Redirect(w, r, redirectURL)
+		return
+	}
+	Redirect(w, r, URLDashboard)
+}
+
+const (
+	inputIdentityAction = "pm-identity-action"
+
+	identityActionLink   = "link"
+	identityActionUnlink = "unlink"
+)
+
+type identitiesData struct {
+	w          http.ResponseWriter `json:"-"`
+	r          *http.Request       `json:"-"`
+	Identities []UserIdentity
+	Providers  []*identityProvider // that the user can link
+	Notice     string
+
+	action   string // set by the form callback on POST
+	provider string // set by the form callback on POST
+	subject  string // set by the form callback on POST
+}
+
+func (data *identitiesData) LogoutForm() (template.HTML, error) {
+	return logoutForm(data.w, data.r)
+}
+
+func (data *identitiesData) Form() (template.HTML, error) {
+	return hyforms.MarshalForm(data.w, data.r, data.formCallback)
+}
+
+func (data *identitiesData) formCallback(form *hyforms.Form) {
+	const timeFormat = "2006-01-02 15:04 MST"
+	form.Set("#pm-identities", hy.Attr{"method": "POST"})
+	for _, errMsg := range form.ErrMsgs() {
+		form.Append("div.red", nil, hy.Txt(errMsg))
+	}
+	displayNames := make(map[string]string)
+	for _, provider := range data.Providers {
+		displayNames[provider.Name] = provider.DisplayName
+	}
+	for _, identity := range data.Identities {
+		div := hy.H("div.mv3", nil)
+		name := displayNames[identity.Provider]
+		if name == "" {
+			name = identity.Provider
+		}
+		header := hy.H("div", nil, hy.Txt(name))
+		if identity.Email != "" {
+			header.Append("span.gray", nil, hy.Txt(" (", identity.Email, ")"))
+		}
+		div.AppendElements(header)
+		div.Append("div.f6.gray", nil, hy.Txt(msg(data.r, "identities.linked_at",
+			identity.CreatedAt.Local().Format(timeFormat),
+			identity.LastLoginAt.Local().Format(timeFormat),
+		)))
+		div.Append("button.pointer.pa1.mt1.bg-white", hy.Attr{
+			"type":  "submit",
+			"name":  inputIdentityAction,
+			"value": identityActionUnlink + ":" + identity.Provider + ":" + identity.Subject,
+		}, hy.Txt(msg(data.r, "identities.unlink")))
+		form.AppendElements(div)
+	}
+	for _, provider := range data.Providers {
+		form.Append("div.mt3", nil, hy.H("button.pointer.pa2.bg-white", hy.Attr{
+			"type":  "submit",
+			"name":  inputIdentityAction,
+			"value": identityActionLink + ":" + provider.Name,
+		}, hy.Txt(msg(data.r, "identities.link", provider.DisplayName))))
+	}
+
+	form.Unmarshal(func() {
+		data.action, data.provider, data.subject = parseIdentityAction(form.Request().FormValue(inputIdentityAction))
+	})
+}
+
+// parseIdentityAction splits the value of an identities page button, which is
+// "link:<provider>" or "unlink:<provider>:<subject>".
+func parseIdentityAction(value string) (action, provider, subject string) {
+	parts := strings.SplitN(value, ":", 3)
+	switch {
+	case len(parts) == 2 && parts[0] == identityActionLink:
+		return parts[0], parts[1], ""
+	case len(parts) == 3 && parts[0] == identityActionUnlink:
+		return parts[0], parts[1], parts[2]
+	}
+	return "", "", ""
+}
+
+// identities is where users see the identities at identity providers that
+// they can log in with, and link and unlink them.
+func (pm *PageManager) identities(w http.ResponseWriter, r *http.Request) {
+	data := &identitiesData{w: w, r: r}
+	user, ok := pm.requireCookieSession(w, r)
+	if !ok {
+		return
+	}
+	if user.UserID != 1 {
+		data.Providers = pm.getIdentityProviders()
+	}
+	var err error
+	data.Identities, err = getUserIdentities(r.Context(), pm.dataDB, user.UserID)
+	if err != nil {
+		pm.InternalServerError(w, r, erro.Wrap(err))
+		return
+	}
+	switch r.Method {
+	case "GET":
+		_ = hyforms.GetCookieValue(w, r, cookieFlash, &data.Notice)
+		err = pm.tpl.Render(w, r, data, tpl.Files("identities.html"))
+		if err != nil {
+			pm.InternalServerError(w, r, erro.Wrap(err))
+			return
+		}
+	case "POST":
+		errMsgs, ok := hyforms.UnmarshalForm(w, r, data.formCallback)
+		if !ok {
+			hyforms.Redirect(w, r, LocaleURL(r, r.URL.Path), errMsgs)
+			return
+		}
+		switch data.action {
+		case identityActionLink:
+			provider, ok := pm.getIdentityProvider(data.provider)
+			if !ok || user.UserID == 1 {
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				return
+			}
+			err = pm.startOAuthFlow(w, r, provider, user.UserID)
+			if err != nil {
+				log.Printf("starting to link %s: %v", provider.Name, err)
+				errMsgs.FormErrMsgs = append(errMsgs.FormErrMsgs, ErrOAuthLoginFailed.Error())
+				hyforms.Redirect(w, r, LocaleURL(r, r.URL.Path), errMsgs)
+			}
+			return
+		case identityActionUnlink:
+			err = unlinkIdentity(r.Context(), pm.dataDB, user.UserID, data.provider, data.subject)
+			if err != nil {
+				pm.InternalServerError(w, r, erro.Wrap(err))
+				return
+			}
+			Redirect(w, r, r.URL.Path)
+		default:
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		}
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,577 @@
+// Package oidc is a client for logging in with an OAuth2 or OpenID Connect
+// provider: the authorization code flow with PKCE, and validation of OIDC ID
+// tokens against the provider's JSON Web Key Set. It supports the RS256 and
+// ES256 signing algorithms.
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrMissingEndpoint = errors.New("provider endpoint not configured")
+	ErrInvalidIDToken  = errors.New("invalid ID token")
+	ErrNoClaims        = errors.New("provider returned neither an ID token nor a userinfo endpoint")
+)
+
+// Leeway is how much clock skew between us and the provider is tolerated
+// when checking the times in an ID token.
+const Leeway = time.Minute
+
+// jwksMinRefresh limits how often the key set is fetched again because an ID
+// token was signed with an unknown key.
+const jwksMinRefresh = time.Minute
+
+// Provider is the configuration of an identity provider. Endpoints that are
+// left empty are discovered from the Issuer's
+// /.well-known/openid-configuration. Without an Issuer the provider is treated
+// as plain OAuth2, and the user's claims come from the UserInfoURL.
+type Provider struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	AuthURL      string
+	TokenURL     string
+	UserInfoURL  string
+	JWKSURL      string
+	Scopes       []string // defaults to openid, email and profile if there is an Issuer
+	// ClientSecretInBody sends the client secret in the token request body
+	// instead of with HTTP basic authentication, for providers that need it.
+	ClientSecretInBody bool
+}
+
+// Client talks to a Provider. It is safe for concurrent use.
+type Client struct {
+	provider   Provider
+	httpClient *http.Client
+
+	mu            sync.Mutex
+	discovered    bool
+	keys          map[string]crypto.PublicKey // key ID => key
+	keysFetchedAt time.Time
+}
+
+// NewClient returns a client for provider. A nil httpClient uses
+// http.DefaultClient.
+func NewClient(provider Provider, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &Client{provider: provider, httpClient: httpClient}
+}
+
+// Claims are the claims about a user from an ID token or userinfo endpoint.
+type Claims map[string]interface{}
+
+// String returns the claim name as a string, formatting numbers (as some
+// providers use for user IDs) without a fraction.
+func (c Claims) String(name string) string {
+	switch v := c[name].(type) {
+	case string:
+		return v
+	case float64:
+		return new(big.Float).SetFloat64(v).Text('f', -1)
+	case json.Number:
+		return v.String()
+	}
+	return ""
+}
+
+// Bool returns the claim name as a bool, accepting "true" as some providers
+// send booleans as strings.
+func (c Claims) Bool(name string) bool {
+	switch v := c[name].(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true"
+	}
+	return false
+}
+
+// Strings returns the claim name as a list of strings. A string claim is split
+// on spaces, as is done for the scope claim.
+func (c Claims) Strings(name string) []string {
+	switch v := c[name].(type) {
+	case string:
+		return strings.Fields(v)
+	case []interface{}:
+		var values []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// Token is the response of the token endpoint.
+type Token struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	IDToken     string `json:"id_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+func randomString() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// NewState returns a random value for the state or nonce of a login.
+func NewState() (string, error) {
+	return randomString()
+}
+
+// NewVerifier returns a random PKCE code verifier.
+func NewVerifier() (string, error) {
+	return randomString()
+}
+
+// Challenge returns the S256 PKCE code challenge of verifier.
+func Challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Discover fills in the endpoints that are not configured from the Issuer's
+// OpenID configuration. It only fetches the configuration once.
+func (c *Client) Discover(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.discovered || c.provider.Issuer == "" {
+		return nil
+	}
+	p := &c.provider
+	if p.AuthURL != "" && p.TokenURL != "" && p.JWKSURL != "" {
+		c.discovered = true
+		return nil
+	}
+	var config struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		UserinfoEndpoint      string `json:"userinfo_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+	}
+	err := c.getJSON(ctx, strings.TrimSuffix(p.Issuer, "/")+"/.well-known/openid-configuration", "", &config)
+	if err != nil {
+		return fmt.Errorf("discovering %s: %w", p.Issuer, err)
+	}
+	if config.Issuer != p.Issuer {
+		return fmt.Errorf("discovering %s: configuration is for issuer %q", p.Issuer, config.Issuer)
+	}
+	if p.AuthURL == "" {
+		p.AuthURL = config.AuthorizationEndpoint
+	}
+	if p.TokenURL == "" {
+		p.TokenURL = config.TokenEndpoint
+	}
+	if p.UserInfoURL == "" {
+		p.UserInfoURL = config.UserinfoEndpoint
+	}
+	if p.JWKSURL == "" {
+		p.JWKSURL = config.JWKSURI
+	}
+	c.discovered = true
+	return nil
+}
+
+func (c *Client) endpoints() Provider {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.provider
+}
+
+// AuthCodeURL returns the URL to send the user to to log in at the provider.
+// The nonce is only used by OIDC providers.
+func (c *Client) AuthCodeURL(ctx context.Context, redirectURL, state, nonce, verifier string) (string, error) {
+	err := c.Discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	p := c.endpoints()
+	if p.AuthURL == "" {
+		return "", fmt.Errorf("%w: AuthURL", ErrMissingEndpoint)
+	}
+	scopes := p.Scopes
+	if len(scopes) == 0 && p.Issuer != "" {
+		scopes = []string{"openid", "email", "profile"}
+	}
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", p.ClientID)
+	query.Set("redirect_uri", redirectURL)
+	query.Set("state", state)
+	query.Set("code_challenge", Challenge(verifier))
+	query.Set("code_challenge_method", "S256")
+	if len(scopes) > 0 {
+		query.Set("scope", strings.Join(scopes, " "))
+	}
+	if p.Issuer != "" {
+		query.Set("nonce", nonce)
+	}
+	sep := "?"
+	if strings.Contains(p.AuthURL, "?") {
+		sep = "&"
+	}
+	return p.AuthURL + sep + query.Encode(), nil
+}
+
+// Exchange exchanges the authorization code that the provider redirected back
+// with for a token, proving with verifier that this client started the login.
+func (c *Client) Exchange(ctx context.Context, redirectURL, code, verifier string) (Token, error) {
+	var token Token
+	err := c.Discover(ctx)
+	if err != nil {
+		return token, err
+	}
+	p := c.endpoints()
+	if p.TokenURL == "" {
+		return token, fmt.Errorf("%w: TokenURL", ErrMissingEndpoint)
+	}
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", redirectURL)
+	form.Set("code_verifier", verifier)
+	form.Set("client_id", p.ClientID)
+	if p.ClientSecretInBody && p.ClientSecret != "" {
+		form.Set("client_secret", p.ClientSecret)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", p.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return token, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if !p.ClientSecretInBody && p.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+	err = c.doJSON(req, &token)
+	if err != nil {
+		return token, fmt.Errorf("exchanging code: %w", err)
+	}
+	if token.AccessToken == "" {
+		return token, fmt.Errorf("exchanging code: no access token in response")
+	}
+	return token, nil
+}
+
+// Claims returns the claims about the user that token belongs to. For OIDC
+// providers the ID token is validated against nonce, and the userinfo
+// endpoint is asked for the claims that the ID token does not have.
+func (c *Client) Claims(ctx context.Context, token Token, nonce string) (Claims, error) {
+	p := c.endpoints()
+	var claims Claims
+	if p.Issuer != "" {
+		if token.IDToken == "" {
+			return nil, fmt.Errorf("%w: no ID token in response", ErrInvalidIDToken)
+		}
+		var err error
+		claims, err = c.VerifyIDToken(ctx, token.IDToken, nonce)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if p.UserInfoURL == "" {
+		if claims == nil {
+			return nil, ErrNoClaims
+		}
+		return claims, nil
+	}
+	var userinfo Claims
+	err := c.getJSON(ctx, p.UserInfoURL, token.AccessToken, &userinfo)
+	if err != nil {
+		return nil, fmt.Errorf("fetching userinfo: %w", err)
+	}
+	if claims == nil {
+		return userinfo, nil
+	}
+	// The userinfo must be about the same user as the ID token.
+	if userinfo.String("sub") != claims.String("sub") {
+		return nil, fmt.Errorf("fetching userinfo: subject %q does not match the ID token's %q", userinfo.String("sub"), claims.String("sub"))
+	}
+	for name, value := range userinfo {
+		if _, ok := claims[name]; !ok {
+			claims[name] = value
+		}
+	}
+	return claims, nil
+}
+
+// VerifyIDToken checks the signature, issuer, audience, expiry and nonce of
+// an ID token and returns its claims.
+func (c *Client) VerifyIDToken(ctx context.Context, rawIDToken, nonce string) (Claims, error) {
+	parts := strings.Split(rawIDToken, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed", ErrInvalidIDToken)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	err := decodeSegment(parts[0], &header)
+	if err != nil {
+		return nil, fmt.Errorf("%w: header: %v", ErrInvalidIDToken, err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: signature: %v", ErrInvalidIDToken, err)
+	}
+	key, err := c.publicKey(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	err = verifySignature(header.Alg, key, parts[0]+"."+parts[1], signature)
+	if err != nil {
+		return nil, err
+	}
+	var claims Claims
+	err = decodeSegment(parts[1], &claims)
+	if err != nil {
+		return nil, fmt.Errorf("%w: claims: %v", ErrInvalidIDToken, err)
+	}
+	err = c.validateClaims(claims, nonce, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (c *Client) validateClaims(claims Claims, nonce string, now time.Time) error {
+	p := c.endpoints()
+	if claims.String("iss") != p.Issuer {
+		return fmt.Errorf("%w: issuer %q", ErrInvalidIDToken, claims.String("iss"))
+	}
+	audiences := claims.Strings("aud")
+	found := false
+	for _, aud := range audiences {
+		if aud == p.ClientID {
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("%w: audience %q", ErrInvalidIDToken, audiences)
+	}
+	if len(audiences) > 1 && claims.String("azp") != p.ClientID {
+		return fmt.Errorf("%w: authorized party %q", ErrInvalidIDToken, claims.String("azp"))
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return fmt.Errorf("%w: no expiry", ErrInvalidIDToken)
+	}
+	if now.Add(-Leeway).After(time.Unix(int64(exp), 0)) {
+		return fmt.Errorf("%w: expired", ErrInvalidIDToken)
+	}
+	if iat, ok := claims["iat"].(float64); ok && now.Add(Leeway).Before(time.Unix(int64(iat), 0)) {
+		return fmt.Errorf("%w: issued in the future", ErrInvalidIDToken)
+	}
+	if subtle.ConstantTimeCompare([]byte(claims.String("nonce")), []byte(nonce)) != 1 {
+		return fmt.Errorf("%w: nonce", ErrInvalidIDToken)
+	}
+	if claims.String("sub") == "" {
+		return fmt.Errorf("%w: no subject", ErrInvalidIDToken)
+	}
+	return nil
+}
+
+func verifySignature(alg string, key crypto.PublicKey, signingInput string, signature []byte) error {
+	digest := sha256.Sum256([]byte(signingInput))
+	switch alg {
+	case "RS256":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("%w: RS256 signature with a non RSA key", ErrInvalidIDToken)
+		}
+		if rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], signature) != nil {
+			return fmt.Errorf("%w: signature", ErrInvalidIDToken)
+		}
+		return nil
+	case "ES256":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || pub.Curve != elliptic.P256() || len(signature) != 64 {
+			return fmt.Errorf("%w: ES256 signature with a non P-256 key", ErrInvalidIDToken)
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(pub, digest[:], r, s) {
+			return fmt.Errorf("%w: signature", ErrInvalidIDToken)
+		}
+		return nil
+	default:
+		// Notably "none" and the HMAC algorithms, which would let anyone who
+		// knows the key set forge tokens.
+		return fmt.Errorf("%w: unsupported algorithm %q", ErrInvalidIDToken, alg)
+	}
+}
+
+// publicKey returns the key with ID kid from the provider's key set, fetching
+// the key set again if the key is not known yet since providers rotate keys.
+func (c *Client) publicKey(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if key, ok := c.lookupKey(kid); ok {
+		return key, nil
+	}
+	if !c.keysFetchedAt.IsZero() && time.Since(c.keysFetchedAt) < jwksMinRefresh {
+		return nil, fmt.Errorf("%w: unknown key %q", ErrInvalidIDToken, kid)
+	}
+	if c.provider.JWKSURL == "" {
+		return nil, fmt.Errorf("%w: JWKSURL", ErrMissingEndpoint)
+	}
+	var jwks struct {
+		Keys []jwk `json:"keys"`
+	}
+	err := c.getJSON(ctx, c.provider.JWKSURL, "", &jwks)
+	if err != nil {
+		return nil, fmt.Errorf("fetching key set: %w", err)
+	}
+	c.keys = make(map[string]crypto.PublicKey)
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			continue
+		}
+		c.keys[k.Kid] = key
+	}
+	c.keysFetchedAt = time.Now()
+	if key, ok := c.lookupKey(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%w: unknown key %q", ErrInvalidIDToken, kid)
+}
+
+// lookupKey finds the key with ID kid. Tokens without a key ID can only be
+// verified if the key set has a single key.
+func (c *Client) lookupKey(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(c.keys) == 1 {
+		for _, key := range c.keys {
+			return key, true
+		}
+	}
+	key, ok := c.keys[kid]
+	return key, ok
+}
+
+// jwk is a JSON Web Key, RFC 7517.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, fmt.Errorf("point not on curve")
+		}
+		return pub, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+func decodeSegment(segment string, dest interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, dest)
+}
+
+func (c *Client) getJSON(ctx context.Context, url, accessToken string, dest interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+	return c.doJSON(req, dest)
+}
+
+// doJSON sends req and decodes the JSON response into dest, turning OAuth2
+// error responses into errors.
+func (c *Client) doJSON(req *http.Request, dest interface{}) error {
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var oauthErr struct {
+			Error            string `json:"error"`
+			ErrorDescription string `json:"error_description"`
+		}
+		if json.Unmarshal(b, &oauthErr) == nil && oauthErr.Error != "" {
+			return fmt.Errorf("%s: %s %s", resp.Status, oauthErr.Error, oauthErr.ErrorDescription)
+		}
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return json.Unmarshal(b, dest)
+}
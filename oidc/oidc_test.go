@@ -0,0 +1,221 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bokwoon95/pagemanager/testutil"
+)
+
+// fakeProvider is a minimal OIDC provider that issues a code for any login,
+// and checks the PKCE verifier and client secret when the code is exchanged.
+type fakeProvider struct {
+	server    *httptest.Server
+	rsaKey    *rsa.PrivateKey
+	ecKey     *ecdsa.PrivateKey
+	alg       string
+	claims    map[string]interface{}
+	challenge string // of the last authorization request
+}
+
+func b64(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+func newFakeProvider(t *testing.T) *fakeProvider {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp := &fakeProvider{rsaKey: rsaKey, ecKey: ecKey, alg: "RS256"}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 fp.server.URL,
+			"authorization_endpoint": fp.server.URL + "/authorize",
+			"token_endpoint":         fp.server.URL + "/token",
+			"userinfo_endpoint":      fp.server.URL + "/userinfo",
+			"jwks_uri":               fp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{
+			{"kty": "RSA", "kid": "rsa", "use": "sig", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+			{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(ecKey.X.Bytes()), "y": b64(ecKey.Y.Bytes())},
+		}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		clientID, clientSecret, _ := r.BasicAuth()
+		if clientID != "client" || clientSecret != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+			return
+		}
+		if Challenge(r.PostFormValue("code_verifier")) != fp.challenge || r.PostFormValue("code") != "code" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"id_token":     fp.sign(t, fp.claims),
+		})
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer access" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"sub": fp.claims["sub"], "groups": []string{"editors"}})
+	})
+	fp.server = httptest.NewServer(mux)
+	t.Cleanup(fp.server.Close)
+	return fp
+}
+
+func (fp *fakeProvider) sign(t *testing.T, claims map[string]interface{}) string {
+	kid := "rsa"
+	if fp.alg == "ES256" {
+		kid = "ec"
+	}
+	header, _ := json.Marshal(map[string]string{"alg": fp.alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signingInput := b64(header) + "." + b64(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	var signature []byte
+	switch fp.alg {
+	case "RS256":
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, fp.rsaKey, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	case "ES256":
+		r, s, err := ecdsa.Sign(rand.Reader, fp.ecKey, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	}
+	return signingInput + "." + b64(signature)
+}
+
+func (fp *fakeProvider) validClaims(nonce string) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":   fp.server.URL,
+		"aud":   "client",
+		"sub":   "user-1",
+		"email": "alice@example.com",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"iat":   time.Now().Unix(),
+		"nonce": nonce,
+	}
+}
+
+// login goes through the authorization code flow, with the provider
+// returning the claims set by setup.
+func login(t *testing.T, fp *fakeProvider, setup func(nonce string)) (Claims, error) {
+	is := testutil.New(t)
+	ctx := context.Background()
+	client := NewClient(Provider{Issuer: fp.server.URL, ClientID: "client", ClientSecret: "secret"}, nil)
+	state, err := NewState()
+	is.NoErr(err)
+	nonce, err := NewState()
+	is.NoErr(err)
+	verifier, err := NewVerifier()
+	is.NoErr(err)
+	authURL, err := client.AuthCodeURL(ctx, "http://localhost/callback", state, nonce, verifier)
+	is.NoErr(err)
+	u, err := url.Parse(authURL)
+	is.NoErr(err)
+	query := u.Query()
+	is.Equal(fp.server.URL+"/authorize", u.Scheme+"://"+u.Host+u.Path)
+	is.Equal(state, query.Get("state"))
+	is.Equal("S256", query.Get("code_challenge_method"))
+	is.Equal("openid email profile", query.Get("scope"))
+	fp.challenge = query.Get("code_challenge")
+	fp.claims = fp.validClaims(nonce)
+	if setup != nil {
+		setup(nonce)
+	}
+	token, err := client.Exchange(ctx, "http://localhost/callback", "code", verifier)
+	if err != nil {
+		return nil, err
+	}
+	return client.Claims(ctx, token, nonce)
+}
+
+func Test_Login(t *testing.T) {
+	fp := newFakeProvider(t)
+	for _, alg := range []string{"RS256", "ES256"} {
+		is := testutil.New(t)
+		fp.alg = alg
+		claims, err := login(t, fp, nil)
+		is.NoErr(err)
+		is.Equal("user-1", claims.String("sub"))
+		is.Equal("alice@example.com", claims.String("email"))
+		is.Equal([]string{"editors"}, claims.Strings("groups"))
+	}
+}
+
+func Test_LoginRejected(t *testing.T) {
+	fp := newFakeProvider(t)
+	type TT struct {
+		description string
+		setup       func(nonce string)
+	}
+	tests := []TT{
+		{"wrong nonce", func(nonce string) { fp.claims["nonce"] = "other" }},
+		{"wrong audience", func(nonce string) { fp.claims["aud"] = "someone-else" }},
+		{"wrong issuer", func(nonce string) { fp.claims["iss"] = "https://evil.example.com" }},
+		{"expired", func(nonce string) { fp.claims["exp"] = time.Now().Add(-time.Hour).Unix() }},
+		{"multiple audiences without azp", func(nonce string) { fp.claims["aud"] = []string{"client", "other"} }},
+		{"wrong PKCE verifier", func(nonce string) { fp.challenge = Challenge("other") }},
+		{"unsigned", func(nonce string) { fp.alg = "none" }},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.description, func(t *testing.T) {
+			is := testutil.New(t)
+			fp.alg = "RS256"
+			_, err := login(t, fp, tt.setup)
+			is.True(err != nil)
+		})
+	}
+}
+
+func Test_TamperedIDToken(t *testing.T) {
+	is := testutil.New(t)
+	fp := newFakeProvider(t)
+	client := NewClient(Provider{Issuer: fp.server.URL, ClientID: "client"}, nil)
+	is.NoErr(client.Discover(context.Background()))
+	token := fp.sign(t, fp.validClaims("nonce"))
+	_, err := client.VerifyIDToken(context.Background(), token, "nonce")
+	is.NoErr(err)
+	parts := strings.Split(token, ".")
+	claims := fp.validClaims("nonce")
+	claims["sub"] = "admin"
+	payload, _ := json.Marshal(claims)
+	_, err = client.VerifyIDToken(context.Background(), parts[0]+"."+b64(payload)+"."+parts[2], "nonce")
+	is.True(errors.Is(err, ErrInvalidIDToken))
+}
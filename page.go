@@ -3,9 +3,11 @@ package pagemanager
 import (
 	"context"
 	"database/sql/driver"
+	"encoding/base64"
 	"encoding/json"
-	"fmt"
 	"html/template"
+	"sort"
+	"strings"
 
 	"github.com/bokwoon95/pagemanager/erro"
 	"github.com/bokwoon95/pagemanager/hy"
@@ -14,16 +16,17 @@ import (
 )
 
 type Page struct {
-	Valid        bool
-	URL          string
-	PageType     string
-	Hidden       bool
-	RedirectURL  string
-	PluginName   string
-	HandlerName  string
-	Content      string
-	ThemePath    string
-	TemplateName string
+	Valid         bool
+	URL           string
+	PageType      string
+	Hidden        bool
+	RedirectURL   string
+	PluginName    string
+	HandlerName   string
+	Content       string
+	ContentFormat string
+	ThemePath     string
+	TemplateName  string
 }
 
 func (page *Page) RowMapper(PAGES tables.PM_PAGES) func(*sq.Row) error {
@@ -37,6 +40,7 @@ func (page *Page) RowMapper(PAGES tables.PM_PAGES) func(*sq.Row) error {
 		page.PluginName = row.String(PAGES.PLUGIN_NAME)
 		page.HandlerName = row.String(PAGES.HANDLER_NAME)
 		page.Content = row.String(PAGES.CONTENT)
+		page.ContentFormat = row.String(PAGES.CONTENT_FORMAT)
 		page.ThemePath = row.String(PAGES.THEME_PATH)
 		page.TemplateName = row.String(PAGES.TEMPLATE_NAME)
 		return nil
@@ -49,9 +53,11 @@ type PageData struct {
 	DataID     string
 	LocaleCode string
 	EditMode   string
+	origin     string // scheme://host of the site, for absolute URLs
 	cssAssets  []Asset
 	jsAssets   []Asset
 	csp        map[string][]string
+	nonce      string
 	json       map[string]interface{}
 }
 
@@ -66,11 +72,16 @@ func (pg PageData) CSS() (template.HTML, error) {
 	var els hy.Elements
 	for _, asset := range pg.cssAssets {
 		if asset.Inline {
-			continue // not handling inline assets for now
+			els = append(els, hy.H("style", nil, hy.UnsafeTxt(string(asset.Data))))
+			continue
+		}
+		attrs := hy.Attr{"href": asset.URL()}
+		if integrity := asset.Integrity(); integrity != "" {
+			attrs["integrity"] = integrity
 		}
-		els = append(els, hy.H("link[rel=stylesheet]", hy.Attr{"href": asset.Path}))
+		els = append(els, hy.H("link[rel=stylesheet]", attrs))
 	}
-	return hy.Marshal(els)
+	return hy.CustomMarshal(els, allowAssets)
 }
 
 func (pg PageData) JS() (template.HTML, error) {
@@ -82,15 +93,55 @@ func (pg PageData) JS() (template.HTML, error) {
 	els = append(els, hy.H("script[data-pm-json][type=application/json]", nil, hy.Txt(jsonData)))
 	for _, asset := range pg.jsAssets {
 		if asset.Inline {
+			els = append(els, hy.H("script", nil, hy.UnsafeTxt(string(asset.Data))))
 			continue
 		}
-		els = append(els, hy.H("script", hy.Attr{"src": asset.Path}))
+		attrs := hy.Attr{"src": asset.URL()}
+		if integrity := asset.Integrity(); integrity != "" {
+			attrs["integrity"] = integrity
+		}
+		els = append(els, hy.H("script", attrs))
 	}
-	return hy.Marshal(els)
+	return hy.CustomMarshal(els, allowAssets)
+}
+
+// allowAssets is hy.Allow plus the <style> and <script> tags, which are
+// needed to render the page's own CSS and JS assets.
+func allowAssets(tag, attrName, attrValue string) bool {
+	switch strings.ToLower(tag) {
+	case "style", "script":
+		return true
+	}
+	return hy.Allow(tag, attrName, attrValue)
+}
+
+// inlineAssetHashes returns the CSP hash sources (e.g. 'sha256-...') of the
+// inline assets, sorted.
+func inlineAssetHashes(assets []Asset) []string {
+	b64HashSet := make(map[string]struct{})
+	for _, asset := range assets {
+		if !asset.Inline || asset.Data == nil {
+			continue
+		}
+		b64HashSet[`'sha256-`+base64.StdEncoding.EncodeToString(asset.Hash[:])+`'`] = struct{}{}
+	}
+	b64HashList := make([]string, 0, len(b64HashSet))
+	for b64Hash := range b64HashSet {
+		b64HashList = append(b64HashList, b64Hash)
+	}
+	sort.Strings(b64HashList)
+	return b64HashList
+}
+
+// ContentSecurityPolicy returns the Content-Security-Policy of the page.
+func (pg PageData) ContentSecurityPolicy() string {
+	return serializeCSP(pg.csp)
 }
 
-func (pg PageData) ContentSecurityPolicy() template.HTML {
-	return template.HTML(fmt.Sprint(pg.csp))
+// Nonce returns the CSP nonce of the page. Templates can use it to allow their
+// own inline scripts and styles e.g. <script nonce="{{ $.Page.Nonce }}">.
+func (pg PageData) Nonce() string {
+	return pg.nonce
 }
 
 type PageDataOption func(*PageData)
@@ -104,8 +155,9 @@ func pmDataID(dataID string) PageDataOption {
 }
 
 type NullString struct {
-	Valid bool
-	Str   string
+	Valid      bool
+	Str        string
+	LocaleCode string // the locale that the value came from
 }
 
 // Scan implements the Scanner interface.
@@ -131,10 +183,6 @@ func (ns NullString) String() string {
 	return ns.Str
 }
 
-func safeHTML(v interface{}) template.HTML {
-	return template.HTML(hy.Stringify(v))
-}
-
 func jsonify(v interface{}) string {
 	b, err := json.Marshal(v)
 	if err != nil {
@@ -143,28 +191,58 @@ func jsonify(v interface{}) string {
 	return string(b)
 }
 
+// localeChain returns the locales that values are looked up in for the
+// localeCode, in order: the locale itself, its fallbacks and finally the empty
+// default locale.
+func (pm *PageManager) localeChain(localeCode string) []string {
+	chain := []string{localeCode}
+	if localeCode != "" {
+		pm.localesMutex.RLock()
+		fallbacks := pm.locales[localeCode].Fallbacks
+		pm.localesMutex.RUnlock()
+		for _, fallback := range fallbacks {
+			if fallback != localeCode {
+				chain = append(chain, fallback)
+			}
+		}
+		chain = append(chain, "")
+	}
+	return chain
+}
+
+// localeChainOrder orders PAGEDATA rows by the position of their locale in
+// the chain.
+func localeChainOrder(PAGEDATA tables.PM_PAGEDATA, chain []string) sq.SimpleCases {
+	order := sq.Case(PAGEDATA.LOCALE_CODE)
+	for i, localeCode := range chain {
+		order = order.When(localeCode, i+1)
+	}
+	return order
+}
+
+// pmGetValue is the template function that returns the value of key, looking
+// it up in the page's locale and then its fallback chain. The LocaleCode of
+// the returned NullString is the locale that the value came from.
 func (pm *PageManager) pmGetValue(pg PageData, key string, opts ...PageDataOption) (NullString, error) {
 	for _, opt := range opts {
 		opt(&pg)
 	}
 	var ns NullString
+	chain := pm.localeChain(pg.LocaleCode)
 	PAGEDATA := tables.NEW_PAGEDATA(pg.Ctx, "p")
 	_, err := sq.FetchContext(pg.Ctx, pm.dataDB, sq.SQLite.
 		From(PAGEDATA).
 		Where(
-			PAGEDATA.LOCALE_CODE.In([]string{pg.LocaleCode, ""}),
+			PAGEDATA.LOCALE_CODE.In(chain),
 			PAGEDATA.DATA_ID.EqString(pg.DataID),
 			PAGEDATA.KEY.EqString(key),
 			PAGEDATA.ARRAY_INDEX.IsNull(),
 		).
-		OrderBy(sq.
-			Case(PAGEDATA.LOCALE_CODE).
-			When(pg.LocaleCode, 1).
-			When("", 2),
-		).
+		OrderBy(localeChainOrder(PAGEDATA, chain)).
 		Limit(1),
 		func(row *sq.Row) error {
 			row.ScanInto(&ns, PAGEDATA.VALUE)
+			ns.LocaleCode = row.String(PAGEDATA.LOCALE_CODE)
 			return nil
 		},
 	)
@@ -174,24 +252,48 @@ func (pm *PageManager) pmGetValue(pg PageData, key string, opts ...PageDataOptio
 	return ns, nil
 }
 
-func (pm *PageManager) pmGetRows(pg PageData, key string, opts ...PageDataOption) ([]interface{}, error) {
-	for _, opt := range opts {
-		opt(&pg)
-	}
+// rowsLocale returns the first locale in the page's locale chain that has
+// rows for key.
+func (pm *PageManager) rowsLocale(pg PageData, key string) (localeCode string, ok bool, err error) {
+	chain := pm.localeChain(pg.LocaleCode)
 	PAGEDATA := tables.NEW_PAGEDATA(pg.Ctx, "p")
-	exists, err := sq.ExistsContext(pg.Ctx, pm.dataDB, sq.SQLite.
+	_, err = sq.FetchContext(pg.Ctx, pm.dataDB, sq.SQLite.
 		From(PAGEDATA).
 		Where(
-			PAGEDATA.LOCALE_CODE.EqString(pg.LocaleCode),
+			PAGEDATA.LOCALE_CODE.In(chain),
 			PAGEDATA.DATA_ID.EqString(pg.DataID),
 			PAGEDATA.KEY.EqString(key),
 			PAGEDATA.ARRAY_INDEX.IsNotNull(),
-		),
+		).
+		OrderBy(localeChainOrder(PAGEDATA, chain)).
+		Limit(1),
+		func(row *sq.Row) error {
+			localeCode = row.String(PAGEDATA.LOCALE_CODE)
+			ok = true
+			return nil
+		},
 	)
-	localeCode := pg.LocaleCode
-	if !exists {
-		localeCode = "" // default locale code
+	if err != nil {
+		return "", false, erro.Wrap(err)
+	}
+	return localeCode, ok, nil
+}
+
+// pmGetRows is the template function that returns the rows of key. The rows
+// are taken as a whole from the first locale in the page's locale chain that
+// has any, use pmRowsLocale to find out which locale that is.
+func (pm *PageManager) pmGetRows(pg PageData, key string, opts ...PageDataOption) ([]interface{}, error) {
+	for _, opt := range opts {
+		opt(&pg)
+	}
+	localeCode, ok, err := pm.rowsLocale(pg, key)
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	if !ok {
+		return nil, nil
 	}
+	PAGEDATA := tables.NEW_PAGEDATA(pg.Ctx, "p")
 	var values []interface{}
 	var b []byte
 	_, err = sq.FetchContext(pg.Ctx, pm.dataDB, sq.SQLite.
@@ -223,13 +325,188 @@ func (pm *PageManager) pmGetRows(pg PageData, key string, opts ...PageDataOption
 	return values, nil
 }
 
+// pmRowsLocale is the template function that returns the locale that
+// pmGetRows takes the rows of key from, e.g.
+// {{ if ne (pmRowsLocale $ "items") $.Page.LocaleCode }}(untranslated){{ end }}.
+func (pm *PageManager) pmRowsLocale(pg PageData, key string, opts ...PageDataOption) (string, error) {
+	for _, opt := range opts {
+		opt(&pg)
+	}
+	localeCode, _, err := pm.rowsLocale(pg, key)
+	if err != nil {
+		return "", erro.Wrap(err)
+	}
+	return localeCode, nil
+}
+
+// pmHreflang is the template function that renders a <link rel="alternate"
+// hreflang> tag for every locale that the page's DATA_ID has data in, e.g.
+// {{ pmHreflang $ }} inside <head>. Data that is not in any locale is linked
+// as the x-default alternate.
+func (pm *PageManager) pmHreflang(pg PageData, opts ...PageDataOption) (template.HTML, error) {
+	for _, opt := range opts {
+		opt(&pg)
+	}
+	PAGEDATA := tables.NEW_PAGEDATA(pg.Ctx, "p")
+	var localeCodes []string
+	_, err := sq.FetchContext(pg.Ctx, pm.dataDB, sq.SQLite.
+		SelectDistinct().
+		From(PAGEDATA).
+		Where(PAGEDATA.DATA_ID.EqString(pg.DataID)).
+		OrderBy(PAGEDATA.LOCALE_CODE),
+		func(row *sq.Row) error {
+			localeCode := row.String(PAGEDATA.LOCALE_CODE)
+			return row.Accumulate(func() error {
+				localeCodes = append(localeCodes, localeCode)
+				return nil
+			})
+		},
+	)
+	if err != nil {
+		return "", erro.Wrap(err)
+	}
+	var els hy.Elements
+	pm.localesMutex.RLock()
+	defer pm.localesMutex.RUnlock()
+	for _, localeCode := range localeCodes {
+		hreflang := localeCode
+		if localeCode == "" {
+			hreflang = "x-default"
+		} else if _, ok := pm.locales[localeCode]; !ok {
+			continue // data left behind by a locale that no longer exists
+		}
+		href := pg.origin + localeURL(localeCode, pg.URL)
+		els.Append("link[rel=alternate]", hy.Attr{"hreflang": hreflang, "href": href})
+	}
+	return hy.Marshal(els)
+}
+
+// getPageData returns the values and rows stored for dataID in exactly the
+// given locale, without falling back to the default locale.
+func (pm *PageManager) getPageData(ctx context.Context, localeCode, dataID string) (values map[string]string, rows map[string][]map[string]interface{}, err error) {
+	values = make(map[string]string)
+	rows = make(map[string][]map[string]interface{})
+	PAGEDATA := tables.NEW_PAGEDATA(ctx, "p")
+	_, err = sq.FetchContext(ctx, pm.dataDB, sq.SQLite.
+		From(PAGEDATA).
+		Where(
+			PAGEDATA.LOCALE_CODE.EqString(localeCode),
+			PAGEDATA.DATA_ID.EqString(dataID),
+		).
+		OrderBy(PAGEDATA.KEY, PAGEDATA.ARRAY_INDEX),
+		func(row *sq.Row) error {
+			key := row.String(PAGEDATA.KEY)
+			arrayIndex := row.NullInt64(PAGEDATA.ARRAY_INDEX)
+			b := row.Bytes(PAGEDATA.VALUE)
+			return row.Accumulate(func() error {
+				if !arrayIndex.Valid {
+					values[key] = string(b)
+					return nil
+				}
+				item := make(map[string]interface{})
+				if err := json.Unmarshal(b, &item); err != nil {
+					return nil // not an object, skip it
+				}
+				rows[key] = append(rows[key], item)
+				return nil
+			})
+		},
+	)
+	if err != nil {
+		return values, rows, erro.Wrap(err)
+	}
+	return values, rows, nil
+}
+
+// setPageValue replaces the value of key for dataID in the given locale. An
+// empty value deletes the key instead, so that it falls back to the default
+// locale again.
+func setPageValue(ctx context.Context, db sq.Queryer, localeCode, dataID, key, value string) error {
+	PAGEDATA := tables.NEW_PAGEDATA(ctx, "p")
+	_, _, err := sq.ExecContext(ctx, db, sq.SQLite.
+		DeleteFrom(PAGEDATA).
+		Where(
+			PAGEDATA.LOCALE_CODE.EqString(localeCode),
+			PAGEDATA.DATA_ID.EqString(dataID),
+			PAGEDATA.KEY.EqString(key),
+			PAGEDATA.ARRAY_INDEX.IsNull(),
+		), 0,
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	if value == "" {
+		return nil
+	}
+	_, _, err = sq.ExecContext(ctx, db, sq.SQLite.
+		InsertInto(PAGEDATA).
+		Valuesx(func(col *sq.Column) error {
+			col.SetString(PAGEDATA.LOCALE_CODE, localeCode)
+			col.SetString(PAGEDATA.DATA_ID, dataID)
+			col.SetString(PAGEDATA.KEY, key)
+			col.Set(PAGEDATA.VALUE, value)
+			return nil
+		}), 0,
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	return nil
+}
+
+// setPageRows replaces the rows of key for dataID in the given locale. Each
+// row is stored as a JSON object, in the order given.
+func setPageRows(ctx context.Context, db sq.Queryer, localeCode, dataID, key string, rows []map[string]interface{}) error {
+	PAGEDATA := tables.NEW_PAGEDATA(ctx, "p")
+	_, _, err := sq.ExecContext(ctx, db, sq.SQLite.
+		DeleteFrom(PAGEDATA).
+		Where(
+			PAGEDATA.LOCALE_CODE.EqString(localeCode),
+			PAGEDATA.DATA_ID.EqString(dataID),
+			PAGEDATA.KEY.EqString(key),
+			PAGEDATA.ARRAY_INDEX.IsNotNull(),
+		), 0,
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	_, _, err = sq.ExecContext(ctx, db, sq.SQLite.
+		InsertInto(PAGEDATA).
+		Valuesx(func(col *sq.Column) error {
+			for i, row := range rows {
+				b, err := json.Marshal(row)
+				if err != nil {
+					return erro.Wrap(err)
+				}
+				col.SetString(PAGEDATA.LOCALE_CODE, localeCode)
+				col.SetString(PAGEDATA.DATA_ID, dataID)
+				col.SetString(PAGEDATA.KEY, key)
+				col.Set(PAGEDATA.VALUE, string(b))
+				col.SetInt(PAGEDATA.ARRAY_INDEX, i)
+			}
+			return nil
+		}), 0,
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	return nil
+}
+
 func (pm *PageManager) funcmap() map[string]interface{} {
 	return map[string]interface{}{
-		"jsonify":    jsonify,
-		"safeHTML":   safeHTML,
-		"pmGetValue": pm.pmGetValue,
-		"pmGetRows":  pm.pmGetRows,
-		"pmLocale":   pmLocale,
-		"pmDataID":   pmDataID,
+		"jsonify":      jsonify,
+		"safeHTML":     pm.safeHTML,
+		"pmGetValue":   pm.pmGetValue,
+		"pmGetRows":    pm.pmGetRows,
+		"pmRowsLocale": pm.pmRowsLocale,
+		"pmLocale":     pmLocale,
+		"pmDataID":     pmDataID,
+		"md":           md,
+		"pmMarkdown":   pmMarkdown,
+		"pmHreflang":   pm.pmHreflang,
 	}
 }
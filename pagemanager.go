@@ -2,7 +2,9 @@ package pagemanager
 
 import (
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
@@ -20,6 +22,8 @@ import (
 	"github.com/bokwoon95/pagemanager/encrypthash"
 	"github.com/bokwoon95/pagemanager/erro"
 	"github.com/bokwoon95/pagemanager/hyforms"
+	"github.com/bokwoon95/pagemanager/mailer"
+	"github.com/bokwoon95/pagemanager/msgcat"
 	"github.com/bokwoon95/pagemanager/sq"
 	"github.com/bokwoon95/pagemanager/tables"
 	"github.com/bokwoon95/pagemanager/tpl"
@@ -29,22 +33,28 @@ import (
 const superadminpassword = "lorem ipsum dolor sit amet"
 
 type PageManager struct {
-	privateBoxFlag      int32
-	privateBox          encrypthash.Box
-	publicBox           encrypthash.Box
-	themesMutex         *sync.RWMutex
-	themes              map[string]theme
-	fallbackAssetsIndex map[string]string // asset => theme name
-	datafolder          string
-	superadminfolder    string
-	dataDB              *sql.DB
-	superadminDB        *sql.DB
-	innerEncryptionKey  []byte // key-stretched from user's low-entropy password
-	innerMACKey         []byte // key-stretched from user's low-entropy password
-	localesMutex        *sync.RWMutex
-	locales             map[string]string
-	plugins             map[string]map[string]http.Handler
-	tpl                 tpl.Renderer
+	privateBoxFlag         int32
+	privateBox             encrypthash.Box
+	publicBox              encrypthash.Box
+	csrfFallbackBox        encrypthash.Box // signs CSRF tokens until the boxes are initialized
+	dummyPasswordHash      []byte          // compared against for login IDs that do not exist
+	mailer                 mailer.Mailer
+	identityProvidersMutex *sync.RWMutex
+	identityProviders      map[string]*identityProvider // name => provider
+	themesMutex            *sync.RWMutex
+	themes                 map[string]theme
+	fallbackAssetsIndex    map[string]string // asset => theme name
+	datafolder             string
+	superadminfolder       string
+	dataDB                 *sql.DB
+	superadminDB           *sql.DB
+	innerEncryptionKey     []byte // key-stretched from user's low-entropy password
+	innerMACKey            []byte // key-stretched from user's low-entropy password
+	localesMutex           *sync.RWMutex
+	locales                map[string]Locale // locale code => locale
+	plugins                map[string]map[string]http.Handler
+	sanitizePolicies       map[string]func(tag, attrName, attrValue string) bool // role name => allowlist
+	tpl                    tpl.Renderer
 }
 
 func New() (*PageManager, error) {
@@ -52,7 +62,19 @@ func New() (*PageManager, error) {
 	pm := &PageManager{}
 	pm.themesMutex = &sync.RWMutex{}
 	pm.localesMutex = &sync.RWMutex{}
+	pm.identityProvidersMutex = &sync.RWMutex{}
+	pm.identityProviders = make(map[string]*identityProvider)
 	pm.themes = make(map[string]theme)
+	pm.sanitizePolicies = make(map[string]func(tag, attrName, attrValue string) bool)
+	pm.csrfFallbackBox, err = newCSRFFallbackBox()
+	if err != nil {
+		return pm, erro.Wrap(err)
+	}
+	pm.dummyPasswordHash, err = newDummyPasswordHash()
+	if err != nil {
+		return pm, erro.Wrap(err)
+	}
+	pm.mailer = newMailer()
 	pm.datafolder, err = LocateDataFolder()
 	if err != nil {
 		return pm, erro.Wrap(err)
@@ -61,11 +83,7 @@ func New() (*PageManager, error) {
 	if err != nil {
 		return pm, erro.Wrap(err)
 	}
-	pm.dataDB, err = sql.Open("sqlite3", filepath.Join(pm.datafolder, "database.sqlite3"+
-		"?_journal_mode=WAL"+
-		"&_synchronous=NORMAL"+
-		"&_foreign_keys=on",
-	))
+	pm.dataDB, err = openDataDB(pm.datafolder)
 	if err != nil {
 		return pm, erro.Wrap(err)
 	}
@@ -88,6 +106,11 @@ func New() (*PageManager, error) {
 		tables.NEW_USER_PERMISSIONS(ctx, ""),
 		tables.NEW_ROLE_PERMISSIONS(ctx, ""),
 		tables.NEW_SESSIONS(ctx, ""),
+		tables.NEW_LOGIN_LOCKOUTS(ctx, ""),
+		tables.NEW_RECOVERY_CODES(ctx, ""),
+		tables.NEW_EMAIL_TOKENS(ctx, ""),
+		tables.NEW_USER_IDENTITIES(ctx, ""),
+		tables.NEW_API_TOKENS(ctx, ""),
 		tables.NEW_LOCALES(ctx, ""),
 	)
 	if err != nil {
@@ -112,6 +135,16 @@ func New() (*PageManager, error) {
 	if err != nil {
 		return pm, erro.Wrap(err)
 	}
+	if *flagIdentityProviders != "" {
+		err = pm.loadIdentityProviders(*flagIdentityProviders)
+		if err != nil {
+			return pm, erro.Wrap(err)
+		}
+	}
+	messages, err = msgcat.Load(pagemanagerFS, "messages", "en")
+	if err != nil {
+		return pm, erro.Wrap(err)
+	}
 	pm.tpl = tpl.New(pagemanagerFS,
 		tpl.Files("common.html"),
 		tpl.FuncMap(pm.funcmap()),
@@ -126,6 +159,14 @@ func New() (*PageManager, error) {
 	return pm, nil
 }
 
+func openDataDB(datafolder string) (*sql.DB, error) {
+	return sql.Open("sqlite3", filepath.Join(datafolder, "database.sqlite3"+
+		"?_journal_mode=WAL"+
+		"&_synchronous=NORMAL"+
+		"&_foreign_keys=on",
+	))
+}
+
 func (pm *PageManager) getKeys() (keys [][]byte, err error) {
 	if !pm.boxesInitialized() {
 		return nil, erro.Wrap(fmt.Errorf("lacking superadmin password"))
@@ -150,8 +191,24 @@ func (pm *PageManager) PageManager(next http.Handler) http.Handler {
 	mux.HandleFunc(URLLogout, pm.logout)
 	mux.HandleFunc(URLLogin, pm.login)
 	mux.HandleFunc(URLSuperadminLogin, pm.superadminLogin)
+	mux.HandleFunc(URLLoginTwoFactor, pm.loginTwoFactor)
+	mux.HandleFunc(URLForgotPassword, pm.forgotPassword)
+	mux.HandleFunc(URLResetPassword, pm.resetPassword)
+	mux.HandleFunc(URLOAuthLogin, pm.oauthLogin)
+	mux.HandleFunc(URLOAuthCallback, pm.oauthCallback)
 	mux.HandleFunc(URLDashboard, pm.dashboard)
 	mux.HandleFunc(URLCreatePage, pm.createPage)
+	mux.HandleFunc(URLCSPReport, pm.cspReport)
+	mux.HandleFunc(URLManageThemes, pm.manageThemes)
+	mux.HandleFunc(URLManageLocales, pm.manageLocales)
+	mux.HandleFunc(URLTranslations, pm.translations)
+	mux.HandleFunc(URLManageUsers, pm.manageUsers)
+	mux.HandleFunc(URLManageRoles, pm.manageRoles)
+	mux.HandleFunc(URLSessions, pm.activeSessions)
+	mux.HandleFunc(URLTwoFactor, pm.twoFactorSettings)
+	mux.HandleFunc(URLVerifyEmail, pm.verifyEmail)
+	mux.HandleFunc(URLIdentities, pm.identities)
+	mux.HandleFunc(URLAPITokens, pm.apiTokens)
 	mux.HandleFunc("/pm-test-encrypt", pm.testEncrypt)
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if strings.HasPrefix(r.URL.Path, "/pm-themes/") ||
@@ -160,21 +217,34 @@ func (pm *PageManager) PageManager(next http.Handler) http.Handler {
 			pm.serveFile(w, r, r.URL.Path)
 			return
 		}
+		if *flagNegotiateLocale && r.URL.Path == "/" && (r.Method == "GET" || r.Method == "HEAD") {
+			w.Header().Add("Vary", "Accept-Language, Cookie")
+			if localeCode := pm.negotiateLocale(r); localeCode != "" {
+				redirectURL := "/" + localeCode + "/"
+				if r.URL.RawQuery != "" {
+					redirectURL += "?" + r.URL.RawQuery
+				}
+				http.Redirect(w, r, redirectURL, http.StatusFound)
+				return
+			}
+		}
 		page, localeCode, err := pm.getPage(r.Context(), r.URL.Path)
 		if err != nil {
 			pm.InternalServerError(w, r, erro.Wrap(err))
 			return
 		}
+		if *flagNegotiateLocale && localeCode != "" {
+			rememberLocale(w, r, localeCode)
+		}
 		r2 := &http.Request{} // r2 is like r, but with the localeCode stripped from the URL and injected into the request context
 		*r2 = *r
 		r2 = r2.WithContext(context.WithValue(r2.Context(), ctxKeyLocaleCode, localeCode))
+		r2 = r2.WithContext(hyforms.WithErrMsgTranslator(r2.Context(), errMsgTranslator(localeCode)))
 		r2.URL = &url.URL{}
 		*r2.URL = *r.URL
 		r2.URL.Path = page.URL
-		user, err := pm.getSession(w, r)
-		if err == nil {
-			r2 = r2.WithContext(context.WithValue(r2.Context(), ctxKeyUser, user))
-		}
+		r2 = r2.WithContext(context.WithValue(r2.Context(), ctxKeyUser, &requestUser{}))
+		r2 = r2.WithContext(hyforms.WithCSRFProtector(r2.Context(), &csrfProtector{pm: pm, w: w}))
 		if _, ok := superadminURLs[r2.URL.Path]; ok && !*flagNoSetup {
 			SUPERADMIN := tables.NEW_SUPERADMIN("")
 			superadminExists, _ := sq.Exists(pm.superadminDB, sq.SQLite.From(SUPERADMIN))
@@ -212,7 +282,7 @@ func (pm *PageManager) PageManager(next http.Handler) http.Handler {
 			}
 			handler.ServeHTTP(w, r2)
 		case PageTypeContent:
-			io.WriteString(w, page.Content)
+			pm.serveContent(w, r2, page)
 		case PageTypeRedirect:
 			Redirect(w, r, page.RedirectURL)
 		case PageTypeDisabled:
@@ -227,6 +297,22 @@ func (pm *PageManager) PageManager(next http.Handler) http.Handler {
 	})
 }
 
+// serveContent serves a content page. Markdown content is rendered to HTML
+// with its root-relative links localized. The HTML is sanitized if the
+// -pm-sanitize-on-render flag is set.
+func (pm *PageManager) serveContent(w http.ResponseWriter, r *http.Request, page Page) {
+	content := page.Content
+	if page.ContentFormat == ContentFormatMarkdown {
+		html, err := renderMarkdown([]byte(page.Content), LocaleCode(r))
+		if err != nil {
+			pm.InternalServerError(w, r, erro.Wrap(err))
+			return
+		}
+		content = string(html)
+	}
+	io.WriteString(w, pm.sanitizeOnRender(content))
+}
+
 // TODO: this is the wrong layer of abstraction to handle url query params. Instead the caller of this function should encode the query params into the url itself. A helper `func querifyURL(url string, q url.Values) string` will reduce the boilerplate.
 func LocaleURL(r *http.Request, url string) string {
 	path := url
@@ -237,12 +323,32 @@ func LocaleURL(r *http.Request, url string) string {
 		return path
 	}
 	localeCode, _ := r.Context().Value(ctxKeyLocaleCode).(string)
+	return localeURL(localeCode, path)
+}
+
+// localeURL prefixes path with the localeCode, if any.
+func localeURL(localeCode, path string) string {
 	if localeCode == "" {
 		return path
 	}
 	return "/" + localeCode + path
 }
 
+// requestOrigin returns the scheme and host of the site e.g.
+// https://example.com. It is the pm-base-url flag if it is set, because the
+// Host header can be forged and the scheme is lost behind a TLS-terminating
+// proxy. Otherwise it is what the request was made to.
+func requestOrigin(r *http.Request) string {
+	if base, err := baseURL(); err == nil {
+		return base
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
 func LocaleCode(r *http.Request) string {
 	localeCode, _ := r.Context().Value(ctxKeyLocaleCode).(string)
 	return localeCode
@@ -302,12 +408,20 @@ func (pm *PageManager) RedirectToLogin(w http.ResponseWriter, r *http.Request) {
 func (pm *PageManager) serveFile(w http.ResponseWriter, r *http.Request, name string) {
 	var f fs.File
 	var err error
-	if strings.HasPrefix(r.URL.Path, "/pm-plugins/pagemanager/") {
-		path := strings.TrimPrefix(filepath.Clean(r.URL.Path), "/pm-plugins/pagemanager/")
+	// Content-hashed URLs are served as the unhashed file. Because the URL
+	// changes whenever the content does, the response can be cached forever,
+	// but only if the hash in the URL is the hash of the content served.
+	// Otherwise the URL is stale or made up, and caching it forever would keep
+	// the wrong content around under it.
+	urlHash := strings.TrimPrefix(assetHashRegexp.FindString(r.URL.Path), ".pm-sha256-")
+	urlPath := assetHashRegexp.ReplaceAllString(r.URL.Path, "")
+	name = assetHashRegexp.ReplaceAllString(name, "")
+	if strings.HasPrefix(urlPath, "/pm-plugins/pagemanager/") {
+		path := strings.TrimPrefix(filepath.Clean(urlPath), "/pm-plugins/pagemanager/")
 		f, err = pagemanagerFS.Open(path)
 	}
-	if strings.HasPrefix(r.URL.Path, "/pm-themes/") || strings.HasPrefix(r.URL.Path, "/pm-images/") {
-		path := strings.TrimPrefix(filepath.Clean(r.URL.Path), "/")
+	if strings.HasPrefix(urlPath, "/pm-themes/") || strings.HasPrefix(urlPath, "/pm-images/") {
+		path := strings.TrimPrefix(filepath.Clean(urlPath), "/")
 		if strings.HasSuffix(path, "theme-config.js") || strings.HasSuffix(path, ".html") {
 			http.NotFound(w, r)
 			return
@@ -362,6 +476,22 @@ func (pm *PageManager) serveFile(w http.ResponseWriter, r *http.Request, name st
 		http.NotFound(w, r)
 		return
 	}
+	if urlHash != "" {
+		h := sha256.New()
+		_, err = io.Copy(h, fseeker)
+		if err != nil {
+			pm.InternalServerError(w, r, erro.Wrap(err))
+			return
+		}
+		_, err = fseeker.Seek(0, io.SeekStart)
+		if err != nil {
+			pm.InternalServerError(w, r, erro.Wrap(err))
+			return
+		}
+		if base64.RawURLEncoding.EncodeToString(h.Sum(nil)) == urlHash {
+			w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		}
+	}
 	http.ServeContent(w, r, name, info.ModTime(), fseeker)
 }
 
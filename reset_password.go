@@ -0,0 +1,310 @@
+package pagemanager
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/bokwoon95/pagemanager/erro"
+	"github.com/bokwoon95/pagemanager/hy"
+	"github.com/bokwoon95/pagemanager/hyforms"
+	"github.com/bokwoon95/pagemanager/keyderiv"
+	"github.com/bokwoon95/pagemanager/mailer"
+	"github.com/bokwoon95/pagemanager/sq"
+	"github.com/bokwoon95/pagemanager/tables"
+	"github.com/bokwoon95/pagemanager/tpl"
+)
+
+type forgotPasswordData struct {
+	Email string
+}
+
+func (d *forgotPasswordData) formCallback(form *hyforms.Form) {
+	email := form.
+		Input("email", "pm-email", d.Email).
+		Set("#pm-email.bg-near-white.pa2.w-100", hy.Attr{"required": hy.Enabled, "autocomplete": "email"})
+
+	form.Set(".bg-white.center-form", hy.Attr{"method": "POST"})
+	for _, errMsg := range form.ErrMsgs() {
+		form.Append("div.red", nil, hy.Txt(errMsg))
+	}
+	form.Append("div.mt3.mb1", nil,
+		hy.H("label.pointer", hy.Attr{"for": email.ID()}, hy.Txt(msg(form.Request(), "forgot_password.email"))))
+	form.Append("div", nil, email)
+	if hyforms.ErrMsgsMatch(email.ErrMsgs(), hyforms.RequiredErrMsg) {
+		form.Append("div.f7.red", nil, hy.Txt(msg(form.Request(), "hyforms.RequiredErrMsg")))
+	}
+	form.Append("div.mt3", nil, hy.H("button.pointer.pa2", hy.Attr{"type": "submit"}, hy.Txt(msg(form.Request(), "forgot_password.submit"))))
+
+	form.Unmarshal(func() {
+		d.Email = strings.TrimSpace(email.Validate(hyforms.Required).Value())
+	})
+}
+
+// forgotPassword emails a password reset link to every user with the given
+// email. It responds the same way whether or not any user has that email, so
+// that it cannot be used to find out who has an account.
+func (pm *PageManager) forgotPassword(w http.ResponseWriter, r *http.Request) {
+	type templateData struct {
+		Title       string
+		Header      template.HTML
+		Explanation string
+		Notice      string
+		Form        template.HTML
+	}
+	data := &forgotPasswordData{}
+	var err error
+	switch r.Method {
+	case "GET":
+		tdata := templateData{
+			Title:       msg(r, "forgot_password.title"),
+			Header:      template.HTML(msg(r, "forgot_password.title")),
+			Explanation: msg(r, "forgot_password.explanation"),
+		}
+		_ = hyforms.GetCookieValue(w, r, cookieFlash, &tdata.Notice)
+		tdata.Form, err = hyforms.MarshalForm(w, r, data.formCallback)
+		if err != nil {
+			pm.InternalServerError(w, r, erro.Wrap(err))
+			return
+		}
+		err = pm.tpl.Render(w, r, tdata, tpl.Files("forgot_password.html"))
+		if err != nil {
+			pm.InternalServerError(w, r, erro.Wrap(err))
+			return
+		}
+	case "POST":
+		errMsgs, ok := hyforms.UnmarshalForm(w, r, data.formCallback)
+		if !ok {
+			hyforms.Redirect(w, r, LocaleURL(r, r.URL.Path), errMsgs)
+			return
+		}
+		// Every request counts towards the lockout, so that no one can flood
+		// an inbox with reset emails.
+		lockoutKeys := mailLockoutKeys(r, "reset", strings.ToLower(data.Email))
+		wait, err := reserveLoginAttempt(r.Context(), pm.dataDB, lockoutKeys)
+		if err != nil {
+			pm.InternalServerError(w, r, erro.Wrap(err))
+			return
+		}
+		if wait > 0 {
+			errMsgs.FormErrMsgs = append(errMsgs.FormErrMsgs, msg(r, "forgot_password.too_many_requests", wait))
+			hyforms.Redirect(w, r, LocaleURL(r, r.URL.Path), errMsgs)
+			return
+		}
+		err = pm.sendResetPasswordEmails(r, data.Email)
+		if errors.Is(err, ErrNoBaseURL) {
+			errMsgs.FormErrMsgs = append(errMsgs.FormErrMsgs, err.Error())
+			hyforms.Redirect(w, r, LocaleURL(r, r.URL.Path), errMsgs)
+			return
+		}
+		if err != nil {
+			pm.InternalServerError(w, r, erro.Wrap(err))
+			return
+		}
+		_ = hyforms.SetCookieValue(w, cookieFlash, msg(r, "forgot_password.sent"), &http.Cookie{HttpOnly: true, MaxAge: 60})
+		Redirect(w, r, r.URL.Path)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// sendResetPasswordEmails emails a password reset link to each enabled user
+// with email. The superadmin's password cannot be reset this way because the
+// site's keys are derived from it.
+func (pm *PageManager) sendResetPasswordEmails(r *http.Request, email string) error {
+	if !pm.boxesInitialized() {
+		return ErrBoxesNotInitialized
+	}
+	if _, err := baseURL(); err != nil {
+		return err
+	}
+	type recipient struct {
+		userID  int64
+		loginID string
+		email   string
+	}
+	var recipients []recipient
+	USERS := tables.NEW_USERS(r.Context(), "u")
+	_, err := sq.FetchContext(r.Context(), pm.dataDB, sq.SQLite.
+		From(USERS).
+		Where(
+			sq.Predicatef("lower(?) = lower(?)", USERS.EMAIL, email),
+			USERS.USER_ID.NeInt(1),
+			sq.Predicatef("COALESCE(?, 0) = 0", USERS.DISABLED),
+		),
+		func(row *sq.Row) error {
+			rcpt := recipient{
+				userID:  row.Int64(USERS.USER_ID),
+				loginID: row.String(USERS.LOGIN_ID),
+				email:   row.String(USERS.EMAIL),
+			}
+			return row.Accumulate(func() error {
+				recipients = append(recipients, rcpt)
+				return nil
+			})
+		},
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	for _, rcpt := range recipients {
+		token, err := pm.newEmailToken(r.Context(), pm.dataDB, emailTokenResetPassword, rcpt.userID, rcpt.email, resetPasswordTokenMaxAge)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		link, err := absoluteURL(r, URLResetPassword, url.Values{"token": {token}})
+		if err != nil {
+			return err
+		}
+		pm.sendMailInBackground(mailer.Message{
+			To:      []string{rcpt.email},
+			Subject: msg(r, "reset_password.email_subject"),
+			Body:    msg(r, "reset_password.email_body", rcpt.loginID, link),
+		})
+	}
+	return nil
+}
+
+type resetPasswordData struct {
+	Password        string
+	ConfirmPassword string
+}
+
+func (d *resetPasswordData) formCallback(form *hyforms.Form) {
+	password := form.
+		Input("password", "pm-password", "").
+		Set("#pm-password.bg-near-white.pa2.w-100", hy.Attr{"required": hy.Enabled, "autocomplete": "new-password"})
+	confirmPassword := form.
+		Input("password", "pm-confirm-password", "").
+		Set("#pm-confirm-password.bg-near-white.pa2.w-100", hy.Attr{"required": hy.Enabled, "autocomplete": "new-password"})
+
+	form.Set(".bg-white.center-form", hy.Attr{"method": "POST"})
+	for _, errMsg := range form.ErrMsgs() {
+		form.Append("div.red", nil, hy.Txt(errMsg))
+	}
+	form.Append("div.mt3.mb1", nil,
+		hy.H("label.pointer", hy.Attr{"for": password.ID()}, hy.Txt(msg(form.Request(), "reset_password.password"))))
+	form.Append("div", nil, password)
+	if hyforms.ErrMsgsMatch(password.ErrMsgs(), hyforms.RequiredErrMsg) {
+		form.Append("div.f7.red", nil, hy.Txt(msg(form.Request(), "hyforms.RequiredErrMsg")))
+	}
+	form.Append("div.mt3.mb1", nil,
+		hy.H("label.pointer", hy.Attr{"for": confirmPassword.ID()}, hy.Txt(msg(form.Request(), "reset_password.confirm_password"))))
+	form.Append("div", nil, confirmPassword)
+	if hyforms.ErrMsgsMatch(confirmPassword.ErrMsgs(), hyforms.RequiredErrMsg) {
+		form.Append("div.f7.red", nil, hy.Txt(msg(form.Request(), "hyforms.RequiredErrMsg")))
+	}
+	form.Append("div.mt3", nil, hy.H("button.pointer.pa2", hy.Attr{"type": "submit"}, hy.Txt(msg(form.Request(), "reset_password.submit"))))
+
+	form.Unmarshal(func() {
+		d.Password = password.Validate(hyforms.Required).Value()
+		d.ConfirmPassword = confirmPassword.Validate(hyforms.Required).Value()
+		if d.Password != d.ConfirmPassword {
+			form.AddErrMsgs(ErrPasswordMismatch.Error())
+		}
+	})
+}
+
+// resetPassword sets a new password for the user that the emailed token in
+// the URL belongs to, and logs them out everywhere.
+func (pm *PageManager) resetPassword(w http.ResponseWriter, r *http.Request) {
+	type templateData struct {
+		Title  string
+		Header template.HTML
+		ErrMsg string
+		Form   template.HTML
+	}
+	// Keep the token in the URL from leaking to other sites.
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	data := &resetPasswordData{}
+	token := r.URL.Query().Get("token")
+	currentURL := LocaleURL(r, r.URL.Path) + "?" + url.Values{"token": {token}}.Encode()
+	var err error
+	switch r.Method {
+	case "GET":
+		tdata := templateData{
+			Title:  msg(r, "reset_password.title"),
+			Header: template.HTML(msg(r, "reset_password.title")),
+		}
+		_, err = pm.getEmailToken(r.Context(), pm.dataDB, emailTokenResetPassword, token)
+		switch {
+		case errors.Is(err, ErrInvalidEmailToken), errors.Is(err, ErrBoxesNotInitialized):
+			tdata.ErrMsg = err.Error()
+		case err != nil:
+			pm.InternalServerError(w, r, erro.Wrap(err))
+			return
+		default:
+			tdata.Form, err = hyforms.MarshalForm(w, r, data.formCallback)
+			if err != nil {
+				pm.InternalServerError(w, r, erro.Wrap(err))
+				return
+			}
+		}
+		err = pm.tpl.Render(w, r, tdata, tpl.Files("reset_password.html"))
+		if err != nil {
+			pm.InternalServerError(w, r, erro.Wrap(err))
+			return
+		}
+	case "POST":
+		errMsgs, ok := hyforms.UnmarshalForm(w, r, data.formCallback)
+		if !ok {
+			hyforms.Redirect(w, r, currentURL, errMsgs)
+			return
+		}
+		err = pm.resetPasswordWithToken(r.Context(), token, data.Password)
+		if errors.Is(err, ErrInvalidEmailToken) || errors.Is(err, ErrBoxesNotInitialized) {
+			errMsgs.FormErrMsgs = append(errMsgs.FormErrMsgs, err.Error())
+			hyforms.Redirect(w, r, currentURL, errMsgs)
+			return
+		}
+		if err != nil {
+			pm.InternalServerError(w, r, erro.Wrap(err))
+			return
+		}
+		_ = hyforms.SetCookieValue(w, cookieFlash, msg(r, "reset_password.done"), &http.Cookie{HttpOnly: true, MaxAge: 60})
+		Redirect(w, r, URLLogin)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// resetPasswordWithToken uses up a password reset token and sets the password
+// of its user, deleting their sessions. Since the token was emailed to the
+// user, their email is also verified if it has not changed since.
+func (pm *PageManager) resetPasswordWithToken(ctx context.Context, token, password string) error {
+	passwordHash, err := keyderiv.GenerateFromPassword([]byte(password))
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	return sq.WithTxContext(ctx, pm.dataDB, nil, func(tx *sql.Tx) error {
+		t, err := pm.useEmailToken(ctx, tx, emailTokenResetPassword, token)
+		if err != nil {
+			return err
+		}
+		var (
+			USERS    = tables.NEW_USERS(ctx, "")
+			SESSIONS = tables.NEW_SESSIONS(ctx, "")
+		)
+		for _, q := range []sq.Query{
+			sq.SQLite.
+				Update(USERS).
+				Set(USERS.PASSWORD_HASH.SetString(string(passwordHash))).
+				Where(USERS.USER_ID.EqInt64(t.userID), USERS.USER_ID.NeInt(1)),
+			sq.SQLite.
+				Update(USERS).
+				Set(USERS.EMAIL_VERIFIED.SetBool(true)).
+				Where(USERS.USER_ID.EqInt64(t.userID), USERS.EMAIL.EqString(t.email)),
+			sq.SQLite.DeleteFrom(SESSIONS).Where(SESSIONS.USER_ID.EqInt64(t.userID)),
+		} {
+			_, _, err = sq.ExecContext(ctx, tx, q, 0)
+			if err != nil {
+				return erro.Wrap(err)
+			}
+		}
+		return nil
+	})
+}
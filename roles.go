@@ -0,0 +1,453 @@
+package pagemanager
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/bokwoon95/pagemanager/erro"
+	"github.com/bokwoon95/pagemanager/sq"
+	"github.com/bokwoon95/pagemanager/tables"
+)
+
+type Role struct {
+	Name        string
+	Description string
+	Permissions []string
+}
+
+type Permission struct {
+	Name        string
+	Description string
+}
+
+// builtinPermissions are the permissions of pagemanager itself. They are
+// seeded on startup and always granted to roleSuperadmin.
+var builtinPermissions = []Permission{
+	{permissionAddPage, "Create pages"},
+	{permissionViewPage, "View pages"},
+	{permissionChangePage, "Edit pages and their translations"},
+	{permissionDeletePage, "Delete pages"},
+	{permissionManageThemes, "Install and uninstall themes"},
+	{permissionManageLocales, "Add, edit and delete locales"},
+	{permissionManageUsers, "Create, edit, disable and delete users"},
+	{permissionManageRoles, "Manage roles, and assign roles and permissions to users"},
+}
+
+// permissionNameRegexp matches namespaced permission names like
+// "myplugin:publish".
+var permissionNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]*:[a-z0-9][a-z0-9_.-]*$`)
+
+var roleNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.:-]*$`)
+
+func validateRoleName(name string) error {
+	if len(name) > 64 || !roleNameRegexp.MatchString(name) {
+		return fmt.Errorf("%w %q", ErrInvalidRoleName, name)
+	}
+	return nil
+}
+
+func validatePermissionName(name string) error {
+	if len(name) > 64 || !permissionNameRegexp.MatchString(name) {
+		return fmt.Errorf("%w %q", ErrInvalidPermissionName, name)
+	}
+	return nil
+}
+
+// RegisterPermission adds a permission that can then be granted to roles and
+// users at URLManageRoles, and checked with SessionUser.Permissions. The name
+// is namespaced by the plugin that registers it e.g. "myplugin:publish";
+// the "pagemanager" namespace is reserved. Registering a permission again only
+// updates its description.
+func (pm *PageManager) RegisterPermission(name, description string) error {
+	err := validatePermissionName(name)
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(name, "pagemanager:") {
+		return fmt.Errorf("%w %q: the pagemanager namespace is reserved", ErrInvalidPermissionName, name)
+	}
+	return upsertPermissions(context.Background(), pm.dataDB, []Permission{{name, description}})
+}
+
+func upsertPermissions(ctx context.Context, db sq.Queryer, permissions []Permission) error {
+	PERMISSIONS := tables.NEW_PERMISSIONS(ctx, "")
+	_, _, err := sq.ExecContext(ctx, db, sq.SQLite.
+		InsertInto(PERMISSIONS).
+		Valuesx(func(col *sq.Column) error {
+			for _, permission := range permissions {
+				col.SetString(PERMISSIONS.PERMISSION_NAME, permission.Name)
+				col.SetString(PERMISSIONS.DESCRIPTION, permission.Description)
+			}
+			return nil
+		}).
+		OnConflict(PERMISSIONS.PERMISSION_NAME).
+		DoUpdateSet(sq.SetExcluded(PERMISSIONS.DESCRIPTION)), 0,
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	return nil
+}
+
+// getPermissions returns every permission, sorted by name.
+func getPermissions(ctx context.Context, db sq.Queryer) ([]Permission, error) {
+	var permissions []Permission
+	PERMISSIONS := tables.NEW_PERMISSIONS(ctx, "p")
+	_, err := sq.FetchContext(ctx, db, sq.SQLite.
+		From(PERMISSIONS).
+		OrderBy(PERMISSIONS.PERMISSION_NAME),
+		func(row *sq.Row) error {
+			permission := Permission{
+				Name:        row.String(PERMISSIONS.PERMISSION_NAME),
+				Description: row.String(PERMISSIONS.DESCRIPTION),
+			}
+			return row.Accumulate(func() error {
+				permissions = append(permissions, permission)
+				return nil
+			})
+		},
+	)
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	return permissions, nil
+}
+
+// getRoles returns every role together with its permissions, sorted by name.
+func getRoles(ctx context.Context, db sq.Queryer) ([]Role, error) {
+	var roles []Role
+	ROLES := tables.NEW_ROLES(ctx, "r")
+	_, err := sq.FetchContext(ctx, db, sq.SQLite.
+		From(ROLES).
+		OrderBy(ROLES.ROLE_NAME),
+		func(row *sq.Row) error {
+			role := Role{
+				Name:        row.String(ROLES.ROLE_NAME),
+				Description: row.String(ROLES.DESCRIPTION),
+			}
+			return row.Accumulate(func() error {
+				roles = append(roles, role)
+				return nil
+			})
+		},
+	)
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	rolePermissions := make(map[string][]string)
+	ROLE_PERMISSIONS := tables.NEW_ROLE_PERMISSIONS(ctx, "rp")
+	_, err = sq.FetchContext(ctx, db, sq.SQLite.
+		SelectDistinct().
+		From(ROLE_PERMISSIONS).
+		OrderBy(ROLE_PERMISSIONS.PERMISSION_NAME),
+		func(row *sq.Row) error {
+			roleName := row.String(ROLE_PERMISSIONS.ROLE_NAME)
+			permissionName := row.String(ROLE_PERMISSIONS.PERMISSION_NAME)
+			return row.Accumulate(func() error {
+				rolePermissions[roleName] = append(rolePermissions[roleName], permissionName)
+				return nil
+			})
+		},
+	)
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	for i := range roles {
+		roles[i].Permissions = rolePermissions[roles[i].Name]
+	}
+	return roles, nil
+}
+
+func roleExists(ctx context.Context, db sq.Queryer, name string) (bool, error) {
+	ROLES := tables.NEW_ROLES(ctx, "r")
+	exists, err := sq.ExistsContext(ctx, db, sq.SQLite.From(ROLES).Where(ROLES.ROLE_NAME.EqString(name)))
+	if err != nil {
+		return false, erro.Wrap(err)
+	}
+	return exists, nil
+}
+
+func addRole(ctx context.Context, db sq.Queryer, name, description string) error {
+	err := validateRoleName(name)
+	if err != nil {
+		return err
+	}
+	exists, err := roleExists(ctx, db, name)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	if exists {
+		return fmt.Errorf("%w %q", ErrRoleExists, name)
+	}
+	ROLES := tables.NEW_ROLES(ctx, "")
+	_, _, err = sq.ExecContext(ctx, db, sq.SQLite.
+		InsertInto(ROLES).
+		Valuesx(func(col *sq.Column) error {
+			col.SetString(ROLES.ROLE_NAME, name)
+			col.SetString(ROLES.DESCRIPTION, description)
+			return nil
+		}), 0,
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	return nil
+}
+
+func describeRole(ctx context.Context, db sq.Queryer, name, description string) error {
+	ROLES := tables.NEW_ROLES(ctx, "")
+	rowsAffected, _, err := sq.ExecContext(ctx, db, sq.SQLite.
+		Update(ROLES).
+		Set(ROLES.DESCRIPTION.SetString(description)).
+		Where(ROLES.ROLE_NAME.EqString(name)),
+		sq.ErowsAffected,
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	if rowsAffected == 0 {
+		return fmt.Errorf("%w %q", ErrRoleNotFound, name)
+	}
+	return nil
+}
+
+// deleteRole deletes a role, taking it away from every user that has it.
+func deleteRole(ctx context.Context, db sq.Queryer, name string) error {
+	if name == roleSuperadmin {
+		return fmt.Errorf("%w %q", ErrRoleReserved, name)
+	}
+	exists, err := roleExists(ctx, db, name)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	if !exists {
+		return fmt.Errorf("%w %q", ErrRoleNotFound, name)
+	}
+	var (
+		ROLE_PERMISSIONS = tables.NEW_ROLE_PERMISSIONS(ctx, "")
+		USER_ROLES       = tables.NEW_USER_ROLES(ctx, "")
+		ROLES            = tables.NEW_ROLES(ctx, "")
+	)
+	for _, q := range []sq.Query{
+		sq.SQLite.DeleteFrom(ROLE_PERMISSIONS).Where(ROLE_PERMISSIONS.ROLE_NAME.EqString(name)),
+		sq.SQLite.DeleteFrom(USER_ROLES).Where(USER_ROLES.ROLE_NAME.EqString(name)),
+		sq.SQLite.DeleteFrom(ROLES).Where(ROLES.ROLE_NAME.EqString(name)),
+	} {
+		_, _, err = sq.ExecContext(ctx, db, q, 0)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+	}
+	return nil
+}
+
+// checkPermissionsExist returns an ErrPermissionNotFound for the first of
+// permissionNames that does not exist.
+func checkPermissionsExist(ctx context.Context, db sq.Queryer, permissionNames []string) error {
+	permissions, err := getPermissions(ctx, db)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	exists := make(map[string]bool)
+	for _, permission := range permissions {
+		exists[permission.Name] = true
+	}
+	for _, name := range permissionNames {
+		if !exists[name] {
+			return fmt.Errorf("%w %q", ErrPermissionNotFound, name)
+		}
+	}
+	return nil
+}
+
+// setRolePermissions replaces the permissions of a role. roleSuperadmin
+// always keeps the builtinPermissions.
+func setRolePermissions(ctx context.Context, db sq.Queryer, name string, permissionNames []string) error {
+	exists, err := roleExists(ctx, db, name)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	if !exists {
+		return fmt.Errorf("%w %q", ErrRoleNotFound, name)
+	}
+	err = checkPermissionsExist(ctx, db, permissionNames)
+	if err != nil {
+		return err
+	}
+	if name == roleSuperadmin {
+		for _, permission := range builtinPermissions {
+			permissionNames = append(permissionNames, permission.Name)
+		}
+	}
+	permissionNames = dedupSorted(permissionNames)
+	ROLE_PERMISSIONS := tables.NEW_ROLE_PERMISSIONS(ctx, "")
+	_, _, err = sq.ExecContext(ctx, db, sq.SQLite.
+		DeleteFrom(ROLE_PERMISSIONS).
+		Where(ROLE_PERMISSIONS.ROLE_NAME.EqString(name)), 0,
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	if len(permissionNames) == 0 {
+		return nil
+	}
+	_, _, err = sq.ExecContext(ctx, db, sq.SQLite.
+		InsertInto(ROLE_PERMISSIONS).
+		Valuesx(func(col *sq.Column) error {
+			for _, permissionName := range permissionNames {
+				col.SetString(ROLE_PERMISSIONS.ROLE_NAME, name)
+				col.SetString(ROLE_PERMISSIONS.PERMISSION_NAME, permissionName)
+			}
+			return nil
+		}), 0,
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	return nil
+}
+
+// getUserAccess returns the roles and the directly granted permissions of the
+// user with userID, sorted by name.
+func getUserAccess(ctx context.Context, db sq.Queryer, userID int64) (roleNames, permissionNames []string, err error) {
+	USER_ROLES := tables.NEW_USER_ROLES(ctx, "ur")
+	_, err = sq.FetchContext(ctx, db, sq.SQLite.
+		SelectDistinct().
+		From(USER_ROLES).
+		Where(USER_ROLES.USER_ID.EqInt64(userID)).
+		OrderBy(USER_ROLES.ROLE_NAME),
+		func(row *sq.Row) error {
+			roleName := row.String(USER_ROLES.ROLE_NAME)
+			return row.Accumulate(func() error {
+				roleNames = append(roleNames, roleName)
+				return nil
+			})
+		},
+	)
+	if err != nil {
+		return nil, nil, erro.Wrap(err)
+	}
+	USER_PERMISSIONS := tables.NEW_USER_PERMISSIONS(ctx, "up")
+	_, err = sq.FetchContext(ctx, db, sq.SQLite.
+		SelectDistinct().
+		From(USER_PERMISSIONS).
+		Where(USER_PERMISSIONS.USER_ID.EqInt64(userID)).
+		OrderBy(USER_PERMISSIONS.PERMISSION_NAME),
+		func(row *sq.Row) error {
+			permissionName := row.String(USER_PERMISSIONS.PERMISSION_NAME)
+			return row.Accumulate(func() error {
+				permissionNames = append(permissionNames, permissionName)
+				return nil
+			})
+		},
+	)
+	if err != nil {
+		return nil, nil, erro.Wrap(err)
+	}
+	return roleNames, permissionNames, nil
+}
+
+// setUserRoles replaces the roles of the user with publicUserID. The
+// superadmin role cannot be given to users, as it belongs to whoever logs in
+// with the superadmin password.
+func setUserRoles(ctx context.Context, db sq.Queryer, publicUserID string, roleNames []string) error {
+	user, err := getUserByPublicID(ctx, db, publicUserID)
+	if err != nil {
+		return err
+	}
+	roleNames = dedupSorted(roleNames)
+	for _, name := range roleNames {
+		if name == roleSuperadmin {
+			return fmt.Errorf("%w %q", ErrRoleReserved, name)
+		}
+		exists, err := roleExists(ctx, db, name)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		if !exists {
+			return fmt.Errorf("%w %q", ErrRoleNotFound, name)
+		}
+	}
+	USER_ROLES := tables.NEW_USER_ROLES(ctx, "")
+	_, _, err = sq.ExecContext(ctx, db, sq.SQLite.
+		DeleteFrom(USER_ROLES).
+		Where(USER_ROLES.USER_ID.EqInt64(user.UserID)), 0,
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	if len(roleNames) == 0 {
+		return nil
+	}
+	_, _, err = sq.ExecContext(ctx, db, sq.SQLite.
+		InsertInto(USER_ROLES).
+		Valuesx(func(col *sq.Column) error {
+			for _, name := range roleNames {
+				col.SetInt64(USER_ROLES.USER_ID, user.UserID)
+				col.SetString(USER_ROLES.ROLE_NAME, name)
+			}
+			return nil
+		}), 0,
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	return nil
+}
+
+// setUserPermissions replaces the permissions granted directly to the user
+// with publicUserID, on top of those of their roles.
+func setUserPermissions(ctx context.Context, db sq.Queryer, publicUserID string, permissionNames []string) error {
+	user, err := getUserByPublicID(ctx, db, publicUserID)
+	if err != nil {
+		return err
+	}
+	permissionNames = dedupSorted(permissionNames)
+	err = checkPermissionsExist(ctx, db, permissionNames)
+	if err != nil {
+		return err
+	}
+	USER_PERMISSIONS := tables.NEW_USER_PERMISSIONS(ctx, "")
+	_, _, err = sq.ExecContext(ctx, db, sq.SQLite.
+		DeleteFrom(USER_PERMISSIONS).
+		Where(USER_PERMISSIONS.USER_ID.EqInt64(user.UserID)), 0,
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	if len(permissionNames) == 0 {
+		return nil
+	}
+	_, _, err = sq.ExecContext(ctx, db, sq.SQLite.
+		InsertInto(USER_PERMISSIONS).
+		Valuesx(func(col *sq.Column) error {
+			for _, name := range permissionNames {
+				col.SetInt64(USER_PERMISSIONS.USER_ID, user.UserID)
+				col.SetString(USER_PERMISSIONS.PERMISSION_NAME, name)
+			}
+			return nil
+		}), 0,
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	return nil
+}
+
+// dedupSorted returns the unique strings of strs, sorted.
+func dedupSorted(strs []string) []string {
+	seen := make(map[string]bool)
+	var unique []string
+	for _, s := range strs {
+		if s == "" || seen[s] {
+			continue
+		}
+		seen[s] = true
+		unique = append(unique, s)
+	}
+	sort.Strings(unique)
+	return unique
+}
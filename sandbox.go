@@ -0,0 +1,96 @@
+package pagemanager
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/dop251/goja"
+)
+
+var (
+	// themeConfigTimeout is how long a theme-config.js is allowed to run
+	// before it is interrupted.
+	themeConfigTimeout = 2 * time.Second
+
+	// themeConfigMaxCallStackSize bounds the recursion depth of a
+	// theme-config.js.
+	themeConfigMaxCallStackSize = 1024
+
+	errThemeConfigTimeout = errors.New("timed out")
+)
+
+// themeConfigEnvPrefix is the prefix of the environment variables that
+// theme-config.js can read with pm.env(). Other environment variables are not
+// visible to themes.
+const themeConfigEnvPrefix = "PM_THEME_"
+
+// themeConfigPrelude removes the globals that can compile code at runtime.
+// theme-config.js only needs to return a plain object.
+const themeConfigPrelude = `(function() {
+	delete globalThis.eval;
+	delete globalThis.Function;
+	Object.defineProperty(Object.getPrototypeOf(function(){}), "constructor", { value: undefined });
+})();`
+
+// runThemeConfig runs the body of a theme-config.js in a sandboxed goja
+// runtime and returns the object it returns. The runtime has no access to the
+// filesystem or network, cannot compile code at runtime and is interrupted if
+// it runs for longer than themeConfigTimeout. The following are made
+// available to the script:
+//
+// $THEME_PATH is the absolute URL path of the theme folder, with a trailing
+// slash.
+//
+// pm.joinPath(...elems) joins path elements with forward slashes, like Go's
+// path.Join.
+//
+// pm.env(name) returns the value of the environment variable PM_THEME_<name>,
+// or undefined if it is not set.
+func runThemeConfig(filename string, src []byte, themePath string) (config interface{}, err error) {
+	vm := goja.New()
+	vm.SetMaxCallStackSize(themeConfigMaxCallStackSize)
+	_, err = vm.RunString(themeConfigPrelude)
+	if err != nil {
+		return nil, fmt.Errorf("%s: setting up sandbox: %w", filename, err)
+	}
+	pm := vm.NewObject()
+	_ = pm.Set("joinPath", func(elems ...string) string {
+		return path.Join(elems...)
+	})
+	_ = pm.Set("env", func(name string) goja.Value {
+		value, ok := os.LookupEnv(themeConfigEnvPrefix + strings.TrimPrefix(name, themeConfigEnvPrefix))
+		if !ok {
+			return goja.Undefined()
+		}
+		return vm.ToValue(value)
+	})
+	vm.Set("pm", pm)
+	vm.Set("$THEME_PATH", themePath)
+	timer := time.AfterFunc(themeConfigTimeout, func() {
+		vm.Interrupt(errThemeConfigTimeout)
+	})
+	defer timer.Stop()
+	// The config is round-tripped through JSON inside the runtime so that any
+	// getters are evaluated while the timeout still applies, and so that only
+	// plain data is exported out of the runtime. The script is wrapped without
+	// adding any newlines so that line numbers in errors match the file.
+	res, err := vm.RunScript(filename, "(function(parse, stringify){var config = (function(){"+string(src)+"\n})();"+
+		" return config === undefined ? config : parse(stringify(config))})(JSON.parse, JSON.stringify)")
+	if err != nil {
+		var interruptedErr *goja.InterruptedError
+		if errors.As(err, &interruptedErr) && interruptedErr.Value() == errThemeConfigTimeout {
+			return nil, fmt.Errorf("%s: timed out after %s", filename, themeConfigTimeout)
+		}
+		var stackOverflowErr *goja.StackOverflowError
+		if errors.As(err, &stackOverflowErr) {
+			// StackOverflowError carries no message of its own.
+			return nil, fmt.Errorf("%s: maximum call stack size of %d exceeded", filename, themeConfigMaxCallStackSize)
+		}
+		return nil, err
+	}
+	return res.Export(), nil
+}
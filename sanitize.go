@@ -0,0 +1,86 @@
+package pagemanager
+
+import (
+	"html/template"
+
+	"github.com/bokwoon95/pagemanager/hy"
+)
+
+// SetSanitizePolicy sets the allowlist used to sanitize the HTML saved by users
+// with the given role. The policy for the empty role name is the default
+// policy, which applies to users whose roles have no policy and to HTML
+// sanitized at render time. Until it is set, the default policy is hy.Allow.
+// A user with several roles may use any markup allowed by any of their roles'
+// policies. SetSanitizePolicy must be called before the PageManager starts
+// serving requests.
+//
+// Superadmins can opt out of sanitization altogether with the
+// -pm-unsanitized-superadmin flag.
+func (pm *PageManager) SetSanitizePolicy(roleName string, allow func(tag, attrName, attrValue string) bool) {
+	if allow == nil {
+		delete(pm.sanitizePolicies, roleName)
+		return
+	}
+	pm.sanitizePolicies[roleName] = allow
+}
+
+// sanitizePolicy returns the allowlist for the HTML saved by user, or nil if
+// the user's HTML is not sanitized.
+func (pm *PageManager) sanitizePolicy(user SessionUser) func(tag, attrName, attrValue string) bool {
+	if *flagUnsanitizedSuperadmin && user.Roles[roleSuperadmin] {
+		return nil
+	}
+	var policies []func(tag, attrName, attrValue string) bool
+	for role := range user.Roles {
+		if policy, ok := pm.sanitizePolicies[role]; ok {
+			policies = append(policies, policy)
+		}
+	}
+	switch len(policies) {
+	case 0:
+		return pm.defaultSanitizePolicy()
+	case 1:
+		return policies[0]
+	}
+	return func(tag, attrName, attrValue string) bool {
+		for _, policy := range policies {
+			if policy(tag, attrName, attrValue) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func (pm *PageManager) defaultSanitizePolicy() func(tag, attrName, attrValue string) bool {
+	if policy, ok := pm.sanitizePolicies[""]; ok {
+		return policy
+	}
+	return hy.Allow
+}
+
+// sanitizeHTML sanitizes HTML saved by user according to the user's policy.
+func (pm *PageManager) sanitizeHTML(user SessionUser, s string) string {
+	allow := pm.sanitizePolicy(user)
+	if allow == nil {
+		return s
+	}
+	return hy.Sanitize(s, allow)
+}
+
+// sanitizeOnRender sanitizes HTML that is about to be served with the default
+// policy if the -pm-sanitize-on-render flag is set. This catches HTML that was
+// saved before sanitization was in place, or written directly to the
+// database.
+func (pm *PageManager) sanitizeOnRender(s string) string {
+	if !*flagSanitizeOnRender {
+		return s
+	}
+	return hy.Sanitize(s, pm.defaultSanitizePolicy())
+}
+
+// safeHTML is the template function that marks a value as HTML, sanitizing it
+// first if the -pm-sanitize-on-render flag is set.
+func (pm *PageManager) safeHTML(v interface{}) template.HTML {
+	return template.HTML(pm.sanitizeOnRender(hy.Stringify(v)))
+}
@@ -6,6 +6,8 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/bokwoon95/pagemanager/erro"
@@ -14,13 +16,16 @@ import (
 )
 
 type User struct {
-	Valid        bool
-	UserID       int64
-	PublicUserID string
-	LoginID      string
-	Email        string
-	Displayname  string
-	UserData     map[string]interface{}
+	Valid         bool
+	UserID        int64
+	PublicUserID  string
+	LoginID       string
+	Email         string
+	Displayname   string
+	UserData      map[string]interface{}
+	Disabled      bool
+	EmailVerified bool
+	TOTPEnabled   bool
 }
 
 func (user *User) RowMapper(USERS tables.PM_USERS) func(*sq.Row) error {
@@ -32,6 +37,9 @@ func (user *User) RowMapper(USERS tables.PM_USERS) func(*sq.Row) error {
 		user.LoginID = row.String(USERS.LOGIN_ID)
 		user.Email = row.String(USERS.EMAIL)
 		user.Displayname = row.String(USERS.DISPLAYNAME)
+		user.Disabled = row.Bool(USERS.DISABLED)
+		user.EmailVerified = row.Bool(USERS.EMAIL_VERIFIED)
+		user.TOTPEnabled = row.Bool(USERS.TOTP_ENABLED)
 		b := row.Bytes(USERS.USER_DATA)
 		return row.Accumulate(func() error {
 			if len(b) > 0 {
@@ -47,11 +55,23 @@ type SessionUser struct {
 	Roles       map[string]bool
 	Permissions map[string]bool
 	SessionData map[string]interface{}
+	sessionHash string
+	createdAt   time.Time
+	lastSeenAt  time.Time
+	// apiTokenHash is set instead of sessionHash if the user is authenticated
+	// by an API token. Permissions are then limited to the token's scopes.
+	apiTokenHash string
 }
 
 func (user *SessionUser) RowMapper(u tables.PM_USERS, s tables.PM_SESSIONS) func(*sq.Row) error {
 	return func(row *sq.Row) error {
 		b := row.Bytes(s.SESSION_DATA)
+		user.sessionHash = row.String(s.SESSION_HASH)
+		user.createdAt = row.Time(s.CREATED_AT)
+		user.lastSeenAt = row.Time(s.LAST_SEEN_AT)
+		if user.lastSeenAt.IsZero() {
+			user.lastSeenAt = user.createdAt
+		}
 		err := user.User.RowMapper(u)(row)
 		if err != nil {
 			return erro.Wrap(err)
@@ -65,7 +85,41 @@ func (user *SessionUser) RowMapper(u tables.PM_USERS, s tables.PM_SESSIONS) func
 	}
 }
 
-func (pm *PageManager) newSession(w http.ResponseWriter, userID int64, sessionData map[string]interface{}) error {
+// sessionRenewInterval is how often the LAST_SEEN_AT and the cookie expiry of
+// a session in use are renewed, so that not every request writes to the
+// database.
+const sessionRenewInterval = time.Minute
+
+// sessionExpiry returns when a session expires: either -pm-session-max-age
+// after it was created, or -pm-session-idle-timeout after it was last seen,
+// whichever comes first.
+func sessionExpiry(createdAt, lastSeenAt time.Time) time.Time {
+	expiry := createdAt.Add(*flagSessionMaxAge)
+	if idleExpiry := lastSeenAt.Add(*flagSessionIdleTimeout); idleExpiry.Before(expiry) {
+		return idleExpiry
+	}
+	return expiry
+}
+
+func setSessionCookie(w http.ResponseWriter, r *http.Request, b64SessionToken string, expires time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Path:     "/",
+		Name:     cookieSession,
+		Value:    b64SessionToken,
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   *flagSecureCookies || r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func clearSessionCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{Path: "/", Name: cookieSession, MaxAge: -1, HttpOnly: true})
+}
+
+// newSession logs userID in on a new session. Other sessions of the user,
+// e.g. on other devices, are left alone.
+func (pm *PageManager) newSession(w http.ResponseWriter, r *http.Request, userID int64, sessionData map[string]interface{}) error {
 	if !pm.boxesInitialized() {
 		return ErrBoxesNotInitialized
 	}
@@ -88,17 +142,24 @@ func (pm *PageManager) newSession(w http.ResponseWriter, userID int64, sessionDa
 		}
 	}
 	ctx := context.Background()
-	SESSIONS := tables.NEW_SESSIONS(ctx, "s")
-	_, _, err = sq.Exec(pm.dataDB, sq.SQLite.DeleteFrom(SESSIONS).Where(SESSIONS.USER_ID.EqInt64(userID)), 0) // optional
+	err = deleteExpiredSessions(ctx, pm.dataDB)
 	if err != nil {
 		return erro.Wrap(err)
 	}
+	userAgent := r.UserAgent()
+	if len(userAgent) > 255 {
+		userAgent = userAgent[:255]
+	}
+	now := time.Now().UTC()
+	SESSIONS := tables.NEW_SESSIONS(ctx, "s")
 	_, _, err = sq.Exec(pm.dataDB, sq.SQLite.
 		InsertInto(SESSIONS).
 		Valuesx(func(col *sq.Column) error {
 			col.SetInt64(SESSIONS.USER_ID, userID)
 			col.SetString(SESSIONS.SESSION_HASH, b64SessionHash)
-			col.SetTime(SESSIONS.CREATED_AT, time.Now())
+			col.SetTime(SESSIONS.CREATED_AT, now)
+			col.SetTime(SESSIONS.LAST_SEEN_AT, now)
+			col.SetString(SESSIONS.USER_AGENT, userAgent)
 			if len(b) > 0 {
 				col.Set(SESSIONS.SESSION_DATA, string(b))
 			}
@@ -108,25 +169,112 @@ func (pm *PageManager) newSession(w http.ResponseWriter, userID int64, sessionDa
 	if err != nil {
 		return erro.Wrap(err)
 	}
-	http.SetCookie(w, &http.Cookie{
-		Path:  "/",
-		Name:  cookieSession,
-		Value: b64SessionToken,
-	})
+	setSessionCookie(w, r, b64SessionToken, sessionExpiry(now, now))
 	return nil
 }
 
+// deleteExpiredSessions deletes the sessions of every user that have expired.
+func deleteExpiredSessions(ctx context.Context, db sq.Queryer) error {
+	now := time.Now().UTC()
+	SESSIONS := tables.NEW_SESSIONS(ctx, "")
+	_, _, err := sq.ExecContext(ctx, db, sq.SQLite.
+		DeleteFrom(SESSIONS).
+		Where(sq.Or(
+			SESSIONS.CREATED_AT.IsNull(),
+			SESSIONS.CREATED_AT.LtTime(now.Add(-*flagSessionMaxAge)),
+			SESSIONS.LAST_SEEN_AT.LtTime(now.Add(-*flagSessionIdleTimeout)),
+		)), 0,
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	return nil
+}
+
+// userGrants fetches the roles of a user, the permissions granted to them
+// directly and the permissions granted through their roles. Each is aggregated
+// in a correlated subquery, so that they are fetched together with the user in
+// one query and do not multiply each other's rows. Role and permission names
+// cannot contain commas, so the default group_concat separator is
+// unambiguous.
+type userGrants struct {
+	roles     sq.CustomField
+	userPerms sq.CustomField
+	rolePerms sq.CustomField
+}
+
+func newUserGrants(ctx context.Context, USERS tables.PM_USERS) userGrants {
+	var (
+		USER_ROLES       = tables.NEW_USER_ROLES(ctx, "ur")
+		USER_PERMISSIONS = tables.NEW_USER_PERMISSIONS(ctx, "up")
+		ROLE_PERMISSIONS = tables.NEW_ROLE_PERMISSIONS(ctx, "rp")
+	)
+	return userGrants{
+		roles: sq.Fieldf("(?)", sq.SQLite.
+			Select(sq.Fieldf("group_concat(?)", USER_ROLES.ROLE_NAME)).
+			From(USER_ROLES).
+			Where(USER_ROLES.USER_ID.Eq(USERS.USER_ID)),
+		),
+		userPerms: sq.Fieldf("(?)", sq.SQLite.
+			Select(sq.Fieldf("group_concat(?)", USER_PERMISSIONS.PERMISSION_NAME)).
+			From(USER_PERMISSIONS).
+			Where(USER_PERMISSIONS.USER_ID.Eq(USERS.USER_ID)),
+		),
+		rolePerms: sq.Fieldf("(?)", sq.SQLite.
+			Select(sq.Fieldf("group_concat(?)", ROLE_PERMISSIONS.PERMISSION_NAME)).
+			From(USER_ROLES).
+			Join(ROLE_PERMISSIONS, ROLE_PERMISSIONS.ROLE_NAME.Eq(USER_ROLES.ROLE_NAME)).
+			Where(USER_ROLES.USER_ID.Eq(USERS.USER_ID)),
+		),
+	}
+}
+
+// RowMapper adds the roles and permissions of the row to user.Roles and
+// user.Permissions, which must not be nil.
+func (g userGrants) RowMapper(user *SessionUser) func(*sq.Row) error {
+	return func(row *sq.Row) error {
+		rolesList := row.Bytes(g.roles)
+		userPermsList := row.Bytes(g.userPerms)
+		rolePermsList := row.Bytes(g.rolePerms)
+		return row.Accumulate(func() error {
+			for _, field := range []struct {
+				list []byte
+				dest map[string]bool
+			}{
+				{rolesList, user.Roles},
+				{userPermsList, user.Permissions},
+				{rolePermsList, user.Permissions},
+			} {
+				if len(field.list) == 0 {
+					continue
+				}
+				for _, name := range strings.Split(string(field.list), ",") {
+					if name != "" {
+						field.dest[name] = true
+					}
+				}
+			}
+			return nil
+		})
+	}
+}
+
+// getSession returns the user logged in on the session cookie of r or, if r
+// has an Authorization: Bearer header, the user of the API token.
 func (pm *PageManager) getSession(w http.ResponseWriter, r *http.Request) (user SessionUser, err error) {
 	if !pm.boxesInitialized() {
 		return user, ErrBoxesNotInitialized
 	}
+	if token, ok := bearerToken(r); ok {
+		return pm.getAPITokenUser(r.Context(), token)
+	}
 	c, _ := r.Cookie(cookieSession)
 	if c == nil {
 		return user, nil
 	}
 	sessionToken, err := base64.RawURLEncoding.DecodeString(c.Value)
 	if err != nil {
-		http.SetCookie(w, &http.Cookie{Name: cookieSession, MaxAge: -1})
+		clearSessionCookie(w)
 		return user, erro.Wrap(err)
 	}
 	sessionHashes, err := pm.publicBox.HashAll(sessionToken)
@@ -137,89 +285,114 @@ func (pm *PageManager) getSession(w http.ResponseWriter, r *http.Request) (user
 	for _, sessionHash := range sessionHashes {
 		b64SessionHashes = append(b64SessionHashes, base64.RawURLEncoding.EncodeToString(sessionHash))
 	}
-	var (
-		SESSIONS         = tables.NEW_SESSIONS(r.Context(), "s")
-		USERS            = tables.NEW_USERS(r.Context(), "u")
-		USER_ROLES       = tables.NEW_USER_ROLES(r.Context(), "ur")
-		USER_PERMISSIONS = tables.NEW_USER_PERMISSIONS(r.Context(), "up")
-		ROLE_PERMISSIONS = tables.NEW_ROLE_PERMISSIONS(r.Context(), "rp")
-	)
+	SESSIONS := tables.NEW_SESSIONS(r.Context(), "s")
+	USERS := tables.NEW_USERS(r.Context(), "u")
+	grants := newUserGrants(r.Context(), USERS)
+	user.Roles = make(map[string]bool)
+	user.Permissions = make(map[string]bool)
 	_, err = sq.Fetch(pm.dataDB, sq.SQLite.
 		From(SESSIONS).
 		Join(USERS, USERS.USER_ID.Eq(SESSIONS.USER_ID)).
 		Where(SESSIONS.SESSION_HASH.In(b64SessionHashes)).
 		Limit(1),
-		user.RowMapper(USERS, SESSIONS),
+		func(row *sq.Row) error {
+			err := user.RowMapper(USERS, SESSIONS)(row)
+			if err != nil {
+				return erro.Wrap(err)
+			}
+			return grants.RowMapper(&user)(row)
+		},
 	)
 	if err != nil {
 		return user, erro.Wrap(err)
 	}
-	user.Roles = make(map[string]bool)
-	user.Permissions = make(map[string]bool)
-	_, err = sq.Fetch(pm.dataDB, sq.SQLite.
-		From(USERS).
-		LeftJoin(USER_ROLES, USER_ROLES.USER_ID.Eq(USERS.USER_ID)).
-		LeftJoin(USER_PERMISSIONS, USER_PERMISSIONS.USER_ID.Eq(USERS.USER_ID)).
-		Join(ROLE_PERMISSIONS, ROLE_PERMISSIONS.ROLE_NAME.Eq(USER_ROLES.ROLE_NAME)).
-		Where(USERS.USER_ID.EqInt64(user.UserID)).
-		GroupBy(USERS.USER_ID),
-		func(row *sq.Row) error {
-			rolesBytes := row.Bytes(sq.Fieldf("json_group_array(?)", USER_ROLES.ROLE_NAME))
-			userPermsBytes := row.Bytes(sq.Fieldf("json_group_array(?)", USER_PERMISSIONS.PERMISSION_NAME))
-			rolePermsBytes := row.Bytes(sq.Fieldf("json_group_array(?)", ROLE_PERMISSIONS.PERMISSION_NAME))
-			return row.Accumulate(func() error {
-				var roles, userPerms, rolePerms []string
-				err := json.Unmarshal(rolesBytes, &roles)
-				if err != nil {
-					return erro.Wrap(err)
-				}
-				err = json.Unmarshal(userPermsBytes, &userPerms)
-				if err != nil {
-					return erro.Wrap(err)
-				}
-				err = json.Unmarshal(rolePermsBytes, &rolePerms)
-				if err != nil {
-					return erro.Wrap(err)
-				}
-				for _, role := range roles {
-					if role == "" {
-						continue
-					}
-					user.Roles[role] = true
-				}
-				for _, perm := range userPerms {
-					if perm == "" {
-						continue
-					}
-					user.Permissions[perm] = true
-				}
-				for _, perm := range rolePerms {
-					if perm == "" {
-						continue
-					}
-					user.Permissions[perm] = true
-				}
-				return nil
-			})
-		},
-	)
+	if !user.Valid {
+		clearSessionCookie(w)
+		return user, nil
+	}
+	if user.Disabled {
+		clearSessionCookie(w)
+		return SessionUser{}, ErrUserDisabled
+	}
+	now := time.Now().UTC()
+	if !now.Before(sessionExpiry(user.createdAt, user.lastSeenAt)) {
+		clearSessionCookie(w)
+		_, _, err = sq.Exec(pm.dataDB, sq.SQLite.
+			DeleteFrom(SESSIONS).
+			Where(SESSIONS.SESSION_HASH.EqString(user.sessionHash)), 0,
+		)
+		if err != nil {
+			return SessionUser{}, erro.Wrap(err)
+		}
+		return SessionUser{}, ErrSessionExpired
+	}
+	if now.Sub(user.lastSeenAt) >= sessionRenewInterval {
+		// sliding renewal: the idle timeout restarts, and the cookie expiry
+		// is pushed back to match
+		user.lastSeenAt = now
+		_, _, err = sq.Exec(pm.dataDB, sq.SQLite.
+			Update(SESSIONS).
+			Set(SESSIONS.LAST_SEEN_AT.SetTime(now)).
+			Where(SESSIONS.SESSION_HASH.EqString(user.sessionHash)), 0,
+		)
+		if err != nil {
+			return SessionUser{}, erro.Wrap(err)
+		}
+		setSessionCookie(w, r, c.Value, sessionExpiry(user.createdAt, user.lastSeenAt))
+	}
 	return user, nil
 }
 
+// requestUser caches the SessionUser of a request, so that the session is
+// looked up at most once per request however many times getUser is called.
+// It is put into the request context by the PageManager handler.
+type requestUser struct {
+	once sync.Once
+	user SessionUser
+	err  error
+}
+
+// getUser returns the user logged in on the session of the request. The user
+// is looked up on the first call and cached for the rest of the request.
 func (pm *PageManager) getUser(w http.ResponseWriter, r *http.Request) (SessionUser, error) {
-	user, ok := r.Context().Value(ctxKeyUser).(SessionUser)
-	if ok {
-		return user, nil
+	lookup := func() (SessionUser, error) {
+		user, err := pm.getSession(w, r)
+		if err != nil {
+			user.Valid = false
+		}
+		return user, erro.Wrap(err)
 	}
-	user, err := pm.getSession(w, r)
-	if err != nil {
-		user.Valid = false
+	cache, ok := r.Context().Value(ctxKeyUser).(*requestUser)
+	if !ok {
+		return lookup()
 	}
-	return user, erro.Wrap(err)
+	cache.once.Do(func() {
+		cache.user, cache.err = lookup()
+	})
+	return cache.user, cache.err
+}
+
+// requireCookieSession returns the user logged in on the session cookie of r,
+// for account pages such as URLSessions that change how the user logs in.
+// Those must not be reachable with an API token, which would otherwise be
+// able to get around its scopes e.g. by linking an identity to log in with.
+// If there is no such user it responds with a redirect to the login page or
+// with Forbidden, and ok is false.
+func (pm *PageManager) requireCookieSession(w http.ResponseWriter, r *http.Request) (user SessionUser, ok bool) {
+	user, _ = pm.getUser(w, r)
+	switch {
+	case !user.Valid:
+		pm.RedirectToLogin(w, r)
+		return user, false
+	case user.apiTokenHash != "":
+		pm.Forbidden(w, r)
+		return user, false
+	}
+	return user, true
 }
 
 func (pm *PageManager) deleteSession(w http.ResponseWriter, r *http.Request) error {
-	defer http.SetCookie(w, &http.Cookie{Path: "/", Name: cookieSession, MaxAge: -1})
+	defer clearSessionCookie(w)
 	if !pm.boxesInitialized() {
 		return ErrBoxesNotInitialized
 	}
@@ -229,7 +402,6 @@ func (pm *PageManager) deleteSession(w http.ResponseWriter, r *http.Request) err
 	}
 	sessionToken, err := base64.RawURLEncoding.DecodeString(c.Value)
 	if err != nil {
-		http.SetCookie(w, &http.Cookie{Name: cookieSession, MaxAge: -1})
 		return erro.Wrap(err)
 	}
 	sessionHashes, err := pm.publicBox.HashAll(sessionToken)
@@ -250,3 +422,87 @@ func (pm *PageManager) deleteSession(w http.ResponseWriter, r *http.Request) err
 	}
 	return nil
 }
+
+// Session is one of the sessions of a user, as listed at URLSessions.
+type Session struct {
+	Hash       string
+	UserAgent  string
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	ExpiresAt  time.Time
+	Current    bool // whether it is the session of the request
+}
+
+// getUserSessions returns the unexpired sessions of userID, most recently seen
+// first. currentHash is the SESSION_HASH of the session of the request.
+func getUserSessions(ctx context.Context, db sq.Queryer, userID int64, currentHash string) ([]Session, error) {
+	var sessions []Session
+	now := time.Now().UTC()
+	SESSIONS := tables.NEW_SESSIONS(ctx, "s")
+	_, err := sq.FetchContext(ctx, db, sq.SQLite.
+		From(SESSIONS).
+		Where(SESSIONS.USER_ID.EqInt64(userID)).
+		OrderBy(SESSIONS.LAST_SEEN_AT.Desc()),
+		func(row *sq.Row) error {
+			session := Session{
+				Hash:       row.String(SESSIONS.SESSION_HASH),
+				UserAgent:  row.String(SESSIONS.USER_AGENT),
+				CreatedAt:  row.Time(SESSIONS.CREATED_AT),
+				LastSeenAt: row.Time(SESSIONS.LAST_SEEN_AT),
+			}
+			return row.Accumulate(func() error {
+				if session.LastSeenAt.IsZero() {
+					session.LastSeenAt = session.CreatedAt
+				}
+				session.ExpiresAt = sessionExpiry(session.CreatedAt, session.LastSeenAt)
+				session.Current = session.Hash == currentHash
+				if now.Before(session.ExpiresAt) {
+					sessions = append(sessions, session)
+				}
+				return nil
+			})
+		},
+	)
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	return sessions, nil
+}
+
+// revokeSession deletes the session of userID with sessionHash, logging out
+// whoever is using it.
+func revokeSession(ctx context.Context, db sq.Queryer, userID int64, sessionHash string) error {
+	SESSIONS := tables.NEW_SESSIONS(ctx, "")
+	rowsAffected, _, err := sq.ExecContext(ctx, db, sq.SQLite.
+		DeleteFrom(SESSIONS).
+		Where(
+			SESSIONS.USER_ID.EqInt64(userID),
+			SESSIONS.SESSION_HASH.EqString(sessionHash),
+		),
+		sq.ErowsAffected,
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	if rowsAffected == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// revokeOtherSessions deletes every session of userID except the one with
+// keepHash.
+func revokeOtherSessions(ctx context.Context, db sq.Queryer, userID int64, keepHash string) error {
+	SESSIONS := tables.NEW_SESSIONS(ctx, "")
+	_, _, err := sq.ExecContext(ctx, db, sq.SQLite.
+		DeleteFrom(SESSIONS).
+		Where(
+			SESSIONS.USER_ID.EqInt64(userID),
+			SESSIONS.SESSION_HASH.NeString(keepHash),
+		), 0,
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	return nil
+}
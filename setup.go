@@ -13,6 +13,7 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/bokwoon95/pagemanager/encrypthash"
 	"github.com/bokwoon95/pagemanager/erro"
@@ -26,6 +27,33 @@ var (
 	flagSuperadminFolder = flag.String("pm-superadmin", "", "")
 	flagNoSetup          = flag.Bool("pm-no-setup", false, "")
 	flagPass             = flag.String("pm-pass", "", "")
+
+	flagSanitizeOnRender      = flag.Bool("pm-sanitize-on-render", false, "")
+	flagUnsanitizedSuperadmin = flag.Bool("pm-unsanitized-superadmin", false, "")
+	flagNegotiateLocale       = flag.Bool("pm-negotiate-locale", false, "")
+
+	flagSessionMaxAge      = flag.Duration("pm-session-max-age", 30*24*time.Hour, "")
+	flagSessionIdleTimeout = flag.Duration("pm-session-idle-timeout", 7*24*time.Hour, "")
+	flagSecureCookies      = flag.Bool("pm-secure-cookies", false, "")
+	// pm-trusted-proxies is a comma separated list of the IPs or CIDRs of the
+	// reverse proxies in front of the PageManager. The client IP of a request
+	// from one of them is taken from its X-Forwarded-For header instead.
+	flagTrustedProxies = flag.String("pm-trusted-proxies", "", "")
+
+	// Emails are sent through the SMTP server if pm-smtp-addr is set, else
+	// written into pm-mail-dir if that is set, else logged.
+	flagSMTPAddr     = flag.String("pm-smtp-addr", "", "")
+	flagSMTPUsername = flag.String("pm-smtp-username", "", "")
+	flagSMTPPassword = flag.String("pm-smtp-password", "", "")
+	flagMailFrom     = flag.String("pm-mail-from", "PageManager <noreply@localhost>", "")
+	flagMailDir      = flag.String("pm-mail-dir", "", "")
+	// pm-base-url is the scheme and host that links in emails and the default
+	// OAuth redirect URL point to e.g. https://example.com. Password reset and
+	// verification emails are not sent if it is not set.
+	flagBaseURL = flag.String("pm-base-url", "", "")
+
+	// pm-identity-providers is a JSON file with a list of IdentityProviders.
+	flagIdentityProviders = flag.String("pm-identity-providers", "", "")
 )
 
 var bufpool = sync.Pool{
@@ -221,101 +249,86 @@ func seedData(ctx context.Context, db sq.Queryer) error {
 	if err != nil {
 		return erro.Wrap(err)
 	}
-	// pm_users
+	// pm_users, pm_user_roles: only the placeholder user 1 is seeded, as users
+	// are managed at URLManageUsers
 	USERS := tables.NEW_USERS(ctx, "u")
-	_, _, err = sq.Exec(db, sq.SQLite.DeleteFrom(USERS), sq.ErowsAffected)
+	placeholderExists, err := sq.Exists(db, sq.SQLite.From(USERS).Where(USERS.USER_ID.EqInt(1)))
 	if err != nil {
 		return erro.Wrap(err)
 	}
-	_, _, err = sq.Exec(db, sq.SQLite.
-		InsertInto(USERS).
-		Valuesx(func(col *sq.Column) error {
-			col.SetInt64(USERS.USER_ID, 1)
-			col.SetString(USERS.PUBLIC_USER_ID, "")
-			col.SetString(USERS.LOGIN_ID, "")
-			return nil
-		}),
-		sq.ErowsAffected,
-	)
-	if err != nil {
-		return erro.Wrap(err)
+	if !placeholderExists {
+		_, _, err = sq.Exec(db, sq.SQLite.
+			InsertInto(USERS).
+			Valuesx(func(col *sq.Column) error {
+				col.SetInt64(USERS.USER_ID, 1)
+				col.SetString(USERS.PUBLIC_USER_ID, "")
+				col.SetString(USERS.LOGIN_ID, "")
+				return nil
+			}),
+			sq.ErowsAffected,
+		)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		USER_ROLES := tables.NEW_USER_ROLES(ctx, "ur")
+		_, _, err = sq.Exec(db, sq.SQLite.
+			InsertInto(USER_ROLES).
+			Valuesx(func(col *sq.Column) error {
+				col.SetInt64(USER_ROLES.USER_ID, 1)
+				col.SetString(USER_ROLES.ROLE_NAME, roleSuperadmin)
+				return nil
+			}),
+			sq.ErowsAffected,
+		)
+		if err != nil {
+			return erro.Wrap(err)
+		}
 	}
-	// pm_roles
+	// pm_roles, pm_permissions, pm_role_permissions: the builtin permissions are
+	// upserted and granted to the superadmin role. Other roles and permissions
+	// are managed at URLManageRoles and are left alone.
 	ROLES := tables.NEW_ROLES(ctx, "r")
-	_, _, err = sq.Exec(db, sq.SQLite.DeleteFrom(ROLES), sq.ErowsAffected)
-	if err != nil {
-		return erro.Wrap(err)
-	}
 	_, _, err = sq.Exec(db, sq.SQLite.
 		InsertInto(ROLES).
 		Valuesx(func(col *sq.Column) error {
 			col.SetString(ROLES.ROLE_NAME, roleSuperadmin)
+			col.SetString(ROLES.DESCRIPTION, "Whoever logs in with the superadmin password")
 			return nil
-		}),
+		}).
+		OnConflict(ROLES.ROLE_NAME).
+		DoNothing(),
 		sq.ErowsAffected,
 	)
 	if err != nil {
 		return erro.Wrap(err)
 	}
-	// pm_permissions
-	PERMISSIONS := tables.NEW_PERMISSIONS(ctx, "p")
-	_, _, err = sq.Exec(db, sq.SQLite.DeleteFrom(PERMISSIONS), sq.ErowsAffected)
+	err = upsertPermissions(ctx, db, builtinPermissions)
 	if err != nil {
 		return erro.Wrap(err)
 	}
-	_, _, err = sq.Exec(db, sq.SQLite.
-		InsertInto(PERMISSIONS).
-		Valuesx(func(col *sq.Column) error {
-			col.SetString(PERMISSIONS.PERMISSION_NAME, permissionAddPage)
-			col.SetString(PERMISSIONS.PERMISSION_NAME, permissionViewPage)
-			col.SetString(PERMISSIONS.PERMISSION_NAME, permissionChangePage)
-			col.SetString(PERMISSIONS.PERMISSION_NAME, permissionDeletePage)
-			return nil
-		}),
-		sq.ErowsAffected,
-	)
-	if err != nil {
-		return erro.Wrap(err)
-	}
-	// pm_user_roles
-	USER_ROLES := tables.NEW_USER_ROLES(ctx, "ur")
-	_, _, err = sq.Exec(db, sq.SQLite.DeleteFrom(USER_ROLES), sq.ErowsAffected)
-	if err != nil {
-		return erro.Wrap(err)
+	var builtinPermissionNames []string
+	for _, permission := range builtinPermissions {
+		builtinPermissionNames = append(builtinPermissionNames, permission.Name)
 	}
+	ROLE_PERMISSIONS := tables.NEW_ROLE_PERMISSIONS(ctx, "rp")
 	_, _, err = sq.Exec(db, sq.SQLite.
-		InsertInto(USER_ROLES).
-		Valuesx(func(col *sq.Column) error {
-			col.SetInt64(USER_ROLES.USER_ID, 1)
-			col.SetString(USER_ROLES.ROLE_NAME, roleSuperadmin)
-			return nil
-		}),
+		DeleteFrom(ROLE_PERMISSIONS).
+		Where(
+			ROLE_PERMISSIONS.ROLE_NAME.EqString(roleSuperadmin),
+			ROLE_PERMISSIONS.PERMISSION_NAME.In(builtinPermissionNames),
+		),
 		sq.ErowsAffected,
 	)
 	if err != nil {
 		return erro.Wrap(err)
 	}
-	// pm_role_permissions
-	ROLE_PERMISSIONS := tables.NEW_ROLE_PERMISSIONS(ctx, "rp")
-	_, _, err = sq.Exec(db, sq.SQLite.DeleteFrom(ROLE_PERMISSIONS), sq.ErowsAffected)
-	if err != nil {
-		return erro.Wrap(err)
-	}
 	_, _, err = sq.Exec(db, sq.SQLite.
 		InsertInto(ROLE_PERMISSIONS).
 		Valuesx(func(col *sq.Column) error {
-			// add
-			col.SetString(ROLE_PERMISSIONS.ROLE_NAME, roleSuperadmin)
-			col.SetString(ROLE_PERMISSIONS.PERMISSION_NAME, permissionAddPage)
-			// view
-			col.SetString(ROLE_PERMISSIONS.ROLE_NAME, roleSuperadmin)
-			col.SetString(ROLE_PERMISSIONS.PERMISSION_NAME, permissionViewPage)
-			// change
-			col.SetString(ROLE_PERMISSIONS.ROLE_NAME, roleSuperadmin)
-			col.SetString(ROLE_PERMISSIONS.PERMISSION_NAME, permissionChangePage)
-			// delete
-			col.SetString(ROLE_PERMISSIONS.ROLE_NAME, roleSuperadmin)
-			col.SetString(ROLE_PERMISSIONS.PERMISSION_NAME, permissionDeletePage)
+			for _, name := range builtinPermissionNames {
+				col.SetString(ROLE_PERMISSIONS.ROLE_NAME, roleSuperadmin)
+				col.SetString(ROLE_PERMISSIONS.PERMISSION_NAME, name)
+			}
 			return nil
 		}),
 		sq.ErowsAffected,
@@ -323,32 +336,37 @@ func seedData(ctx context.Context, db sq.Queryer) error {
 	if err != nil {
 		return erro.Wrap(err)
 	}
-	// pm_locales
+	// pm_locales: only seeded if there are none, as locales are managed at
+	// URLManageLocales
 	l := tables.NEW_LOCALES(ctx, "l")
-	_, _, err = sq.Exec(db, sq.SQLite.DeleteFrom(l), sq.ErowsAffected)
+	localesExist, err := sq.Exists(db, sq.SQLite.From(l))
 	if err != nil {
 		return erro.Wrap(err)
 	}
-	var locales = []struct {
-		code        string
-		description string
-	}{
-		{"en", "English"},
-		{"de", "German"},
-	}
-	_, _, err = sq.Exec(db, sq.SQLite.
-		InsertInto(l).
-		Valuesx(func(col *sq.Column) error {
-			for _, locale := range locales {
-				col.SetString(l.LOCALE_CODE, locale.code)
-				col.SetString(l.DESCRIPTION, locale.description)
-			}
-			return nil
-		}),
-		sq.ErowsAffected,
-	)
-	if err != nil {
-		return erro.Wrap(err)
+	if !localesExist {
+		var locales = []struct {
+			code        string
+			description string
+			isDefault   bool
+		}{
+			{"en", "English", true},
+			{"de", "German", false},
+		}
+		_, _, err = sq.Exec(db, sq.SQLite.
+			InsertInto(l).
+			Valuesx(func(col *sq.Column) error {
+				for _, locale := range locales {
+					col.SetString(l.LOCALE_CODE, locale.code)
+					col.SetString(l.DESCRIPTION, locale.description)
+					col.SetBool(l.IS_DEFAULT, locale.isDefault)
+				}
+				return nil
+			}),
+			sq.ErowsAffected,
+		)
+		if err != nil {
+			return erro.Wrap(err)
+		}
 	}
 	// pm_pagedata
 	// pd := tables.NEW_PAGEDATA(ctx, "pd")
@@ -369,24 +387,6 @@ func seedData(ctx context.Context, db sq.Queryer) error {
 	return nil
 }
 
-func getLocales(ctx context.Context, db sq.Queryer) (map[string]string, error) {
-	l := tables.NEW_LOCALES(ctx, "l")
-	db = sq.NewDB(db, nil, sq.Linterpolate|sq.Lcaller|sq.Lresults)
-	locales := make(map[string]string)
-	_, err := sq.Fetch(db, sq.SQLite.From(l), func(row *sq.Row) error {
-		localeCode := row.String(l.LOCALE_CODE)
-		description := row.String(l.DESCRIPTION)
-		return row.Accumulate(func() error {
-			locales[localeCode] = description
-			return nil
-		})
-	})
-	if err != nil {
-		return locales, erro.Wrap(err)
-	}
-	return locales, nil
-}
-
 func (pm *PageManager) boxesInitialized() bool {
 	return atomic.LoadInt32(&pm.privateBoxFlag) == 1
 }
@@ -1,12 +1,14 @@
 package pagemanager
 
 import (
+	"errors"
 	"html/template"
 	"net/http"
 
 	"github.com/bokwoon95/pagemanager/erro"
 	"github.com/bokwoon95/pagemanager/hy"
 	"github.com/bokwoon95/pagemanager/hyforms"
+	"github.com/bokwoon95/pagemanager/keyderiv"
 	"github.com/bokwoon95/pagemanager/sq"
 	"github.com/bokwoon95/pagemanager/tables"
 	"github.com/bokwoon95/pagemanager/tpl"
@@ -79,6 +81,17 @@ func (pm *PageManager) superadminLogin(w http.ResponseWriter, r *http.Request) {
 			hyforms.Redirect(w, r, LocaleURL(r, r.URL.Path), errMsgs)
 			return
 		}
+		lockoutKeys := loginLockoutKeys(r, "superadmin", data.LoginID)
+		wait, err := reserveLoginAttempt(r.Context(), pm.dataDB, lockoutKeys)
+		if err != nil {
+			pm.InternalServerError(w, r, erro.Wrap(err))
+			return
+		}
+		if wait > 0 {
+			errMsgs.FormErrMsgs = append(errMsgs.FormErrMsgs, msg(r, "login.too_many_attempts", wait))
+			hyforms.Redirect(w, r, LocaleURL(r, r.URL.Path), errMsgs)
+			return
+		}
 		SUPERADMIN := tables.NEW_SUPERADMIN("")
 		exists, err := sq.Exists(pm.superadminDB, sq.SQLite.From(SUPERADMIN).Where(
 			SUPERADMIN.ORDER_NUM.EqInt(1),
@@ -89,18 +102,43 @@ func (pm *PageManager) superadminLogin(w http.ResponseWriter, r *http.Request) {
 			hyforms.Redirect(w, r, LocaleURL(r, r.URL.Path), errMsgs)
 			return
 		}
-		if !exists {
-			errMsgs.FormErrMsgs = append(errMsgs.FormErrMsgs, ErrInvalidLoginCredentials.Error())
-			hyforms.Redirect(w, r, LocaleURL(r, r.URL.Path), errMsgs)
-			return
+		if exists {
+			err = pm.initializeBoxes([]byte(data.Password))
+		} else {
+			_ = keyderiv.CompareHashAndPassword(pm.dummyPasswordHash, []byte(data.Password))
+			err = ErrInvalidLoginCredentials
+		}
+		if err != nil && !errors.Is(err, ErrInvalidLoginCredentials) {
+			if err := cancelLoginAttempt(r.Context(), pm.dataDB, lockoutKeys); err != nil {
+				pm.InternalServerError(w, r, erro.Wrap(err))
+				return
+			}
 		}
-		err = pm.initializeBoxes([]byte(data.Password))
 		if err != nil {
 			errMsgs.FormErrMsgs = append(errMsgs.FormErrMsgs, err.Error())
 			hyforms.Redirect(w, r, LocaleURL(r, r.URL.Path), errMsgs)
 			return
 		}
-		err = pm.newSession(w, 1, nil)
+		err = clearLoginFailures(r.Context(), pm.dataDB, lockoutKeys)
+		if err != nil {
+			pm.InternalServerError(w, r, erro.Wrap(err))
+			return
+		}
+		t, err := pm.getUserTOTP(r.Context(), pm.dataDB, 1)
+		if err != nil {
+			pm.InternalServerError(w, r, erro.Wrap(err))
+			return
+		}
+		if t.enabled {
+			err = pm.setPendingLogin(w, r, 1)
+			if err != nil {
+				pm.InternalServerError(w, r, erro.Wrap(err))
+				return
+			}
+			Redirect(w, r, URLLoginTwoFactor)
+			return
+		}
+		err = pm.newSession(w, r, 1, nil)
 		if err != nil {
 			pm.InternalServerError(w, r, erro.Wrap(err))
 			return
@@ -32,7 +32,8 @@ func (d *superadminSetupData) Form() (template.HTML, error) {
 }
 
 func (d *superadminSetupData) setupForm(form *hyforms.Form) {
-	const passwordNotMatch = "passwords do not match"
+	r := form.Request()
+	passwordNotMatch := msg(r, "superadmin_setup.password_not_match")
 	loginID := form.
 		Text("pm-login-id", d.LoginID).
 		Set("#pm-login-id.bg-near-white.pa2.w-100", hy.Attr{})
@@ -45,30 +46,30 @@ func (d *superadminSetupData) setupForm(form *hyforms.Form) {
 
 	form.Set(".bg-white.setup-form", hy.Attr{"method": "POST"})
 	form.AppendElements(hy.Elements{
-		hy.H("div.f4", nil, hy.Txt("No Superadmin detected.")),
-		hy.H("div.f6", nil, hy.Txt("To make changes to your website, you need to create a Superadmin account.")),
+		hy.H("div.f4", nil, hy.Txt(msg(r, "superadmin_setup.no_superadmin"))),
+		hy.H("div.f6", nil, hy.Txt(msg(r, "superadmin_setup.explanation"))),
 	})
 	form.AppendElements(
 		hy.H("div.mt3.mb1", nil, hy.H("label.pointer", hy.Attr{"for": loginID.ID()},
-			hy.Txt("Email or Username: "), hy.H("span.f6.gray", nil, hy.Txt("(optional)")),
+			hy.Txt(msg(r, "superadmin_setup.login_id")), hy.H("span.f6.gray", nil, hy.Txt(msg(r, "superadmin_setup.optional"))),
 		)),
 		hy.H("div", nil, loginID),
 	)
 	form.AppendElements(
-		hy.H("div.mt3.mb1", nil, hy.H("label.pointer", hy.Attr{"for": password.ID()}, hy.Txt("Superadmin Password:"))),
+		hy.H("div.mt3.mb1", nil, hy.H("label.pointer", hy.Attr{"for": password.ID()}, hy.Txt(msg(r, "superadmin_setup.password")))),
 		hy.H("div", nil, password),
 	)
 	if hyforms.ErrMsgsMatch(password.ErrMsgs(), hyforms.RequiredErrMsg) {
-		form.Append("div.f7.red", nil, hy.Txt(hyforms.RequiredErrMsg))
+		form.Append("div.f7.red", nil, hy.Txt(msg(r, "hyforms.RequiredErrMsg")))
 	}
 	form.AppendElements(
-		hy.H("div.mt3.mb1", nil, hy.H("label.pointer", hy.Attr{"for": confirmPassword.ID()}, hy.Txt("Confirm Superadmin Password:"))),
+		hy.H("div.mt3.mb1", nil, hy.H("label.pointer", hy.Attr{"for": confirmPassword.ID()}, hy.Txt(msg(r, "superadmin_setup.confirm_password")))),
 		hy.H("div", nil, confirmPassword),
 	)
 	if hyforms.ErrMsgsMatch(confirmPassword.ErrMsgs(), passwordNotMatch) {
 		form.Append("div.f7.red", nil, hy.Txt(passwordNotMatch))
 	}
-	form.Append("div.mt3", nil, hy.H("button.pointer.pa2", hy.Attr{"type": "submit"}, hy.Txt("Create Superadmin")))
+	form.Append("div.mt3", nil, hy.H("button.pointer.pa2", hy.Attr{"type": "submit"}, hy.Txt(msg(r, "superadmin_setup.submit"))))
 
 	form.Unmarshal(func() {
 		d.LoginID = loginID.Value()
@@ -86,8 +87,8 @@ func (pm *PageManager) superadminSetup(w http.ResponseWriter, r *http.Request) {
 	var err error
 	switch r.Method {
 	case "GET":
-		data.Title = "PageManager Setup"
-		data.Header = "PageManager Setup"
+		data.Title = msg(r, "superadmin_setup.title")
+		data.Header = template.HTML(data.Title)
 		_ = hyforms.GetCookieValue(w, r, setupForm, data)
 		err = pm.tpl.Render(w, r, data, tpl.Files("superadmin_setup.html"))
 		if err != nil {
@@ -48,7 +48,8 @@ type PM_PAGES struct {
 	PLUGIN_NAME  sq.StringField
 	HANDLER_NAME sq.StringField
 	// content body
-	CONTENT sq.StringField
+	CONTENT        sq.StringField
+	CONTENT_FORMAT sq.StringField
 	// 301 Moved Permanently
 	REDIRECT_URL sq.StringField
 	// 404 Not Found
@@ -88,13 +89,18 @@ func NEW_PAGEDATA(ctx context.Context, alias string) PM_PAGEDATA {
 
 type PM_USERS struct {
 	sq.TableInfo
-	USER_ID        sq.NumberField `sq:"type=INTEGER misc=PRIMARY_KEY"`
-	PUBLIC_USER_ID sq.StringField `sq:"type=TEXT misc=NOT_NULL,UNIQUE"`
-	LOGIN_ID       sq.StringField
-	PASSWORD_HASH  sq.StringField
-	EMAIL          sq.StringField
-	DISPLAYNAME    sq.StringField
-	USER_DATA      sq.JSONField
+	USER_ID           sq.NumberField `sq:"type=INTEGER misc=PRIMARY_KEY"`
+	PUBLIC_USER_ID    sq.StringField `sq:"type=TEXT misc=NOT_NULL,UNIQUE"`
+	LOGIN_ID          sq.StringField
+	PASSWORD_HASH     sq.StringField
+	EMAIL             sq.StringField
+	DISPLAYNAME       sq.StringField
+	USER_DATA         sq.JSONField
+	DISABLED          sq.BooleanField
+	EMAIL_VERIFIED    sq.BooleanField
+	TOTP_SECRET       sq.StringField
+	TOTP_ENABLED      sq.BooleanField
+	TOTP_LAST_COUNTER sq.NumberField
 }
 
 func NEW_USERS(ctx context.Context, alias string) PM_USERS {
@@ -198,6 +204,8 @@ type PM_SESSIONS struct {
 	SESSION_HASH sq.StringField `sq:"type=TEXT misc=NOT_NULL,PRIMARY_KEY"`
 	USER_ID      sq.NumberField `sq:"type=INTEGER misc=NOT_NULL"`
 	CREATED_AT   sq.TimeField
+	LAST_SEEN_AT sq.TimeField
+	USER_AGENT   sq.StringField
 	SESSION_DATA sq.JSONField
 }
 
@@ -212,10 +220,112 @@ func NEW_SESSIONS(ctx context.Context, alias string) PM_SESSIONS {
 	return tbl
 }
 
+type PM_RECOVERY_CODES struct {
+	sq.TableInfo
+	USER_ID   sq.NumberField `sq:"type=INTEGER misc=NOT_NULL"`
+	CODE_HASH sq.StringField `sq:"type=TEXT misc=NOT_NULL,PRIMARY_KEY"`
+}
+
+func NEW_RECOVERY_CODES(ctx context.Context, alias string) PM_RECOVERY_CODES {
+	tbl := PM_RECOVERY_CODES{TableInfo: sq.TableInfo{Alias: alias}}
+	if tenantID, ok := ctx.Value(TenantIDKey{}).(string); ok && tenantID != "" {
+		tbl.TableInfo.Name = "pm_" + tenantID + "_recovery_codes"
+	} else {
+		tbl.TableInfo.Name = "pm_recovery_codes"
+	}
+	_ = sq.ReflectTable(&tbl)
+	return tbl
+}
+
+type PM_EMAIL_TOKENS struct {
+	sq.TableInfo
+	TOKEN_HASH sq.StringField `sq:"type=TEXT misc=NOT_NULL,PRIMARY_KEY"`
+	PURPOSE    sq.StringField `sq:"type=TEXT misc=NOT_NULL"`
+	USER_ID    sq.NumberField `sq:"type=INTEGER misc=NOT_NULL"`
+	EMAIL      sq.StringField
+	EXPIRES_AT sq.TimeField
+}
+
+func NEW_EMAIL_TOKENS(ctx context.Context, alias string) PM_EMAIL_TOKENS {
+	tbl := PM_EMAIL_TOKENS{TableInfo: sq.TableInfo{Alias: alias}}
+	if tenantID, ok := ctx.Value(TenantIDKey{}).(string); ok && tenantID != "" {
+		tbl.TableInfo.Name = "pm_" + tenantID + "_email_tokens"
+	} else {
+		tbl.TableInfo.Name = "pm_email_tokens"
+	}
+	_ = sq.ReflectTable(&tbl)
+	return tbl
+}
+
+type PM_USER_IDENTITIES struct {
+	sq.TableInfo
+	IDENTITY_KEY  sq.StringField `sq:"type=TEXT misc=NOT_NULL,PRIMARY_KEY"` // provider + ":" + subject
+	PROVIDER      sq.StringField `sq:"type=TEXT misc=NOT_NULL"`
+	SUBJECT       sq.StringField `sq:"type=TEXT misc=NOT_NULL"`
+	USER_ID       sq.NumberField `sq:"type=INTEGER misc=NOT_NULL"`
+	EMAIL         sq.StringField
+	CREATED_AT    sq.TimeField
+	LAST_LOGIN_AT sq.TimeField
+}
+
+func NEW_USER_IDENTITIES(ctx context.Context, alias string) PM_USER_IDENTITIES {
+	tbl := PM_USER_IDENTITIES{TableInfo: sq.TableInfo{Alias: alias}}
+	if tenantID, ok := ctx.Value(TenantIDKey{}).(string); ok && tenantID != "" {
+		tbl.TableInfo.Name = "pm_" + tenantID + "_user_identities"
+	} else {
+		tbl.TableInfo.Name = "pm_user_identities"
+	}
+	_ = sq.ReflectTable(&tbl)
+	return tbl
+}
+
+type PM_API_TOKENS struct {
+	sq.TableInfo
+	TOKEN_HASH   sq.StringField `sq:"type=TEXT misc=NOT_NULL,PRIMARY_KEY"`
+	USER_ID      sq.NumberField `sq:"type=INTEGER misc=NOT_NULL"`
+	NAME         sq.StringField
+	SCOPES       sq.StringField // comma separated permission names
+	CREATED_AT   sq.TimeField
+	LAST_USED_AT sq.TimeField
+	EXPIRES_AT   sq.TimeField
+}
+
+func NEW_API_TOKENS(ctx context.Context, alias string) PM_API_TOKENS {
+	tbl := PM_API_TOKENS{TableInfo: sq.TableInfo{Alias: alias}}
+	if tenantID, ok := ctx.Value(TenantIDKey{}).(string); ok && tenantID != "" {
+		tbl.TableInfo.Name = "pm_" + tenantID + "_api_tokens"
+	} else {
+		tbl.TableInfo.Name = "pm_api_tokens"
+	}
+	_ = sq.ReflectTable(&tbl)
+	return tbl
+}
+
+type PM_LOGIN_LOCKOUTS struct {
+	sq.TableInfo
+	LOCKOUT_KEY     sq.StringField `sq:"type=TEXT misc=NOT_NULL,PRIMARY_KEY"`
+	FAILURES        sq.NumberField `sq:"type=INTEGER misc=NOT_NULL"`
+	LAST_FAILURE_AT sq.TimeField
+	LOCKED_UNTIL    sq.TimeField
+}
+
+func NEW_LOGIN_LOCKOUTS(ctx context.Context, alias string) PM_LOGIN_LOCKOUTS {
+	tbl := PM_LOGIN_LOCKOUTS{TableInfo: sq.TableInfo{Alias: alias}}
+	if tenantID, ok := ctx.Value(TenantIDKey{}).(string); ok && tenantID != "" {
+		tbl.TableInfo.Name = "pm_" + tenantID + "_login_lockouts"
+	} else {
+		tbl.TableInfo.Name = "pm_login_lockouts"
+	}
+	_ = sq.ReflectTable(&tbl)
+	return tbl
+}
+
 type PM_LOCALES struct {
 	sq.TableInfo
-	LOCALE_CODE sq.StringField `sq:"type=TEXT misc=PRIMARY_KEY"`
-	DESCRIPTION sq.StringField
+	LOCALE_CODE    sq.StringField `sq:"type=TEXT misc=PRIMARY_KEY"`
+	DESCRIPTION    sq.StringField
+	IS_DEFAULT     sq.BooleanField
+	FALLBACK_CODES sq.JSONField
 }
 
 func NEW_LOCALES(ctx context.Context, alias string) PM_LOCALES {
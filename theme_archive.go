@@ -0,0 +1,285 @@
+package pagemanager
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/bokwoon95/pagemanager/erro"
+	"github.com/bokwoon95/pagemanager/sq"
+	"github.com/bokwoon95/pagemanager/tables"
+)
+
+const (
+	maxThemeArchiveFiles = 10000
+	maxThemeArchiveSize  = 100 << 20 // total uncompressed size
+)
+
+// themePathSegmentRegexp matches a single segment of a theme path. Segments
+// may not start with a dot, which rules out "." and "..".
+var themePathSegmentRegexp = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9_.-]*$`)
+
+func validateThemePath(themePath string) error {
+	if themePath == "" {
+		return fmt.Errorf("%w: theme path is empty", ErrInvalidThemePath)
+	}
+	for _, segment := range strings.Split(themePath, "/") {
+		if !themePathSegmentRegexp.MatchString(segment) {
+			return fmt.Errorf("%w: %q may only contain letters, digits, '_', '-' and '.' separated by '/', and may not start with '.'", ErrInvalidThemePath, themePath)
+		}
+	}
+	return nil
+}
+
+// InstallTheme extracts the theme in a zip archive into
+// <datafolder>/pm-themes/<themePath>. theme-config.js must be at the root of
+// the archive, or at the root of the archive's only top level folder. The
+// archive is rejected if it contains anything other than regular files and
+// folders, any file that would be extracted outside the theme folder, or a
+// theme-config.js that fails to run. Nothing is written to pm-themes unless
+// the whole archive is valid.
+func InstallTheme(datafolder, themePath string, r io.ReaderAt, size int64) error {
+	themePath = strings.Trim(themePath, "/")
+	err := validateThemePath(themePath)
+	if err != nil {
+		return err
+	}
+	themesDir := filepath.Join(datafolder, "pm-themes")
+	themeDir := filepath.Join(themesDir, filepath.FromSlash(themePath))
+	if _, err := os.Stat(themeDir); err == nil {
+		return fmt.Errorf("%w: %s", ErrThemeExists, themePath)
+	}
+	// A theme inside another theme's folder would never be loaded.
+	for dir := path.Dir(themePath); dir != "."; dir = path.Dir(dir) {
+		if _, err := os.Stat(filepath.Join(themesDir, filepath.FromSlash(dir), "theme-config.js")); err == nil {
+			return fmt.Errorf("%w: %s is inside the theme %s", ErrInvalidThemePath, themePath, dir)
+		}
+	}
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidThemeArchive, err)
+	}
+	files, err := themeArchiveFiles(zr)
+	if err != nil {
+		return err
+	}
+	// The theme is extracted into a temporary folder first and only moved into
+	// pm-themes once it is complete. The temporary folder is in the datafolder
+	// so that it is on the same filesystem as pm-themes.
+	tmpDir, err := os.MkdirTemp(datafolder, ".pm-install-theme-")
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	var totalSize int64
+	for _, name := range sortedFileNames(files) {
+		f := files[name]
+		dest := filepath.Join(tmpDir, filepath.FromSlash(name))
+		if f.FileInfo().IsDir() {
+			err = os.MkdirAll(dest, 0755)
+			if err != nil {
+				return erro.Wrap(err)
+			}
+			continue
+		}
+		n, err := extractFile(f, dest, maxThemeArchiveSize-totalSize)
+		if err != nil {
+			return err
+		}
+		totalSize += n
+	}
+	configFile := "pm-themes/" + themePath + "/theme-config.js"
+	b, err := os.ReadFile(filepath.Join(tmpDir, "theme-config.js"))
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	config, err := runThemeConfig(configFile, b, "/pm-themes/"+themePath+"/")
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidThemeArchive, err)
+	}
+	if _, ok := config.(map[string]interface{}); !ok {
+		return fmt.Errorf("%w: %s does not return an object", ErrInvalidThemeArchive, configFile)
+	}
+	err = os.MkdirAll(filepath.Dir(themeDir), 0755)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	err = os.Rename(tmpDir, themeDir)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	return nil
+}
+
+// themeArchiveFiles returns the files of a theme archive keyed by their path
+// relative to the theme folder.
+func themeArchiveFiles(zr *zip.Reader) (map[string]*zip.File, error) {
+	if len(zr.File) > maxThemeArchiveFiles {
+		return nil, fmt.Errorf("%w: more than %d files", ErrInvalidThemeArchive, maxThemeArchiveFiles)
+	}
+	var names []string
+	entries := make(map[string]*zip.File)
+	topLevel := make(map[string]struct{})
+	for _, f := range zr.File {
+		name := strings.TrimSuffix(f.Name, "/")
+		if name == "__MACOSX" || strings.HasPrefix(name, "__MACOSX/") {
+			continue // resource forks added by macOS
+		}
+		if strings.Contains(f.Name, `\`) || !fs.ValidPath(name) || name == "." {
+			return nil, fmt.Errorf("%w: invalid file name %q", ErrInvalidThemeArchive, f.Name)
+		}
+		if mode := f.Mode(); !mode.IsDir() && !mode.IsRegular() {
+			return nil, fmt.Errorf("%w: %s is not a regular file", ErrInvalidThemeArchive, name)
+		}
+		if _, ok := entries[name]; ok {
+			return nil, fmt.Errorf("%w: duplicate file %s", ErrInvalidThemeArchive, name)
+		}
+		entries[name] = f
+		names = append(names, name)
+		topLevel[strings.SplitN(name, "/", 2)[0]] = struct{}{}
+	}
+	var root string
+	if _, ok := entries["theme-config.js"]; !ok {
+		for dir := range topLevel {
+			if _, ok := entries[dir+"/theme-config.js"]; ok && len(topLevel) == 1 {
+				root = dir + "/"
+			}
+		}
+		if root == "" {
+			return nil, fmt.Errorf("%w: theme-config.js not found at the root of the archive", ErrInvalidThemeArchive)
+		}
+	}
+	files := make(map[string]*zip.File)
+	for _, name := range names {
+		if name+"/" == root {
+			continue
+		}
+		if !strings.HasPrefix(name, root) {
+			return nil, fmt.Errorf("%w: %s is outside the theme folder", ErrInvalidThemeArchive, name)
+		}
+		files[strings.TrimPrefix(name, root)] = entries[name]
+	}
+	if f := files["theme-config.js"]; f.FileInfo().IsDir() {
+		return nil, fmt.Errorf("%w: theme-config.js is a folder", ErrInvalidThemeArchive)
+	}
+	return files, nil
+}
+
+// extractFile writes the contents of f to dest and returns the number of bytes
+// written. It fails if f is larger than limit bytes, regardless of the size
+// declared in the archive.
+func extractFile(f *zip.File, dest string, limit int64) (int64, error) {
+	err := os.MkdirAll(filepath.Dir(dest), 0755)
+	if err != nil {
+		return 0, erro.Wrap(err)
+	}
+	src, err := f.Open()
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s: %s", ErrInvalidThemeArchive, f.Name, err)
+	}
+	defer src.Close()
+	file, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return 0, erro.Wrap(err)
+	}
+	defer file.Close()
+	n, err := io.Copy(file, io.LimitReader(src, limit+1))
+	if err != nil {
+		return n, fmt.Errorf("%w: %s: %s", ErrInvalidThemeArchive, f.Name, err)
+	}
+	if n > limit {
+		return n, fmt.Errorf("%w: larger than %d MB when extracted", ErrInvalidThemeArchive, maxThemeArchiveSize>>20)
+	}
+	return n, erro.Wrap(file.Close())
+}
+
+// UninstallTheme removes <datafolder>/pm-themes/<themePath>. It refuses to
+// remove a theme that is still used by a page or that is the parent of another
+// theme.
+func UninstallTheme(datafolder, themePath string) error {
+	db, err := openDataDB(datafolder)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	defer db.Close()
+	return uninstallTheme(context.Background(), db, datafolder, themePath)
+}
+
+func uninstallTheme(ctx context.Context, db sq.Queryer, datafolder, themePath string) error {
+	themePath = strings.Trim(themePath, "/")
+	err := validateThemePath(themePath)
+	if err != nil {
+		return err
+	}
+	themesDir := filepath.Join(datafolder, "pm-themes")
+	themeDir := filepath.Join(themesDir, filepath.FromSlash(themePath))
+	if _, err := os.Stat(filepath.Join(themeDir, "theme-config.js")); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("%w: %s", ErrThemeNotFound, themePath)
+		}
+		return erro.Wrap(err)
+	}
+	var urls []string
+	PAGES := tables.NEW_PAGES(ctx, "p")
+	_, err = sq.FetchContext(ctx, db, sq.SQLite.
+		From(PAGES).
+		Where(PAGES.THEME_PATH.EqString(themePath)).
+		OrderBy(PAGES.URL),
+		func(row *sq.Row) error {
+			url := row.String(PAGES.URL)
+			return row.Accumulate(func() error {
+				urls = append(urls, url)
+				return nil
+			})
+		},
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	if len(urls) > 0 {
+		return fmt.Errorf("%w: %s is used by %s", ErrThemeInUse, themePath, strings.Join(urls, ", "))
+	}
+	themes, _, err := getThemes(datafolder)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	var children []string
+	for _, t := range themes {
+		if t.parent == themePath {
+			children = append(children, t.path)
+		}
+	}
+	if len(children) > 0 {
+		sort.Strings(children)
+		return fmt.Errorf("%w: %s is the parent of %s", ErrThemeInUse, themePath, strings.Join(children, ", "))
+	}
+	err = os.RemoveAll(themeDir)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	// Remove the folders that only existed to hold the theme.
+	for dir := filepath.Dir(themeDir); dir != themesDir; dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break // not empty
+		}
+	}
+	return nil
+}
+
+func sortedFileNames(files map[string]*zip.File) []string {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -1,26 +1,35 @@
 package pagemanager
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"html/template"
 	"io/fs"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"sort"
 	"strings"
 
 	"github.com/bokwoon95/pagemanager/erro"
-	"github.com/dop251/goja"
+	"github.com/bokwoon95/pagemanager/hyforms"
 )
 
 // /pm-themes/plainsimple/index.css
-// /pm-themes/plainsimple/index.pm-sha256-RFWPLDbv2BY+rCkDzsE+0fr8ylGr2R2faWMhq4lfEQc=.css
+// /pm-themes/plainsimple/index.pm-sha256-RFWPLDbv2BY-rCkDzsE-0fr8ylGr2R2faWMhq4lfEQc.css
 // /pm-themes/plainsimple/data
-// /pm-themes/plainsimple/data.pm-sha256-RFWPLDbv2BY+rCkDzsE+0fr8ylGr2R2faWMhq4lfEQc=
+// /pm-themes/plainsimple/data.pm-sha256-RFWPLDbv2BY-rCkDzsE-0fr8ylGr2R2faWMhq4lfEQc
 // /pm-themes/plainsimple/haha.meh
-// /pm-themes/plainsimple/haha.pm-sha256-RFWPLDbv2BY+rCkDzsE+0fr8ylGr2R2faWMhq4lfEQc=.meh
+// /pm-themes/plainsimple/haha.pm-sha256-RFWPLDbv2BY-rCkDzsE-0fr8ylGr2R2faWMhq4lfEQc.meh
+//
+// The hash is encoded with unpadded URL-safe base64 so that it never
+// introduces an extra "/" into the asset's path.
+var assetHashRegexp = regexp.MustCompile(`\.pm-sha256-[A-Za-z0-9_-]{43}`)
 
 type Asset struct {
 	Path   string
@@ -29,19 +38,54 @@ type Asset struct {
 	Inline bool
 }
 
+// URL returns the content-hashed URL of the asset, or its plain path if the
+// asset has not been hashed.
+func (a Asset) URL() string {
+	if a.Hash == [32]byte{} {
+		return a.Path
+	}
+	ext := path.Ext(a.Path)
+	return strings.TrimSuffix(a.Path, ext) + ".pm-sha256-" + base64.RawURLEncoding.EncodeToString(a.Hash[:]) + ext
+}
+
+// Integrity returns the subresource integrity value of the asset, or an empty
+// string if the asset has not been hashed.
+func (a Asset) Integrity() string {
+	if a.Hash == [32]byte{} {
+		return ""
+	}
+	return "sha256-" + base64.StdEncoding.EncodeToString(a.Hash[:])
+}
+
+// templateField is an editable field declared by a template. Fields are
+// edited in the advanced edit mode and their values are stored in
+// PM_PAGEDATA under the field's name.
+type templateField struct {
+	Name        string
+	Type        string // one of the FieldType* constants
+	Label       string
+	Description string
+	Fields      []templateField // the fields of each item, if Type is FieldTypeList
+}
+
 type themeTemplate struct {
-	HTML                  []string
-	CSS                   []Asset
-	JS                    []Asset
-	TemplateVariables     map[string]interface{}
-	ContentSecurityPolicy map[string][]string
+	HTML                            []string
+	CSS                             []Asset
+	JS                              []Asset
+	Fields                          []templateField
+	TemplateVariables               map[string]interface{}
+	ContentSecurityPolicy           map[string][]string
+	ContentSecurityPolicyReportOnly bool
 }
 
 type theme struct {
 	err            error  // any error encountered when parsing theme-config.js
 	path           string // path to the theme folder in the "pm-themes" folder
+	configFile     string // path to theme-config.js, relative to the datafolder
+	unknownKeys    []string
 	name           string
 	description    string
+	parent         string // path of the parent theme, if any
 	fallbackAssets map[string]string
 	themeTemplates map[string]themeTemplate
 }
@@ -71,22 +115,27 @@ func getThemes(datafolder string) (themes map[string]theme, fallbackAssetsIndex
 		}
 		t := theme{
 			path:           strings.TrimPrefix(cwd, "/pm-themes/"),
+			configFile:     strings.TrimPrefix(cwd, "/") + "/theme-config.js",
 			fallbackAssets: make(map[string]string),
 			themeTemplates: make(map[string]themeTemplate),
 		}
-		vm := goja.New()
-		vm.Set("$THEME_PATH", cwd+"/")
-		res, err := vm.RunString("(function(){" + string(b) + "})()")
+		config, err := runThemeConfig(t.configFile, b, cwd+"/")
 		if err != nil {
 			t.err = err
+			themes[t.path] = t
 			return fs.SkipDir
 		}
-		t.Unmarshal(res.Export())
+		t.Unmarshal(config)
 		for asset := range t.fallbackAssets {
-			if _, ok := fallbackAssetsIndex[asset]; ok {
-				return erro.Wrap(fmt.Errorf(`fallback already declared for asset "%s"`, asset))
+			if themePath, ok := fallbackAssetsIndex[asset]; ok {
+				t.err = fmt.Errorf(`fallback for asset "%s" already declared by theme "%s"`, asset, themePath)
+				break
+			}
+		}
+		if t.err == nil {
+			for asset := range t.fallbackAssets {
+				fallbackAssetsIndex[asset] = t.path
 			}
-			fallbackAssetsIndex[asset] = t.path
 		}
 		themes[t.path] = t
 		return fs.SkipDir
@@ -94,9 +143,138 @@ func getThemes(datafolder string) (themes map[string]theme, fallbackAssetsIndex
 	if err != nil {
 		return themes, fallbackAssetsIndex, erro.Wrap(err)
 	}
+	// Parents are resolved and assets are hashed only after every theme has
+	// been walked, because they depend on files from other themes: a theme's
+	// ancestors, or the theme that declared the fallback for a missing asset.
+	datafolderFS := os.DirFS(datafolder)
+	resolveParents(datafolderFS, themes)
+	for _, t := range themes {
+		t.hashAssets(datafolderFS, themes, fallbackAssetsIndex)
+	}
 	return themes, fallbackAssetsIndex, nil
 }
 
+// resolveParents makes each theme that declares a parent inherit the templates
+// it does not define from its ancestors. Every HTML file and asset of the
+// theme's templates is resolved to the closest theme in the chain (starting
+// from the theme itself) that has the file, so a child theme can override any
+// file of its parent by providing a file with the same name. Missing parents
+// and inheritance cycles are reported in theme.err.
+func resolveParents(datafolderFS fs.FS, themes map[string]theme) {
+	for themePath, t := range themes {
+		if t.parent == "" || t.err != nil {
+			continue
+		}
+		chain, err := themeChain(themes, themePath)
+		if err != nil {
+			t.err = err
+			themes[themePath] = t
+			continue
+		}
+		resolve := func(filename string) string {
+			for _, ancestor := range chain {
+				prefix := "/pm-themes/" + ancestor.path + "/"
+				if !strings.HasPrefix(filename, prefix) {
+					continue
+				}
+				name := strings.TrimPrefix(filename, prefix)
+				for _, candidate := range chain {
+					candidateFilename := "/pm-themes/" + candidate.path + "/" + name
+					if _, err := fs.Stat(datafolderFS, strings.TrimPrefix(candidateFilename, "/")); err == nil {
+						return candidateFilename
+					}
+				}
+				break
+			}
+			return filename
+		}
+		for _, ancestor := range chain[1:] {
+			for templateName, tt := range ancestor.themeTemplates {
+				if _, ok := t.themeTemplates[templateName]; !ok {
+					t.themeTemplates[templateName] = tt
+				}
+			}
+		}
+		for templateName, tt := range t.themeTemplates {
+			// tt's slices may belong to an ancestor's template, so the
+			// resolved files are written to new slices.
+			HTML := make([]string, len(tt.HTML))
+			for i, filename := range tt.HTML {
+				HTML[i] = resolve(filename)
+			}
+			CSS := make([]Asset, len(tt.CSS))
+			for i, asset := range tt.CSS {
+				asset.Path = resolve(asset.Path)
+				CSS[i] = asset
+			}
+			JS := make([]Asset, len(tt.JS))
+			for i, asset := range tt.JS {
+				asset.Path = resolve(asset.Path)
+				JS[i] = asset
+			}
+			tt.HTML, tt.CSS, tt.JS = HTML, CSS, JS
+			t.themeTemplates[templateName] = tt
+		}
+	}
+}
+
+// themeChain returns the theme followed by its parent, grandparent and so on.
+func themeChain(themes map[string]theme, themePath string) ([]theme, error) {
+	var chain []theme
+	var seen []string
+	for themePath != "" {
+		for _, path := range seen {
+			if path == themePath {
+				return nil, fmt.Errorf("theme inheritance cycle: %s", strings.Join(append(seen, themePath), " -> "))
+			}
+		}
+		seen = append(seen, themePath)
+		t, ok := themes[themePath]
+		if !ok {
+			return nil, fmt.Errorf(`parent theme "%s" not found`, themePath)
+		}
+		if t.err != nil {
+			return nil, fmt.Errorf(`parent theme "%s": %w`, themePath, t.err)
+		}
+		chain = append(chain, t)
+		themePath = t.parent
+	}
+	return chain, nil
+}
+
+// hashAssets computes the sha256 hash of every CSS and JS asset in the theme.
+// Assets that cannot be read are left unhashed and will be linked to by their
+// plain path. The contents of inline assets are also kept, since they are
+// written directly into the page.
+func (t *theme) hashAssets(datafolderFS fs.FS, themes map[string]theme, fallbackAssetsIndex map[string]string) {
+	hashAsset := func(a *Asset) {
+		b, err := fs.ReadFile(datafolderFS, strings.TrimPrefix(a.Path, "/"))
+		if errors.Is(err, os.ErrNotExist) {
+			fallbackFile, ok := themes[fallbackAssetsIndex[a.Path]].fallbackAssets[a.Path]
+			if !ok {
+				return
+			}
+			b, err = fs.ReadFile(datafolderFS, strings.TrimPrefix(fallbackFile, "/"))
+		}
+		if err != nil {
+			return
+		}
+		a.Hash = sha256.Sum256(b)
+		if a.Inline {
+			a.Data = b
+		}
+	}
+	for templateName, tt := range t.themeTemplates {
+		for i := range tt.CSS {
+			hashAsset(&tt.CSS[i])
+		}
+		for i := range tt.JS {
+			hashAsset(&tt.JS[i])
+		}
+		t.themeTemplates[templateName] = tt
+	}
+}
+
 func (pm *PageManager) refreshThemes() error {
 	themes, fallbackAssetsIndex, err := getThemes(pm.datafolder)
 	if err != nil {
@@ -108,14 +286,47 @@ func (pm *PageManager) refreshThemes() error {
 	return nil
 }
 
+// The keys recognized in theme-config.js.
+var (
+	themeConfigKeys = map[string]struct{}{
+		"Name": {}, "Description": {}, "Parent": {}, "FallbackAssets": {}, "Templates": {},
+	}
+	themeTemplateKeys = map[string]struct{}{
+		"HTML": {}, "CSS": {}, "JS": {}, "Fields": {}, "TemplateVariables": {}, "ContentSecurityPolicy": {},
+		"ContentSecurityPolicyReportOnly": {},
+	}
+	assetKeys = map[string]struct{}{
+		"Path": {}, "Inline": {},
+	}
+	fieldKeys = map[string]struct{}{
+		"Name": {}, "Type": {}, "Label": {}, "Description": {}, "Fields": {},
+	}
+)
+
+// unknownKeys returns the keys of data that are not in knownKeys, sorted and
+// prefixed with prefix.
+func unknownKeys(data map[string]interface{}, prefix string, knownKeys map[string]struct{}) []string {
+	var keys []string
+	for key := range data {
+		if _, ok := knownKeys[key]; !ok {
+			keys = append(keys, prefix+key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 func (t *theme) Unmarshal(data interface{}) {
 	data2, ok := data.(map[string]interface{})
 	if !ok {
 		return
 	}
 	themePath := "/pm-themes/" + t.path
+	t.unknownKeys = append(t.unknownKeys, unknownKeys(data2, "", themeConfigKeys)...)
 	t.name, _ = data2["Name"].(string)
 	t.description, _ = data2["Description"].(string)
+	t.parent, _ = data2["Parent"].(string)
+	t.parent = strings.Trim(strings.TrimPrefix(t.parent, "/pm-themes/"), "/")
 	fallbackAssets, _ := data2["FallbackAssets"].(map[string]interface{})
 	for asset, __fallback__ := range fallbackAssets {
 		fallback, ok := __fallback__.(string)
@@ -135,6 +346,7 @@ func (t *theme) Unmarshal(data interface{}) {
 			ContentSecurityPolicy: make(map[string][]string),
 		}
 		template, _ := __template__.(map[string]interface{})
+		t.unknownKeys = append(t.unknownKeys, unknownKeys(template, "Templates."+templateName+".", themeTemplateKeys)...)
 		HTMLs, _ := template["HTML"].([]interface{})
 		for _, __html__ := range HTMLs {
 			html, ok := __html__.(string)
@@ -148,7 +360,7 @@ func (t *theme) Unmarshal(data interface{}) {
 			}
 		}
 		CSSs, _ := template["CSS"].([]interface{})
-		for _, __css__ := range CSSs {
+		for i, __css__ := range CSSs {
 			var a Asset
 			switch css := __css__.(type) {
 			case string:
@@ -159,7 +371,11 @@ func (t *theme) Unmarshal(data interface{}) {
 				}
 				tt.CSS = append(tt.CSS, a)
 			case map[string]interface{}:
+				t.unknownKeys = append(t.unknownKeys, unknownKeys(css, fmt.Sprintf("Templates.%s.CSS[%d].", templateName, i), assetKeys)...)
 				a.Path, _ = css["Path"].(string)
+				if a.Path != "" && !strings.HasPrefix(a.Path, "/") {
+					a.Path = themePath + "/" + a.Path
+				}
 				a.Inline, _ = css["Inline"].(bool)
 				tt.CSS = append(tt.CSS, a)
 			default:
@@ -167,7 +383,7 @@ func (t *theme) Unmarshal(data interface{}) {
 			}
 		}
 		JSs, _ := template["JS"].([]interface{})
-		for _, __js__ := range JSs {
+		for i, __js__ := range JSs {
 			var a Asset
 			switch js := __js__.(type) {
 			case string:
@@ -178,13 +394,19 @@ func (t *theme) Unmarshal(data interface{}) {
 				}
 				tt.JS = append(tt.JS, a)
 			case map[string]interface{}:
+				t.unknownKeys = append(t.unknownKeys, unknownKeys(js, fmt.Sprintf("Templates.%s.JS[%d].", templateName, i), assetKeys)...)
 				a.Path, _ = js["Path"].(string)
+				if a.Path != "" && !strings.HasPrefix(a.Path, "/") {
+					a.Path = themePath + "/" + a.Path
+				}
 				a.Inline, _ = js["Inline"].(bool)
 				tt.JS = append(tt.JS, a)
 			default:
 				continue
 			}
 		}
+		fields, _ := template["Fields"].([]interface{})
+		tt.Fields = t.unmarshalFields(fields, "Templates."+templateName+".Fields")
 		tt.TemplateVariables, _ = template["TemplateVariables"].(map[string]interface{})
 		contentSecurityPolicy, _ := template["ContentSecurityPolicy"].(map[string]interface{})
 		for name, __policies__ := range contentSecurityPolicy {
@@ -197,10 +419,43 @@ func (t *theme) Unmarshal(data interface{}) {
 				tt.ContentSecurityPolicy[name] = append(tt.ContentSecurityPolicy[name], policy)
 			}
 		}
+		tt.ContentSecurityPolicyReportOnly, _ = template["ContentSecurityPolicyReportOnly"].(bool)
 		t.themeTemplates[templateName] = tt
 	}
 }
 
+func (t *theme) unmarshalFields(data []interface{}, prefix string) []templateField {
+	var fields []templateField
+	for i, __field__ := range data {
+		field, ok := __field__.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		fieldPrefix := fmt.Sprintf("%s[%d]", prefix, i)
+		t.unknownKeys = append(t.unknownKeys, unknownKeys(field, fieldPrefix+".", fieldKeys)...)
+		var f templateField
+		f.Name, _ = field["Name"].(string)
+		if f.Name == "" {
+			continue
+		}
+		f.Type, _ = field["Type"].(string)
+		if f.Type == "" {
+			f.Type = FieldTypeText
+		}
+		f.Label, _ = field["Label"].(string)
+		if f.Label == "" {
+			f.Label = f.Name
+		}
+		f.Description, _ = field["Description"].(string)
+		if f.Type == FieldTypeList {
+			subfields, _ := field["Fields"].([]interface{})
+			f.Fields = t.unmarshalFields(subfields, fieldPrefix+".Fields")
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
 func (pm *PageManager) serveTemplate(w http.ResponseWriter, r *http.Request, themePath, templateName string) {
 	pm.themesMutex.RLock()
 	theme, ok := pm.themes[themePath]
@@ -222,6 +477,10 @@ func (pm *PageManager) serveTemplate(w http.ResponseWriter, r *http.Request, the
 		http.Error(w, erro.Sdump(fmt.Errorf("template has no HTML files")), http.StatusInternalServerError)
 		return
 	}
+	if r.FormValue(queryparamEditMode) == EditModeAdvanced {
+		pm.editTemplate(w, r, themeTemplate.Fields)
+		return
+	}
 	type Data struct {
 		Page              PageData
 		TemplateVariables map[string]interface{}
@@ -248,9 +507,9 @@ func (pm *PageManager) serveTemplate(w http.ResponseWriter, r *http.Request, the
 			URL:        r.URL.Path,
 			DataID:     r.URL.Path,
 			LocaleCode: LocaleCode(r),
+			origin:     requestOrigin(r),
 			cssAssets:  themeTemplate.CSS,
 			jsAssets:   themeTemplate.JS,
-			csp:        themeTemplate.ContentSecurityPolicy,
 		},
 		TemplateVariables: themeTemplate.TemplateVariables,
 	}
@@ -259,10 +518,45 @@ func (pm *PageManager) serveTemplate(w http.ResponseWriter, r *http.Request, the
 		data.Page.EditMode = EditModeBasic
 		data.Page.cssAssets = append(data.Page.cssAssets, Asset{Path: "/pm-plugins/pagemanager/editmode.css"})
 		data.Page.jsAssets = append(data.Page.jsAssets, Asset{Path: "/pm-plugins/pagemanager/editmode.js"})
-	case EditModeAdvanced:
-		data.Page.EditMode = EditModeAdvanced
+		// editmode.js sends the CSRF token along when it saves the page. It is
+		// issued before the page is written, since it may set a cookie.
+		csrfToken, err := hyforms.CSRFToken(r)
+		if err != nil {
+			pm.InternalServerError(w, r, erro.Wrap(err))
+			return
+		}
+		data.Page.json = map[string]interface{}{"csrfToken": csrfToken}
+	}
+	var err error
+	data.Page.nonce, err = newNonce()
+	if err != nil {
+		pm.InternalServerError(w, r, erro.Wrap(err))
+		return
+	}
+	// themeTemplate.ContentSecurityPolicy is shared between requests, copy it
+	// before extending it with the policies that this page needs.
+	data.Page.csp = make(map[string][]string)
+	for name, policies := range themeTemplate.ContentSecurityPolicy {
+		data.Page.csp[name] = append([]string(nil), policies...)
+	}
+	if data.Page.EditMode == EditModeBasic {
+		for directive, sources := range editModeCSP {
+			extendCSP(data.Page.csp, directive, sources...)
+		}
+	}
+	extendCSP(data.Page.csp, "style-src", append(inlineAssetHashes(data.Page.cssAssets), "'nonce-"+data.Page.nonce+"'")...)
+	extendCSP(data.Page.csp, "script-src", append(inlineAssetHashes(data.Page.jsAssets), "'nonce-"+data.Page.nonce+"'")...)
+	if len(data.Page.csp) > 0 {
+		if _, ok := data.Page.csp["report-uri"]; !ok {
+			data.Page.csp["report-uri"] = []string{URLCSPReport}
+		}
+		header := "Content-Security-Policy"
+		if themeTemplate.ContentSecurityPolicyReportOnly {
+			header = "Content-Security-Policy-Report-Only"
+		}
+		w.Header().Set(header, serializeCSP(data.Page.csp))
 	}
-	err := t.Execute(w, data)
+	err = t.Execute(w, data)
 	if err != nil {
 		pm.InternalServerError(w, r, erro.Wrap(err))
 		return
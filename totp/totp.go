@@ -0,0 +1,97 @@
+// Package totp implements RFC 6238 time-based one-time passwords, as used by
+// authenticator apps: HMAC-SHA1, 6 digits and a 30 second period.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	Digits = 6
+	Period = 30 * time.Second
+)
+
+var b32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewSecret returns a random 160 bit secret, the size recommended by RFC 4226.
+func NewSecret() ([]byte, error) {
+	secret := make([]byte, 20)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// EncodeSecret returns secret in the base32 encoding that authenticator apps
+// accept when the secret is entered by hand.
+func EncodeSecret(secret []byte) string {
+	return b32.EncodeToString(secret)
+}
+
+// URI returns the otpauth:// provisioning URI of secret, which is what
+// authenticator apps expect to find in an enrolment QR code.
+func URI(secret []byte, issuer, accountName string) string {
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(accountName)
+	query := url.Values{}
+	query.Set("secret", EncodeSecret(secret))
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(Digits))
+	query.Set("period", fmt.Sprint(int(Period/time.Second)))
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+// Counter returns the time step that t falls in.
+func Counter(t time.Time) int64 {
+	return t.Unix() / int64(Period/time.Second)
+}
+
+// CodeAt returns the code of secret for the time step counter.
+func CodeAt(secret []byte, counter int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < Digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", Digits, value%mod)
+}
+
+// Code returns the code of secret at time t.
+func Code(secret []byte, t time.Time) string {
+	return CodeAt(secret, Counter(t))
+}
+
+// Verify reports whether code is a code of secret within skew time steps of
+// t, to allow for clock drift between the server and the authenticator. It
+// also returns the time step that matched, which callers should remember and
+// only accept codes of later time steps from then on so that a code cannot be
+// used twice. Whitespace in code is ignored.
+func Verify(secret []byte, code string, t time.Time, skew int) (counter int64, ok bool) {
+	code = strings.Join(strings.Fields(code), "")
+	if len(code) != Digits {
+		return 0, false
+	}
+	now := Counter(t)
+	for i := -int64(skew); i <= int64(skew); i++ {
+		if subtle.ConstantTimeCompare([]byte(CodeAt(secret, now+i)), []byte(code)) == 1 {
+			return now + i, true
+		}
+	}
+	return 0, false
+}
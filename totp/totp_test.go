@@ -0,0 +1,53 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bokwoon95/pagemanager/testutil"
+)
+
+func Test_Code(t *testing.T) {
+	// The SHA1 test vectors of RFC 6238 Appendix B, truncated to 6 digits.
+	secret := []byte("12345678901234567890")
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		is := testutil.New(t)
+		is.Equal(tt.code, Code(secret, time.Unix(tt.unix, 0)))
+	}
+}
+
+func Test_Verify(t *testing.T) {
+	is := testutil.New(t)
+	secret, err := NewSecret()
+	is.NoErr(err)
+	now := time.Unix(1234567890, 0)
+	counter, ok := Verify(secret, Code(secret, now.Add(-Period)), now, 1)
+	is.True(ok)
+	is.Equal(Counter(now)-1, counter)
+	code := Code(secret, now)
+	_, ok = Verify(secret, code[:3]+" "+code[3:], now, 1)
+	is.True(ok)
+	_, ok = Verify(secret, Code(secret, now.Add(-2*Period)), now, 1)
+	is.True(!ok)
+	_, ok = Verify(secret, "", now, 1)
+	is.True(!ok)
+}
+
+func Test_URI(t *testing.T) {
+	is := testutil.New(t)
+	uri := URI([]byte("12345678901234567890"), "PageManager", "alice@example.com")
+	is.True(strings.HasPrefix(uri, "otpauth://totp/PageManager:alice@example.com?"))
+	is.True(strings.Contains(uri, "secret=GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"))
+}
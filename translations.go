@@ -0,0 +1,353 @@
+package pagemanager
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/bokwoon95/pagemanager/erro"
+	"github.com/bokwoon95/pagemanager/hy"
+	"github.com/bokwoon95/pagemanager/hyforms"
+	"github.com/bokwoon95/pagemanager/sq"
+	"github.com/bokwoon95/pagemanager/tables"
+	"github.com/bokwoon95/pagemanager/tpl"
+)
+
+// untranslatedKeys are the keys of a DATA_ID that have data in the default
+// locale but not in the locale LocaleCode.
+type untranslatedKeys struct {
+	DataID     string
+	LocaleCode string
+	Keys       []string
+}
+
+// missingTranslations returns the untranslated keys of every DATA_ID for each
+// of the localeCodes, ordered by DATA_ID and then locale code.
+func missingTranslations(ctx context.Context, db sq.Queryer, localeCodes []string) ([]untranslatedKeys, error) {
+	keys := make(map[string]map[string]map[string]bool) // DATA_ID => LOCALE_CODE => KEY set
+	PAGEDATA := tables.NEW_PAGEDATA(ctx, "p")
+	_, err := sq.FetchContext(ctx, db, sq.SQLite.SelectDistinct().From(PAGEDATA), func(row *sq.Row) error {
+		dataID := row.String(PAGEDATA.DATA_ID)
+		localeCode := row.String(PAGEDATA.LOCALE_CODE)
+		key := row.String(PAGEDATA.KEY)
+		return row.Accumulate(func() error {
+			if keys[dataID] == nil {
+				keys[dataID] = make(map[string]map[string]bool)
+			}
+			if keys[dataID][localeCode] == nil {
+				keys[dataID][localeCode] = make(map[string]bool)
+			}
+			keys[dataID][localeCode][key] = true
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	dataIDs := make([]string, 0, len(keys))
+	for dataID := range keys {
+		dataIDs = append(dataIDs, dataID)
+	}
+	sort.Strings(dataIDs)
+	var report []untranslatedKeys
+	for _, dataID := range dataIDs {
+		defaultKeys := make([]string, 0, len(keys[dataID][""]))
+		for key := range keys[dataID][""] {
+			defaultKeys = append(defaultKeys, key)
+		}
+		sort.Strings(defaultKeys)
+		for _, localeCode := range localeCodes {
+			entry := untranslatedKeys{DataID: dataID, LocaleCode: localeCode}
+			for _, key := range defaultKeys {
+				if !keys[dataID][localeCode][key] {
+					entry.Keys = append(entry.Keys, key)
+				}
+			}
+			if len(entry.Keys) > 0 {
+				report = append(report, entry)
+			}
+		}
+	}
+	return report, nil
+}
+
+// pageFields returns the template fields of the page at url, or nil if it is
+// not a template page.
+func (pm *PageManager) pageFields(ctx context.Context, url string) ([]templateField, error) {
+	page, _, err := pm.getPage(ctx, url)
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	if !page.Valid || page.PageType != PageTypeTemplate {
+		return nil, nil
+	}
+	pm.themesMutex.RLock()
+	defer pm.themesMutex.RUnlock()
+	return pm.themes[page.ThemePath].themeTemplates[page.TemplateName].Fields, nil
+}
+
+type translationsData struct {
+	w      http.ResponseWriter `json:"-"`
+	r      *http.Request       `json:"-"`
+	Report []untranslatedKeys
+
+	// set if a DATA_ID is being translated
+	DataID           string
+	LocaleCode       string
+	SourceLocaleCode string
+	SourceValues     map[string]string
+	SourceRows       map[string][]map[string]interface{}
+	Values           map[string]string
+	Rows             map[string][]map[string]interface{}
+	fields           []templateField
+}
+
+func (data *translationsData) LogoutForm() (template.HTML, error) {
+	return logoutForm(data.w, data.r)
+}
+
+// translateURL returns the URL of the editor that translates dataID from the
+// default locale into localeCode.
+func translateURL(dataID, localeCode string) string {
+	return URLTranslations + "?" + queryparamDataID + "=" + url.QueryEscape(dataID) +
+		"&" + queryparamLocale + "=" + url.QueryEscape(localeCode)
+}
+
+func (data *translationsData) ReportList() (template.HTML, error) {
+	if len(data.Report) == 0 {
+		return hy.Marshal(hy.H("div.mv2", nil, hy.Txt("Everything has been translated.")))
+	}
+	var els hy.Elements
+	for _, entry := range data.Report {
+		div := hy.H("div.mv2", nil)
+		header := hy.H("div", nil, hy.Txt(entry.DataID, " (", entry.LocaleCode, "): ", msgN(data.r, "translations.untranslated_keys", len(entry.Keys))))
+		header.Append("a.ml2", hy.Attr{"href": LocaleURL(data.r, translateURL(entry.DataID, entry.LocaleCode))}, hy.Txt("translate"))
+		div.AppendElements(header)
+		div.Append("div.f6.gray", nil, hy.Txt(strings.Join(entry.Keys, ", ")))
+		els.AppendElements(div)
+	}
+	return hy.Marshal(els)
+}
+
+func (data *translationsData) Form() (template.HTML, error) {
+	return hyforms.MarshalForm(data.w, data.r, data.formCallback)
+}
+
+// fieldLabel returns the label of the template field named name, or name
+// itself if there is no such field.
+func fieldLabel(fields []templateField, name string) string {
+	for _, field := range fields {
+		if field.Name == name {
+			return field.Label
+		}
+	}
+	return name
+}
+
+// formCallback renders every key of the source locale, with its source value
+// next to an input for the translated value. List items are translated field
+// by field, only string fields are translated.
+func (data *translationsData) formCallback(form *hyforms.Form) {
+	form.Set("#pm-translate", hy.Attr{"method": "POST"})
+	for _, errMsg := range form.ErrMsgs() {
+		form.Append("div.red", nil, hy.Txt(errMsg))
+	}
+	var unmarshallers []func()
+	sideBySide := func(label, source string, input hy.Element) {
+		row := hy.H("div.mt3.flex", nil)
+		row.Append("div.w-50.pr2", nil,
+			hy.H("div.f6.gray", nil, hy.Txt(label)),
+			hy.H("div.white-space-prewrap", nil, hy.Txt(source)),
+		)
+		row.Append("div.w-50.pl2", nil, input)
+		form.AppendElements(row)
+	}
+	valueKeys := make([]string, 0, len(data.SourceValues))
+	for key := range data.SourceValues {
+		valueKeys = append(valueKeys, key)
+	}
+	sort.Strings(valueKeys)
+	for _, key := range valueKeys {
+		key := key
+		input := form.Textarea("pm-value-"+key, data.Values[key]).Set(".w-100.pa2", nil)
+		sideBySide(fieldLabel(data.fields, key), data.SourceValues[key], input)
+		unmarshallers = append(unmarshallers, func() {
+			data.Values[key] = input.Value()
+		})
+	}
+	rowsKeys := make([]string, 0, len(data.SourceRows))
+	for key := range data.SourceRows {
+		rowsKeys = append(rowsKeys, key)
+	}
+	sort.Strings(rowsKeys)
+	for _, key := range rowsKeys {
+		key := key
+		sourceRows := data.SourceRows[key]
+		rows := data.Rows[key]
+		form.Append("div.mt3.b", nil, hy.Txt(fieldLabel(data.fields, key)))
+		inputs := make([]map[string]*hyforms.TextareaInput, len(sourceRows))
+		for i, sourceRow := range sourceRows {
+			var row map[string]interface{}
+			if i < len(rows) {
+				row = rows[i]
+			}
+			names := make([]string, 0, len(sourceRow))
+			for name, v := range sourceRow {
+				if _, ok := v.(string); ok {
+					names = append(names, name)
+				}
+			}
+			sort.Strings(names)
+			inputs[i] = make(map[string]*hyforms.TextareaInput)
+			for _, name := range names {
+				value, _ := row[name].(string)
+				input := form.Textarea(fmt.Sprintf("pm-rows-%s[%d].%s", key, i, name), value).Set(".w-100.pa2", nil)
+				sideBySide(fmt.Sprintf("%s[%d].%s", key, i, name), sourceRow[name].(string), input)
+				inputs[i][name] = input
+			}
+		}
+		unmarshallers = append(unmarshallers, func() {
+			// Untranslated fields keep the source value, as the rows of a key
+			// are always taken from a single locale. If nothing is translated
+			// the key falls back to the source locale again.
+			translated := false
+			rows := make([]map[string]interface{}, len(sourceRows))
+			for i, sourceRow := range sourceRows {
+				rows[i] = make(map[string]interface{})
+				for name, v := range sourceRow {
+					rows[i][name] = v
+				}
+				for name, input := range inputs[i] {
+					if v := input.Value(); v != "" {
+						rows[i][name] = v
+						translated = true
+					}
+				}
+			}
+			if !translated {
+				rows = nil
+			}
+			data.Rows[key] = rows
+		})
+	}
+	form.Append("div.mt3", nil, hy.H("button.pointer.pa2.bg-white", hy.Attr{"type": "submit"}, hy.Txt("Save")))
+
+	form.Unmarshal(func() {
+		for _, unmarshaller := range unmarshallers {
+			unmarshaller()
+		}
+	})
+}
+
+func (pm *PageManager) translations(w http.ResponseWriter, r *http.Request) {
+	data := &translationsData{
+		w:                w,
+		r:                r,
+		DataID:           r.FormValue(queryparamDataID),
+		LocaleCode:       r.FormValue(queryparamLocale),
+		SourceLocaleCode: r.FormValue(queryparamSourceLocale),
+	}
+	user, _ := pm.getUser(w, r)
+	switch {
+	case !user.Valid:
+		pm.RedirectToLogin(w, r)
+		return
+	case !user.Permissions[permissionChangePage]:
+		pm.Forbidden(w, r)
+		return
+	}
+	var localeCodes []string
+	for _, locale := range pm.sortedLocales() {
+		localeCodes = append(localeCodes, locale.Code)
+	}
+	var err error
+	if data.DataID == "" {
+		if r.Method != "GET" {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		data.Report, err = missingTranslations(r.Context(), pm.dataDB, localeCodes)
+		if err != nil {
+			pm.InternalServerError(w, r, erro.Wrap(err))
+			return
+		}
+		err = pm.tpl.Render(w, r, data, tpl.Files("translations.html"))
+		if err != nil {
+			pm.InternalServerError(w, r, erro.Wrap(err))
+		}
+		return
+	}
+	pm.localesMutex.RLock()
+	_, ok := pm.locales[data.LocaleCode]
+	_, sourceOK := pm.locales[data.SourceLocaleCode]
+	pm.localesMutex.RUnlock()
+	if !ok || (data.SourceLocaleCode != "" && !sourceOK) || data.SourceLocaleCode == data.LocaleCode {
+		http.Error(w, fmt.Sprintf("%s: %q", ErrLocaleNotFound, data.LocaleCode), http.StatusBadRequest)
+		return
+	}
+	data.fields, err = pm.pageFields(r.Context(), data.DataID)
+	if err != nil {
+		pm.InternalServerError(w, r, erro.Wrap(err))
+		return
+	}
+	data.SourceValues, data.SourceRows, err = pm.getPageData(r.Context(), data.SourceLocaleCode, data.DataID)
+	if err != nil {
+		pm.InternalServerError(w, r, erro.Wrap(err))
+		return
+	}
+	editorURL := translateURL(data.DataID, data.LocaleCode)
+	if data.SourceLocaleCode != "" {
+		editorURL += "&" + queryparamSourceLocale + "=" + url.QueryEscape(data.SourceLocaleCode)
+	}
+	switch r.Method {
+	case "GET":
+		data.Values, data.Rows, err = pm.getPageData(r.Context(), data.LocaleCode, data.DataID)
+		if err != nil {
+			pm.InternalServerError(w, r, erro.Wrap(err))
+			return
+		}
+		err = pm.tpl.Render(w, r, data, tpl.Files("translations.html"))
+		if err != nil {
+			pm.InternalServerError(w, r, erro.Wrap(err))
+			return
+		}
+	case "POST":
+		data.Values = make(map[string]string)
+		data.Rows = make(map[string][]map[string]interface{})
+		errMsgs, ok := hyforms.UnmarshalForm(w, r, data.formCallback)
+		if !ok {
+			hyforms.Redirect(w, r, LocaleURL(r, editorURL), errMsgs)
+			return
+		}
+		// Translated values are sanitized the same way as in edit mode, which
+		// covers keys that the page's template does not declare.
+		(&editTemplateData{Fields: data.fields, Values: data.Values, Rows: data.Rows}).sanitize(pm, user)
+		err = sq.WithTxContext(r.Context(), pm.dataDB, nil, func(tx *sql.Tx) error {
+			for key, value := range data.Values {
+				err := setPageValue(r.Context(), tx, data.LocaleCode, data.DataID, key, value)
+				if err != nil {
+					return erro.Wrap(err)
+				}
+			}
+			for key, rows := range data.Rows {
+				err := setPageRows(r.Context(), tx, data.LocaleCode, data.DataID, key, rows)
+				if err != nil {
+					return erro.Wrap(err)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			pm.InternalServerError(w, r, erro.Wrap(err))
+			return
+		}
+		Redirect(w, r, editorURL)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
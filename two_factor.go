@@ -0,0 +1,357 @@
+package pagemanager
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bokwoon95/pagemanager/erro"
+	"github.com/bokwoon95/pagemanager/sq"
+	"github.com/bokwoon95/pagemanager/tables"
+	"github.com/bokwoon95/pagemanager/totp"
+	"github.com/bokwoon95/pagemanager/wordgen"
+)
+
+const (
+	totpIssuer         = "PageManager"
+	totpSkew           = 1 // time steps of clock drift allowed either way
+	recoveryCodeCount  = 10
+	recoveryCodeWords  = 4
+	pendingLoginMaxAge = 5 * time.Minute
+)
+
+// userTOTP is the TOTP state of a user. The secret is stored encrypted with
+// the privateBox.
+type userTOTP struct {
+	secret      []byte // nil if the user has not started enrolling
+	enabled     bool
+	lastCounter int64 // the time step of the last code used, which cannot be used again
+}
+
+func (pm *PageManager) getUserTOTP(ctx context.Context, db sq.Queryer, userID int64) (userTOTP, error) {
+	var t userTOTP
+	var ciphertext string
+	USERS := tables.NEW_USERS(ctx, "u")
+	_, err := sq.FetchContext(ctx, db, sq.SQLite.
+		From(USERS).
+		Where(USERS.USER_ID.EqInt64(userID)),
+		func(row *sq.Row) error {
+			ciphertext = row.String(USERS.TOTP_SECRET)
+			t.enabled = row.Bool(USERS.TOTP_ENABLED)
+			t.lastCounter = row.Int64(USERS.TOTP_LAST_COUNTER)
+			return nil
+		},
+	)
+	if err != nil {
+		return t, erro.Wrap(err)
+	}
+	if ciphertext == "" {
+		return t, nil
+	}
+	if !pm.boxesInitialized() {
+		return t, ErrBoxesNotInitialized
+	}
+	t.secret, err = pm.privateBox.Base64Decrypt([]byte(ciphertext))
+	if err != nil {
+		return t, erro.Wrap(err)
+	}
+	return t, nil
+}
+
+// newTOTPSecret starts the TOTP enrolment of a user by giving them a new
+// secret, replacing any secret of an enrolment they did not finish. TOTP is
+// not enabled until the user confirms that they can generate codes for the
+// secret with enableTOTP.
+func (pm *PageManager) newTOTPSecret(ctx context.Context, db sq.Queryer, userID int64) ([]byte, error) {
+	if !pm.boxesInitialized() {
+		return nil, ErrBoxesNotInitialized
+	}
+	secret, err := totp.NewSecret()
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	ciphertext, err := pm.privateBox.Base64Encrypt(secret)
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	USERS := tables.NEW_USERS(ctx, "")
+	rowsAffected, _, err := sq.ExecContext(ctx, db, sq.SQLite.
+		Update(USERS).
+		Set(
+			USERS.TOTP_SECRET.SetString(string(ciphertext)),
+			USERS.TOTP_LAST_COUNTER.SetInt64(0),
+		).
+		Where(
+			USERS.USER_ID.EqInt64(userID),
+			sq.Predicatef("NOT COALESCE(?, 0)", USERS.TOTP_ENABLED),
+		),
+		sq.ErowsAffected,
+	)
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	if rowsAffected == 0 {
+		return nil, ErrTOTPEnabled
+	}
+	return secret, nil
+}
+
+// verifyTOTP verifies a TOTP code of a user, and uses it up so that it cannot
+// be used again.
+func (pm *PageManager) verifyTOTP(ctx context.Context, db sq.Queryer, userID int64, code string) error {
+	t, err := pm.getUserTOTP(ctx, db, userID)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	if t.secret == nil {
+		return ErrTOTPNotEnrolled
+	}
+	counter, ok := totp.Verify(t.secret, code, time.Now(), totpSkew)
+	if !ok || counter <= t.lastCounter {
+		return ErrInvalidTOTPCode
+	}
+	// Only the request that moves TOTP_LAST_COUNTER forward gets to use the
+	// code, in case it is sent twice at the same time.
+	USERS := tables.NEW_USERS(ctx, "")
+	rowsAffected, _, err := sq.ExecContext(ctx, db, sq.SQLite.
+		Update(USERS).
+		Set(USERS.TOTP_LAST_COUNTER.SetInt64(counter)).
+		Where(
+			USERS.USER_ID.EqInt64(userID),
+			sq.Predicatef("COALESCE(?, 0) < ?", USERS.TOTP_LAST_COUNTER, counter),
+		),
+		sq.ErowsAffected,
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	if rowsAffected == 0 {
+		return ErrInvalidTOTPCode
+	}
+	return nil
+}
+
+// enableTOTP finishes the TOTP enrolment of a user once they have shown that
+// they can generate a valid code, and returns their recovery codes.
+func (pm *PageManager) enableTOTP(ctx context.Context, userID int64, code string) (recoveryCodes []string, err error) {
+	err = sq.WithTxContext(ctx, pm.dataDB, nil, func(tx *sql.Tx) error {
+		t, err := pm.getUserTOTP(ctx, tx, userID)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		if t.enabled {
+			return ErrTOTPEnabled
+		}
+		err = pm.verifyTOTP(ctx, tx, userID, code)
+		if err != nil {
+			return err
+		}
+		USERS := tables.NEW_USERS(ctx, "")
+		_, _, err = sq.ExecContext(ctx, tx, sq.SQLite.
+			Update(USERS).
+			Set(USERS.TOTP_ENABLED.SetBool(true)).
+			Where(USERS.USER_ID.EqInt64(userID)), 0,
+		)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		recoveryCodes, err = pm.newRecoveryCodes(ctx, tx, userID)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		return nil
+	})
+	return recoveryCodes, err
+}
+
+// disableTOTP turns off TOTP for a user, deleting their secret and recovery
+// codes.
+func disableTOTP(ctx context.Context, db sq.Queryer, userID int64) error {
+	var (
+		USERS          = tables.NEW_USERS(ctx, "")
+		RECOVERY_CODES = tables.NEW_RECOVERY_CODES(ctx, "")
+	)
+	for _, q := range []sq.Query{
+		sq.SQLite.
+			Update(USERS).
+			Set(
+				sq.Assign(USERS.TOTP_SECRET, nil),
+				USERS.TOTP_ENABLED.SetBool(false),
+				USERS.TOTP_LAST_COUNTER.SetInt64(0),
+			).
+			Where(USERS.USER_ID.EqInt64(userID)),
+		sq.SQLite.DeleteFrom(RECOVERY_CODES).Where(RECOVERY_CODES.USER_ID.EqInt64(userID)),
+	} {
+		_, _, err := sq.ExecContext(ctx, db, q, 0)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+	}
+	return nil
+}
+
+// normalizeRecoveryCode makes recovery codes match however they were typed
+// in, e.g. in uppercase or with spaces instead of dashes.
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.Join(strings.FieldsFunc(code, func(r rune) bool {
+		return r == '-' || r == ' ' || r == '\t'
+	}), "-"))
+}
+
+func (pm *PageManager) hashRecoveryCode(code string) (string, error) {
+	hash, err := pm.publicBox.Hash([]byte(normalizeRecoveryCode(code)))
+	if err != nil {
+		return "", erro.Wrap(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(hash), nil
+}
+
+// newRecoveryCodes replaces the recovery codes of a user with new ones, which
+// are only stored hashed. Each recovery code can be used once in place of a
+// TOTP code.
+func (pm *PageManager) newRecoveryCodes(ctx context.Context, db sq.Queryer, userID int64) ([]string, error) {
+	if !pm.boxesInitialized() {
+		return nil, ErrBoxesNotInitialized
+	}
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		words, err := wordgen.Words(recoveryCodeWords)
+		if err != nil {
+			return nil, erro.Wrap(err)
+		}
+		codes[i] = strings.Join(words, "-")
+		hashes[i], err = pm.hashRecoveryCode(codes[i])
+		if err != nil {
+			return nil, erro.Wrap(err)
+		}
+	}
+	RECOVERY_CODES := tables.NEW_RECOVERY_CODES(ctx, "")
+	_, _, err := sq.ExecContext(ctx, db, sq.SQLite.
+		DeleteFrom(RECOVERY_CODES).
+		Where(RECOVERY_CODES.USER_ID.EqInt64(userID)), 0,
+	)
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	_, _, err = sq.ExecContext(ctx, db, sq.SQLite.
+		InsertInto(RECOVERY_CODES).
+		Valuesx(func(col *sq.Column) error {
+			for _, hash := range hashes {
+				col.SetInt64(RECOVERY_CODES.USER_ID, userID)
+				col.SetString(RECOVERY_CODES.CODE_HASH, hash)
+			}
+			return nil
+		}), 0,
+	)
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	return codes, nil
+}
+
+// useRecoveryCode uses up a recovery code of a user.
+func (pm *PageManager) useRecoveryCode(ctx context.Context, db sq.Queryer, userID int64, code string) error {
+	if !pm.boxesInitialized() {
+		return ErrBoxesNotInitialized
+	}
+	hashes, err := pm.publicBox.HashAll([]byte(normalizeRecoveryCode(code)))
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	b64Hashes := make([]string, len(hashes))
+	for i, hash := range hashes {
+		b64Hashes[i] = base64.RawURLEncoding.EncodeToString(hash)
+	}
+	RECOVERY_CODES := tables.NEW_RECOVERY_CODES(ctx, "")
+	rowsAffected, _, err := sq.ExecContext(ctx, db, sq.SQLite.
+		DeleteFrom(RECOVERY_CODES).
+		Where(
+			RECOVERY_CODES.USER_ID.EqInt64(userID),
+			RECOVERY_CODES.CODE_HASH.In(b64Hashes),
+		),
+		sq.ErowsAffected,
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	if rowsAffected == 0 {
+		return ErrInvalidRecoveryCode
+	}
+	return nil
+}
+
+func countRecoveryCodes(ctx context.Context, db sq.Queryer, userID int64) (int, error) {
+	var count int
+	RECOVERY_CODES := tables.NEW_RECOVERY_CODES(ctx, "rc")
+	_, err := sq.FetchContext(ctx, db, sq.SQLite.
+		From(RECOVERY_CODES).
+		Where(RECOVERY_CODES.USER_ID.EqInt64(userID)),
+		func(row *sq.Row) error {
+			count = row.Int(sq.Count())
+			return nil
+		},
+	)
+	if err != nil {
+		return 0, erro.Wrap(err)
+	}
+	return count, nil
+}
+
+// pendingLogin is a login that got past the password but still needs a TOTP
+// or recovery code. It is kept in a cookie signed with the publicBox.
+type pendingLogin struct {
+	UserID  int64
+	Expires time.Time
+}
+
+func (pm *PageManager) setPendingLogin(w http.ResponseWriter, r *http.Request, userID int64) error {
+	if !pm.boxesInitialized() {
+		return ErrBoxesNotInitialized
+	}
+	b, err := json.Marshal(pendingLogin{UserID: userID, Expires: time.Now().Add(pendingLoginMaxAge)})
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	value, err := pm.publicBox.Base64Hash(b)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Path:     "/",
+		Name:     cookiePendingLogin,
+		Value:    string(value),
+		MaxAge:   int(pendingLoginMaxAge / time.Second),
+		HttpOnly: true,
+		Secure:   *flagSecureCookies || r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// getPendingLogin returns the user ID of the pending login of r, which is
+// zero if there is none or it has expired.
+func (pm *PageManager) getPendingLogin(r *http.Request) int64 {
+	c, _ := r.Cookie(cookiePendingLogin)
+	if c == nil || !pm.boxesInitialized() {
+		return 0
+	}
+	b, err := pm.publicBox.Base64VerifyHash([]byte(c.Value))
+	if err != nil {
+		return 0
+	}
+	var login pendingLogin
+	err = json.Unmarshal(b, &login)
+	if err != nil || time.Now().After(login.Expires) {
+		return 0
+	}
+	return login.UserID
+}
+
+func clearPendingLogin(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{Path: "/", Name: cookiePendingLogin, MaxAge: -1, HttpOnly: true})
+}
@@ -0,0 +1,224 @@
+package pagemanager
+
+import (
+	"errors"
+	"html/template"
+	"net/http"
+
+	"github.com/bokwoon95/pagemanager/erro"
+	"github.com/bokwoon95/pagemanager/hy"
+	"github.com/bokwoon95/pagemanager/hyforms"
+	"github.com/bokwoon95/pagemanager/totp"
+	"github.com/bokwoon95/pagemanager/tpl"
+)
+
+const (
+	inputTwoFactorAction = "pm-2fa-action"
+	inputTOTPCode        = "pm-totp-code"
+
+	twoFactorActionStart         = "start"
+	twoFactorActionEnable        = "enable"
+	twoFactorActionRecoveryCodes = "recovery-codes"
+	twoFactorActionDisable       = "disable"
+	twoFactorActionCancel        = "cancel"
+)
+
+type twoFactorSettingsData struct {
+	w                 http.ResponseWriter `json:"-"`
+	r                 *http.Request       `json:"-"`
+	Enabled           bool
+	Enrolling         bool         // the user has a secret but has not confirmed it yet
+	URI               template.URL // the otpauth:// provisioning URI of the secret while enrolling
+	Secret            string       // the base32 secret while enrolling, for entering by hand
+	RecoveryCodes     []string
+	RecoveryCodesLeft int
+
+	action string // set by the form callback on POST
+	code   string // set by the form callback on POST
+}
+
+func (data *twoFactorSettingsData) LogoutForm() (template.HTML, error) {
+	return logoutForm(data.w, data.r)
+}
+
+func (data *twoFactorSettingsData) Form() (template.HTML, error) {
+	return hyforms.MarshalForm(data.w, data.r, data.formCallback)
+}
+
+func (data *twoFactorSettingsData) formCallback(form *hyforms.Form) {
+	form.Set("#pm-2fa", hy.Attr{"method": "POST"})
+	for _, errMsg := range form.ErrMsgs() {
+		form.Append("div.red", nil, hy.Txt(errMsg))
+	}
+	code := form.Text(inputTOTPCode, "").Set("#pm-totp-code.pa2", hy.Attr{
+		"autocomplete": "one-time-code",
+		"inputmode":    "numeric",
+	})
+	codeInput := func(label string) {
+		form.Append("div.mt3.mb1", nil, hy.H("label.pointer", hy.Attr{"for": code.ID()}, hy.Txt(label)))
+		form.Append("div", nil, code)
+		for _, errMsg := range code.ErrMsgs() {
+			form.Append("div.f7.red", nil, hy.Txt(errMsg))
+		}
+	}
+	button := func(action, text string) hy.Element {
+		return hy.H("button.pointer.pa2.mr2.bg-white", hy.Attr{
+			"type":  "submit",
+			"name":  inputTwoFactorAction,
+			"value": action,
+		}, hy.Txt(text))
+	}
+	switch {
+	case data.Enabled:
+		codeInput("Enter a code from your authenticator app to change these settings:")
+		form.Append("div.mt3", nil,
+			button(twoFactorActionRecoveryCodes, "Generate new recovery codes"),
+			button(twoFactorActionDisable, "Turn off two-factor authentication"),
+		)
+	case data.Enrolling:
+		codeInput("Enter the code that your authenticator app shows:")
+		form.Append("div.mt3", nil,
+			button(twoFactorActionEnable, "Turn on two-factor authentication"),
+			button(twoFactorActionCancel, "Cancel"),
+		)
+	default:
+		form.Append("div.mt3", nil, button(twoFactorActionStart, "Set up two-factor authentication"))
+	}
+
+	form.Unmarshal(func() {
+		data.action = form.Request().FormValue(inputTwoFactorAction)
+		switch data.action {
+		case twoFactorActionEnable, twoFactorActionRecoveryCodes, twoFactorActionDisable:
+			data.code = code.Validate(hyforms.Required).Value()
+		}
+	})
+}
+
+// twoFactorSettings is where users set up and turn off two-factor
+// authentication with a TOTP authenticator app, and get new recovery codes.
+func (pm *PageManager) twoFactorSettings(w http.ResponseWriter, r *http.Request) {
+	data := &twoFactorSettingsData{w: w, r: r}
+	user, ok := pm.requireCookieSession(w, r)
+	if !ok {
+		return
+	}
+	if !pm.boxesInitialized() {
+		pm.InternalServerError(w, r, ErrBoxesNotInitialized)
+		return
+	}
+	t, err := pm.getUserTOTP(r.Context(), pm.dataDB, user.UserID)
+	if err != nil {
+		pm.InternalServerError(w, r, erro.Wrap(err))
+		return
+	}
+	data.Enabled = t.enabled
+	data.Enrolling = !t.enabled && t.secret != nil
+	switch r.Method {
+	case "GET":
+		if data.Enrolling {
+			accountName := user.LoginID
+			if user.UserID == 1 {
+				accountName = "superadmin"
+			}
+			data.URI = template.URL(totp.URI(t.secret, totpIssuer, accountName))
+			data.Secret = totp.EncodeSecret(t.secret)
+		}
+		if data.Enabled {
+			data.RecoveryCodesLeft, err = countRecoveryCodes(r.Context(), pm.dataDB, user.UserID)
+			if err != nil {
+				pm.InternalServerError(w, r, erro.Wrap(err))
+				return
+			}
+		}
+		err = pm.tpl.Render(w, r, data, tpl.Files("two_factor_settings.html"))
+		if err != nil {
+			pm.InternalServerError(w, r, erro.Wrap(err))
+			return
+		}
+	case "POST":
+		errMsgs, ok := hyforms.UnmarshalForm(w, r, data.formCallback)
+		if !ok {
+			hyforms.Redirect(w, r, LocaleURL(r, r.URL.Path), errMsgs)
+			return
+		}
+		lockoutKeys := twoFactorLockoutKeys(r, user.UserID)
+		if data.code != "" {
+			wait, err := reserveLoginAttempt(r.Context(), pm.dataDB, lockoutKeys)
+			if err != nil {
+				pm.InternalServerError(w, r, erro.Wrap(err))
+				return
+			}
+			if wait > 0 {
+				errMsgs.FormErrMsgs = append(errMsgs.FormErrMsgs, msg(r, "login.too_many_attempts", wait))
+				hyforms.Redirect(w, r, LocaleURL(r, r.URL.Path), errMsgs)
+				return
+			}
+		}
+		var recoveryCodes []string
+		switch data.action {
+		case twoFactorActionStart:
+			_, err = pm.newTOTPSecret(r.Context(), pm.dataDB, user.UserID)
+		case twoFactorActionEnable:
+			recoveryCodes, err = pm.enableTOTP(r.Context(), user.UserID, data.code)
+		case twoFactorActionCancel:
+			if data.Enabled {
+				err = ErrTOTPEnabled
+				break
+			}
+			err = disableTOTP(r.Context(), pm.dataDB, user.UserID)
+		case twoFactorActionRecoveryCodes, twoFactorActionDisable:
+			if !data.Enabled {
+				err = ErrTOTPNotEnrolled
+				break
+			}
+			err = pm.verifyTOTP(r.Context(), pm.dataDB, user.UserID, data.code)
+			if err != nil {
+				break
+			}
+			if data.action == twoFactorActionDisable {
+				err = disableTOTP(r.Context(), pm.dataDB, user.UserID)
+			} else {
+				recoveryCodes, err = pm.newRecoveryCodes(r.Context(), pm.dataDB, user.UserID)
+			}
+		default:
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		// Only a wrong code counts towards the lockout.
+		if data.code != "" && !errors.Is(err, ErrInvalidTOTPCode) {
+			if err := cancelLoginAttempt(r.Context(), pm.dataDB, lockoutKeys); err != nil {
+				pm.InternalServerError(w, r, erro.Wrap(err))
+				return
+			}
+		}
+		switch {
+		case errors.Is(err, ErrInvalidTOTPCode):
+			errMsgs.InputErrMsgs[inputTOTPCode] = []string{err.Error()}
+			hyforms.Redirect(w, r, LocaleURL(r, r.URL.Path), errMsgs)
+			return
+		case errors.Is(err, ErrTOTPEnabled), errors.Is(err, ErrTOTPNotEnrolled):
+			errMsgs.FormErrMsgs = append(errMsgs.FormErrMsgs, err.Error())
+			hyforms.Redirect(w, r, LocaleURL(r, r.URL.Path), errMsgs)
+			return
+		case err != nil:
+			pm.InternalServerError(w, r, erro.Wrap(err))
+			return
+		}
+		if len(recoveryCodes) > 0 {
+			// Recovery codes are shown once in the response itself, so that
+			// they are never stored in a cookie or a cache.
+			data.Enabled, data.Enrolling = true, false
+			data.RecoveryCodes = recoveryCodes
+			data.RecoveryCodesLeft = len(recoveryCodes)
+			w.Header().Set("Cache-Control", "no-store")
+			err = pm.tpl.Render(w, r, data, tpl.Files("two_factor_settings.html"))
+			if err != nil {
+				pm.InternalServerError(w, r, erro.Wrap(err))
+			}
+			return
+		}
+		Redirect(w, r, r.URL.Path)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,311 @@
+package pagemanager
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/bokwoon95/pagemanager/erro"
+	"github.com/bokwoon95/pagemanager/hyforms"
+	"github.com/bokwoon95/pagemanager/keyderiv"
+	"github.com/bokwoon95/pagemanager/sq"
+	"github.com/bokwoon95/pagemanager/tables"
+	"github.com/bokwoon95/pagemanager/wordgen"
+)
+
+// newPublicUserID returns a random PUBLIC_USER_ID. Users are referred to by
+// their PUBLIC_USER_ID outside the database, so that USER_IDs are not leaked.
+func newPublicUserID() (string, error) {
+	b := make([]byte, 12)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", erro.Wrap(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// newInvitePassword returns a random password for users created without one.
+// It is shown once to whoever created the user, to be passed on to the user.
+func newInvitePassword() (string, error) {
+	words, err := wordgen.Words(5)
+	if err != nil {
+		return "", erro.Wrap(err)
+	}
+	return strings.Join(words, "-"), nil
+}
+
+func validateLoginID(loginID string) error {
+	if loginID == "" || len(loginID) > 254 || strings.IndexFunc(loginID, unicode.IsSpace) >= 0 {
+		return fmt.Errorf("%w %q", ErrInvalidLoginID, loginID)
+	}
+	return nil
+}
+
+func validateEmail(email string) error {
+	if email == "" {
+		return nil
+	}
+	if hyforms.Validate(email, hyforms.IsEmail) != nil {
+		return fmt.Errorf("%w %q", ErrInvalidEmail, email)
+	}
+	return nil
+}
+
+// getUsers returns every user except the placeholder user 1 that the
+// superadmin is logged in as.
+func getUsers(ctx context.Context, db sq.Queryer) ([]User, error) {
+	var users []User
+	USERS := tables.NEW_USERS(ctx, "u")
+	_, err := sq.FetchContext(ctx, db, sq.SQLite.
+		From(USERS).
+		Where(USERS.USER_ID.NeInt(1)).
+		OrderBy(USERS.LOGIN_ID),
+		func(row *sq.Row) error {
+			var user User
+			err := user.RowMapper(USERS)(row)
+			if err != nil {
+				return erro.Wrap(err)
+			}
+			return row.Accumulate(func() error {
+				users = append(users, user)
+				return nil
+			})
+		},
+	)
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	return users, nil
+}
+
+// getUserByPublicID returns the user with publicUserID, which is not found if
+// it is the placeholder user 1.
+func getUserByPublicID(ctx context.Context, db sq.Queryer, publicUserID string) (User, error) {
+	var user User
+	USERS := tables.NEW_USERS(ctx, "u")
+	_, err := sq.FetchContext(ctx, db, sq.SQLite.
+		From(USERS).
+		Where(
+			USERS.PUBLIC_USER_ID.EqString(publicUserID),
+			USERS.USER_ID.NeInt(1),
+		),
+		user.RowMapper(USERS),
+	)
+	if err != nil {
+		return user, erro.Wrap(err)
+	}
+	if !user.Valid {
+		return user, fmt.Errorf("%w %q", ErrUserNotFound, publicUserID)
+	}
+	return user, nil
+}
+
+func loginIDExists(ctx context.Context, db sq.Queryer, loginID string, excludeUserID int64) (bool, error) {
+	USERS := tables.NEW_USERS(ctx, "u")
+	exists, err := sq.ExistsContext(ctx, db, sq.SQLite.
+		From(USERS).
+		Where(
+			USERS.LOGIN_ID.EqString(loginID),
+			USERS.USER_ID.NeInt64(excludeUserID),
+		),
+	)
+	if err != nil {
+		return false, erro.Wrap(err)
+	}
+	return exists, nil
+}
+
+// createUser creates a user with a keyderiv hash of password and a new
+// PUBLIC_USER_ID, which is filled into the returned user.
+func createUser(ctx context.Context, db sq.Queryer, user User, password string) (User, error) {
+	err := validateLoginID(user.LoginID)
+	if err != nil {
+		return user, err
+	}
+	err = validateEmail(user.Email)
+	if err != nil {
+		return user, err
+	}
+	exists, err := loginIDExists(ctx, db, user.LoginID, 0)
+	if err != nil {
+		return user, erro.Wrap(err)
+	}
+	if exists {
+		return user, fmt.Errorf("%w %q", ErrLoginIDExists, user.LoginID)
+	}
+	passwordHash, err := keyderiv.GenerateFromPassword([]byte(password))
+	if err != nil {
+		return user, erro.Wrap(err)
+	}
+	user.PublicUserID, err = newPublicUserID()
+	if err != nil {
+		return user, erro.Wrap(err)
+	}
+	var userData []byte
+	if user.UserData != nil {
+		userData, err = json.Marshal(user.UserData)
+		if err != nil {
+			return user, erro.Wrap(err)
+		}
+	}
+	USERS := tables.NEW_USERS(ctx, "")
+	_, user.UserID, err = sq.ExecContext(ctx, db, sq.SQLite.
+		InsertInto(USERS).
+		Valuesx(func(col *sq.Column) error {
+			col.SetString(USERS.PUBLIC_USER_ID, user.PublicUserID)
+			col.SetString(USERS.LOGIN_ID, user.LoginID)
+			col.SetString(USERS.PASSWORD_HASH, string(passwordHash))
+			col.SetString(USERS.EMAIL, user.Email)
+			col.SetString(USERS.DISPLAYNAME, user.Displayname)
+			if len(userData) > 0 {
+				col.Set(USERS.USER_DATA, string(userData))
+			}
+			col.SetBool(USERS.DISABLED, user.Disabled)
+			return nil
+		}),
+		sq.ElastInsertID,
+	)
+	if err != nil {
+		return user, erro.Wrap(err)
+	}
+	user.Valid = true
+	return user, nil
+}
+
+// updateUser updates the login ID, email, displayname and user data of the
+// user identified by user.PublicUserID. Changing the email makes it
+// unverified again.
+func updateUser(ctx context.Context, db sq.Queryer, user User) error {
+	current, err := getUserByPublicID(ctx, db, user.PublicUserID)
+	if err != nil {
+		return err
+	}
+	err = validateLoginID(user.LoginID)
+	if err != nil {
+		return err
+	}
+	err = validateEmail(user.Email)
+	if err != nil {
+		return err
+	}
+	exists, err := loginIDExists(ctx, db, user.LoginID, current.UserID)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	if exists {
+		return fmt.Errorf("%w %q", ErrLoginIDExists, user.LoginID)
+	}
+	var userData interface{}
+	if user.UserData != nil {
+		b, err := json.Marshal(user.UserData)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		userData = string(b)
+	}
+	USERS := tables.NEW_USERS(ctx, "")
+	_, _, err = sq.ExecContext(ctx, db, sq.SQLite.
+		Update(USERS).
+		Set(
+			USERS.LOGIN_ID.SetString(user.LoginID),
+			USERS.EMAIL.SetString(user.Email),
+			USERS.EMAIL_VERIFIED.SetBool(current.EmailVerified && user.Email == current.Email),
+			USERS.DISPLAYNAME.SetString(user.Displayname),
+			sq.Assign(USERS.USER_DATA, userData),
+		).
+		Where(USERS.USER_ID.EqInt64(current.UserID)), 0,
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	return nil
+}
+
+// setUserPassword replaces the password of the user with publicUserID.
+func setUserPassword(ctx context.Context, db sq.Queryer, publicUserID, password string) error {
+	user, err := getUserByPublicID(ctx, db, publicUserID)
+	if err != nil {
+		return err
+	}
+	passwordHash, err := keyderiv.GenerateFromPassword([]byte(password))
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	USERS := tables.NEW_USERS(ctx, "")
+	_, _, err = sq.ExecContext(ctx, db, sq.SQLite.
+		Update(USERS).
+		Set(USERS.PASSWORD_HASH.SetString(string(passwordHash))).
+		Where(USERS.USER_ID.EqInt64(user.UserID)), 0,
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	return nil
+}
+
+// setUserDisabled disables or enables the user with publicUserID. Disabling a
+// user also logs them out everywhere, since a disabled user can neither log
+// in nor use an existing session.
+func setUserDisabled(ctx context.Context, db sq.Queryer, publicUserID string, disabled bool) error {
+	user, err := getUserByPublicID(ctx, db, publicUserID)
+	if err != nil {
+		return err
+	}
+	USERS := tables.NEW_USERS(ctx, "")
+	_, _, err = sq.ExecContext(ctx, db, sq.SQLite.
+		Update(USERS).
+		Set(USERS.DISABLED.SetBool(disabled)).
+		Where(USERS.USER_ID.EqInt64(user.UserID)), 0,
+	)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	if !disabled {
+		return nil
+	}
+	SESSIONS := tables.NEW_SESSIONS(ctx, "")
+	_, _, err = sq.ExecContext(ctx, db, sq.SQLite.DeleteFrom(SESSIONS).Where(SESSIONS.USER_ID.EqInt64(user.UserID)), 0)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	return nil
+}
+
+// deleteUser deletes the user with publicUserID together with their sessions,
+// roles, permissions, recovery codes, email tokens and linked identities.
+func deleteUser(ctx context.Context, db sq.Queryer, publicUserID string) error {
+	user, err := getUserByPublicID(ctx, db, publicUserID)
+	if err != nil {
+		return err
+	}
+	var (
+		SESSIONS         = tables.NEW_SESSIONS(ctx, "")
+		USER_ROLES       = tables.NEW_USER_ROLES(ctx, "")
+		USER_PERMISSIONS = tables.NEW_USER_PERMISSIONS(ctx, "")
+		RECOVERY_CODES   = tables.NEW_RECOVERY_CODES(ctx, "")
+		EMAIL_TOKENS     = tables.NEW_EMAIL_TOKENS(ctx, "")
+		USER_IDENTITIES  = tables.NEW_USER_IDENTITIES(ctx, "")
+		API_TOKENS       = tables.NEW_API_TOKENS(ctx, "")
+		USERS            = tables.NEW_USERS(ctx, "")
+	)
+	for _, q := range []sq.Query{
+		sq.SQLite.DeleteFrom(SESSIONS).Where(SESSIONS.USER_ID.EqInt64(user.UserID)),
+		sq.SQLite.DeleteFrom(USER_ROLES).Where(USER_ROLES.USER_ID.EqInt64(user.UserID)),
+		sq.SQLite.DeleteFrom(USER_PERMISSIONS).Where(USER_PERMISSIONS.USER_ID.EqInt64(user.UserID)),
+		sq.SQLite.DeleteFrom(RECOVERY_CODES).Where(RECOVERY_CODES.USER_ID.EqInt64(user.UserID)),
+		sq.SQLite.DeleteFrom(EMAIL_TOKENS).Where(EMAIL_TOKENS.USER_ID.EqInt64(user.UserID)),
+		sq.SQLite.DeleteFrom(USER_IDENTITIES).Where(USER_IDENTITIES.USER_ID.EqInt64(user.UserID)),
+		sq.SQLite.DeleteFrom(API_TOKENS).Where(API_TOKENS.USER_ID.EqInt64(user.UserID)),
+		sq.SQLite.DeleteFrom(USERS).Where(USERS.USER_ID.EqInt64(user.UserID)),
+	} {
+		_, _, err = sq.ExecContext(ctx, db, q, 0)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+	}
+	return nil
+}
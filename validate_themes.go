@@ -0,0 +1,170 @@
+package pagemanager
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bokwoon95/pagemanager/erro"
+)
+
+// ThemeDiagnostic is a problem found in a theme.
+type ThemeDiagnostic struct {
+	File    string // relative to the datafolder
+	Line    int    // 0 if the line is not known
+	Message string
+}
+
+func (d ThemeDiagnostic) String() string {
+	if d.Line > 0 {
+		return d.File + ":" + strconv.Itoa(d.Line) + ": " + d.Message
+	}
+	return d.File + ": " + d.Message
+}
+
+// ThemeReport holds the problems found in a theme.
+type ThemeReport struct {
+	ThemePath   string
+	Diagnostics []ThemeDiagnostic
+}
+
+var templateErrRegexp = regexp.MustCompile(`^template: (.+?):(\d+):\s*(.*)$`)
+
+// ValidateThemes loads every theme in the datafolder and reports the problems
+// found in each theme, sorted by theme path. It parses every template, checks
+// that every HTML, CSS and JS file referenced by theme-config.js exists and
+// reports any keys in theme-config.js that are not recognized.
+func ValidateThemes(datafolder string) ([]ThemeReport, error) {
+	themes, _, err := getThemes(datafolder)
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	datafolderFS := os.DirFS(datafolder)
+	funcmap := (&PageManager{}).funcmap()
+	var reports []ThemeReport
+	for _, t := range themes {
+		report := ThemeReport{ThemePath: t.path}
+		config, _ := fs.ReadFile(datafolderFS, t.configFile)
+		addDiagnostic := func(file string, line int, format string, a ...interface{}) {
+			report.Diagnostics = append(report.Diagnostics, ThemeDiagnostic{
+				File:    file,
+				Line:    line,
+				Message: fmt.Sprintf(format, a...),
+			})
+		}
+		if t.err != nil {
+			line := 0
+			if matches := regexp.MustCompile(regexp.QuoteMeta(t.configFile) + `:(\d+)`).FindStringSubmatch(t.err.Error()); len(matches) > 0 {
+				line, _ = strconv.Atoi(matches[1])
+			}
+			addDiagnostic(t.configFile, line, "%s", t.err)
+			reports = append(reports, report)
+			continue
+		}
+		for _, key := range t.unknownKeys {
+			name := key[strings.LastIndexAny(key, ".]")+1:]
+			keyRegexp := regexp.MustCompile(`["']?\b` + regexp.QuoteMeta(name) + `\b["']?\s*:`)
+			addDiagnostic(t.configFile, lineOf(config, keyRegexp.FindIndex(config)), "unknown key %s", key)
+		}
+		templateNames := make([]string, 0, len(t.themeTemplates))
+		for templateName := range t.themeTemplates {
+			templateNames = append(templateNames, templateName)
+		}
+		sort.Strings(templateNames)
+		for _, templateName := range templateNames {
+			tt := t.themeTemplates[templateName]
+			if len(tt.HTML) == 0 {
+				addDiagnostic(t.configFile, 0, "template %s has no HTML files", templateName)
+				continue
+			}
+			tmpl := template.New("").Funcs(funcmap)
+			for _, filename := range tt.HTML {
+				filename = strings.TrimPrefix(filename, "/")
+				b, err := fs.ReadFile(datafolderFS, filename)
+				if err != nil {
+					if errors.Is(err, fs.ErrNotExist) {
+						addDiagnostic(t.configFile, lineOfReference(config, t.path, filename), "template %s: HTML file %s does not exist", templateName, filename)
+					} else {
+						addDiagnostic(filename, 0, "%s", err)
+					}
+					continue
+				}
+				_, err = tmpl.New(filename).Parse(string(b))
+				if err != nil {
+					if matches := templateErrRegexp.FindStringSubmatch(err.Error()); len(matches) > 0 {
+						line, _ := strconv.Atoi(matches[2])
+						addDiagnostic(matches[1], line, "%s", matches[3])
+					} else {
+						addDiagnostic(filename, 0, "%s", err)
+					}
+				}
+			}
+			for _, field := range invalidFields(tt.Fields) {
+				typeRegexp := regexp.MustCompile(`["'` + "`" + `]` + regexp.QuoteMeta(field.Type) + `["'` + "`" + `]`)
+				addDiagnostic(t.configFile, lineOf(config, typeRegexp.FindIndex(config)), "template %s: field %s has unknown type %s", templateName, field.Name, field.Type)
+			}
+			for _, asset := range append(append([]Asset(nil), tt.CSS...), tt.JS...) {
+				// Assets that could not be read when the theme was loaded are
+				// left unhashed.
+				if asset.Hash != [32]byte{} || asset.Path == "" {
+					continue
+				}
+				filename := strings.TrimPrefix(asset.Path, "/")
+				addDiagnostic(t.configFile, lineOfReference(config, t.path, filename), "template %s: asset %s does not exist", templateName, filename)
+			}
+		}
+		sort.SliceStable(report.Diagnostics, func(i, j int) bool {
+			if report.Diagnostics[i].File != report.Diagnostics[j].File {
+				return report.Diagnostics[i].File < report.Diagnostics[j].File
+			}
+			return report.Diagnostics[i].Line < report.Diagnostics[j].Line
+		})
+		reports = append(reports, report)
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].ThemePath < reports[j].ThemePath })
+	return reports, nil
+}
+
+// invalidFields returns the fields (including the fields of lists) whose type
+// is not one of the FieldType constants.
+func invalidFields(fields []templateField) []templateField {
+	var invalid []templateField
+	for _, field := range fields {
+		switch field.Type {
+		case FieldTypeText, FieldTypeRichText, FieldTypeImage, FieldTypeLink, FieldTypeBoolean, FieldTypeNumber:
+		case FieldTypeList:
+			invalid = append(invalid, invalidFields(field.Fields)...)
+		default:
+			invalid = append(invalid, field)
+		}
+	}
+	return invalid
+}
+
+// lineOfReference returns the line in theme-config.js that refers to filename,
+// either by its path relative to the theme folder or by its absolute path.
+func lineOfReference(config []byte, themePath, filename string) int {
+	relativeName := strings.TrimPrefix(filename, "pm-themes/"+themePath+"/")
+	for _, name := range []string{relativeName, "/" + filename} {
+		if i := bytes.Index(config, []byte(name)); i >= 0 {
+			return lineOf(config, []int{i})
+		}
+	}
+	return 0
+}
+
+// lineOf returns the line number of the byte offset loc[0] in src, or 0 if loc
+// is empty.
+func lineOf(src []byte, loc []int) int {
+	if len(loc) == 0 {
+		return 0
+	}
+	return bytes.Count(src[:loc[0]], []byte("\n")) + 1
+}
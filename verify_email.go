@@ -0,0 +1,169 @@
+package pagemanager
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/bokwoon95/pagemanager/erro"
+	"github.com/bokwoon95/pagemanager/hy"
+	"github.com/bokwoon95/pagemanager/hyforms"
+	"github.com/bokwoon95/pagemanager/mailer"
+	"github.com/bokwoon95/pagemanager/sq"
+	"github.com/bokwoon95/pagemanager/tables"
+	"github.com/bokwoon95/pagemanager/tpl"
+)
+
+type verifyEmailData struct {
+	w             http.ResponseWriter `json:"-"`
+	r             *http.Request       `json:"-"`
+	Email         string
+	EmailVerified bool
+	Notice        string
+}
+
+func (data *verifyEmailData) LogoutForm() (template.HTML, error) {
+	return logoutForm(data.w, data.r)
+}
+
+func (data *verifyEmailData) Form() (template.HTML, error) {
+	return hyforms.MarshalForm(data.w, data.r, data.formCallback)
+}
+
+func (data *verifyEmailData) formCallback(form *hyforms.Form) {
+	form.Set("#pm-verify-email", hy.Attr{"method": "POST"})
+	for _, errMsg := range form.ErrMsgs() {
+		form.Append("div.red", nil, hy.Txt(errMsg))
+	}
+	if data.Email != "" && !data.EmailVerified {
+		form.Append("div.mt3", nil, hy.H("button.pointer.pa2.bg-white", hy.Attr{"type": "submit"}, hy.Txt(msg(form.Request(), "verify_email.send"))))
+	}
+}
+
+// verifyEmail verifies the email of a user when they open the link that was
+// emailed to them, and is where users ask for that link to be sent.
+func (pm *PageManager) verifyEmail(w http.ResponseWriter, r *http.Request) {
+	data := &verifyEmailData{w: w, r: r}
+	if token := r.URL.Query().Get("token"); token != "" && r.Method == "GET" {
+		// Keep the token in the URL from leaking to other sites.
+		w.Header().Set("Referrer-Policy", "no-referrer")
+		notice := msg(r, "verify_email.verified")
+		err := pm.verifyEmailWithToken(r.Context(), token)
+		if errors.Is(err, ErrInvalidEmailToken) || errors.Is(err, ErrBoxesNotInitialized) {
+			notice = err.Error()
+		} else if err != nil {
+			pm.InternalServerError(w, r, erro.Wrap(err))
+			return
+		}
+		_ = hyforms.SetCookieValue(w, cookieFlash, notice, &http.Cookie{HttpOnly: true, MaxAge: 60})
+		Redirect(w, r, r.URL.Path)
+		return
+	}
+	user, ok := pm.requireCookieSession(w, r)
+	if !ok {
+		return
+	}
+	data.Email = user.Email
+	data.EmailVerified = user.EmailVerified
+	switch r.Method {
+	case "GET":
+		_ = hyforms.GetCookieValue(w, r, cookieFlash, &data.Notice)
+		err := pm.tpl.Render(w, r, data, tpl.Files("verify_email.html"))
+		if err != nil {
+			pm.InternalServerError(w, r, erro.Wrap(err))
+			return
+		}
+	case "POST":
+		errMsgs, ok := hyforms.UnmarshalForm(w, r, data.formCallback)
+		if !ok {
+			hyforms.Redirect(w, r, LocaleURL(r, r.URL.Path), errMsgs)
+			return
+		}
+		if data.EmailVerified {
+			Redirect(w, r, r.URL.Path)
+			return
+		}
+		if data.Email == "" {
+			errMsgs.FormErrMsgs = append(errMsgs.FormErrMsgs, ErrNoEmail.Error())
+			hyforms.Redirect(w, r, LocaleURL(r, r.URL.Path), errMsgs)
+			return
+		}
+		if _, err := baseURL(); err != nil {
+			errMsgs.FormErrMsgs = append(errMsgs.FormErrMsgs, err.Error())
+			hyforms.Redirect(w, r, LocaleURL(r, r.URL.Path), errMsgs)
+			return
+		}
+		// Every email sent counts towards the lockout, so that no one can
+		// flood an inbox with verification emails.
+		lockoutKeys := mailLockoutKeys(r, "verify", strconv.FormatInt(user.UserID, 10))
+		wait, err := reserveLoginAttempt(r.Context(), pm.dataDB, lockoutKeys)
+		if err != nil {
+			pm.InternalServerError(w, r, erro.Wrap(err))
+			return
+		}
+		if wait > 0 {
+			errMsgs.FormErrMsgs = append(errMsgs.FormErrMsgs, msg(r, "verify_email.too_many_requests", wait))
+			hyforms.Redirect(w, r, LocaleURL(r, r.URL.Path), errMsgs)
+			return
+		}
+		token, err := pm.newEmailToken(r.Context(), pm.dataDB, emailTokenVerifyEmail, user.UserID, user.Email, verifyEmailTokenMaxAge)
+		if errors.Is(err, ErrBoxesNotInitialized) {
+			errMsgs.FormErrMsgs = append(errMsgs.FormErrMsgs, err.Error())
+			hyforms.Redirect(w, r, LocaleURL(r, r.URL.Path), errMsgs)
+			return
+		}
+		if err != nil {
+			pm.InternalServerError(w, r, erro.Wrap(err))
+			return
+		}
+		link, err := absoluteURL(r, URLVerifyEmail, url.Values{"token": {token}})
+		if err != nil {
+			pm.InternalServerError(w, r, erro.Wrap(err))
+			return
+		}
+		err = pm.mailer.Send(r.Context(), mailer.Message{
+			To:      []string{user.Email},
+			Subject: msg(r, "verify_email.email_subject"),
+			Body:    msg(r, "verify_email.email_body", user.LoginID, link),
+		})
+		if err != nil {
+			errMsgs.FormErrMsgs = append(errMsgs.FormErrMsgs, msg(r, "verify_email.send_failed", err))
+			hyforms.Redirect(w, r, LocaleURL(r, r.URL.Path), errMsgs)
+			return
+		}
+		_ = hyforms.SetCookieValue(w, cookieFlash, msg(r, "verify_email.sent", user.Email), &http.Cookie{HttpOnly: true, MaxAge: 60})
+		Redirect(w, r, r.URL.Path)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// verifyEmailWithToken uses up an email verification token and marks the
+// email of its user as verified, unless the user has changed their email since
+// the token was sent.
+func (pm *PageManager) verifyEmailWithToken(ctx context.Context, token string) error {
+	return sq.WithTxContext(ctx, pm.dataDB, nil, func(tx *sql.Tx) error {
+		t, err := pm.useEmailToken(ctx, tx, emailTokenVerifyEmail, token)
+		if err != nil {
+			return err
+		}
+		USERS := tables.NEW_USERS(ctx, "")
+		rowsAffected, _, err := sq.ExecContext(ctx, tx, sq.SQLite.
+			Update(USERS).
+			Set(USERS.EMAIL_VERIFIED.SetBool(true)).
+			Where(USERS.USER_ID.EqInt64(t.userID), USERS.EMAIL.EqString(t.email)),
+			sq.ErowsAffected,
+		)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		if rowsAffected == 0 {
+			return ErrInvalidEmailToken
+		}
+		return nil
+	})
+}